@@ -0,0 +1,272 @@
+package main
+
+import (
+	"auth-service/data"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognise
+const apiKeyPrefix = "ak_"
+
+// apiKeyTouchInterval limits how often the last used time of a key is written
+const apiKeyTouchInterval = time.Minute
+
+// errInvalidAPIKey is returned for unknown, revoked and expired keys alike
+var errInvalidAPIKey = errors.New("invalid api key")
+
+// createdAPIKey is returned once when a key is created, it is the only time the key is shown
+type createdAPIKey struct {
+	*data.APIKey
+	Key string `json:"key"`
+}
+
+// generateAPIKey returns a new key, the prefix shown to identify it and the hash to store
+func generateAPIKey() (key, prefix, hash string, err error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	key = apiKeyPrefix + secret
+	return key, key[:len(apiKeyPrefix)+8], hashToken(key), nil
+}
+
+// apiKeyClaims authenticates an API key and returns claims like the ones of an access token,
+// so RequirePermission works the same for both. The scope is the permissions of the user,
+// narrowed down to the scopes of the key.
+func (app *Config) apiKeyClaims(ctx context.Context, apiKey string) (jwt.MapClaims, error) {
+	key, err := app.APIKeys.GetAPIKeyByHash(ctx, hashToken(apiKey))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && !key.ExpiresAt.After(now)) {
+		return nil, errInvalidAPIKey
+	}
+
+	user, err := app.Repo.GetOne(ctx, key.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+	if !user.IsActive() {
+		return nil, errInvalidAPIKey
+	}
+
+	roles, err := app.Repo.GetRoles(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := app.Repo.GetPermissions(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		err = app.APIKeys.TouchAPIKey(ctx, key.ID, now)
+		if err != nil {
+			log.Println("Error updating the last used time of an api key:", err)
+		}
+	}
+
+	return jwt.MapClaims{
+		"sub":   float64(user.ID),
+		"akid":  float64(key.ID),
+		"roles": roles,
+		"scope": strings.Join(keyPermissions(permissions, key.Scopes), " "),
+	}, nil
+}
+
+// keyPermissions returns the permissions of the user which the key scopes allow
+func keyPermissions(permissions, scopes []string) []string {
+	if len(scopes) == 0 {
+		return permissions
+	}
+
+	var granted []string
+	for _, permission := range permissions {
+		for _, scope := range scopes {
+			if permission == scope {
+				granted = append(granted, permission)
+				break
+			}
+		}
+	}
+
+	return granted
+}
+
+// viaAPIKey reports whether the request was authenticated with an API key rather than an
+// access token
+func viaAPIKey(r *http.Request) bool {
+	claims, _ := r.Context().Value(claimsKey).(jwt.MapClaims)
+	_, ok := claims["akid"]
+	return ok
+}
+
+// RequireLogin only lets through requests made with an access token. Managing credentials and
+// sessions needs the user to have logged in, an API key is not enough. It must be used after
+// authTokenMiddleware.
+func (app *Config) RequireLogin() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if viaAPIKey(r) {
+				app.errorJSON(w, errors.New("this action can't be done with an api key"), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// GetMyAPIKeys lists the API keys of the current user, without the keys themselves
+func (app *Config) GetMyAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	keys, err := app.APIKeys.GetUserAPIKeys(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []*data.APIKey{}
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched api keys of user %d", userID),
+		Data:    keys,
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// CreateAPIKey creates a named API key for the current user. The key can be limited to some
+// of the permissions of the user and given an expiry. It is returned only in this response.
+func (app *Config) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	requestPayload.Name = strings.TrimSpace(requestPayload.Name)
+	if requestPayload.Name == "" || len(requestPayload.Name) > 255 {
+		app.errorJSON(w, errors.New("name is required and can have at most 255 characters"), http.StatusBadRequest)
+		return
+	}
+	if requestPayload.ExpiresAt != nil && !requestPayload.ExpiresAt.After(time.Now()) {
+		app.errorJSON(w, errors.New("expires_at must be in the future"), http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	// a key can't grant more than the user has
+	permissions, err := app.Repo.GetPermissions(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	for _, scope := range requestPayload.Scopes {
+		if len(keyPermissions(permissions, []string{scope})) == 0 {
+			app.errorJSON(w, fmt.Errorf("missing permission %s", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, prefix, hash, err := generateAPIKey()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	apiKey := data.APIKey{
+		UserID:    userID,
+		Name:      requestPayload.Name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Scopes:    requestPayload.Scopes,
+		ExpiresAt: requestPayload.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+	apiKey.ID, err = app.APIKeys.InsertAPIKey(r.Context(), apiKey)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("api key %d (%s) has been created", apiKey.ID, apiKey.Name))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Created api key %d, it is shown only once", apiKey.ID),
+		Data:    createdAPIKey{APIKey: &apiKey, Key: key},
+	}
+	app.writeJSON(w, http.StatusCreated, payload)
+}
+
+// RevokeAPIKey revokes one API key of the current user
+func (app *Config) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "key"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid api key id"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.APIKeys.RevokeAPIKey(r.Context(), r.Context().Value(userIDKey).(int), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("api key not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("api key %d has been revoked", id))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked api key %d", id),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// GetMyScope returns who the request was made by and what they may do. Other services use it
+// to check API keys, which they can't verify on their own like access tokens.
+func (app *Config) GetMyScope(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(claimsKey).(jwt.MapClaims)
+	scope, _ := claims["scope"].(string)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Fetched scope",
+		Data: map[string]any{
+			"user_id": r.Context().Value(userIDKey).(int),
+			"roles":   claims["roles"],
+			"scope":   scope,
+		},
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test_APIKeys проверяет создание, использование и отзыв API-ключей.
+func Test_APIKeys(t *testing.T) {
+	routes := testApp.routes()
+	_ = testApp.Repo.GrantRole(context.Background(), 8, "admin")
+	userData, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), 8, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	request := func(method, path string, body any, headers map[string]string) *httptest.ResponseRecorder {
+		var reader *bytes.Reader
+		if body != nil {
+			b, _ := json.Marshal(body)
+			reader = bytes.NewReader(b)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		req, _ := http.NewRequest(method, path, reader)
+		req.RemoteAddr = "192.168.1.1:12345"
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+	bearer := map[string]string{"Authorization": "Bearer " + userData.AccessToken}
+
+	create := func(body map[string]any) (int, createdAPIKey) {
+		rr := request("POST", "/me/api-keys", body, bearer)
+
+		var response struct {
+			Data createdAPIKey `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr.Code, response.Data
+	}
+
+	code, readKey := create(map[string]any{"name": "ci", "scopes": []string{"users:read"}})
+	if code != http.StatusCreated || !strings.HasPrefix(readKey.Key, apiKeyPrefix) || !strings.HasPrefix(readKey.Key, readKey.Prefix) {
+		t.Fatalf("expected a new key, got %d %+v", code, readKey)
+	}
+	_, logKey := create(map[string]any{"name": "logs only", "scopes": []string{"logs:write"}})
+	_, fullKey := create(map[string]any{"name": "everything", "expires_at": time.Now().Add(time.Hour)})
+
+	invalid := []struct {
+		name string
+		body map[string]any
+	}{
+		{"no name", map[string]any{"name": " "}},
+		{"expired", map[string]any{"name": "old", "expires_at": time.Now().Add(-time.Hour)}},
+		{"permission the user doesn't have", map[string]any{"name": "root", "scopes": []string{"everything:all"}}},
+	}
+	for _, e := range invalid {
+		if code, _ := create(e.body); code != http.StatusBadRequest {
+			t.Errorf("%s: expected http.StatusBadRequest but got %d", e.name, code)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		expected int
+	}{
+		{"scoped key", readKey.Key, http.StatusAccepted},
+		{"key without the scope", logKey.Key, http.StatusForbidden},
+		{"unscoped key", fullKey.Key, http.StatusAccepted},
+		{"unknown key", apiKeyPrefix + "unknown", http.StatusUnauthorized},
+	}
+	for _, e := range tests {
+		if rr := request("GET", "/users", nil, map[string]string{"X-API-Key": e.key}); rr.Code != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, rr.Code)
+		}
+	}
+
+	// ключом нельзя управлять учётными данными
+	if rr := request("POST", "/me/api-keys", map[string]any{"name": "more"}, map[string]string{"X-API-Key": fullKey.Key}); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for creating a key with a key but got %d", rr.Code)
+	}
+
+	// и своей учётной записью через /users/{id} без нужного scope
+	logHeaders := map[string]string{"X-API-Key": logKey.Key}
+	if rr := request("PATCH", "/users/8", map[string]any{"email": "thief@here.com"}, logHeaders); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for changing the owner with a key but got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/users/8", nil, logHeaders); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for deleting the owner with a key but got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/users/8/sessions/any", nil, logHeaders); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for ending a session with a key but got %d", rr.Code)
+	}
+
+	rr := request("GET", "/me/scope", nil, map[string]string{"X-API-Key": readKey.Key})
+	var scope struct {
+		Data struct {
+			UserID int    `json:"user_id"`
+			Scope  string `json:"scope"`
+		} `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &scope)
+	if rr.Code != http.StatusOK || scope.Data.UserID != 8 || scope.Data.Scope != "users:read" {
+		t.Errorf("expected the scope of the key, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// в списке ключей нет самих ключей, но видно время последнего использования
+	rr = request("GET", "/me/api-keys", nil, bearer)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), readKey.Key) {
+		t.Fatalf("expected the keys without their values, got %d %s", rr.Code, rr.Body.String())
+	}
+	var list struct {
+		Data []data.APIKey `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &list)
+	if len(list.Data) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(list.Data))
+	}
+	for _, key := range list.Data {
+		if key.ID == readKey.ID && key.LastUsedAt == nil {
+			t.Error("expected the last used time to be recorded")
+		}
+	}
+
+	if rr := request("DELETE", "/me/api-keys/"+strconv.Itoa(readKey.ID), nil, bearer); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	if rr := request("GET", "/users", nil, map[string]string{"X-API-Key": readKey.Key}); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for a revoked key but got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/me/api-keys/"+strconv.Itoa(readKey.ID), nil, bearer); rr.Code != http.StatusNotFound {
+		t.Errorf("expected http.StatusNotFound for a revoked key but got %d", rr.Code)
+	}
+
+	// просроченный ключ не принимается
+	expired := time.Now().Add(-time.Minute)
+	_, err = testApp.APIKeys.InsertAPIKey(context.Background(), data.APIKey{UserID: 8, Name: "expired", KeyHash: hashToken("ak_expired"), ExpiresAt: &expired})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if rr := request("GET", "/me", nil, map[string]string{"X-API-Key": "ak_expired"}); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for an expired key but got %d", rr.Code)
+	}
+}
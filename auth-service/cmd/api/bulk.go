@@ -0,0 +1,801 @@
+package main
+
+import (
+	"auth-service/data"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	// importInvite sends every imported user a link to choose a password
+	importInvite = "invite"
+	// importPassword gives every imported user a temporary password, returned in the report
+	importPassword = "password"
+
+	// maxImportRows is the largest number of users one import may create
+	maxImportRows = 10000
+	// maxImportBytes is the largest file the import endpoint accepts
+	maxImportBytes = 10 << 20
+
+	// invitationTTL is how long the link in an invitation email can be used
+	invitationTTL = 7 * 24 * time.Hour
+)
+
+// importColumns are the columns a CSV import may have, email is required
+var importColumns = map[string]bool{"email": true, "first_name": true, "last_name": true, "roles": true}
+
+// exportOnlyColumns are written by the export and skipped by the import, so an exported
+// file can be imported elsewhere. active is written by older versions.
+var exportOnlyColumns = map[string]bool{"id": true, "status": true, "active": true, "created_at": true, "updated_at": true}
+
+// exportColumns is the header of a CSV export
+var exportColumns = []string{"id", "email", "first_name", "last_name", "status", "roles", "created_at", "updated_at"}
+
+// errImportFailed rolls back an import when one of the rows can't be saved
+var errImportFailed = errors.New("import failed")
+
+// importRow is one user to import
+type importRow struct {
+	// Line is the line of the file the user is on
+	Line      int
+	Email     string
+	FirstName string
+	LastName  string
+	Roles     []string
+	// Err is set when the row can't be imported
+	Err string
+}
+
+// importOptions control how the users are imported
+type importOptions struct {
+	// Mode is importInvite or importPassword
+	Mode string
+	// DryRun only validates the rows
+	DryRun bool
+}
+
+// importResult is what happened to one row
+type importResult struct {
+	Line              int    `json:"line"`
+	Email             string `json:"email"`
+	ID                int    `json:"id,omitempty"`
+	TemporaryPassword string `json:"temporary_password,omitempty"`
+	Invited           bool   `json:"invited,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
+
+// importReport is the outcome of an import. Either every row has been imported or none.
+type importReport struct {
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+	DryRun   bool           `json:"dry_run"`
+	Rows     []importResult `json:"rows"`
+}
+
+// exportedUser is one user in an NDJSON export, without the password hash
+type exportedUser struct {
+	*data.User
+	Roles []string `json:"roles"`
+}
+
+// ImportUsers creates the users from a CSV or NDJSON body in one transaction. The format is
+// taken from ?format= or the Content-Type, ?mode= is invite (the default) or password and
+// ?dry_run=true only validates the file. Granting roles other than the default one needs
+// the roles:manage permission, and only the roles the caller holds can be granted.
+func (app *Config) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatFromContentType(r.Header.Get("Content-Type"))
+	}
+
+	opts := importOptions{Mode: r.URL.Query().Get("mode")}
+	if opts.Mode == "" {
+		opts.Mode = importInvite
+	}
+	if dryRun := r.URL.Query().Get("dry_run"); dryRun != "" {
+		var err error
+		opts.DryRun, err = strconv.ParseBool(dryRun)
+		if err != nil {
+			app.errorJSON(w, errors.New("dry_run must be true or false"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := parseImport(http.MaxBytesReader(w, r.Body, maxImportBytes), format)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !hasPermission(r, "roles:manage") {
+		for _, row := range rows {
+			if len(row.Roles) > 0 && !(len(row.Roles) == 1 && row.Roles[0] == defaultRole) {
+				app.errorJSON(w, errors.New("missing permission roles:manage"), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	// like invitations, the imported users only get roles the caller holds
+	own, err := app.Repo.GetRoles(r.Context(), r.Context().Value(userIDKey).(int))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	for i := range rows {
+		for _, role := range rows[i].Roles {
+			if rows[i].Err == "" && role != defaultRole && !containsScope(own, role) {
+				rows[i].Err = fmt.Sprintf("can't hand out the role %s", role)
+			}
+		}
+	}
+
+	report, err := app.importUsers(r.Context(), rows, opts)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if report.Failed > 0 {
+		payload := jsonResponse{
+			Error:   true,
+			Message: fmt.Sprintf("%d of %d rows are invalid, no users have been imported", report.Failed, len(report.Rows)),
+			Data:    report,
+		}
+		app.writeJSON(w, http.StatusBadRequest, payload)
+		return
+	}
+
+	message := fmt.Sprintf("All %d rows are valid", len(report.Rows))
+	if !report.DryRun {
+		message = fmt.Sprintf("Imported %d users", report.Imported)
+		app.logUserEvent(r, fmt.Sprintf("%d users have been imported", report.Imported))
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: message,
+		Data:    report,
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// ExportUsers streams the users matching the filters of GET /users as CSV or, with
+// ?format=ndjson, one JSON object per line. Password hashes are never exported.
+func (app *Config) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatCSV
+	}
+	if format != formatCSV && format != formatNDJSON {
+		app.errorJSON(w, fmt.Errorf("unknown format %q, use csv or ndjson", format), http.StatusBadRequest)
+		return
+	}
+
+	query, err := userQueryFromURL(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// the first page is read before anything is written, so a bad query still gets an
+	// error response
+	query.Limit = data.MaxPageSize
+	page, err := app.Repo.List(r.Context(), query)
+	if errors.Is(err, data.ErrInvalidUserQuery) {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "text/csv"
+	if format == formatNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+
+	err = app.exportUsers(r.Context(), w, format, query, &page)
+	if err != nil {
+		// the status has been sent already, the client sees a truncated file
+		log.Println("Error exporting users:", err)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("%d users have been exported", page.TotalCount))
+}
+
+// formatFromContentType returns the import format of a Content-Type, or an empty string
+func formatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "text/csv":
+		return formatCSV
+	case "application/x-ndjson", "application/jsonl", "application/json-lines":
+		return formatNDJSON
+	}
+
+	return ""
+}
+
+// parseImport reads the users from a CSV file with a header line or from an NDJSON file.
+// Rows which can't be read are returned with Err set, an error is returned only when the
+// file as a whole is unusable.
+func parseImport(r io.Reader, format string) ([]importRow, error) {
+	var rows []importRow
+	var err error
+
+	switch format {
+	case formatCSV:
+		rows, err = parseImportCSV(r)
+	case formatNDJSON:
+		rows, err = parseImportNDJSON(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q, use csv or ndjson", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("the file has no users")
+	}
+	if len(rows) > maxImportRows {
+		return nil, fmt.Errorf("at most %d users can be imported at once", maxImportRows)
+	}
+
+	return rows, nil
+}
+
+func parseImportCSV(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("can't read the CSV header: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !importColumns[name] && !exportOnlyColumns[name] {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return nil, errors.New("the email column is required")
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && errors.Is(parseErr.Err, csv.ErrFieldCount) {
+			rows = append(rows, importRow{Line: parseErr.StartLine, Err: "wrong number of columns"})
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("can't read the CSV file: %w", err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, importRow{
+			Line:      line,
+			Email:     csvUnescape(field(record, "email")),
+			FirstName: csvUnescape(field(record, "first_name")),
+			LastName:  csvUnescape(field(record, "last_name")),
+			Roles:     splitRoles(field(record, "roles")),
+		})
+	}
+
+	return rows, nil
+}
+
+// splitRoles splits the roles column of a CSV file, where the roles are separated by semicolons
+func splitRoles(roles string) []string {
+	var split []string
+	for _, role := range strings.Split(roles, ";") {
+		if role = strings.TrimSpace(role); role != "" {
+			split = append(split, role)
+		}
+	}
+
+	return split
+}
+
+func parseImportNDJSON(r io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var rows []importRow
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var user struct {
+			Email     string   `json:"email"`
+			FirstName string   `json:"first_name"`
+			LastName  string   `json:"last_name"`
+			Roles     []string `json:"roles"`
+
+			// written by the export, ignored. active is written by older versions.
+			ID           json.RawMessage `json:"id"`
+			Status       json.RawMessage `json:"status"`
+			StatusReason json.RawMessage `json:"status_reason"`
+			DeletedAt    json.RawMessage `json:"deleted_at"`
+			Active       json.RawMessage `json:"active"`
+			CreatedAt    json.RawMessage `json:"created_at"`
+			UpdatedAt    json.RawMessage `json:"updated_at"`
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&user)
+		if err != nil {
+			rows = append(rows, importRow{Line: line, Err: fmt.Sprintf("invalid JSON: %v", err)})
+			continue
+		}
+
+		rows = append(rows, importRow{
+			Line:      line,
+			Email:     strings.TrimSpace(user.Email),
+			FirstName: strings.TrimSpace(user.FirstName),
+			LastName:  strings.TrimSpace(user.LastName),
+			Roles:     user.Roles,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read the NDJSON file: %w", err)
+	}
+
+	return rows, nil
+}
+
+// validateImportRow returns why the row can't be imported, or an empty string
+func (app *Config) validateImportRow(ctx context.Context, row importRow, seen map[string]int) string {
+	if row.Err != "" {
+		return row.Err
+	}
+
+	if row.Email == "" {
+		return "email is required"
+	}
+	address, err := mail.ParseAddress(row.Email)
+	if err != nil || address.Address != row.Email {
+		return "email is not a valid address"
+	}
+
+	if utf8.RuneCountInString(row.Email) > 255 || utf8.RuneCountInString(row.FirstName) > 255 || utf8.RuneCountInString(row.LastName) > 255 {
+		return "email and names must be at most 255 characters long"
+	}
+
+	email := strings.ToLower(row.Email)
+	if line, ok := seen[email]; ok {
+		return fmt.Sprintf("email is already on line %d", line)
+	}
+	seen[email] = row.Line
+
+	_, err = app.Repo.GetByEmail(ctx, row.Email)
+	if err == nil {
+		return data.ErrDuplicateEmail.Error()
+	}
+
+	for _, role := range row.Roles {
+		if strings.TrimSpace(role) == "" {
+			return "roles must not be empty"
+		}
+	}
+
+	return ""
+}
+
+// importUsers validates the rows and, unless one of them is invalid or it is a dry run,
+// creates all the users in one transaction. The imported users are active, the invitations
+// are sent once the transaction has been committed. The error is only set when the import
+// couldn't run at all, invalid rows are reported in the report.
+func (app *Config) importUsers(ctx context.Context, rows []importRow, opts importOptions) (*importReport, error) {
+	if opts.Mode != importInvite && opts.Mode != importPassword {
+		return nil, fmt.Errorf("unknown mode %q, use %s or %s", opts.Mode, importInvite, importPassword)
+	}
+
+	report := &importReport{DryRun: opts.DryRun, Rows: make([]importResult, len(rows))}
+
+	seen := make(map[string]int)
+	for i, row := range rows {
+		report.Rows[i] = importResult{Line: row.Line, Email: row.Email}
+		report.Rows[i].Error = app.validateImportRow(ctx, row, seen)
+		if report.Rows[i].Error != "" {
+			report.Failed++
+		}
+	}
+	if report.Failed > 0 || opts.DryRun {
+		return report, nil
+	}
+
+	err := app.Repo.WithTx(ctx, func(repo data.Repository) error {
+		for i, row := range rows {
+			result := &report.Rows[i]
+
+			password, err := app.temporaryPassword(row)
+			if err != nil {
+				return err
+			}
+
+			result.ID, err = repo.Insert(ctx, data.User{
+				Email:     row.Email,
+				FirstName: row.FirstName,
+				LastName:  row.LastName,
+				Password:  password,
+				Status:    data.StatusActive,
+			})
+			if errors.Is(err, data.ErrDuplicateEmail) {
+				result.Error = err.Error()
+				return errImportFailed
+			} else if err != nil {
+				return err
+			}
+
+			roles := row.Roles
+			if len(roles) == 0 {
+				roles = []string{defaultRole}
+			}
+			for _, role := range roles {
+				err = repo.GrantRole(ctx, result.ID, role)
+				if errors.Is(err, data.ErrUnknownRole) {
+					result.Error = fmt.Sprintf("unknown role %q", role)
+					return errImportFailed
+				} else if err != nil {
+					return err
+				}
+			}
+
+			// the password of invited users is never shown, they choose their own
+			if opts.Mode == importPassword {
+				result.TemporaryPassword = password
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		for i := range report.Rows {
+			report.Rows[i].ID = 0
+			report.Rows[i].TemporaryPassword = ""
+		}
+		if errors.Is(err, errImportFailed) {
+			report.Failed = 1
+			return report, nil
+		}
+		return nil, err
+	}
+	report.Imported = len(rows)
+
+	if opts.Mode == importInvite {
+		for i, row := range rows {
+			err = app.sendInvitation(ctx, report.Rows[i].ID, row.Email)
+			if err != nil {
+				// the user exists already, they can still use the forgotten password form
+				log.Printf("Error sending the invitation to %s: %v", row.Email, err)
+				continue
+			}
+			report.Rows[i].Invited = true
+		}
+	}
+
+	return report, nil
+}
+
+// temporaryPassword generates a random password accepted by the password policy
+func (app *Config) temporaryPassword(row importRow) (string, error) {
+	user := data.User{Email: row.Email, FirstName: row.FirstName, LastName: row.LastName}
+
+	// four characters for every three random bytes
+	size := 12
+	if policy := app.PasswordPolicy; policy.MinLength*3/4+1 > size {
+		size = policy.MinLength*3/4 + 1
+	}
+
+	for attempt := 0; attempt < 100; attempt++ {
+		password, err := randomToken(size)
+		if err != nil {
+			return "", err
+		}
+		if max := app.PasswordPolicy.MaxLength; max > 0 && len(password) > max {
+			password = password[:max]
+		}
+
+		if len(app.PasswordPolicy.Check(password, user)) == 0 {
+			return password, nil
+		}
+	}
+
+	return "", errors.New("can't generate a temporary password the password policy accepts")
+}
+
+// sendInvitation emails the user a link to choose a password, which works like a password
+// reset link but can be used for longer
+func (app *Config) sendInvitation(ctx context.Context, userID int, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.Resets.InsertPasswordReset(ctx, data.PasswordReset{
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(invitationTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	return app.Mailer.Send(Message{
+		To:      email,
+		Subject: "You have been invited",
+		Body: fmt.Sprintf("An account has been created for you.\n\n"+
+			"To choose your password, open the link below within %s:\n%s?token=%s\n",
+			invitationTTL, app.PasswordResetURL, url.QueryEscape(token)),
+	})
+}
+
+// exportUsers writes the users matching the query, page by page, starting with the page
+// which has been read already
+func (app *Config) exportUsers(ctx context.Context, w io.Writer, format string, query data.UserQuery, page *data.Page) error {
+	var csvWriter *csv.Writer
+	var encoder *json.Encoder
+	if format == formatCSV {
+		csvWriter = csv.NewWriter(w)
+		err := csvWriter.Write(exportColumns)
+		if err != nil {
+			return err
+		}
+	} else {
+		encoder = json.NewEncoder(w)
+	}
+
+	for {
+		for _, user := range page.Users {
+			roles, err := app.Repo.GetRoles(ctx, user.ID)
+			if err != nil {
+				return err
+			}
+
+			if csvWriter != nil {
+				err = csvWriter.Write([]string{
+					strconv.Itoa(user.ID),
+					csvSafe(user.Email),
+					csvSafe(user.FirstName),
+					csvSafe(user.LastName),
+					user.Status,
+					strings.Join(roles, ";"),
+					user.CreatedAt.Format(time.RFC3339),
+					user.UpdatedAt.Format(time.RFC3339),
+				})
+			} else {
+				err = encoder.Encode(exportedUser{User: user, Roles: roles})
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+
+		query.Cursor = page.NextCursor
+		next, err := app.Repo.List(ctx, query)
+		if err != nil {
+			return err
+		}
+		page = &next
+	}
+}
+
+// csvSafe keeps spreadsheets from running a value as a formula, since anybody can choose
+// their own name
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+// csvUnescape removes the quote added by csvSafe, so an export imports unchanged. A value
+// that really starts with a quote followed by one of those characters loses the quote.
+func csvUnescape(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(value[1])) {
+		return value[1:]
+	}
+
+	return value
+}
+
+// usersCommand runs auth-service users import | export
+func (app *Config) usersCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	usage := errors.New("usage: users import [-format csv|ndjson] [-mode invite|password] [-dry-run] FILE | " +
+		"users export [-format csv|ndjson] [FILE] | users purge")
+	if len(args) == 0 {
+		return usage
+	}
+
+	flags := flag.NewFlagSet("users "+args[0], flag.ContinueOnError)
+	format := flags.String("format", "", "csv or ndjson, taken from the file extension by default")
+
+	switch args[0] {
+	case "import":
+		mode := flags.String("mode", importInvite, "invite or password")
+		dryRun := flags.Bool("dry-run", false, "only validate the file")
+		err := flags.Parse(args[1:])
+		if err != nil || flags.NArg() != 1 {
+			return usage
+		}
+
+		in, closeIn, err := openCommandFile(flags.Arg(0), stdin)
+		if err != nil {
+			return err
+		}
+		defer closeIn()
+
+		rows, err := parseImport(in, formatOf(*format, flags.Arg(0)))
+		if err != nil {
+			return err
+		}
+
+		report, err := app.importUsers(context.Background(), rows, importOptions{Mode: *mode, DryRun: *dryRun})
+		if err != nil {
+			return err
+		}
+
+		for _, row := range report.Rows {
+			switch {
+			case row.Error != "":
+				fmt.Fprintf(stdout, "line %d\t%s\terror: %s\n", row.Line, row.Email, row.Error)
+			case row.TemporaryPassword != "":
+				fmt.Fprintf(stdout, "line %d\t%s\tid %d\tpassword %s\n", row.Line, row.Email, row.ID, row.TemporaryPassword)
+			case row.ID != 0:
+				fmt.Fprintf(stdout, "line %d\t%s\tid %d\tinvited %t\n", row.Line, row.Email, row.ID, row.Invited)
+			}
+		}
+
+		if report.Failed > 0 {
+			return fmt.Errorf("%d of %d rows are invalid, no users have been imported", report.Failed, len(report.Rows))
+		}
+		if report.DryRun {
+			fmt.Fprintf(stdout, "All %d rows are valid\n", len(report.Rows))
+			return nil
+		}
+
+		fmt.Fprintf(stdout, "Imported %d users\n", report.Imported)
+		err = app.logRequest("users", fmt.Sprintf("%d users have been imported from the command line", report.Imported))
+		if err != nil {
+			log.Println("Error logging the import:", err)
+		}
+	case "export":
+		err := flags.Parse(args[1:])
+		if err != nil || flags.NArg() > 1 {
+			return usage
+		}
+
+		out := stdout
+		if flags.NArg() == 1 && flags.Arg(0) != "-" {
+			f, err := os.Create(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+
+		exportFormat := formatOf(*format, flags.Arg(0))
+		if exportFormat == "" {
+			exportFormat = formatCSV
+		}
+		if exportFormat != formatCSV && exportFormat != formatNDJSON {
+			return fmt.Errorf("unknown format %q, use csv or ndjson", exportFormat)
+		}
+
+		query := data.UserQuery{Limit: data.MaxPageSize}
+		page, err := app.Repo.List(context.Background(), query)
+		if err != nil {
+			return err
+		}
+
+		return app.exportUsers(context.Background(), out, exportFormat, query, &page)
+	case "purge":
+		if len(args) > 1 {
+			return usage
+		}
+
+		purged, err := app.purgeDeletedUsers(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Purged %d users deleted more than %s ago\n", purged, app.DeletionGracePeriod)
+	default:
+		return usage
+	}
+
+	return nil
+}
+
+// openCommandFile opens the file named on the command line, - is stdin
+func openCommandFile(name string, stdin io.Reader) (io.Reader, func(), error) {
+	if name == "-" {
+		return stdin, func() {}, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, func() { f.Close() }, nil
+}
+
+// formatOf returns the format given with -format, or the one of the file extension
+func formatOf(format, file string) string {
+	if format != "" {
+		return format
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".csv":
+		return formatCSV
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	}
+
+	return ""
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// setupBulk подменяет хранилище пользователей пустым и возвращает id администратора. Отзывы
+// токенов тоже свои: id пользователей повторяются, и отзыв всех сессий в одном тесте иначе
+// задевал бы токены, выданные в другом в ту же секунду.
+func setupBulk(t *testing.T) int {
+	t.Helper()
+
+	repo, resets, revocations := testApp.Repo, testApp.Resets, testApp.Revocations
+	testApp.Repo = data.NewMemoryRepository()
+	testApp.Resets = data.NewMemoryPasswordResetRepository()
+	testApp.Revocations = data.NewMemoryRevocationStore()
+	t.Cleanup(func() { testApp.Repo, testApp.Resets, testApp.Revocations = repo, resets, revocations })
+
+	ctx := context.Background()
+	admin, _ := testApp.Repo.Insert(ctx, data.User{Email: "admin@here.com", LastName: "Admin", Password: "verysecret", Status: data.StatusActive})
+	_ = testApp.Repo.GrantRole(ctx, admin, "admin")
+
+	return admin
+}
+
+// serveBulk отправляет тело как есть от имени пользователя userID.
+func serveBulk(t *testing.T, method, path, contentType, body string, userID int) *httptest.ResponseRecorder {
+	t.Helper()
+
+	userData, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), userID, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = "192.168.1.1:12345"
+	req.Header.Set("Content-Type", contentType)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: userData.AccessToken})
+
+	rr := httptest.NewRecorder()
+	testApp.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func decodeImportReport(t *testing.T, rr *httptest.ResponseRecorder) importReport {
+	t.Helper()
+
+	var payload struct {
+		Data importReport `json:"data"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &payload)
+	if err != nil {
+		t.Fatalf("expected a JSON response, got %s", rr.Body.String())
+	}
+
+	return payload.Data
+}
+
+func Test_ImportUsers_TemporaryPasswords(t *testing.T) {
+	admin := setupBulk(t)
+	ctx := context.Background()
+
+	file := "email,first_name,last_name,roles\n" +
+		"ann@here.com,Ann,Lee,\n" +
+		"bob@here.com,Bob,Stone,admin;user\n"
+
+	rr := serveBulk(t, "POST", "/users/import?mode=password", "text/csv", file, admin)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	report := decodeImportReport(t, rr)
+	if report.Imported != 2 || len(report.Rows) != 2 || report.Rows[0].Line != 2 || report.Rows[1].Line != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	for i, roles := range []string{"user", "admin,user"} {
+		row := report.Rows[i]
+		user, err := testApp.Repo.GetOne(ctx, row.ID)
+		if err != nil {
+			t.Fatalf("expected the user of line %d to exist, got %v", row.Line, err)
+		}
+		if !user.IsActive() {
+			t.Errorf("expected imported users to be active, got %+v", user)
+		}
+
+		// временный пароль подходит для входа
+		if ok, _ := testApp.Repo.PasswordMatches(ctx, row.TemporaryPassword, *user); !ok || row.TemporaryPassword == "" {
+			t.Errorf("expected the temporary password of line %d to match", row.Line)
+		}
+
+		granted, _ := testApp.Repo.GetRoles(ctx, row.ID)
+		if strings.Join(granted, ",") != roles {
+			t.Errorf("expected roles %s for line %d, got %v", roles, row.Line, granted)
+		}
+	}
+}
+
+func Test_ImportUsers_InvalidRows(t *testing.T) {
+	admin := setupBulk(t)
+
+	file := strings.Join([]string{
+		`{"email": "ok@here.com", "first_name": "Ok"}`,
+		`{"email": "not an email"}`,
+		``,
+		`{"email": "admin@here.com"}`,
+		`{"email": "OK@here.com"}`,
+		`{"email": "x@here.com", "password": "secret"}`,
+		`{"email": "y@here.com"`,
+	}, "\n")
+
+	rr := serveBulk(t, "POST", "/users/import", "application/x-ndjson", file, admin)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected http.StatusBadRequest but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	report := decodeImportReport(t, rr)
+	errs := map[int]string{}
+	for _, row := range report.Rows {
+		errs[row.Line] = row.Error
+	}
+
+	expected := map[int]string{
+		1: "",
+		2: "email is not a valid address",
+		4: "email is already in use",
+		5: "email is already on line 1",
+		6: "invalid JSON",
+		7: "invalid JSON",
+	}
+	for line, message := range expected {
+		if !strings.HasPrefix(errs[line], message) || (message == "" && errs[line] != "") {
+			t.Errorf("line %d: expected the error %q, got %q", line, message, errs[line])
+		}
+	}
+	if report.Failed != 5 || report.Imported != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	// при ошибках ничего не импортируется
+	if _, err := testApp.Repo.GetByEmail(context.Background(), "ok@here.com"); err == nil {
+		t.Error("expected no users to be imported")
+	}
+}
+
+func Test_ImportUsers_RollsBack(t *testing.T) {
+	admin := setupBulk(t)
+
+	// через API неизвестную роль не пропускает проверка своих ролей, поэтому импорт
+	// запускается напрямую, как из командной строки
+	rows := []importRow{{Line: 2, Email: "first@here.com", Roles: []string{"user"}}, {Line: 3, Email: "second@here.com", Roles: []string{"superuser"}}}
+	report, err := testApp.importUsers(context.Background(), rows, importOptions{Mode: importPassword})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if report.Rows[1].Error != `unknown role "superuser"` || report.Rows[0].ID != 0 || report.Rows[0].TemporaryPassword != "" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	// первая строка тоже откатывается
+	if _, err := testApp.Repo.GetByEmail(context.Background(), "first@here.com"); err == nil {
+		t.Error("expected the import to be rolled back")
+	}
+
+	for _, e := range []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+	}{
+		{"unknown format", "/users/import", "text/plain", "email\nx@here.com\n"},
+		{"unknown column", "/users/import", "text/csv", "email,password\nx@here.com,secret\n"},
+		{"no email column", "/users/import", "text/csv", "first_name\nX\n"},
+		{"empty file", "/users/import", "text/csv", "email\n"},
+		{"unknown mode", "/users/import?mode=magic", "text/csv", "email\nx@here.com\n"},
+	} {
+		rr := serveBulk(t, "POST", e.path, e.contentType, e.body, admin)
+		if rr.Code != http.StatusBadRequest && rr.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected an error but got %d", e.name, rr.Code)
+		}
+	}
+}
+
+func Test_ImportUsers_OwnRoles(t *testing.T) {
+	setupBulk(t)
+	ctx := context.Background()
+
+	// у вызывающего есть roles:manage, но нет роли admin
+	manager, _ := testApp.Repo.Insert(ctx, data.User{Email: "manager@here.com", Password: "verysecret", Status: data.StatusActive})
+	_ = testApp.Repo.GrantRole(ctx, manager, "user")
+
+	file := "email,roles\nfriend@here.com,user\nboss@here.com,admin\n"
+	req, _ := http.NewRequest("POST", "/users/import", strings.NewReader(file))
+	req.Header.Set("Content-Type", "text/csv")
+	ctx = context.WithValue(ctx, userIDKey, manager)
+	ctx = context.WithValue(ctx, claimsKey, jwt.MapClaims{"scope": "roles:manage users:write"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(testApp.ImportUsers).ServeHTTP(rr, req.WithContext(ctx))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected http.StatusBadRequest but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	report := decodeImportReport(t, rr)
+	if report.Rows[0].Error != "" || report.Rows[1].Error != "can't hand out the role admin" {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if _, err := testApp.Repo.GetByEmail(ctx, "boss@here.com"); err == nil {
+		t.Error("expected no users to be imported")
+	}
+}
+
+func Test_ImportUsers_Invitations(t *testing.T) {
+	admin := setupBulk(t)
+
+	outbox := t.TempDir()
+	mailer := testApp.Mailer
+	testApp.Mailer = NewOutboxMailer(outbox)
+	defer func() { testApp.Mailer = mailer }()
+	testApp.PasswordResetURL = "http://localhost/reset-password"
+
+	// проверка файла без импорта
+	rr := serveBulk(t, "POST", "/users/import?dry_run=true", "text/csv", "email\ninvited@here.com\n", admin)
+	if rr.Code != http.StatusAccepted || !decodeImportReport(t, rr).DryRun {
+		t.Fatalf("expected a successful dry run but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := testApp.Repo.GetByEmail(context.Background(), "invited@here.com"); err == nil {
+		t.Error("expected a dry run not to import the users")
+	}
+
+	rr = serveBulk(t, "POST", "/users/import", "text/csv", "email\ninvited@here.com\n", admin)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	report := decodeImportReport(t, rr)
+	if !report.Rows[0].Invited || report.Rows[0].TemporaryPassword != "" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(outbox, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one invitation in the outbox, got %d", len(files))
+	}
+	email, _ := os.ReadFile(files[0])
+	match := regexp.MustCompile(`reset-password\?token=([A-Za-z0-9_-]+)`).FindSubmatch(email)
+	if match == nil {
+		t.Fatalf("expected a link in the invitation, got %s", email)
+	}
+
+	// ссылка из приглашения задаёт пароль так же, как ссылка для сброса
+	body, _ := json.Marshal(map[string]string{"token": string(match[1]), "password": "my own password"})
+	req, _ := http.NewRequest("POST", "/password/reset", bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(testApp.ResetPassword).ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func Test_ExportUsers(t *testing.T) {
+	admin := setupBulk(t)
+	ctx := context.Background()
+
+	id, _ := testApp.Repo.Insert(ctx, data.User{Email: "evil@here.com", FirstName: "=HYPERLINK(1)", LastName: "Zed", Password: "verysecret"})
+	_ = testApp.Repo.GrantRole(ctx, id, "user")
+
+	rr := serveBulk(t, "GET", "/users/export", "", "", admin)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("expected a CSV file but got %d: %s", rr.Code, rr.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 3 || lines[0] != "id,email,first_name,last_name,status,roles,created_at,updated_at" {
+		t.Fatalf("unexpected export %q", lines)
+	}
+	// значения, похожие на формулы, экранируются
+	if !strings.HasPrefix(lines[2], "2,evil@here.com,'=HYPERLINK(1),Zed,pending,user,") {
+		t.Errorf("unexpected row %q", lines[2])
+	}
+
+	rr = serveBulk(t, "GET", "/users/export?format=ndjson&status=active", "", "", admin)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected http.StatusOK but got %d", rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), "argon2id") || strings.Contains(rr.Body.String(), "password") {
+		t.Errorf("expected no password hashes in the export, got %s", rr.Body.String())
+	}
+	exported := rr.Body.String()
+	if strings.Count(exported, "\n") != 1 || !strings.Contains(exported, `"roles":["admin"]`) {
+		t.Errorf("expected only the active admin, got %s", exported)
+	}
+
+	if rr := serveBulk(t, "GET", "/users/export?format=xml", "", "", admin); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for an unknown format but got %d", rr.Code)
+	}
+
+	// выгрузку можно загрузить обратно в другую базу
+	setupBulk(t)
+	csvExport := strings.Join(lines, "\n")
+	csvExport = strings.Replace(csvExport, "admin@here.com", "other@here.com", 1)
+	rr = serveBulk(t, "POST", "/users/import?dry_run=true", "text/csv", csvExport, admin)
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("expected the export to be importable, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// экранирование снимается при загрузке
+	rr = serveBulk(t, "POST", "/users/import", "text/csv", csvExport, admin)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if found, err := testApp.Repo.GetByEmail(ctx, "evil@here.com"); err != nil || found.FirstName != "=HYPERLINK(1)" {
+		t.Errorf("expected the name to round-trip, got %+v %v", found, err)
+	}
+}
+
+func Test_UsersCommand(t *testing.T) {
+	setupBulk(t)
+
+	file := filepath.Join(t.TempDir(), "users.ndjson")
+	_ = os.WriteFile(file, []byte(`{"email": "cli@here.com", "last_name": "Cli"}`+"\n"), 0o600)
+
+	var out bytes.Buffer
+	err := testApp.usersCommand([]string{"import", "-mode", "password", file}, nil, &out)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.Contains(out.String(), "cli@here.com\tid 2\tpassword ") || !strings.Contains(out.String(), "Imported 1 users") {
+		t.Errorf("unexpected output %s", out.String())
+	}
+
+	// повторный импорт того же файла отклоняется целиком
+	out.Reset()
+	err = testApp.usersCommand([]string{"import", file}, nil, &out)
+	if err == nil || !strings.Contains(out.String(), "error: email is already in use") {
+		t.Errorf("expected the duplicate to be reported, got %v: %s", err, out.String())
+	}
+
+	out.Reset()
+	err = testApp.usersCommand([]string{"export", "-format", "ndjson"}, nil, &out)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Count(out.String(), "\n") != 2 || !strings.Contains(out.String(), `"email":"cli@here.com"`) {
+		t.Errorf("unexpected export %s", out.String())
+	}
+
+	if err := testApp.usersCommand([]string{"delete"}, nil, &out); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+}
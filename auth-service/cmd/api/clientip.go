@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClientIPResolver works out the address of the client a request comes from. The forwarding
+// headers are only believed when the request was sent by one of the trusted proxies, e.g.
+// the broker, otherwise anybody could pick the address their tokens are bound to.
+type ClientIPResolver struct {
+	TrustedProxies []*net.IPNet
+}
+
+// newClientIPResolver reads the trusted proxies from TRUSTED_PROXIES, a comma separated list
+// of addresses and CIDR ranges
+func newClientIPResolver() (ClientIPResolver, error) {
+	var resolver ClientIPResolver
+
+	for _, entry := range strings.Split(envOr("TRUSTED_PROXIES", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return resolver, fmt.Errorf("TRUSTED_PROXIES: invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return resolver, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		resolver.TrustedProxies = append(resolver.TrustedProxies, network)
+	}
+
+	return resolver, nil
+}
+
+// ClientIP returns the address of the client. Behind trusted proxies the Forwarded header, or
+// X-Forwarded-For when there is none, is walked from the right, and the first address which
+// is not a trusted proxy is the client.
+func (c ClientIPResolver) ClientIP(r *http.Request) string {
+	remote := parseIP(r.RemoteAddr)
+	if remote == nil {
+		return r.RemoteAddr
+	}
+	if !c.trusted(remote) {
+		return remote.String()
+	}
+
+	// when every hop is a trusted proxy, the one furthest from us is the best we know
+	client := remote
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseIP(hops[i])
+		if ip == nil {
+			// an address we can't make sense of was not added by one of our proxies
+			break
+		}
+
+		client = ip
+		if !c.trusted(ip) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+func (c ClientIPResolver) trusted(ip net.IP) bool {
+	for _, network := range c.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedFor returns the addresses of the hops in the Forwarded header (RFC 7239) or, when
+// there is none, in X-Forwarded-For. The address closest to the client comes first.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						hops = append(hops, strings.Trim(node, `"`))
+					}
+				}
+			}
+		}
+
+		return hops
+	}
+
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	return hops
+}
+
+// parseIP parses an address with or without a port, such as 10.0.0.1, 10.0.0.1:8080, ::1,
+// [::1]:8080 or fe80::1%eth0. IPv4 addresses mapped to IPv6 are returned as IPv4.
+func parseIP(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if zone := strings.IndexByte(address, '%'); zone >= 0 {
+		address = address[:zone]
+	}
+
+	ip := net.ParseIP(address)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
+
+// IP binding modes, how closely the address a token is used from has to match the address
+// it was issued to
+const (
+	IPBindingStrict = "strict"
+	IPBindingSubnet = "subnet"
+	IPBindingOff    = "off"
+)
+
+// IPBindingPolicy decides whether a token bound to one address may be used from another.
+// In subnet mode both addresses have to be in the same IPv4Prefix or IPv6Prefix network.
+type IPBindingPolicy struct {
+	Mode       string
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// newIPBindingPolicy reads the policy from IP_BINDING and IP_BINDING_IPV4_PREFIX and
+// IP_BINDING_IPV6_PREFIX
+func newIPBindingPolicy() (IPBindingPolicy, error) {
+	policy := IPBindingPolicy{Mode: envOr("IP_BINDING", IPBindingStrict)}
+
+	switch policy.Mode {
+	case IPBindingStrict, IPBindingSubnet, IPBindingOff:
+	default:
+		return policy, fmt.Errorf("IP_BINDING: unknown mode %q", policy.Mode)
+	}
+
+	prefixes := []struct {
+		key   string
+		def   string
+		max   int
+		value *int
+	}{
+		{"IP_BINDING_IPV4_PREFIX", "24", 8 * net.IPv4len, &policy.IPv4Prefix},
+		{"IP_BINDING_IPV6_PREFIX", "64", 8 * net.IPv6len, &policy.IPv6Prefix},
+	}
+	for _, setting := range prefixes {
+		prefix, err := strconv.Atoi(envOr(setting.key, setting.def))
+		if err != nil {
+			return policy, fmt.Errorf("%s: %w", setting.key, err)
+		}
+		if prefix < 0 || prefix > setting.max {
+			return policy, fmt.Errorf("%s: prefix must be between 0 and %d", setting.key, setting.max)
+		}
+		*setting.value = prefix
+	}
+
+	return policy, nil
+}
+
+// Allows reports whether a token issued to boundIP may be used from ip
+func (p IPBindingPolicy) Allows(boundIP, ip string) bool {
+	if p.Mode == IPBindingOff {
+		return true
+	}
+
+	bound, current := parseIP(boundIP), parseIP(ip)
+	if bound == nil || current == nil {
+		return boundIP == ip
+	}
+	if p.Mode != IPBindingSubnet {
+		return bound.Equal(current)
+	}
+	if (bound.To4() == nil) != (current.To4() == nil) {
+		return false
+	}
+
+	mask := net.CIDRMask(p.IPv6Prefix, 8*net.IPv6len)
+	if bound.To4() != nil {
+		mask = net.CIDRMask(p.IPv4Prefix, 8*net.IPv4len)
+	}
+
+	return bound.Mask(mask).Equal(current.Mask(mask))
+}
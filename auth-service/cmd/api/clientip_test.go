@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test_ClientIP проверяет определение адреса клиента за доверенными прокси.
+func Test_ClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	_, proxiesV6, _ := net.ParseCIDR("fd00::/8")
+	resolver := ClientIPResolver{TrustedProxies: []*net.IPNet{proxies, proxiesV6}}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"ipv4", "192.168.1.1:12345", nil, "192.168.1.1"},
+		{"ipv6", "[2001:db8::1]:12345", nil, "2001:db8::1"},
+		{"ipv6 with zone", "[fe80::1%eth0]:12345", nil, "fe80::1"},
+		{"mapped ipv4", "[::ffff:192.168.1.1]:12345", nil, "192.168.1.1"},
+		{"untrusted proxy", "192.168.1.1:12345", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "192.168.1.1"},
+		{"trusted proxy", "10.0.0.5:12345", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"spoofed hop", "10.0.0.5:12345", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.7, 10.0.0.6"}, "203.0.113.7"},
+		{"only proxies", "10.0.0.5:12345", map[string]string{"X-Forwarded-For": "10.0.0.7, 10.0.0.6"}, "10.0.0.7"},
+		{"garbage hop", "10.0.0.5:12345", map[string]string{"X-Forwarded-For": "unknown, 10.0.0.6"}, "10.0.0.6"},
+		{"no header", "10.0.0.5:12345", nil, "10.0.0.5"},
+		{"forwarded", "10.0.0.5:12345", map[string]string{"Forwarded": `for=192.0.2.60;proto=http, for="[2001:db8::2]:4711"`}, "2001:db8::2"},
+		{"forwarded wins", "10.0.0.5:12345", map[string]string{"Forwarded": "for=192.0.2.60", "X-Forwarded-For": "203.0.113.7"}, "192.0.2.60"},
+		{"ipv6 proxy", "[fd00::1]:12345", map[string]string{"X-Forwarded-For": "2001:db8::3"}, "2001:db8::3"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = e.remoteAddr
+		for key, value := range e.headers {
+			req.Header.Set(key, value)
+		}
+
+		if ip := resolver.ClientIP(req); ip != e.expected {
+			t.Errorf("%s: expected %s but got %s", e.name, e.expected, ip)
+		}
+	}
+}
+
+// Test_NewClientIPResolver проверяет разбор TRUSTED_PROXIES.
+func Test_NewClientIPResolver(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1, ::1")
+	resolver, err := newClientIPResolver()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for ip, expected := range map[string]bool{"10.1.2.3": true, "192.168.1.1": true, "192.168.1.2": false, "::1": true, "::2": false} {
+		if trusted := resolver.trusted(net.ParseIP(ip)); trusted != expected {
+			t.Errorf("%s: expected trusted %v but got %v", ip, expected, trusted)
+		}
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "not-an-ip")
+	if _, err := newClientIPResolver(); err == nil {
+		t.Error("expected an error for an invalid proxy")
+	}
+}
+
+// Test_IPBindingPolicy проверяет режимы привязки токена к адресу.
+func Test_IPBindingPolicy(t *testing.T) {
+	tests := []struct {
+		mode     string
+		boundIP  string
+		ip       string
+		expected bool
+	}{
+		{IPBindingStrict, "192.168.1.1", "192.168.1.1", true},
+		{IPBindingStrict, "192.168.1.1", "192.168.1.2", false},
+		{IPBindingStrict, "2001:db8::1", "2001:db8:0:0::1", true},
+		{IPBindingSubnet, "192.168.1.1", "192.168.1.200", true},
+		{IPBindingSubnet, "192.168.1.1", "192.168.2.1", false},
+		{IPBindingSubnet, "2001:db8::1", "2001:db8::ffff:1", true},
+		{IPBindingSubnet, "2001:db8::1", "2001:db8:0:1::1", false},
+		{IPBindingSubnet, "192.168.1.1", "::ffff:192.168.1.9", true},
+		{IPBindingSubnet, "192.168.1.1", "2001:db8::1", false},
+		{IPBindingOff, "192.168.1.1", "2001:db8::1", true},
+	}
+
+	for _, e := range tests {
+		policy := IPBindingPolicy{Mode: e.mode, IPv4Prefix: 24, IPv6Prefix: 64}
+		if allowed := policy.Allows(e.boundIP, e.ip); allowed != e.expected {
+			t.Errorf("%s %s -> %s: expected %v but got %v", e.mode, e.boundIP, e.ip, e.expected, allowed)
+		}
+	}
+
+	t.Setenv("IP_BINDING", "sometimes")
+	if _, err := newIPBindingPolicy(); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+
+	t.Setenv("IP_BINDING", IPBindingSubnet)
+	t.Setenv("IP_BINDING_IPV4_PREFIX", "33")
+	if _, err := newIPBindingPolicy(); err == nil {
+		t.Error("expected an error for a too long prefix")
+	}
+}
+
+// Test_IPBinding проверяет, что middleware отклоняет токен, использованный с другого адреса.
+func Test_IPBinding(t *testing.T) {
+	var logged []string
+	testApp.Client = NewTestClient(func(req *http.Request) *http.Response {
+		body, _ := io.ReadAll(req.Body)
+		logged = append(logged, string(body))
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error": false}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	policy := testApp.IPBinding
+	defer func() { testApp.IPBinding = policy }()
+
+	routes := testApp.routes()
+	userData, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), 5, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	me := func(remoteAddr string) int {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer "+userData.AccessToken)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	tests := []struct {
+		mode       string
+		remoteAddr string
+		expected   int
+	}{
+		{IPBindingStrict, "192.168.1.1:1", http.StatusOK},
+		{IPBindingStrict, "192.168.1.2:1", http.StatusUnauthorized},
+		{IPBindingSubnet, "192.168.1.2:1", http.StatusOK},
+		{IPBindingSubnet, "192.168.2.1:1", http.StatusUnauthorized},
+		{IPBindingOff, "[2001:db8::1]:1", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		testApp.IPBinding = IPBindingPolicy{Mode: e.mode, IPv4Prefix: 24, IPv6Prefix: 64}
+		logged = nil
+
+		if code := me(e.remoteAddr); code != e.expected {
+			t.Errorf("%s from %s: expected %d but got %d", e.mode, e.remoteAddr, e.expected, code)
+		}
+
+		// каждый отказ из-за адреса попадает в журнал
+		mismatch := len(logged) == 1 && strings.Contains(logged[0], "ip-mismatch") && strings.Contains(logged[0], "192.168.1.1")
+		if (e.expected == http.StatusUnauthorized) != mismatch {
+			t.Errorf("%s from %s: unexpected log entries %v", e.mode, e.remoteAddr, logged)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+create table if not exists users
+(
+    id         serial primary key,
+    email      varchar(255) not null unique,
+    first_name varchar(255) not null default '',
+    last_name  varchar(255) not null default '',
+    password   varchar(60)  not null,
+    active     integer      not null default 0,
+    created_at timestamp    not null default now(),
+    updated_at timestamp    not null default now()
+);
+
+-- the demo admin account from the login page, the password is verysecret
+insert into users (email, first_name, last_name, password, active)
+values ('admin@example.com', 'Admin', 'User', '$2a$12$oqoOqys6o/Y3.D3YvyVPpevGRqxGLkEmQ/U7Ei7kt8Kg4H6XQmAtC', 1)
+on conflict (email) do nothing;
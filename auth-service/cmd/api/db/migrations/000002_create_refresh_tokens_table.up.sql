@@ -0,0 +1,13 @@
+create table if not exists refresh_tokens
+(
+    id         serial primary key,
+    user_id    integer      not null references users (id) on delete cascade,
+    token_hash varchar(64)  not null unique,
+    family_id  varchar(64)  not null,
+    ip         varchar(255) not null,
+    expires_at timestamp    not null,
+    created_at timestamp    not null,
+    revoked_at timestamp
+);
+
+create index if not exists refresh_tokens_family_id_idx on refresh_tokens (family_id);
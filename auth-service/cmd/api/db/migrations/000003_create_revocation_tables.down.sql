@@ -0,0 +1,2 @@
+drop table if exists user_revocations;
+drop table if exists revoked_tokens;
@@ -0,0 +1,11 @@
+create table if not exists revoked_tokens
+(
+    jti        varchar(64) primary key,
+    expires_at timestamp not null
+);
+
+create table if not exists user_revocations
+(
+    user_id        integer primary key references users (id) on delete cascade,
+    revoked_before timestamp not null
+);
@@ -0,0 +1,55 @@
+create table if not exists roles
+(
+    id   serial primary key,
+    name varchar(64) not null unique
+);
+
+create table if not exists permissions
+(
+    id   serial primary key,
+    name varchar(64) not null unique
+);
+
+create table if not exists role_permissions
+(
+    role_id       integer not null references roles (id) on delete cascade,
+    permission_id integer not null references permissions (id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists user_roles
+(
+    user_id integer not null references users (id) on delete cascade,
+    role_id integer not null references roles (id) on delete cascade,
+    primary key (user_id, role_id)
+);
+
+insert into roles (name)
+values ('admin'),
+       ('user')
+on conflict do nothing;
+
+insert into permissions (name)
+values ('users:read'),
+       ('users:write'),
+       ('users:delete'),
+       ('roles:manage'),
+       ('logs:write')
+on conflict do nothing;
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id
+from roles r,
+     permissions p
+where r.name = 'admin'
+   or (r.name = 'user' and p.name = 'logs:write')
+on conflict do nothing;
+
+-- every existing user gets the default role, and the demo admin account gets the admin role
+insert into user_roles (user_id, role_id)
+select u.id, r.id
+from users u,
+     roles r
+where r.name = 'user'
+   or (r.name = 'admin' and u.email = 'admin@example.com')
+on conflict do nothing;
@@ -0,0 +1,7 @@
+create table if not exists login_attempts
+(
+    key             varchar(320) primary key,
+    failures        integer   not null default 0,
+    last_failure_at timestamp not null,
+    locked_until    timestamp
+);
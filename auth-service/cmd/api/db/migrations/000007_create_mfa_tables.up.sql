@@ -0,0 +1,18 @@
+create table if not exists user_mfa
+(
+    user_id        integer primary key references users (id) on delete cascade,
+    secret         varchar(64) not null,
+    last_used_step bigint      not null default 0,
+    enabled_at     timestamp,
+    created_at     timestamp   not null
+);
+
+create table if not exists mfa_recovery_codes
+(
+    id        serial primary key,
+    user_id   integer     not null references users (id) on delete cascade,
+    code_hash varchar(64) not null,
+    used_at   timestamp
+);
+
+create index if not exists mfa_recovery_codes_user_id_idx on mfa_recovery_codes (user_id);
@@ -0,0 +1,13 @@
+create table if not exists sessions
+(
+    id           varchar(64) primary key,
+    user_id      integer      not null references users (id) on delete cascade,
+    ip           varchar(255) not null,
+    user_agent   text         not null default '',
+    created_at   timestamp    not null,
+    last_seen_at timestamp    not null,
+    expires_at   timestamp    not null,
+    revoked_at   timestamp
+);
+
+create index if not exists sessions_user_id_idx on sessions (user_id);
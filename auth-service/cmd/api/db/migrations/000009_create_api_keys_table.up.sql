@@ -0,0 +1,15 @@
+create table if not exists api_keys
+(
+    id           serial primary key,
+    user_id      integer      not null references users (id) on delete cascade,
+    name         varchar(255) not null,
+    prefix       varchar(16)  not null,
+    key_hash     varchar(64)  not null unique,
+    scopes       text         not null default '',
+    expires_at   timestamp,
+    last_used_at timestamp,
+    created_at   timestamp    not null,
+    revoked_at   timestamp
+);
+
+create index if not exists api_keys_user_id_idx on api_keys (user_id);
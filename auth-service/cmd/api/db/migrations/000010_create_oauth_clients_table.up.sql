@@ -0,0 +1,8 @@
+create table if not exists oauth_clients
+(
+    client_id   varchar(255) primary key,
+    name        varchar(255) not null default '',
+    secret_hash varchar(64)  not null,
+    scopes      text         not null default '',
+    created_at  timestamp    not null
+);
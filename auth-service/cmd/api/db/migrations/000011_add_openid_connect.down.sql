@@ -0,0 +1,3 @@
+drop table if exists oauth_authorization_codes;
+drop table if exists oauth_consents;
+alter table oauth_clients drop column if exists redirect_uris;
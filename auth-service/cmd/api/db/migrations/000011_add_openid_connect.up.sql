@@ -0,0 +1,24 @@
+alter table oauth_clients add column if not exists redirect_uris text not null default '';
+
+create table if not exists oauth_consents
+(
+    user_id    integer      not null references users (id) on delete cascade,
+    client_id  varchar(255) not null references oauth_clients (client_id) on delete cascade,
+    scopes     text         not null default '',
+    created_at timestamp    not null,
+    primary key (user_id, client_id)
+);
+
+create table if not exists oauth_authorization_codes
+(
+    code_hash      varchar(64) primary key,
+    client_id      varchar(255) not null references oauth_clients (client_id) on delete cascade,
+    user_id        integer      not null references users (id) on delete cascade,
+    redirect_uri   text         not null,
+    scopes         text         not null default '',
+    nonce          text         not null default '',
+    code_challenge varchar(128) not null,
+    expires_at     timestamp    not null,
+    used_at        timestamp,
+    created_at     timestamp    not null
+);
@@ -0,0 +1 @@
+drop table if exists magic_links;
@@ -0,0 +1,11 @@
+create table if not exists magic_links
+(
+    id         serial primary key,
+    user_id    integer     not null references users (id) on delete cascade,
+    token_hash varchar(64) not null unique,
+    expires_at timestamp   not null,
+    created_at timestamp   not null,
+    used_at    timestamp
+);
+
+create index if not exists magic_links_user_id_idx on magic_links (user_id);
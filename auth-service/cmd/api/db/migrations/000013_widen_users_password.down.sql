@@ -0,0 +1,3 @@
+-- argon2id hashes are longer than bcrypt ones, so the column can only be narrowed once
+-- every hash is a bcrypt hash again
+alter table users alter column password type varchar(60);
@@ -0,0 +1,12 @@
+create table if not exists invitations
+(
+    id         serial primary key,
+    code_hash  varchar(64)  not null unique,
+    email      varchar(255) not null default '',
+    roles      text         not null default '',
+    created_by integer references users (id) on delete set null,
+    expires_at timestamp    not null,
+    created_at timestamp    not null,
+    used_at    timestamp,
+    used_by    integer references users (id) on delete set null
+);
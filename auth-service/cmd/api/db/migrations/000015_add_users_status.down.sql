@@ -0,0 +1,10 @@
+drop index if exists users_deleted_at_idx;
+
+alter table users add column active integer not null default 0;
+
+update users set active = 1 where status = 'active';
+
+alter table users
+    drop column deleted_at,
+    drop column status_reason,
+    drop column status;
@@ -0,0 +1,13 @@
+-- the active flag becomes an explicit state: pending (email not verified), active, suspended
+-- or deleted. Deleted users are kept until the grace period is over.
+alter table users
+    add column status        varchar(16) not null default 'pending'
+        check (status in ('pending', 'active', 'suspended', 'deleted')),
+    add column status_reason text        not null default '',
+    add column deleted_at    timestamp;
+
+update users set status = 'active' where active = 1;
+
+alter table users drop column active;
+
+create index if not exists users_deleted_at_idx on users (deleted_at) where deleted_at is not null;
@@ -0,0 +1,2 @@
+-- the demo admin account is not restored, set SEED_DEMO_ADMIN=true to create it again
+select 1;
@@ -0,0 +1,7 @@
+-- older versions created the demo admin account with the public password verysecret in every
+-- database, it is only seeded with SEED_DEMO_ADMIN=true now. Accounts whose password has been
+-- changed are kept.
+delete
+from users
+where email = 'admin@example.com'
+  and password = '$2a$12$oqoOqys6o/Y3.D3YvyVPpevGRqxGLkEmQ/U7Ei7kt8Kg4H6XQmAtC';
@@ -0,0 +1,6 @@
+delete
+from user_revocations
+where user_id not in (select id from users);
+
+alter table user_revocations
+    add constraint user_revocations_user_id_fkey foreign key (user_id) references users (id) on delete cascade;
@@ -0,0 +1,3 @@
+-- revocations are kept when the user is deleted, so tokens issued before that stay revoked
+alter table user_revocations
+    drop constraint if exists user_revocations_user_id_fkey;
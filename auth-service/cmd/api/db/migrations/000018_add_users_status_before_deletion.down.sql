@@ -0,0 +1 @@
+alter table users drop column status_before_deletion;
@@ -0,0 +1,3 @@
+-- the state a deleted user had, so restoring the account doesn't activate an unverified email.
+-- Users deleted before this migration are restored as pending.
+alter table users add column status_before_deletion varchar(16);
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"archive/zip"
+	"auth-service/data"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// eraseDelete deletes the account and the log entries which mention it
+	eraseDelete = "delete"
+	// eraseAnonymize keeps the account and the log entries, with everything which identifies
+	// the user replaced
+	eraseAnonymize = "anonymize"
+)
+
+// errLogService is returned when the log service can't be reached or fails
+var errLogService = errors.New("the log service is not available")
+
+// logMentions are the terms log entries of the user are found by, the way auth-service and
+// the other services write them
+func logMentions(user data.User) []string {
+	return []string{user.Email, fmt.Sprintf("user %d", user.ID)}
+}
+
+// erasedName replaces the email of an anonymized user, in the account and in the logs
+func erasedName(id int) string {
+	return fmt.Sprintf("erased-user-%d", id)
+}
+
+// logServiceRequest sends a request to the log service with the service token and decodes the
+// data of the response into out, when it is not nil
+func (app *Config) logServiceRequest(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(jsonData)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, logServiceURL+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	if app.ServiceTokens != nil {
+		token, err := app.ServiceTokens.Token()
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := app.Client.Do(request)
+	if err != nil {
+		log.Println("Error calling the log service:", err)
+		return errLogService
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusMultipleChoices {
+		log.Println("The log service answered", response.StatusCode, "to", method, path)
+		return errLogService
+	}
+	if out == nil {
+		return nil
+	}
+
+	payload := jsonResponse{Data: out}
+	err = json.NewDecoder(response.Body).Decode(&payload)
+	if err != nil {
+		log.Println("Error decoding the response of the log service:", err)
+		return errLogService
+	}
+
+	return nil
+}
+
+// fetchLogMentions returns the log entries which mention the user, as the log service sent them
+func (app *Config) fetchLogMentions(ctx context.Context, user data.User) ([]json.RawMessage, error) {
+	query := url.Values{"mention": logMentions(user)}
+
+	entries := []json.RawMessage{}
+	err := app.logServiceRequest(ctx, "GET", "/logs?"+query.Encode(), nil, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// eraseLogMentions deletes or anonymizes the log entries which mention the user
+func (app *Config) eraseLogMentions(ctx context.Context, user data.User, mode string) error {
+	body := map[string]any{
+		"mentions": logMentions(user),
+		"mode":     mode,
+	}
+	if mode == eraseAnonymize {
+		body["replacement"] = erasedName(user.ID)
+	}
+
+	return app.logServiceRequest(ctx, "POST", "/logs/erase", body, nil)
+}
+
+// ExportMyData sends the current user a zip archive with everything auth-service and the log
+// service keep about them: the profile with the roles, the sessions, the API keys, the
+// invitations and the log entries which mention them.
+func (app *Config) ExportMyData(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Repo.GetOne(r.Context(), r.Context().Value(userIDKey).(int))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	files, err := app.collectUserData(r.Context(), *user)
+	if errors.Is(err, errLogService) {
+		app.errorJSON(w, err, http.StatusBadGateway)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, file := range files {
+		out, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: time.Now()})
+		if err == nil {
+			_, err = fw.Write(out)
+		}
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, "the data of the account has been exported")
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-export.zip"`, user.ID))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(archive.Bytes())
+}
+
+// exportFile is one JSON file of the data export
+type exportFile struct {
+	name    string
+	content any
+}
+
+// collectUserData gathers the files of the data export of the user
+func (app *Config) collectUserData(ctx context.Context, user data.User) ([]exportFile, error) {
+	roles, err := app.Repo.GetRoles(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := app.Repo.GetPermissions(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	mfa, err := app.MFA.GetMFA(ctx, user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	sessions, err := app.Sessions.GetUserSessions(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := app.APIKeys.GetUserAPIKeys(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if sessions == nil {
+		sessions = []*data.Session{}
+	}
+	if apiKeys == nil {
+		apiKeys = []*data.APIKey{}
+	}
+
+	all, err := app.Invitations.GetInvitations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	invitations := []*data.Invitation{}
+	for _, invitation := range all {
+		if (invitation.CreatedBy != nil && *invitation.CreatedBy == user.ID) || (invitation.UsedBy != nil && *invitation.UsedBy == user.ID) {
+			invitations = append(invitations, invitation)
+		}
+	}
+
+	logs, err := app.fetchLogMentions(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return []exportFile{
+		{"profile.json", map[string]any{
+			"user":        user,
+			"roles":       roles,
+			"permissions": permissions,
+			"mfa_enabled": mfa != nil && mfa.Enabled(),
+			"exported_at": time.Now(),
+		}},
+		{"sessions.json", sessions},
+		{"api_keys.json", apiKeys},
+		{"invitations.json", invitations},
+		{"logs.json", logs},
+	}, nil
+}
+
+// EraseMe erases the account of the current user, who has to confirm the password. The mode
+// is delete, the default, or anonymize.
+func (app *Config) EraseMe(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Password string `json:"password"`
+		Mode     string `json:"mode"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), r.Context().Value(userIDKey).(int))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	valid, err := app.Repo.PasswordMatches(r.Context(), requestPayload.Password, *user)
+	if err != nil || !valid {
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.eraseUser(w, r, *user, requestPayload.Mode) {
+		return
+	}
+
+	clearTokenCookies(w)
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Account erased",
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// EraseUser erases the account of another user, which needs the users:delete permission. Users
+// erase their own account with EraseMe, which asks for the password.
+func (app *Config) EraseUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Mode string `json:"mode"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.userFromURL(w, r, "users:delete")
+	if !ok {
+		return
+	}
+	if user.ID == r.Context().Value(userIDKey).(int) {
+		app.errorJSON(w, errors.New("use /me/erase to erase your own account"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.eraseUser(w, r, *user, requestPayload.Mode) {
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Erased user %d", user.ID),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// eraseUser erases the log entries which mention the user, ends all of their sessions and
+// API keys and then deletes or anonymizes the account. The logs go first, so nothing is
+// changed when the log service is not available. When it reports false, the error response
+// has already been written.
+func (app *Config) eraseUser(w http.ResponseWriter, r *http.Request, user data.User, mode string) bool {
+	if mode == "" {
+		mode = eraseDelete
+	}
+	if mode != eraseDelete && mode != eraseAnonymize {
+		app.errorJSON(w, fmt.Errorf("mode must be %s or %s", eraseDelete, eraseAnonymize), http.StatusBadRequest)
+		return false
+	}
+
+	err := app.eraseLogMentions(r.Context(), user, mode)
+	if errors.Is(err, errLogService) {
+		app.errorJSON(w, err, http.StatusBadGateway)
+		return false
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	err = app.revokeAllSessions(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	err = app.Repo.WithTx(r.Context(), func(repo data.Repository) error {
+		err := app.forgetUser(r.Context(), repo, user)
+		if err != nil {
+			return err
+		}
+
+		// erasure can't wait for the grace period of deleted accounts
+		if mode == eraseDelete {
+			return repo.PurgeByID(r.Context(), user.ID)
+		}
+		return app.anonymizeUser(r.Context(), repo, user)
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	// the entry names neither the email nor "user N", so it survives the next erasure
+	by := r.Context().Value(userIDKey).(int)
+	event := fmt.Sprintf("%s has been erased (%s) by user %d", erasedName(user.ID), mode, by)
+	if by == user.ID {
+		event = fmt.Sprintf("%s has erased the account (%s)", erasedName(user.ID), mode)
+	}
+	if err := app.logRequest("users", event); err != nil {
+		log.Println("Error logging user event:", err)
+	}
+
+	return true
+}
+
+// forgetUser removes the personal data kept outside the account: the failed logins of the
+// email, the email of the invitations and the addresses of the sessions and refresh tokens
+func (app *Config) forgetUser(ctx context.Context, repo data.Repository, user data.User) error {
+	err := app.Attempts.InTx(repo).Reset(ctx, "account:"+strings.ToLower(user.Email))
+	if err != nil {
+		return err
+	}
+
+	err = app.Invitations.InTx(repo).ClearInvitationEmails(ctx, user.Email, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.Sessions.InTx(repo).ClearUserSessionClients(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return app.Tokens.InTx(repo).ClearUserRefreshTokenIPs(ctx, user.ID)
+}
+
+// anonymizeUser keeps the account of the user, with the email, the names and the password
+// replaced, the API keys revoked, two-factor authentication disabled and the account suspended
+func (app *Config) anonymizeUser(ctx context.Context, repo data.Repository, user data.User) error {
+	err := app.APIKeys.InTx(repo).RevokeUserAPIKeys(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.MFA.InTx(repo).DisableMFA(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	password, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	err = repo.ResetPassword(ctx, password, user)
+	if err != nil {
+		return err
+	}
+
+	user.Email = erasedName(user.ID) + "@erased.invalid"
+	user.FirstName = ""
+	user.LastName = ""
+
+	err = repo.Update(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	// suspended and deleted accounts can't log in already
+	if !data.CanTransition(user.Status, data.StatusSuspended) {
+		return nil
+	}
+
+	return repo.SetStatus(ctx, user.ID, data.StatusSuspended, "erased")
+}
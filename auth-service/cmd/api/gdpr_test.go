@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/zip"
+	"auth-service/data"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logServiceStub подменяет log-service: отдаёт записи на GET /logs и запоминает запросы на удаление.
+type logServiceStub struct {
+	down     bool
+	mentions []string
+	erasures []map[string]any
+}
+
+func (s *logServiceStub) client() *http.Client {
+	return NewTestClient(func(req *http.Request) *http.Response {
+		status, body := http.StatusAccepted, `{"error": false}`
+
+		switch {
+		case s.down:
+			status, body = http.StatusServiceUnavailable, `{"error": true}`
+		case req.URL.Path == "/logs":
+			s.mentions = req.URL.Query()["mention"]
+			status, body = http.StatusOK, `{"error": false, "data": [{"name": "authentication", "data": "Logged in user jane@here.com"}]}`
+		case req.URL.Path == "/logs/erase":
+			var erasure map[string]any
+			_ = json.NewDecoder(req.Body).Decode(&erasure)
+			s.erasures = append(s.erasures, erasure)
+			status = http.StatusOK
+		}
+
+		return &http.Response{
+			StatusCode: status,
+			Body:       io.NopCloser(bytes.NewBufferString(body)),
+			Header:     make(http.Header),
+		}
+	})
+}
+
+func setupGDPR(t *testing.T) (admin, user int, logs *logServiceStub) {
+	t.Helper()
+
+	admin = setupBulk(t)
+	user, _ = testApp.Repo.Insert(context.Background(), data.User{Email: "jane@here.com", FirstName: "Jane", Password: "verysecret", Status: data.StatusActive})
+
+	client := testApp.Client
+	logs = &logServiceStub{}
+	testApp.Client = logs.client()
+	t.Cleanup(func() { testApp.Client = client })
+
+	return admin, user, logs
+}
+
+func Test_ExportMyData(t *testing.T) {
+	_, user, logs := setupGDPR(t)
+
+	_ = testApp.Sessions.InsertSession(context.Background(), data.Session{ID: "jane-session", UserID: user, IP: "192.168.1.1", CreatedAt: time.Now(), LastSeenAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+	_, _ = testApp.APIKeys.InsertAPIKey(context.Background(), data.APIKey{UserID: user, Name: "ci", Prefix: "abc", KeyHash: "hash", CreatedAt: time.Now()})
+
+	rr := serveAuthenticated(t, "GET", "/me/export", nil, user)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected http.StatusOK but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Type") != "application/zip" || !strings.HasPrefix(rr.Header().Get("Content-Disposition"), "attachment") {
+		t.Errorf("expected a zip attachment, got %v", rr.Header())
+	}
+	if strings.Join(logs.mentions, ",") != "jane@here.com,user 2" {
+		t.Errorf("expected the logs to be searched by the email and the id, got %v", logs.mentions)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("expected a zip archive, got %v", err)
+	}
+
+	files := map[string]string{}
+	for _, file := range archive.File {
+		f, _ := file.Open()
+		content, _ := io.ReadAll(f)
+		f.Close()
+		files[file.Name] = string(content)
+	}
+
+	for name, expected := range map[string]string{
+		"profile.json":     `"email": "jane@here.com"`,
+		"sessions.json":    `"id": "jane-session"`,
+		"api_keys.json":    `"name": "ci"`,
+		"invitations.json": `[]`,
+		"logs.json":        `Logged in user jane@here.com`,
+	} {
+		if !strings.Contains(files[name], expected) {
+			t.Errorf("expected %s to contain %s, got %q", name, expected, files[name])
+		}
+	}
+	// хеши ключей и пароль в выгрузку не попадают
+	if strings.Contains(files["api_keys.json"], "hash") || strings.Contains(files["profile.json"], "password") {
+		t.Errorf("expected no secrets in the export, got %v", files)
+	}
+
+	// без логов выгрузка неполная
+	logs.down = true
+	if rr := serveAuthenticated(t, "GET", "/me/export", nil, user); rr.Code != http.StatusBadGateway {
+		t.Errorf("expected http.StatusBadGateway but got %d", rr.Code)
+	}
+}
+
+func Test_EraseMe(t *testing.T) {
+	_, user, logs := setupGDPR(t)
+	ctx := context.Background()
+
+	if rr := serveAuthenticated(t, "POST", "/me/erase", map[string]string{"password": "wrong", "mode": "anonymize"}, user); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for a wrong password but got %d", rr.Code)
+	}
+	if rr := serveAuthenticated(t, "POST", "/me/erase", map[string]string{"password": "verysecret", "mode": "shred"}, user); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for an unknown mode but got %d", rr.Code)
+	}
+
+	// если log-service недоступен, учётная запись не меняется
+	logs.down = true
+	if rr := serveAuthenticated(t, "POST", "/me/erase", map[string]string{"password": "verysecret", "mode": "anonymize"}, user); rr.Code != http.StatusBadGateway {
+		t.Errorf("expected http.StatusBadGateway but got %d", rr.Code)
+	}
+	if found, err := testApp.Repo.GetOne(ctx, user); err != nil || found.Email != "jane@here.com" {
+		t.Fatalf("expected the user to be kept, got %+v %v", found, err)
+	}
+	logs.down = false
+
+	rr := serveAuthenticated(t, "POST", "/me/erase", map[string]string{"password": "verysecret", "mode": "anonymize"}, user)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if len(logs.erasures) != 1 || logs.erasures[0]["mode"] != "anonymize" || logs.erasures[0]["replacement"] != "erased-user-2" {
+		t.Errorf("expected the logs to be anonymized, got %v", logs.erasures)
+	}
+
+	found, err := testApp.Repo.GetOne(ctx, user)
+	if err != nil {
+		t.Fatalf("expected the user to be kept, got %v", err)
+	}
+	if found.Email != "erased-user-2@erased.invalid" || found.FirstName != "" || found.Status != data.StatusSuspended {
+		t.Errorf("expected the user to be anonymized, got %+v", found)
+	}
+	if valid, _ := testApp.Repo.PasswordMatches(ctx, "verysecret", *found); valid {
+		t.Error("expected the password to be replaced")
+	}
+
+	sessions, _ := testApp.Sessions.GetUserSessions(ctx, user)
+	for _, session := range sessions {
+		if session.RevokedAt == nil {
+			t.Errorf("expected session %s to be revoked", session.ID)
+		}
+	}
+}
+
+func Test_EraseUser(t *testing.T) {
+	admin, user, logs := setupGDPR(t)
+
+	if rr := serveAuthenticated(t, "POST", "/users/1/erase", map[string]string{}, user); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden but got %d", rr.Code)
+	}
+	// себя можно стереть только через /me/erase, с паролем
+	if rr := serveAuthenticated(t, "POST", "/users/2/erase", map[string]string{}, user); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for self without users:delete but got %d", rr.Code)
+	}
+	if rr := serveAuthenticated(t, "POST", "/users/1/erase", map[string]string{}, admin); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for self but got %d", rr.Code)
+	}
+	if len(logs.erasures) != 0 {
+		t.Fatalf("expected nothing to be erased, got %v", logs.erasures)
+	}
+
+	rr := serveAuthenticated(t, "POST", "/users/2/erase", map[string]string{}, admin)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// по умолчанию учётная запись и записи логов удаляются
+	if len(logs.erasures) != 1 || logs.erasures[0]["mode"] != "delete" {
+		t.Errorf("expected the logs to be deleted, got %v", logs.erasures)
+	}
+	if _, err := testApp.Repo.GetOne(context.Background(), user); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the user to be deleted, got %v", err)
+	}
+
+	if rr := serveAuthenticated(t, "POST", "/users/2/erase", map[string]string{}, admin); rr.Code != http.StatusNotFound {
+		t.Errorf("expected http.StatusNotFound but got %d", rr.Code)
+	}
+}
+
+func Test_EraseClearsPersonalData(t *testing.T) {
+	for _, mode := range []string{"delete", "anonymize"} {
+		t.Run(mode, func(t *testing.T) {
+			admin, user, _ := setupGDPR(t)
+			ctx := context.Background()
+
+			store := testApp.Invitations
+			testApp.Invitations = data.NewMemoryInvitationRepository()
+			t.Cleanup(func() { testApp.Invitations = store })
+
+			// следы адреса и клиента вне самой учётной записи
+			_, _ = testApp.Attempts.RecordFailure(ctx, "account:jane@here.com", time.Hour)
+			invited, _ := testApp.Invitations.InsertInvitation(ctx, data.Invitation{CodeHash: "jane-invitation-" + mode, Email: "Jane@here.com", ExpiresAt: time.Now().Add(time.Hour)})
+			_ = testApp.Sessions.InsertSession(ctx, data.Session{ID: "jane-erased-" + mode, UserID: user, IP: "192.168.1.1", UserAgent: "curl", CreatedAt: time.Now(), LastSeenAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+			_, _ = testApp.Tokens.InsertRefreshToken(ctx, data.RefreshToken{UserID: user, TokenHash: "jane-refresh-" + mode, FamilyID: "jane", IP: "192.168.1.1", ExpiresAt: time.Now().Add(time.Hour)})
+
+			rr := serveAuthenticated(t, "POST", "/users/2/erase", map[string]string{"mode": mode}, admin)
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			if attempts, _ := testApp.Attempts.GetAttempts(ctx, "account:jane@here.com"); attempts.Failures != 0 {
+				t.Errorf("expected the failed logins to be forgotten, got %+v", attempts)
+			}
+
+			invitations, _ := testApp.Invitations.GetInvitations(ctx)
+			for _, invitation := range invitations {
+				if invitation.ID == invited && invitation.Email != "" {
+					t.Errorf("expected the invitation email to be cleared, got %q", invitation.Email)
+				}
+			}
+
+			sessions, _ := testApp.Sessions.GetUserSessions(ctx, user)
+			for _, session := range sessions {
+				if session.IP != "" || session.UserAgent != "" {
+					t.Errorf("expected session %s to be cleared, got %q %q", session.ID, session.IP, session.UserAgent)
+				}
+			}
+
+			token, err := testApp.Tokens.GetRefreshTokenByHash(ctx, "jane-refresh-"+mode)
+			if err != nil || token.IP != "" {
+				t.Errorf("expected the refresh token address to be cleared, got %+v %v", token, err)
+			}
+		})
+	}
+}
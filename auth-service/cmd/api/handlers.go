@@ -4,12 +4,15 @@ import (
 	"auth-service/data"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/golang-jwt/jwt"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/golang-jwt/jwt/v4"
 	"log"
 	"net/http"
 	"strings"
@@ -25,28 +28,44 @@ type UserData struct {
 }
 
 type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	FirstName string    `json:"first_name,omitempty"`
-	LastName  string    `json:"last_name,omitempty"`
-	Password  string    `json:"-"`
-	Active    int       `json:"active"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           int        `json:"id"`
+	Email        string     `json:"email"`
+	FirstName    string     `json:"first_name,omitempty"`
+	LastName     string     `json:"last_name,omitempty"`
+	Password     string     `json:"-"`
+	Status       string     `json:"status"`
+	StatusReason string     `json:"status_reason,omitempty"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
 }
 
 type contextKey string
 
-const userIDKey contextKey = "userID"
+const (
+	userIDKey contextKey = "userID"
+	claimsKey contextKey = "claims"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
 
-// Registrate insert new user to the database
+	// defaultRole is granted to every newly registered user
+	defaultRole = "user"
+)
+
+// Registrate insert new user to the database. The account stays pending until the user
+// follows the link from the verification email. Who may register is decided by the
+// registration policy, an invitation code also grants the roles of the invitation.
 func (app *Config) Registrate(w http.ResponseWriter, r *http.Request) {
 	var requestPayload struct {
 		Email     string `json:"email"`
 		FirstName string `json:"first_name,omitempty"`
 		LastName  string `json:"last_name,omitempty"`
 		Password  string `json:"password"`
-		Active    int    `json:"active"`
+		// InvitationCode is required in the invite-only registration mode
+		InvitationCode string `json:"invitation_code,omitempty"`
 	}
 
 	err := app.readJSON(w, r, &requestPayload)
@@ -54,19 +73,79 @@ func (app *Config) Registrate(w http.ResponseWriter, r *http.Request) {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
+	invitation, ok := app.checkRegistration(w, r, requestPayload.Email, requestPayload.InvitationCode)
+	if !ok {
+		return
+	}
 	user := User{
 		Email:     requestPayload.Email,
 		FirstName: requestPayload.FirstName,
 		LastName:  requestPayload.LastName,
 		Password:  requestPayload.Password,
-		Active:    requestPayload.Active,
+		Status:    data.StatusPending,
+	}
+	if !app.checkPassword(w, user.Password, data.User(user)) {
+		return
 	}
-	id, err := app.Repo.Insert(data.User(user))
+
+	roles := []string{defaultRole}
+	if invitation != nil {
+		roles = append(roles, invitation.Roles...)
+	}
+
+	// the invitation, the user and the roles are created together, so a failed grant doesn't
+	// leave behind an account without any permissions, and the invitation is only used up
+	// when the account has been created. It is consumed first, so two registrations can't
+	// both use it.
+	var id int
+	status := http.StatusBadRequest
+	err = app.Repo.WithTx(r.Context(), func(repo data.Repository) error {
+		invitations := app.Invitations.InTx(repo)
+		if invitation != nil {
+			_, err := invitations.ConsumeInvitation(r.Context(), invitation.CodeHash)
+			if errors.Is(err, sql.ErrNoRows) {
+				status = http.StatusForbidden
+				return errors.New("invalid or expired invitation code")
+			} else if err != nil {
+				status = http.StatusInternalServerError
+				return err
+			}
+		}
+
+		var err error
+		id, err = repo.Insert(r.Context(), data.User(user))
+		if err != nil {
+			return err
+		}
+
+		status = http.StatusInternalServerError
+		for _, role := range roles {
+			err = repo.GrantRole(r.Context(), id, role)
+			if err != nil {
+				return err
+			}
+		}
+
+		if invitation != nil {
+			return invitations.SetInvitationUser(r.Context(), invitation.ID, id)
+		}
+		return nil
+	})
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, err, status)
 		return
 	}
-	err = app.logRequest("registrations", fmt.Sprintf("%s has been registrated", user.Email))
+	user.ID = id
+	err = app.sendVerificationEmail((*data.User)(&user))
+	if err != nil {
+		// the user can ask for the email again with /verify/resend
+		log.Println("Error sending verification email:", err)
+	}
+	registrated := fmt.Sprintf("%s has been registrated", user.Email)
+	if invitation != nil {
+		registrated += fmt.Sprintf(" with invitation %d", invitation.ID)
+	}
+	err = app.logRequest("registrations", registrated)
 	if err != nil {
 		fmt.Println("Error logging of user has benn authenticated:", err)
 		app.errorJSON(w, err, http.StatusInternalServerError)
@@ -74,7 +153,7 @@ func (app *Config) Registrate(w http.ResponseWriter, r *http.Request) {
 	}
 	payload := jsonResponse{
 		Error:   false,
-		Message: fmt.Sprintf("Succesfully created new user, id: %d", id),
+		Message: fmt.Sprintf("Succesfully created new user, id: %d. Please confirm your email to activate the account", id),
 	}
 
 	app.
@@ -94,44 +173,353 @@ func (app *Config) Authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := app.ClientIP.ClientIP(r)
+	if !app.checkLoginAllowed(r.Context(), w, requestPayload.Email, ip) {
+		return
+	}
+
 	// validate the user against the database
-	user, err := app.Repo.GetByEmail(requestPayload.Email)
+	user, err := app.Repo.GetByEmail(r.Context(), requestPayload.Email)
 
 	if err != nil {
 		fmt.Println("Error in auth service, invalid credentials email")
+		app.recordLoginFailure(r.Context(), requestPayload.Email, ip)
 		app.errorJSON(w, errors.New("invalid credentials"), http.StatusBadRequest)
 		return
 	}
 
-	valid, err := app.Repo.PasswordMatches(requestPayload.Password, *user)
+	valid, err := app.Repo.PasswordMatches(r.Context(), requestPayload.Password, *user)
 	if err != nil || !valid {
 		fmt.Println("Error in auth service, password inmatches")
+		app.recordLoginFailure(r.Context(), requestPayload.Email, ip)
 		app.errorJSON(w, errors.New("invalid credentials"), http.StatusBadRequest)
 		return
 	}
 
-	ip := strings.Split(r.RemoteAddr, ":")[0]
-	secretKey := "some_secret_key"
-	userData, err := generateTokens(user.ID, ip, secretKey)
+	err = app.Attempts.Reset(r.Context(), accountLockoutKey(requestPayload.Email))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.finishLogin(w, r, user, ip, "")
+}
+
+// finishLogin logs in a user whose credentials have been checked: it asks for the second
+// factor when the user has one, otherwise starts a session and issues the tokens. How the user
+// logged in is added to the audit entry.
+func (app *Config) finishLogin(w http.ResponseWriter, r *http.Request, user *data.User, ip, how string) {
+	if status, err := accountStatusError(user); err != nil {
+		app.errorJSON(w, err, status)
+		return
+	}
+
+	mfa, err := app.MFA.GetMFA(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if mfa != nil && mfa.Enabled() {
+		// the tokens are issued by AuthenticateMFA once the user has entered a code
+		mfaToken, err := generateMFAPendingToken(app.Keys, user.ID, ip)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		payload := jsonResponse{
+			Error:   false,
+			Message: "Two-factor authentication required",
+			Data:    mfaChallenge{MFARequired: true, MFAToken: mfaToken},
+		}
+		app.writeJSON(w, http.StatusAccepted, payload)
+		return
+	}
+
+	sessionID, err := app.startSession(r, user.ID, ip)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	userData, err := app.issueTokens(r.Context(), w, user.ID, ip, sessionID)
 	if err != nil {
 		fmt.Println("Error generating tokens:", err)
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	err = app.logRequest("authentication", fmt.Sprintf("%s logged in", user.Email))
+	err = app.logRequest("authentication", fmt.Sprintf("%s logged in%s", user.Email, how))
 	if err != nil {
 		fmt.Println("Error logging of user has benn authenticated:", err)
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	err = validateRefreshToken(userData.HashedRefreshToken, userData.RefreshToken)
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Logged in user %s", user.Email),
+		Data:    app.loginData(user, userData),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// Refresh exchanges a refresh token for a new pair of tokens. Every refresh token can be used
+// only once: presenting an already rotated token revokes the whole family it belongs to.
+func (app *Config) Refresh(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		requestPayload.RefreshToken = cookie.Value
+	}
+	if r.ContentLength > 0 {
+		err := app.readJSON(w, r, &requestPayload)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	if requestPayload.RefreshToken == "" {
+		app.errorJSON(w, errors.New("refresh token is required"), http.StatusUnauthorized)
+		return
+	}
+
+	stored, err := app.Tokens.GetRefreshTokenByHash(r.Context(), hashToken(requestPayload.RefreshToken))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	if stored.RevokedAt != nil {
+		app.revokeReusedFamily(r.Context(), stored)
+		app.errorJSON(w, errors.New("invalid refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		app.errorJSON(w, errors.New("refresh token has expired"), http.StatusUnauthorized)
+		return
+	}
+
+	ip := app.ClientIP.ClientIP(r)
+	if !app.IPBinding.Allows(stored.IP, ip) {
+		app.logIPMismatch("refresh token", stored.UserID, stored.IP, ip)
+		app.errorJSON(w, errors.New("refresh token was issued to another address"), http.StatusUnauthorized)
+		return
+	}
+
+	rotated, err := app.Tokens.MarkRefreshTokenUsed(r.Context(), stored.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !rotated {
+		// somebody else has used this token in the meantime
+		app.revokeReusedFamily(r.Context(), stored)
+		app.errorJSON(w, errors.New("invalid refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), stored.UserID)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid refresh token"), http.StatusUnauthorized)
+		return
+	}
+	// the refresh token may have been issued before the account was suspended or deleted
+	if status, err := accountStatusError(user); err != nil {
+		app.errorJSON(w, err, status)
+		return
+	}
+
+	userData, err := app.issueTokens(r.Context(), w, user.ID, ip, stored.FamilyID)
+	if err != nil {
+		fmt.Println("Error generating tokens:", err)
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Refreshed tokens of user %s", user.Email),
+		Data:    app.loginData(user, userData),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// tokenResponse is the data of the login responses when TokensInBody is enabled. The user
+// fields stay where clients without tokens in the body find them.
+type tokenResponse struct {
+	*data.User
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// loginData returns the data of a successful login: the user, together with the tokens
+// when they are returned in the body
+func (app *Config) loginData(user *data.User, userData *UserData) any {
+	if !app.TokensInBody {
+		return user
+	}
+
+	return tokenResponse{
+		User:         user,
+		AccessToken:  userData.AccessToken,
+		RefreshToken: userData.RefreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}
+}
+
+// revokeReusedFamily is called when a refresh token is presented for the second time,
+// which means it has leaked, so nothing issued from the same login can be trusted anymore.
+func (app *Config) revokeReusedFamily(ctx context.Context, token *data.RefreshToken) {
+	err := app.endSession(ctx, token.FamilyID)
+	if err != nil {
+		log.Println("Error revoking refresh token family:", err)
+	}
+
+	err = app.logRequest("authentication", fmt.Sprintf("refresh token reuse detected for user %d", token.UserID))
+	if err != nil {
+		log.Println("Error logging refresh token reuse:", err)
+	}
+}
+
+// Logout ends the current session: the access token it was called with is revoked together
+// with the refresh tokens of the same login.
+func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+	claims := r.Context().Value(claimsKey).(jwt.MapClaims)
+
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	err := app.Revocations.RevokeToken(r.Context(), jti, time.Unix(int64(exp), 0))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if sessionID, _ := claims["sid"].(string); sessionID != "" {
+		err = app.endSession(r.Context(), sessionID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = app.logRequest("authentication", fmt.Sprintf("user %d logged out", userID))
+	if err != nil {
+		log.Println("Error logging of user has been logged out:", err)
+	}
+
+	clearTokenCookies(w)
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Logged out",
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// LogoutAll ends every session of the current user on every device
+func (app *Config) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(userIDKey).(int)
+
+	err := app.revokeAllSessions(r.Context(), userID)
 	if err != nil {
-		fmt.Println("Error in auth service, invalid refresh token")
+		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
-	fmt.Println("Refresh tokens validated")
+
+	err = app.logRequest("authentication", fmt.Sprintf("user %d logged out of all sessions", userID))
+	if err != nil {
+		log.Println("Error logging of user has been logged out:", err)
+	}
+
+	clearTokenCookies(w)
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Logged out of all sessions",
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// revokeAllSessions revokes every session and every access and refresh token issued to
+// the user so far
+func (app *Config) revokeAllSessions(ctx context.Context, userID int) error {
+	err := app.Revocations.RevokeUserTokens(ctx, userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = app.Sessions.RevokeUserSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return app.Tokens.RevokeUserRefreshTokens(ctx, userID)
+}
+
+// clearTokenCookies removes the token cookies set by issueTokens
+func clearTokenCookies(w http.ResponseWriter) {
+	for _, name := range []string{"access_token", "refresh_token"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+			MaxAge:   -1,
+		})
+	}
+}
+
+// issueTokens generates a new access and refresh token pair, stores the refresh token and sets
+// both of them as cookies. The familyID is the session the tokens belong to, whose expiry is
+// extended; an empty one starts a new family which isn't recorded as a session.
+func (app *Config) issueTokens(ctx context.Context, w http.ResponseWriter, userID int, ip, familyID string) (*UserData, error) {
+	var err error
+	if familyID == "" {
+		familyID, err = randomToken(16)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	roles, err := app.Repo.GetRoles(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := app.Repo.GetPermissions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	userData, err := generateTokens(app.Keys, userID, ip, familyID, roles, permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(refreshTokenTTL)
+	_, err = app.Tokens.InsertRefreshToken(ctx, data.RefreshToken{
+		UserID:    userID,
+		TokenHash: userData.HashedRefreshToken,
+		FamilyID:  familyID,
+		IP:        ip,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.Sessions.ExtendSession(ctx, familyID, ip, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
 	http.SetCookie(w, &http.Cookie{
 		Name:     "access_token",
 		Value:    userData.AccessToken,
@@ -139,23 +527,28 @@ func (app *Config) Authenticate(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		Secure:   true,
 		SameSite: http.SameSiteStrictMode,
-		Expires:  time.Now().Add(15 * time.Minute),
+		Expires:  time.Now().Add(accessTokenTTL),
 	})
-	payload := jsonResponse{
-		Error:   false,
-		Message: fmt.Sprintf("Logged in user %s", user.Email),
-		Data:    user,
-	}
-	app.writeJSON(w, http.StatusAccepted, payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    userData.RefreshToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  expiresAt,
+	})
+
+	return userData, nil
 }
 
-func generateTokens(userID int, ip, secretKey string) (*UserData, error) {
-	accessToken, err := generateAccessToken(userID, ip, secretKey)
+func generateTokens(keys *Keyring, userID int, ip, sessionID string, roles, permissions []string) (*UserData, error) {
+	accessToken, err := generateAccessToken(keys, userID, ip, sessionID, roles, permissions)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshToken, hashedRefreshToken, err := generateRefreshToken(secretKey, ip)
+	refreshToken, hashedRefreshToken, err := generateRefreshToken()
 	if err != nil {
 		return nil, err
 	}
@@ -184,48 +577,87 @@ func (app *Config) logRequest(name, data string) error {
 		return err
 	}
 
-	logServiceURL := "http://log-service:82/log"
-
-	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequest("POST", logServiceURL+"/log", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	if app.ServiceTokens != nil {
+		token, err := app.ServiceTokens.Token()
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
 
-	_, err = app.Client.Do(request)
+	response, err := app.Client.Do(request)
 	if err != nil {
 		log.Println("Error during doing log request in auth-service")
 		return err
 	}
+	defer response.Body.Close()
+
+	// the entry is lost when the log service rejects it, e.g. the service token
+	if response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("the log service answered %d", response.StatusCode)
+	}
 	return nil
 }
 
-func validateRefreshToken(hashedRefreshToken, refreshToken string) error {
-	decodedBytes, err := base64.StdEncoding.DecodeString(hashedRefreshToken)
-	err = bcrypt.CompareHashAndPassword(decodedBytes, []byte(refreshToken))
+// generateRefreshToken creates a random opaque refresh token and the hash of it, which is the only
+// thing we keep in the database
+func generateRefreshToken() (string, string, error) {
+	refreshToken, err := randomToken(32)
 	if err != nil {
-		return fmt.Errorf("invalid refresh token: %w", err)
+		return "", "", err
 	}
-	return nil
+
+	return refreshToken, hashToken(refreshToken), nil
 }
 
-func generateRefreshToken(secretKey, ip string) (string, string, error) {
-	refreshToken := secretKey + ip // Создайте Refresh-токен из secretKey и ip
+// hashToken hashes a random token, e.g. a refresh token, for storage. Such tokens are long random
+// strings, so a fast hash is enough here and lets us look the token up by its hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-	hashedRefreshToken, err := bcrypt.GenerateFromPassword([]byte(refreshToken), bcrypt.DefaultCost)
+// randomToken returns n random bytes encoded as a url safe string
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
-	return refreshToken, base64.StdEncoding.EncodeToString(hashedRefreshToken), nil // Преобразование хеша в base64 перед хранением
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func generateAccessToken(userID int, ip, secretKey string) (string, error) {
-	expirationTime := time.Now().Add(time.Minute * 15) // Access-токен действителен в течение 15 минут
+// generateAccessToken signs a new access token. Every token gets its own jti, so it can be revoked
+// on logout, and carries the id of the session (the refresh token family) it was issued for.
+// The roles of the user and their permissions, as a space separated scope, are embedded too.
+func generateAccessToken(keys *Keyring, userID int, ip, sessionID string, roles, permissions []string) (string, error) {
+	issuedAt := time.Now()
+	expirationTime := issuedAt.Add(accessTokenTTL) // Access-токен действителен в течение 15 минут
+
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
 
 	claims := &jwt.MapClaims{
-		"sub": userID,
-		"exp": expirationTime.Unix(),
-		"ip":  ip,
+		"sub":   userID,
+		"exp":   expirationTime.Unix(),
+		"iat":   issuedAt.Unix(),
+		"jti":   jti,
+		"sid":   sessionID,
+		"ip":    ip,
+		"roles": roles,
+		"scope": strings.Join(permissions, " "),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims) // Используйте метод подписи HS512 для Access-токена
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := keys.Sign(claims) // Access-токен подписывается текущим ключом из keyring
 	if err != nil {
 		return "", err
 	}
@@ -233,56 +665,195 @@ func generateAccessToken(userID int, ip, secretKey string) (string, error) {
 	return tokenString, nil
 }
 
-// authTokenMiddleware auths users to get access to some pages only by having access token
-func (app *Config) authTokenMiddleware(secretKey string) func(http.Handler) http.Handler {
+// authTokenMiddleware auths users to get access to some pages only by having access token,
+// or an API key in the X-API-Key header
+func (app *Config) authTokenMiddleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-			cookie, err := r.Cookie("access_token")
-			if err != nil {
-				app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+			if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+				claims, err := app.apiKeyClaims(r.Context(), apiKey)
+				if errors.Is(err, errInvalidAPIKey) {
+					app.errorJSON(w, err, http.StatusUnauthorized)
+					return
+				} else if err != nil {
+					app.errorJSON(w, err, http.StatusInternalServerError)
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), userIDKey, int(claims["sub"].(float64)))
+				ctx = context.WithValue(ctx, claimsKey, claims)
+				next.ServeHTTP(w, r.WithContext(ctx))
 				return
 			}
-			tokenString := cookie.Value
-			claims := &jwt.MapClaims{
-				"sub": userIDKey,
-			}
-			token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-				return []byte(secretKey), nil
-			})
 
-			if err != nil || !token.Valid {
-				app.errorJSON(w, errors.New("token is not valid"), http.StatusUnauthorized)
+			claims, status, err := app.verifyAccessToken(r)
+			if err != nil {
+				app.errorJSON(w, err, status)
 				return
 			}
 
-			userID, ok := (*claims)["sub"].(float64)
-			if !ok {
-				app.errorJSON(w, errors.New("invalid token claims"), http.StatusUnauthorized)
+			// suspended and deleted users are rejected even while their tokens are valid
+			status, err = app.checkAccountStatus(r.Context(), int(claims["sub"].(float64)))
+			if err != nil {
+				app.errorJSON(w, err, status)
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), userIDKey, int(userID))
+			ctx := context.WithValue(r.Context(), userIDKey, int(claims["sub"].(float64)))
+			ctx = context.WithValue(ctx, claimsKey, claims)
 			r = r.WithContext(ctx)
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// GetAllUsers retrieves all users from the database, sort them by points
+// verifyAccessToken checks the access token the request was made with: its signature, that it
+// hasn't been revoked, its session and the address it was issued to. When the token is not
+// accepted, it returns the status to respond with.
+func (app *Config) verifyAccessToken(r *http.Request) (jwt.MapClaims, int, error) {
+	tokenString, err := app.accessTokenFromRequest(r)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	claims := &jwt.MapClaims{
+		"sub": userIDKey,
+	}
+	token, err := jwt.ParseWithClaims(tokenString, claims, app.Keys.Keyfunc)
+
+	// tokens with a type, like mfa_pending, are not access tokens
+	if err != nil || !token.Valid || (*claims)["typ"] != nil {
+		return nil, http.StatusUnauthorized, errors.New("token is not valid")
+	}
+
+	userID, ok := (*claims)["sub"].(float64)
+	if !ok {
+		return nil, http.StatusUnauthorized, errors.New("invalid token claims")
+	}
+
+	jti, _ := (*claims)["jti"].(string)
+	issuedAt, _ := (*claims)["iat"].(float64)
+	revoked, err := app.Revocations.IsRevoked(r.Context(), jti, int(userID), time.Unix(int64(issuedAt), 0))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if revoked {
+		return nil, http.StatusUnauthorized, errors.New("token has been revoked")
+	}
+
+	if sessionID, _ := (*claims)["sid"].(string); sessionID != "" {
+		valid, err := app.checkSession(r.Context(), int(userID), sessionID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if !valid {
+			return nil, http.StatusUnauthorized, errors.New("session has been revoked")
+		}
+	}
+
+	// tokens without the claim are not bound to an address
+	if boundIP, _ := (*claims)["ip"].(string); boundIP != "" {
+		ip := app.ClientIP.ClientIP(r)
+		if !app.IPBinding.Allows(boundIP, ip) {
+			app.logIPMismatch("access token", int(userID), boundIP, ip)
+			return nil, http.StatusUnauthorized, errors.New("token was issued to another address")
+		}
+	}
+
+	return *claims, 0, nil
+}
+
+// logIPMismatch records that a token was rejected because it was used from an address the
+// binding policy doesn't allow
+func (app *Config) logIPMismatch(kind string, userID int, boundIP, ip string) {
+	err := app.logRequest("ip-mismatch", fmt.Sprintf("%s of user %d issued to %s was used from %s (binding %s)",
+		kind, userID, boundIP, ip, app.IPBinding.Mode))
+	if err != nil {
+		log.Println("Error logging IP mismatch:", err)
+	}
+}
+
+// accessTokenFromRequest takes the access token from the Authorization header when bearer tokens
+// are enabled and the header is present, otherwise from the access_token cookie. Both tokens
+// are validated the same way.
+func (app *Config) accessTokenFromRequest(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" && app.BearerTokens {
+		scheme, token, ok := strings.Cut(header, " ")
+		token = strings.TrimSpace(token)
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", errors.New("invalid authorization header")
+		}
+
+		return token, nil
+	}
+
+	cookie, err := r.Cookie("access_token")
+	if err != nil {
+		return "", errors.New("unauthorized")
+	}
+
+	return cookie.Value, nil
+}
+
+// RequirePermission only lets through requests whose access token grants all of the permissions.
+// It must be used after authTokenMiddleware.
+func (app *Config) RequirePermission(permissions ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, permission := range permissions {
+				if !hasPermission(r, permission) {
+					app.errorJSON(w, fmt.Errorf("missing permission %s", permission), http.StatusForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hasPermission reports whether the scope of the access token the request was made with
+// contains the permission
+func hasPermission(r *http.Request, permission string) bool {
+	claims, ok := r.Context().Value(claimsKey).(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+
+	scope, _ := claims["scope"].(string)
+	for _, granted := range strings.Fields(scope) {
+		if granted == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetAllUsers returns one page of users. The query parameters filter (email, name, status,
+// created_after, created_before), sort (sort=field or sort=-field for descending) and page
+// (limit, cursor) the list.
 func (app *Config) GetAllUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := app.Repo.GetAll()
+	query, err := userQueryFromURL(r)
 	if err != nil {
-		app.errorJSON(w, errors.New("couldn't fetch All users"), http.StatusBadRequest)
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	page, err := app.Repo.List(r.Context(), query)
+	if errors.Is(err, data.ErrInvalidUserQuery) {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch the users"), http.StatusInternalServerError)
 		return
 	}
 
 	payload := jsonResponse{
 		Error:   false,
-		Message: fmt.Sprintf("Fetched all users"),
-		Data:    users,
+		Message: fmt.Sprintf("Fetched %d of %d users", len(page.Users), page.TotalCount),
+		Data:    page,
 	}
 
 	app.writeJSON(w, http.StatusAccepted, payload)
-
 }
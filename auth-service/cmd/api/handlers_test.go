@@ -2,10 +2,9 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
-	"github.com/golang-jwt/jwt"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/golang-jwt/jwt/v4"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -173,40 +172,81 @@ func Test_GenerateTokensTest(t *testing.T) {
 
 // Test_GenerateRefreshToken тестирует функцию generateRefreshToken.
 func Test_GenerateRefreshToken(t *testing.T) {
-	secretKey := "superSecretKey"
-	ip := "192.168.1.1"
-
 	// Вызов функции
-	refreshToken, hashedRefreshToken, err := generateRefreshToken(secretKey, ip)
+	refreshToken, hashedRefreshToken, err := generateRefreshToken()
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
 
-	// Проверка значений
-	expectedRefreshToken := secretKey + ip
-	if refreshToken != expectedRefreshToken {
-		t.Errorf("expected RefreshToken %s, got %s", expectedRefreshToken, refreshToken)
+	// Проверка хешированного токена
+	if hashedRefreshToken != hashToken(refreshToken) {
+		t.Errorf("hashedRefreshToken does not match the refreshToken")
 	}
 
-	// Проверка хешированного токена
-	hashedBytes, err := base64.StdEncoding.DecodeString(hashedRefreshToken)
+	// Проверка, что токены случайные
+	otherRefreshToken, _, err := generateRefreshToken()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if refreshToken == otherRefreshToken {
+		t.Error("expected two refresh tokens to differ")
+	}
+}
+
+// Test_Refresh проверяет ротацию refresh-токенов и отзыв семейства при повторном использовании.
+func Test_Refresh(t *testing.T) {
+	testApp.Client = NewTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error": false}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"refresh_token": token})
+		req, _ := http.NewRequest("POST", "/refresh", bytes.NewReader(body))
+		req.RemoteAddr = "192.168.1.1:12345"
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(testApp.Refresh).ServeHTTP(rr, req)
+		return rr
+	}
+
+	userData, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), 1, "192.168.1.1", "")
 	if err != nil {
-		t.Fatalf("failed to decode hashedRefreshToken: %v", err)
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	rr := refresh(userData.RefreshToken)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
 	}
 
-	// Проверка, что хеш соответствует оригинальному токену
-	if err := bcrypt.CompareHashAndPassword(hashedBytes, []byte(refreshToken)); err != nil {
-		t.Errorf("hashedRefreshToken does not match the refreshToken: %v", err)
+	var rotated string
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == "refresh_token" {
+			rotated = cookie.Value
+		}
+	}
+	if rotated == "" || rotated == userData.RefreshToken {
+		t.Fatal("expected a new refresh token")
+	}
+
+	// повторное использование старого токена отзывает всё семейство
+	if rr := refresh(userData.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for reused token but got %d", rr.Code)
+	}
+	if rr := refresh(rotated); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for revoked family but got %d", rr.Code)
 	}
 }
 
 func Test_GenerateAccessToken(t *testing.T) {
 	userID := 1
 	ip := "192.168.1.1"
-	secretKey := "superSecretKey"
 
 	// Вызов функции
-	tokenString, err := generateAccessToken(userID, ip, secretKey)
+	tokenString, err := generateAccessToken(testApp.Keys, userID, ip, "session", []string{"user"}, []string{"logs:write", "users:read"})
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -214,10 +254,10 @@ func Test_GenerateAccessToken(t *testing.T) {
 	// Проверка токена
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		// Проверка метода подписи
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			t.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(secretKey), nil
+		return testApp.Keys.Keyfunc(token)
 	})
 
 	if err != nil {
@@ -238,9 +278,182 @@ func Test_GenerateAccessToken(t *testing.T) {
 		t.Errorf("expected IP %s, got %v", ip, claims["ip"])
 	}
 
+	if claims["sid"] != "session" {
+		t.Errorf("expected session %s, got %v", "session", claims["sid"])
+	}
+
+	if jti, _ := claims["jti"].(string); jti == "" {
+		t.Error("expected token to have a jti")
+	}
+
+	if claims["scope"] != "logs:write users:read" {
+		t.Errorf("expected scope %s, got %v", "logs:write users:read", claims["scope"])
+	}
+
 	// Проверка времени истечения токена
 	expirationTime := time.Unix(int64(claims["exp"].(float64)), 0)
 	if time.Now().After(expirationTime) {
 		t.Error("token has expired")
 	}
 }
+
+// Test_Logout проверяет, что после выхода access-токен и refresh-токен больше не принимаются.
+func Test_Logout(t *testing.T) {
+	testApp.Client = NewTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error": false}`)),
+			Header:     make(http.Header),
+		}
+	})
+	routes := testApp.routes()
+
+	request := func(path string, userData *UserData) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, nil)
+		if path == "/users" || path == "/me" {
+			req.Method = "GET"
+		}
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: userData.AccessToken})
+		req.AddCookie(&http.Cookie{Name: "refresh_token", Value: userData.RefreshToken})
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	current, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), 3, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	other, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), 3, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if rr := request("/logout", current); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	if rr := request("/users", current); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized after logout but got %d", rr.Code)
+	}
+	if rr := request("/refresh", current); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for refresh after logout but got %d", rr.Code)
+	}
+
+	// другая сессия не затронута выходом из текущей
+	if rr := request("/me", other); rr.Code != http.StatusOK {
+		t.Errorf("expected http.StatusOK for other session but got %d", rr.Code)
+	}
+	if rr := request("/logout-all", other); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	if rr := request("/users", other); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized after logout-all but got %d", rr.Code)
+	}
+}
+
+// Test_BearerTokens проверяет, что токен из заголовка Authorization проверяется так же, как из cookie.
+func Test_BearerTokens(t *testing.T) {
+	routes := testApp.routes()
+	defer func() { testApp.BearerTokens = true }()
+
+	request := func(method, path, authorization string, cookie *UserData) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if cookie != nil {
+			req.AddCookie(&http.Cookie{Name: "access_token", Value: cookie.AccessToken})
+		}
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	userData, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), 4, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        *UserData
+		expected      int
+	}{
+		{"bearer", "Bearer " + userData.AccessToken, nil, http.StatusOK},
+		{"lower case scheme", "bearer " + userData.AccessToken, nil, http.StatusOK},
+		{"cookie", "", userData, http.StatusOK},
+		{"other scheme", "Basic " + userData.AccessToken, nil, http.StatusUnauthorized},
+		{"empty token", "Bearer ", nil, http.StatusUnauthorized},
+		{"invalid token", "Bearer invalid", userData, http.StatusUnauthorized},
+		{"nothing", "", nil, http.StatusUnauthorized},
+	}
+
+	for _, e := range tests {
+		if rr := request("GET", "/me", e.authorization, e.cookie); rr.Code != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, rr.Code)
+		}
+	}
+
+	// отозванный токен отклоняется независимо от того, откуда он пришёл
+	if rr := request("POST", "/logout", "Bearer "+userData.AccessToken, nil); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	if rr := request("GET", "/me", "Bearer "+userData.AccessToken, nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized after logout but got %d", rr.Code)
+	}
+
+	// если заголовок отключён, учитывается только cookie
+	other, _ := testApp.issueTokens(context.Background(), httptest.NewRecorder(), 4, "192.168.1.1", "")
+	testApp.BearerTokens = false
+	if rr := request("GET", "/me", "Bearer "+other.AccessToken, nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized with bearer tokens disabled but got %d", rr.Code)
+	}
+	if rr := request("GET", "/me", "Bearer invalid", other); rr.Code != http.StatusOK {
+		t.Errorf("expected http.StatusOK for cookie with bearer tokens disabled but got %d", rr.Code)
+	}
+}
+
+// Test_TokensInBody проверяет, что токены возвращаются в ответе, только если это включено.
+func Test_TokensInBody(t *testing.T) {
+	defer func() { testApp.TokensInBody = false }()
+
+	login := func() map[string]any {
+		body, _ := json.Marshal(map[string]string{"email": "me@here.com", "password": "verysecret"})
+		req, _ := http.NewRequest("POST", "/authenticate", bytes.NewReader(body))
+		req.RemoteAddr = "192.168.1.1:12345"
+		rr := httptest.NewRecorder()
+		testApp.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+		}
+
+		var response struct {
+			Data map[string]any `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &response)
+		return response.Data
+	}
+
+	if data := login(); data["access_token"] != nil || data["email"] != "me@here.com" {
+		t.Errorf("expected only the user without tokens, got %v", data)
+	}
+
+	testApp.TokensInBody = true
+	data := login()
+	if data["email"] != "me@here.com" || data["token_type"] != "Bearer" || data["refresh_token"] == "" {
+		t.Errorf("expected the user together with the tokens, got %v", data)
+	}
+
+	accessToken, _ := data["access_token"].(string)
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.RemoteAddr = "192.168.1.1:12345"
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rr := httptest.NewRecorder()
+	testApp.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected http.StatusOK with the returned token but got %d", rr.Code)
+	}
+}
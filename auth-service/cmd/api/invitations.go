@@ -0,0 +1,232 @@
+package main
+
+import (
+	"auth-service/data"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// registrationOpen lets anybody register
+	registrationOpen = "open"
+	// registrationInviteOnly requires an invitation code to register
+	registrationInviteOnly = "invite-only"
+	// registrationDomainAllowlist lets addresses of the allowed domains register, and
+	// everybody else with an invitation code
+	registrationDomainAllowlist = "domain-allowlist"
+
+	// invitationCodeTTL is how long an invitation code can be used when no expiry is given
+	invitationCodeTTL = 7 * 24 * time.Hour
+)
+
+// RegistrationPolicy decides who may register through /registrate
+type RegistrationPolicy struct {
+	Mode string
+	// AllowedDomains are the email domains which may register in the domain-allowlist mode
+	AllowedDomains []string
+}
+
+// newRegistrationPolicy reads the policy from REGISTRATION_MODE and, for the domain-allowlist
+// mode, REGISTRATION_ALLOWED_DOMAINS, a comma separated list of domains
+func newRegistrationPolicy() (RegistrationPolicy, error) {
+	policy := RegistrationPolicy{Mode: envOr("REGISTRATION_MODE", registrationOpen)}
+
+	for _, domain := range strings.Split(envOr("REGISTRATION_ALLOWED_DOMAINS", ""), ",") {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain != "" {
+			policy.AllowedDomains = append(policy.AllowedDomains, domain)
+		}
+	}
+
+	switch policy.Mode {
+	case registrationOpen, registrationInviteOnly:
+	case registrationDomainAllowlist:
+		if len(policy.AllowedDomains) == 0 {
+			return policy, errors.New("REGISTRATION_ALLOWED_DOMAINS is required in the domain-allowlist mode")
+		}
+	default:
+		return policy, fmt.Errorf("REGISTRATION_MODE must be %s, %s or %s", registrationOpen, registrationInviteOnly, registrationDomainAllowlist)
+	}
+
+	return policy, nil
+}
+
+// domainAllowed reports whether the email belongs to one of the allowed domains
+func (p RegistrationPolicy) domainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range p.AllowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRegistration decides whether the email may register, returning the invitation the code
+// belongs to, if one has been given. When it reports false, the error response has already
+// been written.
+func (app *Config) checkRegistration(w http.ResponseWriter, r *http.Request, email, code string) (*data.Invitation, bool) {
+	if code != "" {
+		invitation, err := app.Invitations.GetInvitation(r.Context(), hashToken(code))
+		if err != nil {
+			app.errorJSON(w, errors.New("invalid or expired invitation code"), http.StatusForbidden)
+			return nil, false
+		}
+		if invitation.Email != "" && !strings.EqualFold(invitation.Email, email) {
+			app.errorJSON(w, errors.New("the invitation code is for another email"), http.StatusForbidden)
+			return nil, false
+		}
+
+		return invitation, true
+	}
+
+	switch app.Registration.Mode {
+	case registrationInviteOnly:
+		app.errorJSON(w, errors.New("registration requires an invitation code"), http.StatusForbidden)
+		return nil, false
+	case registrationDomainAllowlist:
+		if !app.Registration.domainAllowed(email) {
+			app.errorJSON(w, errors.New("registration requires an invitation code for this email domain"), http.StatusForbidden)
+			return nil, false
+		}
+	}
+
+	return nil, true
+}
+
+// createdInvitation is the response to a new invitation, the only time the code is shown
+type createdInvitation struct {
+	*data.Invitation
+	Code string `json:"code"`
+}
+
+// CreateInvitation creates a single-use invitation code. It can be limited to one email, given
+// an expiry and roles which are granted on registration. Roles other than the default one need
+// the roles:manage permission, and nobody can hand out a role they don't have.
+func (app *Config) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email     string     `json:"email"`
+		Roles     []string   `json:"roles"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := time.Now().Add(invitationCodeTTL)
+	if requestPayload.ExpiresAt != nil {
+		if !requestPayload.ExpiresAt.After(time.Now()) {
+			app.errorJSON(w, errors.New("expires_at must be in the future"), http.StatusBadRequest)
+			return
+		}
+		expiresAt = *requestPayload.ExpiresAt
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+
+	own, err := app.Repo.GetRoles(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	for _, role := range requestPayload.Roles {
+		if role == defaultRole {
+			continue
+		}
+		if !hasPermission(r, "roles:manage") {
+			app.errorJSON(w, errors.New("missing permission roles:manage"), http.StatusForbidden)
+			return
+		}
+		if !containsScope(own, role) {
+			app.errorJSON(w, fmt.Errorf("can't hand out the role %s", role), http.StatusBadRequest)
+			return
+		}
+	}
+
+	code, err := randomToken(16)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	invitation := data.Invitation{
+		CodeHash:  hashToken(code),
+		Email:     strings.TrimSpace(requestPayload.Email),
+		Roles:     requestPayload.Roles,
+		CreatedBy: &userID,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+	invitation.ID, err = app.Invitations.InsertInvitation(r.Context(), invitation)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("invitation %d has been created", invitation.ID))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Created invitation %d, the code is shown only once", invitation.ID),
+		Data:    createdInvitation{Invitation: &invitation, Code: code},
+	}
+	app.writeJSON(w, http.StatusCreated, payload)
+}
+
+// GetInvitations returns all the invitations, used or not
+func (app *Config) GetInvitations(w http.ResponseWriter, r *http.Request) {
+	invitations, err := app.Invitations.GetInvitations(r.Context())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched %d invitations", len(invitations)),
+		Data:    invitations,
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// RevokeInvitation deletes an invitation which hasn't been used yet
+func (app *Config) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid invitation id"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Invitations.RevokeInvitation(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("invitation not found or already used"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("invitation %d has been revoked", id))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked invitation %d", id),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_NewRegistrationPolicy(t *testing.T) {
+	tests := []struct {
+		mode    string
+		domains string
+		valid   bool
+	}{
+		{"", "", true},
+		{"invite-only", "", true},
+		{"domain-allowlist", " @Example.com, corp.example.com ", true},
+		{"domain-allowlist", "", false},
+		{"closed", "", false},
+	}
+
+	for _, e := range tests {
+		t.Setenv("REGISTRATION_MODE", e.mode)
+		t.Setenv("REGISTRATION_ALLOWED_DOMAINS", e.domains)
+
+		policy, err := newRegistrationPolicy()
+		if (err == nil) != e.valid {
+			t.Errorf("%q %q: expected valid %v, got %v", e.mode, e.domains, e.valid, err)
+		}
+		if e.valid && e.domains != "" {
+			// домены сравниваются без учёта регистра
+			if !policy.domainAllowed("me@EXAMPLE.com") || !policy.domainAllowed("me@corp.example.com") || policy.domainAllowed("me@other.com") {
+				t.Errorf("unexpected allowed domains %v", policy.AllowedDomains)
+			}
+		}
+	}
+}
+
+func Test_InvitationOnlyRegistration(t *testing.T) {
+	admin := setupBulk(t)
+
+	registration := testApp.Registration
+	testApp.Registration = RegistrationPolicy{Mode: registrationInviteOnly}
+	defer func() { testApp.Registration = registration }()
+
+	register := func(email, code string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"email": email, "password": "long enough pw", "invitation_code": code})
+		req, _ := http.NewRequest("POST", "/registrate", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(testApp.Registrate).ServeHTTP(rr, req)
+		return rr
+	}
+	invite := func(body map[string]any) (*httptest.ResponseRecorder, string, int) {
+		rr := serveAuthenticated(t, "POST", "/invitations", body, admin)
+		var payload struct {
+			Data struct {
+				ID   int    `json:"id"`
+				Code string `json:"code"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &payload)
+		return rr, payload.Data.Code, payload.Data.ID
+	}
+
+	if rr := register("new@here.com", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden without a code but got %d", rr.Code)
+	}
+
+	rr, code, _ := invite(map[string]any{"email": "new@here.com", "roles": []string{"admin"}})
+	if rr.Code != http.StatusCreated || code == "" {
+		t.Fatalf("expected http.StatusCreated but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := register("new@here.com", "wrong"); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for a wrong code but got %d", rr.Code)
+	}
+	if rr := register("other@here.com", code); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for another email but got %d", rr.Code)
+	}
+	if rr := register("NEW@here.com", code); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	user, err := testApp.Repo.GetByEmail(context.Background(), "NEW@here.com")
+	if err != nil {
+		t.Fatalf("expected the user to be registered, got %v", err)
+	}
+	if roles, _ := testApp.Repo.GetRoles(context.Background(), user.ID); strings.Join(roles, ",") != "admin,user" {
+		t.Errorf("expected the roles of the invitation, got %v", roles)
+	}
+
+	_ = testApp.Repo.RevokeRole(context.Background(), user.ID, "admin")
+	// неподтверждённый пользователь не проходит проверку токена
+	_ = testApp.Repo.SetStatus(context.Background(), user.ID, data.StatusActive, "")
+
+	// код одноразовый
+	if rr := register("new2@here.com", code); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for a used code but got %d", rr.Code)
+	}
+
+	invitations, _ := testApp.Invitations.GetInvitations(context.Background())
+	if len(invitations) != 1 || invitations[0].UsedBy == nil || *invitations[0].UsedBy != user.ID {
+		t.Errorf("expected the invitation to be used by user %d, got %+v", user.ID, invitations)
+	}
+
+	// ошибка регистрации не расходует приглашение
+	_, unrestricted, _ := invite(map[string]any{})
+	if rr := register("admin@here.com", unrestricted); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for an email in use but got %d", rr.Code)
+	}
+	if rr := register("open@here.com", unrestricted); rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// отозванное приглашение не действует
+	_, code, id := invite(map[string]any{})
+	if rr := serveAuthenticated(t, "DELETE", fmt.Sprintf("/invitations/%d", id), nil, admin); rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	if rr := register("revoked@here.com", code); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for a revoked code but got %d", rr.Code)
+	}
+	if rr := serveAuthenticated(t, "DELETE", fmt.Sprintf("/invitations/%d", id), nil, admin); rr.Code != http.StatusNotFound {
+		t.Errorf("expected http.StatusNotFound but got %d", rr.Code)
+	}
+
+	for _, body := range []map[string]any{
+		{"expires_at": time.Now().Add(-time.Hour)},
+		{"roles": []string{"superuser"}},
+	} {
+		if rr, _, _ := invite(body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected http.StatusBadRequest but got %d", body, rr.Code)
+		}
+	}
+
+	if rr := serveAuthenticated(t, "GET", "/invitations", nil, user.ID); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for a user but got %d", rr.Code)
+	}
+}
+
+func Test_DomainAllowlistRegistration(t *testing.T) {
+	setupBulk(t)
+
+	registration := testApp.Registration
+	testApp.Registration = RegistrationPolicy{Mode: registrationDomainAllowlist, AllowedDomains: []string{"corp.com"}}
+	defer func() { testApp.Registration = registration }()
+
+	for email, expected := range map[string]int{
+		"worker@Corp.com":     http.StatusAccepted,
+		"stranger@gmail.com":  http.StatusForbidden,
+		"worker@evilcorp.com": http.StatusForbidden,
+	} {
+		body, _ := json.Marshal(map[string]string{"email": email, "password": "long enough pw"})
+		req, _ := http.NewRequest("POST", "/registrate", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(testApp.Registrate).ServeHTTP(rr, req)
+		if rr.Code != expected {
+			t.Errorf("%s: expected %d but got %d", email, expected, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// keyRetention is how long retired keys stay available for verification. It has to cover the
+// longest lived token the keyring signs, which is the service token.
+const keyRetention = serviceTokenTTL
+
+// signingKey is one key of the keyring. Retired keys don't sign anymore, but tokens signed
+// with them are still accepted until they expire.
+type signingKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	Private   crypto.Signer
+	CreatedAt time.Time
+	RetiredAt *time.Time
+}
+
+// Keyring holds the keys access tokens are signed with. Exactly one key is current and signs new
+// tokens, the rest are kept only for verification and are published at /.well-known/jwks.json,
+// so other services can verify our tokens without holding any secret.
+type Keyring struct {
+	mu        sync.RWMutex
+	algorithm string
+	keys      []*signingKey
+	retention time.Duration
+}
+
+// NewKeyring creates a keyring with a freshly generated current key. The algorithm is either
+// RS256 or EdDSA.
+func NewKeyring(algorithm string) (*Keyring, error) {
+	k := &Keyring{
+		algorithm: algorithm,
+		retention: keyRetention,
+	}
+
+	err := k.Rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// LoadKeyring reads PEM encoded private keys from a directory, the name of the file without the
+// extension being the key id. The most recently modified key becomes the current one, which lets
+// several replicas share the same keys.
+func LoadKeyring(dir string) (*Keyring, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", dir)
+	}
+
+	k := &Keyring{retention: keyRetention}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := readPrivateKey(file)
+		if err != nil {
+			return nil, err
+		}
+
+		k.keys = append(k.keys, &signingKey{
+			ID:        strings.TrimSuffix(filepath.Base(file), ".pem"),
+			Method:    methodFor(key),
+			Private:   key,
+			CreatedAt: info.ModTime(),
+		})
+	}
+
+	sort.Slice(k.keys, func(i, j int) bool {
+		return k.keys[i].CreatedAt.Before(k.keys[j].CreatedAt)
+	})
+
+	now := time.Now()
+	for _, key := range k.keys[:len(k.keys)-1] {
+		key.RetiredAt = &now
+	}
+	k.algorithm = k.keys[len(k.keys)-1].Method.Alg()
+
+	return k, nil
+}
+
+// Rotate generates a new current key. The previous current key is retired and stays
+// available for verification until every token signed with it has expired.
+func (k *Keyring) Rotate() error {
+	key, err := generateKey(k.algorithm)
+	if err != nil {
+		return err
+	}
+
+	id, err := randomToken(8)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	for _, existing := range k.keys {
+		if existing.RetiredAt == nil {
+			existing.RetiredAt = &now
+		}
+	}
+
+	k.keys = append(k.keys, &signingKey{
+		ID:        id,
+		Method:    methodFor(key),
+		Private:   key,
+		CreatedAt: now,
+	})
+
+	return nil
+}
+
+// Prune drops retired keys which can't have signed any token that is still valid
+func (k *Keyring) Prune() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var keys []*signingKey
+	for _, key := range k.keys {
+		if key.RetiredAt == nil || time.Since(*key.RetiredAt) < k.retention {
+			keys = append(keys, key)
+		}
+	}
+	k.keys = keys
+}
+
+// StartRotation rotates the keys every interval for as long as the service runs
+func (k *Keyring) StartRotation(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := k.Rotate()
+			if err != nil {
+				log.Println("Error rotating signing keys:", err)
+				continue
+			}
+			k.Prune()
+			log.Println("Signing keys rotated")
+		}
+	}()
+}
+
+// Sign signs the claims with the current key, putting its id into the kid header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	current := k.keys[len(k.keys)-1]
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(current.Method, claims)
+	token.Header["kid"] = current.ID
+
+	return token.SignedString(current.Private)
+}
+
+// Algorithm returns the algorithm new tokens are signed with
+func (k *Keyring) Algorithm() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.keys[len(k.keys)-1].Method.Alg()
+}
+
+// Keyfunc looks up the public key a token was signed with by its kid header. It is meant to be
+// passed to jwt.Parse.
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.ID != kid {
+			continue
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		if key.RetiredAt != nil && time.Since(*key.RetiredAt) > k.retention {
+			return nil, errors.New("signing key has been retired")
+		}
+		return key.Private.Public(), nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public part of every key which may still have valid tokens signed with it
+func (k *Keyring) JWKS() []jsonWebKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := []jsonWebKey{}
+	for _, key := range k.keys {
+		if key.RetiredAt != nil && time.Since(*key.RetiredAt) > k.retention {
+			continue
+		}
+
+		jwk := jsonWebKey{
+			Kid: key.ID,
+			Use: "sig",
+			Alg: key.Method.Alg(),
+		}
+
+		switch public := key.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+
+		keys = append(keys, jwk)
+	}
+
+	return keys
+}
+
+// JWKSHandler publishes the verification keys as a JSON Web Key Set
+func (app *Config) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	app.writeJSON(w, http.StatusOK, map[string]any{"keys": app.Keys.JWKS()})
+}
+
+func generateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+}
+
+func methodFor(key crypto.Signer) jwt.SigningMethod {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+func readPrivateKey(file string) (crypto.Signer, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", file)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", file, key)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func Test_KeyringRotation(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "EdDSA"} {
+		keys, err := NewKeyring(algorithm)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", algorithm, err)
+		}
+
+		oldToken, err := generateAccessToken(keys, 1, "192.168.1.1", "session", nil, nil)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", algorithm, err)
+		}
+
+		err = keys.Rotate()
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", algorithm, err)
+		}
+
+		newToken, err := generateAccessToken(keys, 1, "192.168.1.1", "session", nil, nil)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", algorithm, err)
+		}
+
+		// токены, подписанные обоими ключами, проходят проверку
+		for _, tokenString := range []string{oldToken, newToken} {
+			token, err := jwt.Parse(tokenString, keys.Keyfunc)
+			if err != nil || !token.Valid {
+				t.Errorf("%s: expected token to be valid, got %v", algorithm, err)
+			}
+			if token.Method.Alg() != algorithm {
+				t.Errorf("%s: expected token to be signed with %s, got %s", algorithm, algorithm, token.Method.Alg())
+			}
+		}
+
+		oldKid, _ := jwt.Parse(oldToken, nil)
+		newKid, _ := jwt.Parse(newToken, nil)
+		if oldKid.Header["kid"] == newKid.Header["kid"] {
+			t.Errorf("%s: expected a new kid after rotation", algorithm)
+		}
+
+		if jwks := keys.JWKS(); len(jwks) != 2 {
+			t.Errorf("%s: expected 2 published keys, got %d", algorithm, len(jwks))
+		}
+	}
+}
+
+// Test_KeyRetention проверяет, что вышедший из употребления ключ хранится, пока действителен
+// любой подписанный им токен.
+func Test_KeyRetention(t *testing.T) {
+	for name, ttl := range map[string]time.Duration{
+		"access":     accessTokenTTL,
+		"service":    serviceTokenTTL,
+		"mfa":        mfaPendingTTL,
+		"magic link": magicLinkTTL,
+		"consent":    consentRequestTTL,
+	} {
+		if keyRetention < ttl {
+			t.Errorf("%s tokens live %s, longer than the keys are kept (%s)", name, ttl, keyRetention)
+		}
+	}
+
+	keys, err := NewKeyring("EdDSA")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	serviceToken, _ := NewServiceTokenSource(keys, "auth-service", "logs:write").Token()
+
+	// ключ, выведенный почти час назад, ещё проверяет сервисный токен
+	_ = keys.Rotate()
+	retired := time.Now().Add(-serviceTokenTTL + time.Minute)
+	keys.keys[0].RetiredAt = &retired
+	keys.Prune()
+	if _, err := jwt.Parse(serviceToken, keys.Keyfunc); err != nil {
+		t.Errorf("expected the service token to be valid, got %v", err)
+	}
+}
+
+func Test_JWKSHandler(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(testApp.JWKSHandler)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected http.StatusOK but got %d", rr.Code)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.NewDecoder(rr.Body).Decode(&set)
+	if err != nil {
+		t.Fatalf("failed to decode jwks: %v", err)
+	}
+
+	if len(set.Keys) == 0 || set.Keys[0].Kty != "RSA" || set.Keys[0].N == "" || set.Keys[0].Kid == "" {
+		t.Errorf("unexpected jwks: %+v", set.Keys)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"auth-service/data"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// accountStatusError returns the error a user who can't log in gets, and the status to respond
+// with. Deleted users get the same answer as a wrong password.
+func accountStatusError(user *data.User) (int, error) {
+	switch user.Status {
+	case data.StatusActive:
+		return 0, nil
+	case data.StatusPending:
+		return http.StatusForbidden, errors.New("email has not been verified")
+	case data.StatusSuspended:
+		return http.StatusForbidden, errors.New("account has been suspended")
+	}
+
+	return http.StatusBadRequest, errors.New("invalid credentials")
+}
+
+// checkAccountStatus rejects requests of users who can't log in anymore, whatever the token
+// they come with
+func (app *Config) checkAccountStatus(ctx context.Context, userID int) (int, error) {
+	user, err := app.Repo.GetOne(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return http.StatusUnauthorized, errors.New("user not found")
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !user.IsActive() {
+		return http.StatusUnauthorized, fmt.Errorf("account is %s", user.Status)
+	}
+
+	return 0, nil
+}
+
+// invalidTransition is the error of a status change the account can't make
+func invalidTransition(from, to string) error {
+	return fmt.Errorf("a %s account can't become %s", from, to)
+}
+
+// changeStatus moves the user to the new state. Leaving the active state ends all of the
+// sessions of the user. When it reports false, the error response has already been written.
+func (app *Config) changeStatus(w http.ResponseWriter, r *http.Request, user *data.User, status, reason string) bool {
+	err := app.Repo.SetStatus(r.Context(), user.ID, status, reason)
+	if err != nil {
+		app.statusError(w, user, status, err)
+		return false
+	}
+
+	return app.statusChanged(w, r, user, status, reason)
+}
+
+// statusError writes the error response for a failed SetStatus
+func (app *Config) statusError(w http.ResponseWriter, user *data.User, status string, err error) {
+	if errors.Is(err, data.ErrInvalidTransition) {
+		app.errorJSON(w, invalidTransition(user.Status, status), http.StatusConflict)
+	} else if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+	} else {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+	}
+}
+
+// statusChanged ends the sessions of a user who left the active state and logs the change,
+// once the new status has been saved
+func (app *Config) statusChanged(w http.ResponseWriter, r *http.Request, user *data.User, status, reason string) bool {
+	if status != data.StatusActive {
+		err := app.revokeAllSessions(r.Context(), user.ID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return false
+		}
+	}
+
+	event := fmt.Sprintf("user %d has become %s", user.ID, status)
+	if reason != "" {
+		event += " (" + reason + ")"
+	}
+	app.logUserEvent(r, event)
+
+	user.Status = status
+	user.StatusReason = reason
+	return true
+}
+
+// SuspendUser suspends one user, who can't log in until reactivated. All of their sessions
+// end. The reason is required, and nobody can suspend themselves.
+func (app *Config) SuspendUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Reason string `json:"reason"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if requestPayload.Reason == "" {
+		app.errorJSON(w, errors.New("reason is required"), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.userFromURL(w, r, "users:write")
+	if !ok {
+		return
+	}
+	if user.ID == r.Context().Value(userIDKey).(int) {
+		app.errorJSON(w, errors.New("can't suspend your own account"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.changeStatus(w, r, user, data.StatusSuspended, requestPayload.Reason) {
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Suspended user %d", user.ID),
+		Data:    user,
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// restoreUser brings a deleted user back to the state they had before the deletion, so an
+// account which was never verified stays pending. When it reports false, the error response
+// has already been written.
+func (app *Config) restoreUser(w http.ResponseWriter, r *http.Request, user *data.User, reason string) bool {
+	status, err := app.Repo.Restore(r.Context(), user.ID, reason)
+	if err != nil {
+		app.statusError(w, user, data.StatusActive, err)
+		return false
+	}
+
+	return app.statusChanged(w, r, user, status, reason)
+}
+
+// ReactivateUser lets a suspended user log in again, or restores a deleted user who hasn't
+// been purged yet to the state they had before
+func (app *Config) ReactivateUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Reason string `json:"reason"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.userFromURL(w, r, "users:write")
+	if !ok {
+		return
+	}
+
+	if user.Status == data.StatusDeleted {
+		if !app.restoreUser(w, r, user, requestPayload.Reason) {
+			return
+		}
+	} else if !app.changeStatus(w, r, user, data.StatusActive, requestPayload.Reason) {
+		return
+	}
+	user.DeletedAt = nil
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Reactivated user %d", user.ID),
+		Data:    user,
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// purgeDeletedUsers removes the users whose grace period is over
+func (app *Config) purgeDeletedUsers(ctx context.Context) (int, error) {
+	purged, err := app.Repo.PurgeDeleted(ctx, time.Now().Add(-app.DeletionGracePeriod))
+	if err != nil {
+		return 0, err
+	}
+
+	if purged > 0 {
+		err = app.logRequest("users", fmt.Sprintf("%d deleted users have been purged", purged))
+		if err != nil {
+			log.Println("Error logging user event:", err)
+		}
+	}
+
+	return purged, nil
+}
+
+// startPurge purges the deleted users every interval for as long as the service runs
+func (app *Config) startPurge(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			_, err := app.purgeDeletedUsers(context.Background())
+			if err != nil {
+				log.Println("Error purging deleted users:", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_SuspendUser(t *testing.T) {
+	admin := setupBulk(t)
+	ctx := context.Background()
+	user, _ := testApp.Repo.Insert(ctx, data.User{Email: "jane@here.com", FirstName: "Jane", Password: "verysecret", Status: data.StatusActive})
+
+	authenticate := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"email": "jane@here.com", "password": "verysecret"})
+		req, _ := http.NewRequest("POST", "/authenticate", bytes.NewReader(body))
+		req.RemoteAddr = "10.0.2.1:12345"
+		rr := httptest.NewRecorder()
+		testApp.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serveAuthenticated(t, "POST", "/users/2/suspend", map[string]string{}, admin); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest without a reason but got %d", rr.Code)
+	}
+	if rr := serveAuthenticated(t, "POST", "/users/1/suspend", map[string]string{"reason": "test"}, admin); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for self but got %d", rr.Code)
+	}
+	if rr := serveAuthenticated(t, "POST", "/users/1/suspend", map[string]string{"reason": "test"}, user); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for a user but got %d", rr.Code)
+	}
+
+	rr := serveAuthenticated(t, "POST", "/users/2/suspend", map[string]string{"reason": "spam"}, admin)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	found, _ := testApp.Repo.GetOne(ctx, user)
+	if found.Status != data.StatusSuspended || found.StatusReason != "spam" {
+		t.Errorf("expected the user to be suspended, got %+v", found)
+	}
+
+	// уже выданные токены перестают действовать, войти заново нельзя
+	if rr := serveAuthenticated(t, "GET", "/me/sessions", nil, user); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for a suspended user but got %d", rr.Code)
+	}
+	if rr := authenticate(); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "suspended") {
+		t.Errorf("expected http.StatusForbidden for a suspended user but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := serveAuthenticated(t, "POST", "/users/2/suspend", map[string]string{"reason": "again"}, admin); rr.Code != http.StatusConflict {
+		t.Errorf("expected http.StatusConflict for a suspended user but got %d", rr.Code)
+	}
+
+	if rr := serveAuthenticated(t, "POST", "/users/2/reactivate", map[string]string{}, admin); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serveAuthenticated(t, "POST", "/users/2/reactivate", map[string]string{}, admin); rr.Code != http.StatusConflict {
+		t.Errorf("expected http.StatusConflict for an active user but got %d", rr.Code)
+	}
+	if rr := authenticate(); rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted after reactivation but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := serveAuthenticated(t, "POST", "/users/3/reactivate", map[string]string{}, admin); rr.Code != http.StatusNotFound {
+		t.Errorf("expected http.StatusNotFound but got %d", rr.Code)
+	}
+}
+
+// Test_SuspendedUserTokens проверяет, что токены, полученные до приостановки, не дают новых.
+func Test_SuspendedUserTokens(t *testing.T) {
+	setupBulk(t)
+	ctx := context.Background()
+	user, _ := testApp.Repo.Insert(ctx, data.User{Email: "jane@here.com", Password: "verysecret", Status: data.StatusActive})
+
+	userData, err := testApp.issueTokens(ctx, httptest.NewRecorder(), user, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	mfaToken, err := generateMFAPendingToken(testApp.Keys, user, "192.168.1.1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	_ = testApp.Repo.SetStatus(ctx, user, data.StatusSuspended, "spam")
+
+	post := func(path string, body map[string]string) *httptest.ResponseRecorder {
+		out, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewReader(out))
+		req.RemoteAddr = "192.168.1.1:12345"
+		rr := httptest.NewRecorder()
+		testApp.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := post("/refresh", map[string]string{"refresh_token": userData.RefreshToken}); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "suspended") {
+		t.Errorf("expected http.StatusForbidden for refreshing but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := post("/authenticate/mfa", map[string]string{"mfa_token": mfaToken, "code": "000000"}); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "suspended") {
+		t.Errorf("expected http.StatusForbidden for the second factor but got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func Test_SoftDeleteAndPurge(t *testing.T) {
+	admin := setupBulk(t)
+	ctx := context.Background()
+	user, _ := testApp.Repo.Insert(ctx, data.User{Email: "jane@here.com", FirstName: "Jane", Password: "verysecret", Status: data.StatusActive})
+
+	if rr := serveAuthenticated(t, "DELETE", "/users/2", nil, admin); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	found, err := testApp.Repo.GetOne(ctx, user)
+	if err != nil || found.Status != data.StatusDeleted || found.DeletedAt == nil {
+		t.Fatalf("expected the user to be kept as deleted, got %+v %v", found, err)
+	}
+
+	// удалённые не попадают в список без фильтра по статусу
+	rr := serveAuthenticated(t, "GET", "/users", nil, admin)
+	if strings.Contains(rr.Body.String(), "jane@here.com") {
+		t.Errorf("expected deleted users to be hidden, got %s", rr.Body.String())
+	}
+	rr = serveAuthenticated(t, "GET", "/users?status=deleted", nil, admin)
+	if !strings.Contains(rr.Body.String(), "jane@here.com") {
+		t.Errorf("expected the deleted user, got %s", rr.Body.String())
+	}
+
+	// до окончания срока учётную запись можно восстановить
+	if purged, err := testApp.purgeDeletedUsers(ctx); err != nil || purged != 0 {
+		t.Errorf("expected nothing to be purged during the grace period, got %d %v", purged, err)
+	}
+	if rr := serveAuthenticated(t, "POST", "/users/2/reactivate", map[string]string{"reason": "mistake"}, admin); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if found, _ := testApp.Repo.GetOne(ctx, user); found.Status != data.StatusActive || found.DeletedAt != nil {
+		t.Errorf("expected the user to be restored, got %+v", found)
+	}
+
+	// неподтверждённая учётная запись после восстановления остаётся неподтверждённой
+	pending, _ := testApp.Repo.Insert(ctx, data.User{Email: "pending@here.com", Password: "verysecret"})
+	if rr := serveAuthenticated(t, "DELETE", fmt.Sprintf("/users/%d", pending), nil, admin); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	if rr := serveAuthenticated(t, "PATCH", fmt.Sprintf("/users/%d", pending), map[string]any{"status": "active"}, admin); rr.Code != http.StatusConflict {
+		t.Errorf("expected http.StatusConflict activating a deleted user but got %d", rr.Code)
+	}
+	if rr := serveAuthenticated(t, "POST", fmt.Sprintf("/users/%d/reactivate", pending), map[string]string{}, admin); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if found, _ := testApp.Repo.GetOne(ctx, pending); found.Status != data.StatusPending || found.DeletedAt != nil {
+		t.Errorf("expected the user to be restored as pending, got %+v", found)
+	}
+	_ = testApp.Repo.PurgeByID(ctx, pending)
+
+	if rr := serveAuthenticated(t, "DELETE", "/users/2", nil, admin); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+
+	grace := testApp.DeletionGracePeriod
+	testApp.DeletionGracePeriod = -time.Minute
+	defer func() { testApp.DeletionGracePeriod = grace }()
+
+	var out bytes.Buffer
+	if err := testApp.usersCommand([]string{"purge"}, nil, &out); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "Purged 1 users") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if _, err := testApp.Repo.GetOne(ctx, user); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the user to be purged, got %v", err)
+	}
+	if found, err := testApp.Repo.GetOne(ctx, admin); err != nil || !found.IsActive() {
+		t.Errorf("expected the admin to be kept, got %+v %v", found, err)
+	}
+}
+
+// Test_UpdateUserStatusAndEmail проверяет, что отклонённый переход статуса или неотправленное
+// письмо ничего не сохраняют, а новый email применяется только после перехода по ссылке.
+func Test_UpdateUserStatusAndEmail(t *testing.T) {
+	admin := setupBulk(t)
+	ctx := context.Background()
+	user, _ := testApp.Repo.Insert(ctx, data.User{Email: "jane@here.com", FirstName: "Jane", Password: "verysecret", Status: data.StatusActive})
+
+	outbox := t.TempDir()
+	mailer := testApp.Mailer
+	defer func() { testApp.Mailer = mailer }()
+
+	rr := serveAuthenticated(t, "PATCH", "/users/2", map[string]any{"first_name": "Changed", "status": "pending"}, admin)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected http.StatusConflict but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if found, _ := testApp.Repo.GetOne(ctx, user); found.FirstName != "Jane" {
+		t.Errorf("expected a rejected update to change nothing, got %+v", found)
+	}
+
+	// свой статус не меняют даже администраторы
+	for _, status := range []string{"suspended", "deleted"} {
+		rr = serveAuthenticated(t, "PATCH", "/users/1", map[string]any{"status": status, "status_reason": "oops"}, admin)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected http.StatusBadRequest for own status %s but got %d", status, rr.Code)
+		}
+	}
+	if found, _ := testApp.Repo.GetOne(ctx, admin); found.Status != data.StatusActive {
+		t.Errorf("expected the admin to stay active, got %s", found.Status)
+	}
+
+	// если письмо не ушло, профиль не меняется
+	testApp.Mailer = failingMailer{}
+	rr = serveAuthenticated(t, "PATCH", "/users/2", map[string]any{"first_name": "Changed", "email": "new@here.com"}, user)
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected http.StatusInternalServerError but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if found, _ := testApp.Repo.GetOne(ctx, user); found.FirstName != "Jane" {
+		t.Errorf("expected a failed update to change nothing, got %+v", found)
+	}
+
+	testApp.Mailer = NewOutboxMailer(outbox)
+	rr = serveAuthenticated(t, "PATCH", "/users/2", map[string]any{"email": "new@here.com"}, user)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if found, _ := testApp.Repo.GetOne(ctx, user); found.Email != "jane@here.com" {
+		t.Errorf("expected the email to be kept until it is confirmed, got %s", found.Email)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(outbox, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one email in the outbox, got %d", len(files))
+	}
+	email, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(email), "To: new@here.com") {
+		t.Errorf("expected the confirmation to go to the new email, got %s", email)
+	}
+
+	// ссылка из письма меняет email
+	token, _ := generateEmailChangeToken(testApp.VerificationSecret, user, "jane@here.com", "new@here.com")
+	req, _ := http.NewRequest("GET", "/verify?token="+url.QueryEscape(token), nil)
+	rr = httptest.NewRecorder()
+	testApp.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected http.StatusOK but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if found, _ := testApp.Repo.GetOne(ctx, user); found.Email != "new@here.com" {
+		t.Errorf("expected the email to be changed, got %s", found.Email)
+	}
+
+	// повторно ссылка не срабатывает, email уже другой
+	rr = httptest.NewRecorder()
+	testApp.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for a used link but got %d", rr.Code)
+	}
+
+	// администратор меняет email сразу
+	rr = serveAuthenticated(t, "PATCH", "/users/2", map[string]any{"email": "admin-set@here.com"}, admin)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if found, _ := testApp.Repo.GetOne(ctx, user); found.Email != "admin-set@here.com" {
+		t.Errorf("expected the admin to change the email, got %s", found.Email)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockoutPolicy configures how failed logins are throttled. After BackoffAfter failures every
+// further attempt has to wait BackoffBase, doubled with each failure up to MaxBackoff. Reaching
+// a lockout threshold locks the account or the IP address for LockoutDuration.
+type LockoutPolicy struct {
+	BackoffAfter     int
+	BackoffBase      time.Duration
+	MaxBackoff       time.Duration
+	AccountThreshold int
+	IPThreshold      int
+	LockoutDuration  time.Duration
+	// ResetAfter is how long without failures it takes for the counters to start over
+	ResetAfter time.Duration
+}
+
+// newLockoutPolicy reads the policy from the LOCKOUT_* environment variables
+func newLockoutPolicy() (LockoutPolicy, error) {
+	var policy LockoutPolicy
+	var err error
+
+	ints := []struct {
+		key   string
+		def   string
+		value *int
+	}{
+		{"LOCKOUT_BACKOFF_AFTER", "3", &policy.BackoffAfter},
+		{"LOCKOUT_ACCOUNT_THRESHOLD", "10", &policy.AccountThreshold},
+		{"LOCKOUT_IP_THRESHOLD", "100", &policy.IPThreshold},
+	}
+	for _, setting := range ints {
+		*setting.value, err = strconv.Atoi(envOr(setting.key, setting.def))
+		if err != nil {
+			return policy, fmt.Errorf("%s: %w", setting.key, err)
+		}
+	}
+
+	durations := []struct {
+		key   string
+		def   string
+		value *time.Duration
+	}{
+		{"LOCKOUT_BACKOFF_BASE", "1s", &policy.BackoffBase},
+		{"LOCKOUT_MAX_BACKOFF", "30s", &policy.MaxBackoff},
+		{"LOCKOUT_DURATION", "15m", &policy.LockoutDuration},
+		{"LOCKOUT_RESET_AFTER", "1h", &policy.ResetAfter},
+	}
+	for _, setting := range durations {
+		*setting.value, err = time.ParseDuration(envOr(setting.key, setting.def))
+		if err != nil {
+			return policy, fmt.Errorf("%s: %w", setting.key, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// backoff returns how long to wait after the given number of failures
+func (p LockoutPolicy) backoff(failures int) time.Duration {
+	if failures < p.BackoffAfter {
+		return 0
+	}
+
+	wait := float64(p.BackoffBase) * math.Pow(2, float64(failures-p.BackoffAfter))
+	if wait > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+
+	return time.Duration(wait)
+}
+
+func accountLockoutKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func ipLockoutKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLoginAllowed checks that neither the account nor the IP address is locked or still has
+// to wait before the next attempt. When it reports false, the error response has already been
+// written.
+func (app *Config) checkLoginAllowed(ctx context.Context, w http.ResponseWriter, email, ip string) bool {
+	for _, key := range []string{accountLockoutKey(email), ipLockoutKey(ip)} {
+		attempts, err := app.Attempts.GetAttempts(ctx, key)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return false
+		}
+
+		now := time.Now()
+		if attempts.LockedUntil != nil && attempts.LockedUntil.After(now) {
+			retryAfter := attempts.LockedUntil.Sub(now)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			app.errorJSON(w, errors.New("too many failed logins, temporarily locked"), http.StatusTooManyRequests)
+			return false
+		}
+
+		if next := attempts.LastFailureAt.Add(app.Lockout.backoff(attempts.Failures)); next.After(now) {
+			retryAfter := next.Sub(now)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			app.errorJSON(w, fmt.Errorf("too many failed logins, retry in %s", retryAfter.Round(time.Second)), http.StatusTooManyRequests)
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordLoginFailure counts a failed login for the account and the IP address, locking
+// whichever of them has reached its threshold
+func (app *Config) recordLoginFailure(ctx context.Context, email, ip string) {
+	keys := []struct {
+		key       string
+		threshold int
+	}{
+		{accountLockoutKey(email), app.Lockout.AccountThreshold},
+		{ipLockoutKey(ip), app.Lockout.IPThreshold},
+	}
+
+	for _, k := range keys {
+		attempts, err := app.Attempts.RecordFailure(ctx, k.key, app.Lockout.ResetAfter)
+		if err != nil {
+			log.Println("Error recording failed login:", err)
+			continue
+		}
+
+		if attempts.Failures < k.threshold {
+			continue
+		}
+
+		err = app.Attempts.Lock(ctx, k.key, time.Now().Add(app.Lockout.LockoutDuration))
+		if err != nil {
+			log.Println("Error locking after failed logins:", err)
+			continue
+		}
+
+		err = app.logRequest("lockout", fmt.Sprintf("%s locked for %s after %d failed logins",
+			k.key, app.Lockout.LockoutDuration, attempts.Failures))
+		if err != nil {
+			log.Println("Error logging lockout:", err)
+		}
+	}
+}
+
+// Unlock lifts the lockout of one user and optionally of an IP address
+func (app *Config) Unlock(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		IP string `json:"ip"`
+	}
+
+	if r.ContentLength > 0 {
+		err := app.readJSON(w, r, &requestPayload)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	user, ok := app.userFromURL(w, r, "users:write")
+	if !ok {
+		return
+	}
+
+	keys := []string{accountLockoutKey(user.Email)}
+	if requestPayload.IP != "" {
+		keys = append(keys, ipLockoutKey(requestPayload.IP))
+	}
+
+	for _, key := range keys {
+		err := app.Attempts.Reset(r.Context(), key)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("%s has been unlocked", strings.Join(keys, ", ")))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Unlocked user %d", user.ID),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
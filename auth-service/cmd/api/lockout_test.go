@@ -0,0 +1,138 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_LockoutPolicy_Backoff(t *testing.T) {
+	policy := LockoutPolicy{BackoffAfter: 3, BackoffBase: time.Second, MaxBackoff: 5 * time.Second}
+
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 5 * time.Second},
+		{20, 5 * time.Second},
+	}
+
+	for _, e := range tests {
+		if got := policy.backoff(e.failures); got != e.expected {
+			t.Errorf("%d failures: expected %s but got %s", e.failures, e.expected, got)
+		}
+	}
+}
+
+func Test_Lockout(t *testing.T) {
+	var logged []string
+	testApp.Client = NewTestClient(func(req *http.Request) *http.Response {
+		body, _ := io.ReadAll(req.Body)
+		logged = append(logged, string(body))
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error": false}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	// отдельное хранилище и политика, чтобы не блокировать входы в остальных тестах
+	attempts, lockout := testApp.Attempts, testApp.Lockout
+	defer func() { testApp.Attempts, testApp.Lockout = attempts, lockout }()
+
+	login := func(email, password, ip string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"email": email, "password": password})
+		req, _ := http.NewRequest("POST", "/authenticate", bytes.NewReader(body))
+		req.RemoteAddr = ip + ":12345"
+		rr := httptest.NewRecorder()
+		testApp.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("backoff", func(t *testing.T) {
+		testApp.Attempts = data.NewMemoryLoginAttemptStore()
+		testApp.Lockout = LockoutPolicy{BackoffAfter: 2, BackoffBase: time.Minute, MaxBackoff: time.Hour,
+			AccountThreshold: 10, IPThreshold: 10, LockoutDuration: time.Hour, ResetAfter: time.Hour}
+
+		for i := 0; i < 2; i++ {
+			if rr := login("me@here.com", data.WrongTestPassword, "10.0.0.1"); rr.Code != http.StatusBadRequest {
+				t.Fatalf("attempt %d: expected http.StatusBadRequest but got %d", i+1, rr.Code)
+			}
+		}
+
+		// даже правильный пароль отклоняется, пока не истекла задержка
+		rr := login("me@here.com", "verysecret", "10.0.0.1")
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected http.StatusTooManyRequests but got %d", rr.Code)
+		}
+		if rr.Header().Get("Retry-After") != "60" {
+			t.Errorf("expected Retry-After 60, got %q", rr.Header().Get("Retry-After"))
+		}
+
+		// администратор снимает блокировку
+		_ = testApp.Repo.GrantRole(context.Background(), 100, "admin")
+		if rr := serveAuthenticated(t, "POST", "/users/1/unlock", nil, 1); rr.Code != http.StatusForbidden {
+			t.Errorf("expected http.StatusForbidden for non admin but got %d", rr.Code)
+		}
+		if rr := serveAuthenticated(t, "POST", "/users/1/unlock", map[string]string{"ip": "10.0.0.1"}, 100); rr.Code != http.StatusAccepted {
+			t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+		}
+
+		if rr := login("me@here.com", "verysecret", "10.0.0.1"); rr.Code != http.StatusAccepted {
+			t.Errorf("expected http.StatusAccepted after unlock but got %d", rr.Code)
+		}
+	})
+
+	t.Run("account lockout", func(t *testing.T) {
+		testApp.Attempts = data.NewMemoryLoginAttemptStore()
+		testApp.Lockout = LockoutPolicy{BackoffAfter: 100, BackoffBase: time.Second, MaxBackoff: time.Second,
+			AccountThreshold: 3, IPThreshold: 100, LockoutDuration: time.Hour, ResetAfter: time.Hour}
+		logged = nil
+
+		for i := 0; i < 3; i++ {
+			if rr := login("me@here.com", data.WrongTestPassword, "10.0.0.2"); rr.Code != http.StatusBadRequest {
+				t.Fatalf("attempt %d: expected http.StatusBadRequest but got %d", i+1, rr.Code)
+			}
+		}
+
+		// блокировка не зависит от регистра email
+		if rr := login("ME@here.com", "verysecret", "10.0.0.3"); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected http.StatusTooManyRequests but got %d", rr.Code)
+		}
+
+		if len(logged) != 1 || !strings.Contains(logged[0], "lockout") || !strings.Contains(logged[0], "account:me@here.com") {
+			t.Errorf("expected the lockout to be logged, got %v", logged)
+		}
+	})
+
+	t.Run("ip lockout", func(t *testing.T) {
+		testApp.Attempts = data.NewMemoryLoginAttemptStore()
+		testApp.Lockout = LockoutPolicy{BackoffAfter: 100, BackoffBase: time.Second, MaxBackoff: time.Second,
+			AccountThreshold: 100, IPThreshold: 3, LockoutDuration: time.Hour, ResetAfter: time.Hour}
+
+		for _, email := range []string{"a@here.com", "b@here.com", "c@here.com"} {
+			if rr := login(email, data.WrongTestPassword, "10.0.0.4"); rr.Code != http.StatusBadRequest {
+				t.Fatalf("%s: expected http.StatusBadRequest but got %d", email, rr.Code)
+			}
+		}
+
+		if rr := login("me@here.com", "verysecret", "10.0.0.4"); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected http.StatusTooManyRequests but got %d", rr.Code)
+		}
+		if rr := login("me@here.com", "verysecret", "10.0.0.5"); rr.Code != http.StatusAccepted {
+			t.Errorf("expected http.StatusAccepted from another ip but got %d", rr.Code)
+		}
+	})
+}
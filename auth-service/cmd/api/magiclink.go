@@ -0,0 +1,152 @@
+package main
+
+import (
+	"auth-service/data"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// magicLinkTTL is how long a passwordless login link can be used
+const magicLinkTTL = 15 * time.Minute
+
+const magicLinkType = "magic_link"
+
+var errInvalidMagicLink = errors.New("invalid, expired or already used login link")
+
+// RequestMagicLink emails the user a link which logs them in without a password. It is rate
+// limited per email, and like ForgotPassword answers the same whether the email is registered
+// or not.
+func (app *Config) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.magicLinkLimiter.Allow(strings.ToLower(requestPayload.Email)) {
+		app.errorJSON(w, errors.New("too many login links requested, try again later"), http.StatusTooManyRequests)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "If the email is registered, a login link has been sent to it",
+	}
+
+	user, err := app.Repo.GetByEmail(r.Context(), requestPayload.Email)
+	if err != nil || !user.IsActive() {
+		app.writeJSON(w, http.StatusAccepted, payload)
+		return
+	}
+
+	token, err := generateMagicLinkToken(app.Keys, user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = app.MagicLinks.InsertMagicLink(r.Context(), data.MagicLink{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(magicLinkTTL),
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("To log in, open the link below within %s:\n%s?token=%s\n\n"+
+			"The link works only once. If you didn't ask for it, just ignore this email.\n",
+			magicLinkTTL, app.MagicLinkURL, url.QueryEscape(token)),
+	})
+	if err != nil {
+		log.Println("Error sending login link email:", err)
+		app.errorJSON(w, errors.New("couldn't send the login link email"), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.logRequest("authentication", fmt.Sprintf("%s requested a login link", user.Email))
+	if err != nil {
+		log.Println("Error logging login link request:", err)
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// MagicLinkCallback logs the user in with the token from a login link, the same way
+// Authenticate does after checking the password. Every link can be used only once.
+func (app *Config) MagicLinkCallback(w http.ResponseWriter, r *http.Request) {
+	tokenString := r.URL.Query().Get("token")
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, &claims, app.Keys.Keyfunc)
+	if err != nil || !token.Valid || claims["typ"] != magicLinkType {
+		app.errorJSON(w, errInvalidMagicLink, http.StatusUnauthorized)
+		return
+	}
+
+	link, err := app.MagicLinks.ConsumeMagicLink(r.Context(), hashToken(tokenString))
+	if errors.Is(err, sql.ErrNoRows) {
+		// a signed link which can't be used anymore has been used before or replaced by a newer one
+		userID, _ := claims["sub"].(float64)
+		err = app.logRequest("authentication", fmt.Sprintf("used login link of user %d was presented again", int(userID)))
+		if err != nil {
+			log.Println("Error logging login link replay:", err)
+		}
+
+		app.errorJSON(w, errInvalidMagicLink, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if userID, _ := claims["sub"].(float64); int(userID) != link.UserID {
+		app.errorJSON(w, errInvalidMagicLink, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), link.UserID)
+	if err != nil {
+		app.errorJSON(w, errInvalidMagicLink, http.StatusUnauthorized)
+		return
+	}
+
+	app.finishLogin(w, r, user, app.ClientIP.ClientIP(r), " with a login link")
+}
+
+// generateMagicLinkToken signs the token of a login link. The signature keeps anyone from
+// making up links, and the stored hash lets each link be used only once.
+func generateMagicLinkToken(keys *Keyring, userID int) (string, error) {
+	issuedAt := time.Now()
+
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &jwt.MapClaims{
+		"sub": userID,
+		"exp": issuedAt.Add(magicLinkTTL).Unix(),
+		"iat": issuedAt.Unix(),
+		"jti": jti,
+		"typ": magicLinkType,
+	}
+
+	return keys.Sign(claims)
+}
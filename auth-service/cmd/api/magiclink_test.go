@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Test_MagicLink проверяет вход по одноразовой ссылке из письма.
+func Test_MagicLink(t *testing.T) {
+	outbox := t.TempDir()
+	mailer := testApp.Mailer
+	testApp.Mailer = NewOutboxMailer(outbox)
+	defer func() { testApp.Mailer = mailer }()
+
+	var logged []string
+	client := testApp.Client
+	testApp.Client = NewTestClient(func(req *http.Request) *http.Response {
+		body, _ := io.ReadAll(req.Body)
+		logged = append(logged, string(body))
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error": false}`)),
+			Header:     make(http.Header),
+		}
+	})
+	defer func() { testApp.Client = client }()
+
+	routes := testApp.routes()
+
+	requestLink := func() string {
+		body, _ := json.Marshal(map[string]string{"email": "me@here.com"})
+		req, _ := http.NewRequest("POST", "/login/magic", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+		}
+
+		files, _ := filepath.Glob(filepath.Join(outbox, "*.eml"))
+		if len(files) == 0 {
+			t.Fatal("expected an email in the outbox")
+		}
+		var newest []byte
+		for _, file := range files {
+			email, _ := os.ReadFile(file)
+			newest = email
+			os.Remove(file)
+		}
+
+		match := regexp.MustCompile(`login/magic/callback\?token=([A-Za-z0-9_.%-]+)`).FindSubmatch(newest)
+		if match == nil {
+			t.Fatalf("expected a login link in the email, got %s", newest)
+		}
+		token, _ := url.QueryUnescape(string(match[1]))
+		return token
+	}
+	callback := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/login/magic/callback?token="+url.QueryEscape(token), nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	token := requestLink()
+
+	if rr := callback(token + "x"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a forged token but got %d", rr.Code)
+	}
+
+	rr := callback(token)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// выдаются те же cookie, что и при входе по паролю
+	cookies := map[string]bool{}
+	for _, cookie := range rr.Result().Cookies() {
+		cookies[cookie.Name] = cookie.Value != ""
+	}
+	if !cookies["access_token"] || !cookies["refresh_token"] {
+		t.Errorf("expected the token cookies, got %v", rr.Result().Cookies())
+	}
+
+	// ссылка одноразовая
+	if rr := callback(token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a used link but got %d", rr.Code)
+	}
+
+	// новая ссылка отменяет предыдущую
+	first := requestLink()
+	second := requestLink()
+	if rr := callback(first); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a replaced link but got %d", rr.Code)
+	}
+	if rr := callback(second); rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+
+	audit := strings.Join(logged, "\n")
+	if !strings.Contains(audit, "logged in with a login link") || !strings.Contains(audit, "was presented again") {
+		t.Errorf("expected the logins and the replay in the audit log, got %s", audit)
+	}
+
+	// количество писем ограничено
+	limited := 0
+	for i := 0; i < 5; i++ {
+		body, _ := json.Marshal(map[string]string{"email": "me@here.com"})
+		req, _ := http.NewRequest("POST", "/login/magic", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		if rr.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited == 0 {
+		t.Error("expected login link requests to be rate limited")
+	}
+}
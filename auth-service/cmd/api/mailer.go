@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is one plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails to users, e.g. password reset links
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{msg.To}, formatMessage(m.From, msg))
+}
+
+// OutboxMailer doesn't send anything, it writes every email as an .eml file into a directory.
+// It is meant for local development and tests.
+type OutboxMailer struct {
+	Dir  string
+	From string
+}
+
+func NewOutboxMailer(dir string) *OutboxMailer {
+	return &OutboxMailer{
+		Dir:  dir,
+		From: "no-reply@localhost",
+	}
+}
+
+func (m *OutboxMailer) Send(msg Message) error {
+	err := os.MkdirAll(m.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	suffix, err := randomToken(4)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405.000000"), suffix)
+	return os.WriteFile(filepath.Join(m.Dir, name), formatMessage(m.From, msg), 0o644)
+}
+
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
+
+// newMailer creates the mailer selected by MAIL_DRIVER, either smtp or outbox
+func newMailer() (Mailer, error) {
+	from := envOr("MAIL_FROM", "no-reply@localhost")
+
+	switch driver := envOr("MAIL_DRIVER", "outbox"); driver {
+	case "smtp":
+		return &SMTPMailer{
+			Host:     envOr("SMTP_HOST", "localhost"),
+			Port:     envOr("SMTP_PORT", "25"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	case "outbox":
+		return &OutboxMailer{
+			Dir:  envOr("MAIL_OUTBOX_DIR", "outbox"),
+			From: from,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", driver)
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"auth-service/data"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	_ "github.com/jackc/pgconn"
@@ -15,34 +19,179 @@ import (
 
 const webPort = "82"
 
+// logServiceURL is where the log service is reached
+const logServiceURL = "http://log-service:82"
+
 var counts int64
 
 type Config struct {
-	Repo   data.Repository
-	Client *http.Client
+	Repo        data.Repository
+	Tokens      data.RefreshTokenRepository
+	Revocations data.RevocationStore
+	Resets      data.PasswordResetRepository
+	Attempts    data.LoginAttemptStore
+	MFA         data.MFARepository
+	Sessions    data.SessionRepository
+	APIKeys     data.APIKeyRepository
+	Clients     data.OAuthClientRepository
+	Codes       data.AuthorizationCodeRepository
+	Consents    data.ConsentRepository
+	MagicLinks  data.MagicLinkRepository
+	Invitations data.InvitationRepository
+	Keys        *Keyring
+	Mailer      Mailer
+	Client      *http.Client
+
+	// ServiceTokens authenticates auth-service to the log service
+	ServiceTokens *ServiceTokenSource
+
+	// PasswordResetURL is the page password reset links point to, the token is added to it
+	PasswordResetURL string
+	// VerifyURL is where email verification links point to
+	VerifyURL string
+	// MagicLinkURL is where passwordless login links point to
+	MagicLinkURL string
+	// VerificationSecret signs the email verification tokens
+	VerificationSecret []byte
+	// Issuer is the public address of auth-service, which OpenID Connect clients see
+	Issuer string
+	// LoginURL is the login page users who aren't logged in are sent to by /authorize
+	LoginURL string
+	// ConsentURL is the page where users allow OpenID Connect clients to log them in
+	ConsentURL string
+	// MFAIssuer names the service in authenticator apps
+	MFAIssuer string
+	// BearerTokens lets clients send the access token in the Authorization header
+	// instead of the cookie
+	BearerTokens bool
+	// TokensInBody returns the access and refresh tokens in the login responses as well,
+	// for clients which can't use cookies
+	TokensInBody bool
+	// Lockout throttles and locks out repeated failed logins
+	Lockout LockoutPolicy
+	// PasswordPolicy decides which new passwords are accepted
+	PasswordPolicy PasswordPolicy
+	// Registration decides who may register
+	Registration RegistrationPolicy
+	// ClientIP resolves the address of the client behind trusted proxies
+	ClientIP ClientIPResolver
+	// IPBinding decides from which addresses tokens bound to an IP may be used
+	IPBinding IPBindingPolicy
+	// DeletionGracePeriod is how long deleted accounts can be restored before they are purged
+	DeletionGracePeriod time.Duration
+
+	resendEmailLimiter *rateLimiter
+	resendIPLimiter    *rateLimiter
+	magicLinkLimiter   *rateLimiter
+	resetEmailLimiter  *rateLimiter
+	resetIPLimiter     *rateLimiter
 }
 
 func main() {
 	log.Println("Starting authentication service")
 
-	// connect to DB
-	conn := connectToDB()
-	if conn == nil {
-		log.Panic("Can't connect to Postgres!")
+	// auth-service migrate up | down [steps] | status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		conn := connectToDB()
+		if conn == nil {
+			log.Panic("Can't connect to Postgres!")
+		}
+
+		err := migrateCommand(conn, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	// set up config
 	app := Config{
-		Client: &http.Client{},
+		Client:             &http.Client{},
+		PasswordResetURL:   envOr("PASSWORD_RESET_URL", "http://localhost:82/reset-password"),
+		VerifyURL:          envOr("VERIFY_URL", "http://localhost:8081/verify"),
+		MagicLinkURL:       envOr("MAGIC_LINK_URL", "http://localhost:8081/login/magic/callback"),
+		Issuer:             strings.TrimSuffix(envOr("OIDC_ISSUER", "http://localhost:8081"), "/"),
+		LoginURL:           envOr("OIDC_LOGIN_URL", "http://localhost:82/"),
+		ConsentURL:         envOr("OIDC_CONSENT_URL", "http://localhost:82/consent"),
+		MFAIssuer:          envOr("MFA_ISSUER", "test_task"),
+		BearerTokens:       envOr("AUTH_BEARER_TOKENS", "true") == "true",
+		TokensInBody:       envOr("AUTH_TOKENS_IN_BODY", "false") == "true",
+		resendEmailLimiter: newRateLimiter(3, time.Hour),
+		resendIPLimiter:    newRateLimiter(20, time.Hour),
+		magicLinkLimiter:   newRateLimiter(5, time.Hour),
+		resetEmailLimiter:  newRateLimiter(3, time.Hour),
+		resetIPLimiter:     newRateLimiter(20, time.Hour),
+	}
+	app.setupVerificationSecret()
+	app.setupStorage()
+	if envOr("SEED_DEMO_ADMIN", "false") == "true" {
+		err := app.seedDemoAdmin(context.Background())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	app.setupKeys()
+	app.setupOAuthClients()
+	app.ServiceTokens = NewServiceTokenSource(app.Keys, "auth-service", "logs:write", "logs:read", "logs:erase")
+
+	lockout, err := newLockoutPolicy()
+	if err != nil {
+		log.Panic(err)
+	}
+	app.Lockout = lockout
+
+	app.PasswordPolicy, err = newPasswordPolicy()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	app.Registration, err = newRegistrationPolicy()
+	if err != nil {
+		log.Panic(err)
 	}
-	app.setupRepo(conn)
+
+	app.ClientIP, err = newClientIPResolver()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	app.IPBinding, err = newIPBindingPolicy()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	app.DeletionGracePeriod, err = time.ParseDuration(envOr("ACCOUNT_DELETION_GRACE_PERIOD", "720h"))
+	if err != nil {
+		log.Panicf("ACCOUNT_DELETION_GRACE_PERIOD: %v", err)
+	}
+
+	mailer, err := newMailer()
+	if err != nil {
+		log.Panic(err)
+	}
+	app.Mailer = mailer
+
+	// auth-service users import | export | purge ...
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		err := app.usersCommand(os.Args[2:], os.Stdin, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	purgeInterval, err := time.ParseDuration(envOr("ACCOUNT_PURGE_INTERVAL", "1h"))
+	if err != nil {
+		log.Panicf("ACCOUNT_PURGE_INTERVAL: %v", err)
+	}
+	app.startPurge(purgeInterval)
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", webPort),
 		Handler: app.routes(),
 	}
 
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Panic(err)
 	}
@@ -63,7 +212,7 @@ func openDB(dsn string) (*sql.DB, error) {
 }
 
 func connectToDB() *sql.DB {
-	dsn := "host=postgres port=5432 dbname=test_task user=postgres password=password"
+	dsn := envOr("DSN", "host=postgres port=5432 dbname=test_task user=postgres password=password")
 
 	for {
 		connection, err := openDB(dsn)
@@ -86,7 +235,170 @@ func connectToDB() *sql.DB {
 	}
 }
 
+// setupStorage selects where the data is kept with DB_DRIVER: postgres (the default), sqlite
+// or memory. With sqlite only the users and roles are kept in the SQLITE_PATH file, sessions
+// and the other short lived data are kept in memory.
+func (app *Config) setupStorage() {
+	switch driver := envOr("DB_DRIVER", "postgres"); driver {
+	case "postgres":
+		conn := connectToDB()
+		if conn == nil {
+			log.Panic("Can't connect to Postgres!")
+		}
+
+		if envOr("MIGRATE_ON_START", "true") == "true" {
+			migrator, err := NewMigrator(conn)
+			if err != nil {
+				log.Panic(err)
+			}
+
+			applied, err := migrator.Up(context.Background())
+			if err != nil {
+				log.Panic(err)
+			}
+			log.Printf("Applied %d migrations", applied)
+		}
+
+		app.setupRepo(conn)
+	case "sqlite":
+		conn, err := data.OpenSQLite(envOr("SQLITE_PATH", "auth.db"))
+		if err != nil {
+			log.Panic(err)
+		}
+
+		repo, err := data.NewSQLiteRepository(conn)
+		if err != nil {
+			log.Panic(err)
+		}
+		app.Repo = repo
+		app.setupMemoryStores()
+		// users can't set these up again after a restart, unlike sessions or login attempts
+		app.MFA = data.NewPostgresMFARepository(conn)
+		app.APIKeys = data.NewPostgresAPIKeyRepository(conn)
+		app.Invitations = data.NewPostgresInvitationRepository(conn)
+	case "memory":
+		app.Repo = data.NewMemoryRepository()
+		app.setupMemoryStores()
+	default:
+		log.Panicf("unknown database driver %q", driver)
+	}
+}
+
 func (app *Config) setupRepo(conn *sql.DB) {
 	db := data.NewPostgresRepository(conn)
 	app.Repo = db
+	app.Tokens = data.NewPostgresRefreshTokenRepository(conn)
+	app.Revocations = data.NewPostgresRevocationStore(conn)
+	app.Resets = data.NewPostgresPasswordResetRepository(conn)
+	app.Attempts = data.NewPostgresLoginAttemptStore(conn)
+	app.MFA = data.NewPostgresMFARepository(conn)
+	app.Sessions = data.NewPostgresSessionRepository(conn)
+	app.APIKeys = data.NewPostgresAPIKeyRepository(conn)
+	app.Clients = data.NewPostgresOAuthClientRepository(conn)
+	app.Codes = data.NewPostgresAuthorizationCodeRepository(conn)
+	app.Consents = data.NewPostgresConsentRepository(conn)
+	app.MagicLinks = data.NewPostgresMagicLinkRepository(conn)
+	app.Invitations = data.NewPostgresInvitationRepository(conn)
+}
+
+// setupMemoryStores keeps everything but the users in memory
+func (app *Config) setupMemoryStores() {
+	app.Tokens = data.NewMemoryRefreshTokenRepository()
+	app.Revocations = data.NewMemoryRevocationStore()
+	app.Resets = data.NewMemoryPasswordResetRepository()
+	app.Attempts = data.NewMemoryLoginAttemptStore()
+	app.MFA = data.NewMemoryMFARepository()
+	app.Sessions = data.NewMemorySessionRepository()
+	app.APIKeys = data.NewMemoryAPIKeyRepository()
+	app.Clients = data.NewMemoryOAuthClientRepository()
+	app.Codes = data.NewMemoryAuthorizationCodeRepository()
+	app.Consents = data.NewMemoryConsentRepository()
+	app.MagicLinks = data.NewMemoryMagicLinkRepository()
+	app.Invitations = data.NewMemoryInvitationRepository()
+}
+
+// demoAdminEmail and demoAdminPassword are the demo admin account shown on the login page
+// of the front-end
+const (
+	demoAdminEmail    = "admin@example.com"
+	demoAdminPassword = "verysecret"
+)
+
+// seedDemoAdmin creates the active demo admin account unless it exists. The password is public,
+// so it is only done for local development with SEED_DEMO_ADMIN=true.
+func (app *Config) seedDemoAdmin(ctx context.Context) error {
+	_, err := app.Repo.GetByEmail(ctx, demoAdminEmail)
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	log.Printf("Creating the demo admin account %s, don't use SEED_DEMO_ADMIN in production", demoAdminEmail)
+	return app.Repo.WithTx(ctx, func(repo data.Repository) error {
+		id, err := repo.Insert(ctx, data.User{
+			Email:     demoAdminEmail,
+			FirstName: "Admin",
+			LastName:  "User",
+			Password:  demoAdminPassword,
+			Status:    data.StatusActive,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, role := range []string{defaultRole, "admin"} {
+			err = repo.GrantRole(ctx, id, role)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// setupKeys loads the signing keys from JWT_KEY_DIR when it is set, otherwise generates them
+// with JWT_ALGORITHM and rotates them every JWT_KEY_ROTATION. Keys from JWT_KEY_DIR are shared
+// by the replicas, so they are rotated by adding a key file and restarting, never in process:
+// a key generated by one replica would be unknown to the others.
+func (app *Config) setupKeys() {
+	if dir := os.Getenv("JWT_KEY_DIR"); dir != "" {
+		keys, err := LoadKeyring(dir)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		app.Keys = keys
+		return
+	}
+
+	keys, err := NewKeyring(envOr("JWT_ALGORITHM", "RS256"))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	rotation, err := time.ParseDuration(envOr("JWT_KEY_ROTATION", "24h"))
+	if err != nil {
+		log.Panic(err)
+	}
+	keys.StartRotation(rotation)
+
+	app.Keys = keys
+}
+
+// setupVerificationSecret takes the secret verification tokens are signed with from
+// VERIFICATION_SECRET. Without it a random secret is used, and links sent before a restart
+// stop working.
+func (app *Config) setupVerificationSecret() {
+	if secret := os.Getenv("VERIFICATION_SECRET"); secret != "" {
+		app.VerificationSecret = []byte(secret)
+		return
+	}
+
+	log.Println("VERIFICATION_SECRET is not set, using a random one")
+	secret, err := randomToken(32)
+	if err != nil {
+		log.Panic(err)
+	}
+	app.VerificationSecret = []byte(secret)
 }
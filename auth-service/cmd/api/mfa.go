@@ -0,0 +1,356 @@
+package main
+
+import (
+	"auth-service/data"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// mfaPendingTTL is how long a user has to enter the code after the password was accepted
+	mfaPendingTTL     = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// mfaEnrollment is returned when a user starts to set up two-factor authentication
+type mfaEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// mfaChallenge is returned by Authenticate instead of the tokens when the user has to
+// enter a code
+type mfaChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// EnrollMFA generates a new TOTP secret for the current user. It doesn't protect the account
+// until it is confirmed with ConfirmMFA.
+func (app *Config) EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Repo.GetOne(r.Context(), r.Context().Value(userIDKey).(int))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	mfa, err := app.MFA.GetMFA(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if mfa != nil && mfa.Enabled() {
+		app.errorJSON(w, errors.New("two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.MFA.SetMFASecret(r.Context(), user.ID, secret)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Add the secret to your authenticator app and confirm it with a code",
+		Data: mfaEnrollment{
+			Secret: secret,
+			URI:    totpURI(app.MFAIssuer, user.Email, secret),
+		},
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// ConfirmMFA enables two-factor authentication once the user proves the authenticator app
+// works. The recovery codes are returned only here, they are stored hashed.
+func (app *Config) ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(userIDKey).(int)
+	mfa, err := app.MFA.GetMFA(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("two-factor authentication has not been enrolled"), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if mfa.Enabled() {
+		app.errorJSON(w, errors.New("two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+
+	ok, err := app.checkTOTP(r.Context(), mfa, requestPayload.Code)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		app.errorJSON(w, errors.New("invalid code"), http.StatusBadRequest)
+		return
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i], err = generateRecoveryCode()
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	err = app.MFA.EnableMFA(r.Context(), userID, hashes)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("two-factor authentication of user %d has been enabled", userID))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two-factor authentication enabled, keep the recovery codes in a safe place",
+		Data:    codes,
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// DisableMFA turns two-factor authentication off for the current user, who has to confirm
+// the password
+func (app *Config) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), r.Context().Value(userIDKey).(int))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	valid, err := app.Repo.PasswordMatches(r.Context(), requestPayload.Password, *user)
+	if err != nil || !valid {
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.MFA.DisableMFA(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("two-factor authentication of user %d has been disabled", user.ID))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two-factor authentication disabled",
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// AuthenticateMFA finishes a login started by Authenticate. It exchanges the mfa_pending token
+// and a code from the authenticator app, or one of the recovery codes, for the real tokens.
+func (app *Config) AuthenticateMFA(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	ip := app.ClientIP.ClientIP(r)
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(requestPayload.MFAToken, &claims, app.Keys.Keyfunc)
+	if err != nil || !token.Valid || claims["typ"] != "mfa_pending" {
+		app.errorJSON(w, errors.New("invalid or expired mfa token"), http.StatusUnauthorized)
+		return
+	}
+
+	userID, _ := claims["sub"].(float64)
+	jti, _ := claims["jti"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+	expiresAt, _ := claims["exp"].(float64)
+
+	revoked, err := app.Revocations.IsRevoked(r.Context(), jti, int(userID), time.Unix(int64(issuedAt), 0))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		app.errorJSON(w, errors.New("invalid or expired mfa token"), http.StatusUnauthorized)
+		return
+	}
+
+	if boundIP, _ := claims["ip"].(string); !app.IPBinding.Allows(boundIP, ip) {
+		app.logIPMismatch("mfa token", int(userID), boundIP, ip)
+		app.errorJSON(w, errors.New("IP address mismatch"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), int(userID))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusUnauthorized)
+		return
+	}
+	// the account may have been suspended or deleted since the password was checked
+	if status, err := accountStatusError(user); err != nil {
+		app.errorJSON(w, err, status)
+		return
+	}
+
+	if !app.checkLoginAllowed(r.Context(), w, user.Email, ip) {
+		return
+	}
+
+	mfa, err := app.MFA.GetMFA(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, errors.New("two-factor authentication is not enabled"), http.StatusBadRequest)
+		return
+	}
+
+	var ok bool
+	if requestPayload.RecoveryCode != "" {
+		ok, err = app.MFA.ConsumeRecoveryCode(r.Context(), user.ID, hashRecoveryCode(requestPayload.RecoveryCode))
+	} else {
+		ok, err = app.checkTOTP(r.Context(), mfa, requestPayload.Code)
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		app.recordLoginFailure(r.Context(), user.Email, ip)
+		app.errorJSON(w, errors.New("invalid code"), http.StatusBadRequest)
+		return
+	}
+
+	// the mfa token can only be exchanged once
+	err = app.Revocations.RevokeToken(r.Context(), jti, time.Unix(int64(expiresAt), 0))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Attempts.Reset(r.Context(), accountLockoutKey(user.Email))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	sessionID, err := app.startSession(r, user.ID, ip)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	userData, err := app.issueTokens(r.Context(), w, user.ID, ip, sessionID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	event := fmt.Sprintf("%s logged in with two-factor authentication", user.Email)
+	if requestPayload.RecoveryCode != "" {
+		event = fmt.Sprintf("%s logged in with a recovery code", user.Email)
+	}
+	err = app.logRequest("authentication", event)
+	if err != nil {
+		log.Println("Error logging of user has been authenticated:", err)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Logged in user %s", user.Email),
+		Data:    app.loginData(user, userData),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// checkTOTP validates a code from the authenticator app. Every code is accepted only once.
+func (app *Config) checkTOTP(ctx context.Context, mfa *data.MFA, code string) (bool, error) {
+	step, ok := validateTOTP(mfa.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return app.MFA.UseTOTPStep(ctx, mfa.UserID, step)
+}
+
+// generateMFAPendingToken creates the short lived token which proves the password of the user
+// has been accepted. It can't be used as an access token.
+func generateMFAPendingToken(keys *Keyring, userID int, ip string) (string, error) {
+	issuedAt := time.Now()
+
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &jwt.MapClaims{
+		"sub": userID,
+		"exp": issuedAt.Add(mfaPendingTTL).Unix(),
+		"iat": issuedAt.Unix(),
+		"jti": jti,
+		"ip":  ip,
+		"typ": "mfa_pending",
+	}
+
+	return keys.Sign(claims)
+}
+
+// generateRecoveryCode returns a code like 4f7q2-kx3ma which is easy to type
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// hashRecoveryCode hashes a recovery code the way the user may type it, in any case and
+// with or without the dash
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return hashToken(code)
+}
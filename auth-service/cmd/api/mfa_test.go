@@ -0,0 +1,174 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_TOTPCode(t *testing.T) {
+	// тестовые векторы из RFC 6238 (SHA1), последние шесть цифр
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, e := range tests {
+		code, err := totpCode(secret, totpStep(time.Unix(e.unix, 0)))
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if code != e.expected {
+			t.Errorf("%d: expected %s but got %s", e.unix, e.expected, code)
+		}
+	}
+
+	if _, ok := validateTOTP(secret, "287082", time.Unix(59+30, 0)); !ok {
+		t.Error("expected the code of the previous step to be accepted")
+	}
+	if _, ok := validateTOTP(secret, "287082", time.Unix(59+90, 0)); ok {
+		t.Error("expected an old code to be rejected")
+	}
+}
+
+func Test_MFA(t *testing.T) {
+	// отдельные хранилища, чтобы двухфакторная аутентификация не мешала остальным тестам
+	mfaRepo, attempts := testApp.MFA, testApp.Attempts
+	testApp.MFA = data.NewPostgresTestMFARepository(nil)
+	testApp.Attempts = data.NewMemoryLoginAttemptStore()
+	defer func() { testApp.MFA, testApp.Attempts = mfaRepo, attempts }()
+
+	post := func(path string, body any) *httptest.ResponseRecorder {
+		out, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewReader(out))
+		req.RemoteAddr = "10.0.1.1:12345"
+		rr := httptest.NewRecorder()
+		testApp.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	var response struct {
+		Error   bool            `json:"error"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+
+	// подключение: секрет и otpauth URI
+	rr := serveAuthenticated(t, "POST", "/me/mfa", nil, 1)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	var enrollment mfaEnrollment
+	_ = json.Unmarshal(rr.Body.Bytes(), &response)
+	_ = json.Unmarshal(response.Data, &enrollment)
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/test_task:me@here.com?") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Errorf("unexpected otpauth URI %s", enrollment.URI)
+	}
+
+	// до подтверждения вход работает без кода
+	rr = post("/authenticate", map[string]string{"email": "me@here.com", "password": "verysecret"})
+	if len(rr.Result().Cookies()) == 0 {
+		t.Fatal("expected tokens before mfa is confirmed")
+	}
+
+	if rr := serveAuthenticated(t, "POST", "/me/mfa/confirm", map[string]string{"code": "000000"}, 1); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for wrong code but got %d", rr.Code)
+	}
+
+	step := totpStep(time.Now())
+	code, _ := totpCode(enrollment.Secret, step)
+	rr = serveAuthenticated(t, "POST", "/me/mfa/confirm", map[string]string{"code": code}, 1)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	var recoveryCodes []string
+	_ = json.Unmarshal(rr.Body.Bytes(), &response)
+	_ = json.Unmarshal(response.Data, &recoveryCodes)
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(recoveryCodes))
+	}
+
+	if rr := serveAuthenticated(t, "POST", "/me/mfa", nil, 1); rr.Code != http.StatusConflict {
+		t.Errorf("expected http.StatusConflict for second enrollment but got %d", rr.Code)
+	}
+
+	login := func() string {
+		rr := post("/authenticate", map[string]string{"email": "me@here.com", "password": "verysecret"})
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+		}
+		if len(rr.Result().Cookies()) != 0 {
+			t.Fatal("expected no tokens before the code is entered")
+		}
+
+		var challenge mfaChallenge
+		_ = json.Unmarshal(rr.Body.Bytes(), &response)
+		_ = json.Unmarshal(response.Data, &challenge)
+		if !challenge.MFARequired || challenge.MFAToken == "" {
+			t.Fatalf("expected an mfa challenge, got %s", rr.Body.String())
+		}
+		return challenge.MFAToken
+	}
+
+	mfaToken := login()
+
+	// mfa_pending токен не является access-токеном
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: mfaToken})
+	rr = httptest.NewRecorder()
+	testApp.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for mfa token but got %d", rr.Code)
+	}
+
+	// код, уже использованный при подтверждении, повторно не принимается
+	if rr := post("/authenticate/mfa", map[string]string{"mfa_token": mfaToken, "code": code}); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for reused code but got %d", rr.Code)
+	}
+
+	next, _ := totpCode(enrollment.Secret, step+1)
+	rr = post("/authenticate/mfa", map[string]string{"mfa_token": mfaToken, "code": next})
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(rr.Result().Cookies()) == 0 {
+		t.Error("expected the token cookies to be set")
+	}
+
+	if rr := post("/authenticate/mfa", map[string]string{"mfa_token": mfaToken, "code": next}); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for reused mfa token but got %d", rr.Code)
+	}
+
+	// вход по коду восстановления, каждый код одноразовый
+	recovery := strings.ToUpper(strings.ReplaceAll(recoveryCodes[0], "-", ""))
+	if rr := post("/authenticate/mfa", map[string]string{"mfa_token": login(), "recovery_code": recovery}); rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted for recovery code but got %d", rr.Code)
+	}
+	if rr := post("/authenticate/mfa", map[string]string{"mfa_token": login(), "recovery_code": recoveryCodes[0]}); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for used recovery code but got %d", rr.Code)
+	}
+
+	// отключение требует пароль
+	if rr := serveAuthenticated(t, "DELETE", "/me/mfa", map[string]string{"password": data.WrongTestPassword}, 1); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for wrong password but got %d", rr.Code)
+	}
+	if rr := serveAuthenticated(t, "DELETE", "/me/mfa", map[string]string{"password": "verysecret"}, 1); rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	rr = post("/authenticate", map[string]string{"email": "me@here.com", "password": "verysecret"})
+	if len(rr.Result().Cookies()) == 0 {
+		t.Error("expected tokens after mfa is disabled")
+	}
+}
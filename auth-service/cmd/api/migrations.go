@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+//go:embed db/migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the key of the Postgres advisory lock held while migrating, so replicas
+// starting at the same time don't apply the same migration twice
+const migrationLockID = 4_210_931_482
+
+// migrationName matches files like 000001_create_users_table.up.sql
+var migrationName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// migration is one version of the schema, with the SQL to apply and to revert it
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads the migrations from the directory, ordered by version. Every migration
+// needs both an up and a down file.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*migration)
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		body, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrator applies the migrations to the database. It keeps the current version in the
+// schema_migrations table in the same format as the migrate CLI, so databases migrated
+// with it before keep working.
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []migration
+}
+
+// NewMigrator returns a migrator for the migrations embedded into the binary
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "db/migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		DB:         db,
+		Migrations: migrations,
+	}, nil
+}
+
+// Up applies all the pending migrations and returns how many were applied
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	applied := 0
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.Migrations {
+			if mig.Version <= current {
+				continue
+			}
+
+			err = applyMigration(ctx, conn, mig.Up, mig.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			applied++
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the given number of the most recently applied migrations and returns how many
+// were reverted
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	reverted := 0
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.Migrations) - 1; i >= 0 && reverted < steps; i-- {
+			mig := m.Migrations[i]
+			if mig.Version > current {
+				continue
+			}
+
+			var previous int64
+			if i > 0 {
+				previous = m.Migrations[i-1].Version
+			}
+
+			err = applyMigration(ctx, conn, mig.Down, previous)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			reverted++
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Version returns the version the database has been migrated to, 0 if none
+func (m *Migrator) Version(ctx context.Context) (int64, error) {
+	var version int64
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		var err error
+		version, err = currentVersion(ctx, conn)
+		return err
+	})
+
+	return version, err
+}
+
+// withLock runs fn on a single connection holding the migration advisory lock. The lock
+// belongs to the session, which is why all the statements have to use this connection.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, migrationLockID)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `create table if not exists schema_migrations
+		(version bigint not null primary key, dirty boolean not null)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// currentVersion reads the version from schema_migrations. A dirty version was left behind by
+// a migration which failed halfway and has to be fixed by hand.
+func currentVersion(ctx context.Context, conn *sql.Conn) (int64, error) {
+	var version int64
+	var dirty bool
+
+	err := conn.QueryRowContext(ctx, `select version, dirty from schema_migrations limit 1`).Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if dirty {
+		return 0, fmt.Errorf("database is dirty at version %d, fix it and update schema_migrations by hand", version)
+	}
+
+	return version, nil
+}
+
+// applyMigration runs the SQL and records the new version in one transaction, so a failed
+// migration leaves nothing behind
+func applyMigration(ctx context.Context, conn *sql.Conn, body string, version int64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, body)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version > 0 {
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, dirty) values ($1, false)`, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateCommand runs the migrate subcommand: up, down [steps] or status
+func migrateCommand(conn *sql.DB, args []string) error {
+	migrator, err := NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if len(args) == 0 {
+		return errors.New("usage: migrate up | down [steps] | status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reverted %d migrations\n", reverted)
+	case "status":
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range migrator.Migrations {
+			state := "pending"
+			if mig.Version <= version {
+				state = "applied"
+			}
+			fmt.Printf("%06d_%s\t%s\n", mig.Version, mig.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+
+	return nil
+}
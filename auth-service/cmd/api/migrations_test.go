@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func Test_EmbeddedMigrations(t *testing.T) {
+	migrator, err := NewMigrator(nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// версии идут подряд, начиная с таблицы пользователей
+	for i, mig := range migrator.Migrations {
+		if mig.Version != int64(i+1) {
+			t.Errorf("expected version %d, got %d_%s", i+1, mig.Version, mig.Name)
+		}
+	}
+	if migrator.Migrations[0].Name != "create_users_table" || !strings.Contains(migrator.Migrations[0].Up, "create table if not exists users") {
+		t.Errorf("expected the first migration to create the users table, got %s", migrator.Migrations[0].Name)
+	}
+}
+
+func Test_LoadMigrations(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       fstest.MapFS
+		expectError bool
+		expected    []int64
+	}{
+		{"sorted", fstest.MapFS{
+			"m/000010_b.up.sql":   {Data: []byte("b")},
+			"m/000010_b.down.sql": {Data: []byte("b")},
+			"m/000002_a.up.sql":   {Data: []byte("a")},
+			"m/000002_a.down.sql": {Data: []byte("a")},
+			"m/README.md":         {Data: []byte("ignored")},
+		}, false, []int64{2, 10}},
+		{"missing down", fstest.MapFS{
+			"m/000001_a.up.sql": {Data: []byte("a")},
+		}, true, nil},
+		{"two names", fstest.MapFS{
+			"m/000001_a.up.sql":   {Data: []byte("a")},
+			"m/000001_b.down.sql": {Data: []byte("b")},
+		}, true, nil},
+	}
+
+	for _, e := range tests {
+		migrations, err := loadMigrations(e.files, "m")
+		if e.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", e.name, err)
+		}
+
+		if len(migrations) != len(e.expected) {
+			t.Fatalf("%s: expected %d migrations, got %d", e.name, len(e.expected), len(migrations))
+		}
+		for i, version := range e.expected {
+			if migrations[i].Version != version {
+				t.Errorf("%s: expected version %d at %d, got %d", e.name, version, i, migrations[i].Version)
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"auth-service/data"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// serviceTokenTTL is how long the tokens of the client_credentials grant are valid
+const serviceTokenTTL = time.Hour
+
+// serviceTokenType marks the tokens issued to services, so they are never taken for the access
+// token of a user
+const serviceTokenType = "service"
+
+// oauthClientConfig is one client in OAUTH_CLIENTS
+type oauthClientConfig struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Name         string   `json:"name"`
+	Scopes       []string `json:"scopes"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// setupOAuthClients registers the clients listed in OAUTH_CLIENTS, a JSON array like
+// [{"client_id": "broker-service", "client_secret": "...", "scopes": ["logs:write"]}].
+// Applications logging users in with OpenID Connect list their redirect_uris instead of
+// scopes, and may leave out the secret to be public clients.
+func (app *Config) setupOAuthClients() {
+	value := os.Getenv("OAUTH_CLIENTS")
+	if value == "" {
+		return
+	}
+
+	var clients []oauthClientConfig
+	err := json.Unmarshal([]byte(value), &clients)
+	if err != nil {
+		log.Panicf("OAUTH_CLIENTS: %v", err)
+	}
+
+	for _, client := range clients {
+		if client.ClientID == "" || (client.ClientSecret == "" && len(client.RedirectURIs) == 0) {
+			log.Panic("OAUTH_CLIENTS: every client needs a client_id, and a client_secret or redirect_uris")
+		}
+		for _, redirectURI := range client.RedirectURIs {
+			if u, err := url.Parse(redirectURI); err != nil || !u.IsAbs() || u.Fragment != "" {
+				log.Panicf("OAUTH_CLIENTS: %s is not a valid redirect uri", redirectURI)
+			}
+		}
+
+		var secretHash string
+		if client.ClientSecret != "" {
+			secretHash = hashToken(client.ClientSecret)
+		}
+
+		err = app.Clients.UpsertOAuthClient(context.Background(), data.OAuthClient{
+			ID:           client.ClientID,
+			Name:         client.Name,
+			SecretHash:   secretHash,
+			Scopes:       client.Scopes,
+			RedirectURIs: client.RedirectURIs,
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+// oauthError writes an error response in the format of RFC 6749, section 5.2
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// OAuthToken is the OAuth2 token endpoint. It supports the client_credentials grant for
+// services and the authorization_code grant of OpenID Connect. Clients authenticate through
+// HTTP Basic or the client_id and client_secret parameters; public clients only send their
+// client_id.
+func (app *Config) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	err := r.ParseForm()
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "the body must be form encoded")
+		return
+	}
+
+	client, ok := app.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case "client_credentials":
+		app.clientCredentialsGrant(w, r, client)
+	case "authorization_code":
+		app.authorizationCodeGrant(w, r, client)
+	default:
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("grant type %q is not supported", grantType))
+	}
+}
+
+// clientCredentialsGrant issues a service token to the client itself
+func (app *Config) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, client *data.OAuthClient) {
+	// anyone can claim to be a public client
+	if client.Public() {
+		oauthError(w, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client_credentials grant")
+		return
+	}
+
+	// without a scope parameter the client gets all of its scopes
+	scopes := client.Scopes
+	if requested := strings.Fields(r.PostForm.Get("scope")); len(requested) > 0 {
+		for _, scope := range requested {
+			if !client.HasScope(scope) {
+				oauthError(w, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("scope %s is not allowed for the client", scope))
+				return
+			}
+		}
+		scopes = requested
+	}
+
+	token, err := generateServiceToken(app.Keys, client.ID, scopes, serviceTokenTTL)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	writeTokenResponse(w, map[string]any{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(serviceTokenTTL.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	})
+}
+
+// writeTokenResponse writes a successful response of the token endpoint, which must never be
+// cached
+func writeTokenResponse(w http.ResponseWriter, response map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// authenticateClient checks the credentials of the client making a token request. When it
+// reports false, the error response has already been written.
+func (app *Config) authenticateClient(w http.ResponseWriter, r *http.Request) (*data.OAuthClient, bool) {
+	clientID, clientSecret, basic := r.BasicAuth()
+	if basic {
+		if r.PostForm.Get("client_secret") != "" {
+			oauthError(w, http.StatusBadRequest, "invalid_request", "only one client authentication method may be used")
+			return nil, false
+		}
+
+		// the credentials are form encoded before they are put into the header
+		var err1, err2 error
+		clientID, err1 = url.QueryUnescape(clientID)
+		clientSecret, err2 = url.QueryUnescape(clientSecret)
+		if err1 != nil || err2 != nil {
+			oauthError(w, http.StatusBadRequest, "invalid_request", "malformed client credentials")
+			return nil, false
+		}
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	if clientID == "" {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication is required")
+		return nil, false
+	}
+
+	client, err := app.Clients.GetOAuthClient(r.Context(), clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	} else if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return nil, false
+	}
+
+	// public clients have no secret, PKCE protects their codes instead
+	if client.Public() {
+		if clientSecret != "" {
+			oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+			return nil, false
+		}
+		return client, true
+	}
+
+	if clientSecret == "" {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication is required")
+		return nil, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(clientSecret)), []byte(client.SecretHash)) != 1 {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	}
+
+	return client, true
+}
+
+// generateServiceToken signs a token for a service. Its subject is the client id, and the
+// typ claim keeps it from being accepted where the access token of a user is expected.
+func generateServiceToken(keys *Keyring, clientID string, scopes []string, ttl time.Duration) (string, error) {
+	issuedAt := time.Now()
+
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &jwt.MapClaims{
+		"sub":       clientID,
+		"client_id": clientID,
+		"exp":       issuedAt.Add(ttl).Unix(),
+		"iat":       issuedAt.Unix(),
+		"jti":       jti,
+		"typ":       serviceTokenType,
+		"scope":     strings.Join(scopes, " "),
+	}
+
+	return keys.Sign(claims)
+}
+
+// ServiceTokenSource gives auth-service its own service token for calls to other services.
+// It signs the token itself instead of asking its own token endpoint, and reuses it until
+// shortly before it expires.
+type ServiceTokenSource struct {
+	Keys     *Keyring
+	ClientID string
+	Scopes   []string
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func NewServiceTokenSource(keys *Keyring, clientID string, scopes ...string) *ServiceTokenSource {
+	return &ServiceTokenSource{
+		Keys:     keys,
+		ClientID: clientID,
+		Scopes:   scopes,
+	}
+}
+
+// Token returns a valid service token
+func (s *ServiceTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a minute of leeway, so the token doesn't expire on its way
+	if s.token != "" && time.Until(s.expiresAt) > time.Minute {
+		return s.token, nil
+	}
+
+	token, err := generateServiceToken(s.Keys, s.ClientID, s.Scopes, serviceTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.expiresAt = time.Now().Add(serviceTokenTTL)
+
+	return token, nil
+}
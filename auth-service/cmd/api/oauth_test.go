@@ -0,0 +1,167 @@
+package main
+
+import (
+	"auth-service/data"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Test_OAuthToken проверяет выдачу сервисных токенов по client_credentials.
+func Test_OAuthToken(t *testing.T) {
+	err := testApp.Clients.UpsertOAuthClient(context.Background(), data.OAuthClient{
+		ID:         "broker-service",
+		SecretHash: hashToken("broker-secret"),
+		Scopes:     []string{"logs:write", "logs:read"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	request := func(form url.Values, basicID, basicSecret string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if basicID != "" {
+			req.SetBasicAuth(basicID, basicSecret)
+		}
+		rr := httptest.NewRecorder()
+		testApp.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name          string
+		form          url.Values
+		basicID       string
+		basicSecret   string
+		expected      int
+		expectedError string
+		expectedScope string
+	}{
+		{"basic auth", url.Values{"grant_type": {"client_credentials"}}, "broker-service", "broker-secret", http.StatusOK, "", "logs:write logs:read"},
+		{"form credentials", url.Values{"grant_type": {"client_credentials"}, "client_id": {"broker-service"}, "client_secret": {"broker-secret"}, "scope": {"logs:write"}}, "", "", http.StatusOK, "", "logs:write"},
+		{"wrong secret", url.Values{"grant_type": {"client_credentials"}}, "broker-service", "wrong", http.StatusUnauthorized, "invalid_client", ""},
+		{"unknown client", url.Values{"grant_type": {"client_credentials"}}, "nobody", "broker-secret", http.StatusUnauthorized, "invalid_client", ""},
+		{"no credentials", url.Values{"grant_type": {"client_credentials"}}, "", "", http.StatusUnauthorized, "invalid_client", ""},
+		{"two methods", url.Values{"grant_type": {"client_credentials"}, "client_secret": {"broker-secret"}}, "broker-service", "broker-secret", http.StatusBadRequest, "invalid_request", ""},
+		{"other grant", url.Values{"grant_type": {"password"}}, "broker-service", "broker-secret", http.StatusBadRequest, "unsupported_grant_type", ""},
+		{"scope not allowed", url.Values{"grant_type": {"client_credentials"}, "scope": {"users:write"}}, "broker-service", "broker-secret", http.StatusBadRequest, "invalid_scope", ""},
+	}
+
+	for _, e := range tests {
+		rr := request(e.form, e.basicID, e.basicSecret)
+		if rr.Code != e.expected {
+			t.Errorf("%s: expected %d but got %d: %s", e.name, e.expected, rr.Code, rr.Body.String())
+			continue
+		}
+		if rr.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: expected the response not to be cached", e.name)
+		}
+
+		var response struct {
+			AccessToken string `json:"access_token"`
+			TokenType   string `json:"token_type"`
+			Scope       string `json:"scope"`
+			Error       string `json:"error"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &response)
+
+		if response.Error != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, response.Error)
+		}
+		if e.expected != http.StatusOK {
+			continue
+		}
+
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(response.AccessToken, claims, testApp.Keys.Keyfunc)
+		if err != nil || !token.Valid {
+			t.Fatalf("%s: expected a valid token, got %v", e.name, err)
+		}
+		if claims["sub"] != "broker-service" || claims["typ"] != serviceTokenType || claims["scope"] != e.expectedScope || response.Scope != e.expectedScope {
+			t.Errorf("%s: unexpected claims %v", e.name, claims)
+		}
+
+		// сервисный токен не подходит вместо токена пользователя
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("Authorization", "Bearer "+response.AccessToken)
+		me := httptest.NewRecorder()
+		testApp.routes().ServeHTTP(me, req)
+		if me.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected http.StatusUnauthorized for a service token on /me but got %d", e.name, me.Code)
+		}
+	}
+}
+
+// Test_ServiceTokenSource проверяет, что auth-service переиспользует свой сервисный токен.
+func Test_ServiceTokenSource(t *testing.T) {
+	source := NewServiceTokenSource(testApp.Keys, "auth-service", "logs:write")
+
+	first, err := source.Token()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	second, _ := source.Token()
+	if first != second {
+		t.Error("expected the token to be reused")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(first, claims, testApp.Keys.Keyfunc)
+	if err != nil || claims["client_id"] != "auth-service" || claims["scope"] != "logs:write" {
+		t.Errorf("unexpected token %v: %v", claims, err)
+	}
+
+	// токен, которому осталось меньше минуты, выпускается заново
+	source.expiresAt = source.expiresAt.Add(-serviceTokenTTL)
+	if third, _ := source.Token(); third == first {
+		t.Error("expected a new token shortly before the old one expires")
+	}
+}
+
+// Test_LogRequest_ServiceToken проверяет, что запросы в log-service подписаны сервисным токеном.
+func Test_LogRequest_ServiceToken(t *testing.T) {
+	client := testApp.Client
+	defer func() { testApp.Client = client }()
+
+	var authorization string
+	testApp.Client = NewTestClient(func(req *http.Request) *http.Response {
+		authorization = req.Header.Get("Authorization")
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       http.NoBody,
+			Header:     make(http.Header),
+		}
+	})
+	testApp.ServiceTokens = NewServiceTokenSource(testApp.Keys, "auth-service", "logs:write")
+	defer func() { testApp.ServiceTokens = nil }()
+
+	err := testApp.logRequest("test", "data")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	token, _ := testApp.ServiceTokens.Token()
+	if authorization != "Bearer "+token {
+		t.Errorf("expected the service token to be sent, got %q", authorization)
+	}
+
+	// отклонённая запись не теряется молча
+	testApp.Client = NewTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Body:       http.NoBody,
+			Header:     make(http.Header),
+		}
+	})
+	if err := testApp.logRequest("test", "data"); err == nil {
+		t.Error("expected an error when the log service rejects the entry")
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"auth-service/data"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// authorizationCodeTTL is how long a client has to exchange an authorization code
+	authorizationCodeTTL = time.Minute
+	// consentRequestTTL is how long a user has to answer the consent screen
+	consentRequestTTL = 10 * time.Minute
+
+	oidcAccessTokenType     = "oidc_access"
+	consentRequestType      = "oidc_consent"
+	minCodeVerifierLength   = 43
+	maxCodeVerifierLength   = 128
+	codeChallengeMethodS256 = "S256"
+)
+
+// oidcScopes are the scopes clients can ask for at the authorization endpoint. Other scopes
+// are ignored, as OpenID Connect asks for.
+var oidcScopes = []string{"openid", "profile", "email"}
+
+// authorizeRequest is an authorization request which has been checked to come from a
+// registered client and to send the user back to one of its redirect uris
+type authorizeRequest struct {
+	ClientID      string
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	Nonce         string
+	CodeChallenge string
+}
+
+// OpenIDConfiguration is the discovery document of the OpenID Connect provider
+func (app *Config) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	app.writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                app.Issuer,
+		"authorization_endpoint":                app.Issuer + "/authorize",
+		"token_endpoint":                        app.Issuer + "/token",
+		"userinfo_endpoint":                     app.Issuer + "/userinfo",
+		"jwks_uri":                              app.Issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "client_credentials"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{app.Keys.Algorithm()},
+		"scopes_supported":                      oidcScopes,
+		"claims_supported":                      []string{"sub", "email", "email_verified", "name", "given_name", "family_name", "updated_at"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{codeChallengeMethodS256},
+	})
+}
+
+// Authorize is the authorization endpoint of the code flow. Users who aren't logged in are sent
+// to the login page first, and users who haven't allowed the client the scopes yet to the
+// consent screen of the front end. Otherwise they are sent back to the client with a code.
+func (app *Config) Authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// until the client and the redirect uri are known to be right, errors are shown to the
+	// user instead of being sent to a redirect uri nobody has registered
+	client, err := app.Clients.GetOAuthClient(r.Context(), query.Get("client_id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("unknown client"), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	request := authorizeRequest{
+		ClientID:      client.ID,
+		RedirectURI:   query.Get("redirect_uri"),
+		Scopes:        requestedOIDCScopes(query.Get("scope")),
+		State:         query.Get("state"),
+		Nonce:         query.Get("nonce"),
+		CodeChallenge: query.Get("code_challenge"),
+	}
+	if !client.HasRedirectURI(request.RedirectURI) {
+		app.errorJSON(w, errors.New("redirect_uri is not registered for the client"), http.StatusBadRequest)
+		return
+	}
+
+	redirectError := func(code, description string) {
+		http.Redirect(w, r, request.redirectURL(url.Values{
+			"error":             {code},
+			"error_description": {description},
+		}), http.StatusFound)
+	}
+
+	if query.Get("response_type") != "code" {
+		redirectError("unsupported_response_type", "only the code response type is supported")
+		return
+	}
+	if !containsScope(request.Scopes, "openid") {
+		redirectError("invalid_scope", "the openid scope is required")
+		return
+	}
+	if request.CodeChallenge == "" || query.Get("code_challenge_method") != codeChallengeMethodS256 {
+		redirectError("invalid_request", "PKCE with the S256 code challenge method is required")
+		return
+	}
+
+	prompt := query.Get("prompt")
+
+	claims, status, err := app.verifyAccessToken(r)
+	if status == http.StatusInternalServerError {
+		app.errorJSON(w, err, status)
+		return
+	}
+	if err != nil {
+		if prompt == "none" {
+			redirectError("login_required", "the user is not logged in")
+			return
+		}
+
+		// the login page sends the user back here once they are logged in
+		http.Redirect(w, r, withQuery(app.LoginURL, url.Values{"next": {app.Issuer + r.URL.RequestURI()}}), http.StatusFound)
+		return
+	}
+	userID := int(claims["sub"].(float64))
+
+	consent, err := app.Consents.GetConsent(r.Context(), userID, client.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if consent != nil && consent.Covers(request.Scopes) && prompt != "consent" {
+		redirectURL, err := app.issueAuthorizationCode(r, request, userID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+		return
+	}
+
+	if prompt == "none" {
+		redirectError("consent_required", "the user has not allowed the client yet")
+		return
+	}
+
+	consentRequest, err := generateConsentRequestToken(app.Keys, userID, request)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	name := client.Name
+	if name == "" {
+		name = client.ID
+	}
+
+	http.Redirect(w, r, withQuery(app.ConsentURL, url.Values{
+		"consent_request": {consentRequest},
+		"client":          {name},
+		"scope":           {strings.Join(request.Scopes, " ")},
+	}), http.StatusFound)
+}
+
+// AuthorizeConsent records the answer of the user on the consent screen. It returns the
+// address the front end sends the user to: back to the client with a code, or with an
+// access_denied error.
+func (app *Config) AuthorizeConsent(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ConsentRequest string `json:"consent_request"`
+		Approve        bool   `json:"approve"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(requestPayload.ConsentRequest, &claims, app.Keys.Keyfunc)
+	if err != nil || !token.Valid || claims["typ"] != consentRequestType {
+		app.errorJSON(w, errors.New("invalid or expired consent request"), http.StatusBadRequest)
+		return
+	}
+
+	// the consent request was made for the user who got to see the consent screen
+	userID := r.Context().Value(userIDKey).(int)
+	if subject, _ := claims["sub"].(float64); int(subject) != userID {
+		app.errorJSON(w, errors.New("the consent request was made for another user"), http.StatusForbidden)
+		return
+	}
+
+	request := authorizeRequest{}
+	request.ClientID, _ = claims["client_id"].(string)
+	request.RedirectURI, _ = claims["redirect_uri"].(string)
+	request.State, _ = claims["state"].(string)
+	request.Nonce, _ = claims["nonce"].(string)
+	request.CodeChallenge, _ = claims["code_challenge"].(string)
+	scope, _ := claims["scope"].(string)
+	request.Scopes = strings.Fields(scope)
+
+	// the client may have been changed since the request was made
+	client, err := app.Clients.GetOAuthClient(r.Context(), request.ClientID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !client.HasRedirectURI(request.RedirectURI)) {
+		app.errorJSON(w, errors.New("the client is no longer registered"), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	redirectURL := request.redirectURL(url.Values{
+		"error":             {"access_denied"},
+		"error_description": {"the user has not allowed the client"},
+	})
+
+	if requestPayload.Approve {
+		scopes := request.Scopes
+		consent, err := app.Consents.GetConsent(r.Context(), userID, client.ID)
+		if err == nil {
+			scopes = mergeScopes(consent.Scopes, scopes)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		err = app.Consents.SaveConsent(r.Context(), data.Consent{UserID: userID, ClientID: client.ID, Scopes: scopes})
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		redirectURL, err = app.issueAuthorizationCode(r, request, userID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		app.logUserEvent(r, fmt.Sprintf("client %s has been allowed %s", client.ID, strings.Join(scopes, " ")))
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Consent for client %s recorded", client.ID),
+		Data:    map[string]string{"redirect_to": redirectURL},
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// issueAuthorizationCode stores a new code for the request and returns the address that
+// sends it to the client
+func (app *Config) issueAuthorizationCode(r *http.Request, request authorizeRequest, userID int) (string, error) {
+	code, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.Codes.InsertAuthorizationCode(r.Context(), data.AuthorizationCode{
+		CodeHash:      hashToken(code),
+		ClientID:      request.ClientID,
+		UserID:        userID,
+		RedirectURI:   request.RedirectURI,
+		Scopes:        request.Scopes,
+		Nonce:         request.Nonce,
+		CodeChallenge: request.CodeChallenge,
+		ExpiresAt:     time.Now().Add(authorizationCodeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return request.redirectURL(url.Values{"code": {code}}), nil
+}
+
+// authorizationCodeGrant exchanges an authorization code for an ID token and an access token
+// for the userinfo endpoint. The code verifier must answer the challenge of the authorization
+// request.
+func (app *Config) authorizationCodeGrant(w http.ResponseWriter, r *http.Request, client *data.OAuthClient) {
+	code, err := app.Codes.ConsumeAuthorizationCode(r.Context(), hashToken(r.PostForm.Get("code")))
+	if errors.Is(err, sql.ErrNoRows) {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "the authorization code is invalid or has been used")
+		return
+	} else if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	if code.ClientID != client.ID || time.Now().After(code.ExpiresAt) {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "the authorization code is invalid or has expired")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != code.RedirectURI {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri doesn't match the authorization request")
+		return
+	}
+	if !verifyCodeChallenge(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match the code challenge")
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), code.UserID)
+	if err != nil || !user.IsActive() {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "the user can't log in")
+		return
+	}
+
+	accessToken, err := generateOIDCAccessToken(app.Keys, user.ID, client.ID, code.Scopes)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	idToken, err := generateIDToken(app.Keys, app.Issuer, user, client.ID, code.Nonce, code.Scopes)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	err = app.logRequest("authentication", fmt.Sprintf("%s logged in to %s", user.Email, client.ID))
+	if err != nil {
+		log.Println("Error logging OpenID Connect login:", err)
+	}
+
+	writeTokenResponse(w, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenTTL.Seconds()),
+		"scope":        strings.Join(code.Scopes, " "),
+		"id_token":     idToken,
+	})
+}
+
+// UserInfo returns the claims about the user the access token from the token endpoint was
+// issued for, limited to the scopes the user has allowed
+func (app *Config) UserInfo(w http.ResponseWriter, r *http.Request) {
+	invalidToken := func(description string) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, description))
+		app.errorJSON(w, errors.New(description), http.StatusUnauthorized)
+	}
+
+	scheme, tokenString, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		app.errorJSON(w, errors.New("a bearer token is required"), http.StatusUnauthorized)
+		return
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(strings.TrimSpace(tokenString), &claims, app.Keys.Keyfunc)
+	if err != nil || !token.Valid || claims["typ"] != oidcAccessTokenType {
+		invalidToken("token is not valid")
+		return
+	}
+
+	userID, _ := claims["sub"].(float64)
+	jti, _ := claims["jti"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+	revoked, err := app.Revocations.IsRevoked(r.Context(), jti, int(userID), time.Unix(int64(issuedAt), 0))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		invalidToken("token has been revoked")
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), int(userID))
+	if err != nil || !user.IsActive() {
+		invalidToken("the user can't log in")
+		return
+	}
+
+	scope, _ := claims["scope"].(string)
+	app.writeJSON(w, http.StatusOK, userClaims(user, strings.Fields(scope)))
+}
+
+// generateConsentRequestToken signs the authorization request the user is asked to allow, so
+// the consent screen doesn't need to keep any state
+func generateConsentRequestToken(keys *Keyring, userID int, request authorizeRequest) (string, error) {
+	issuedAt := time.Now()
+
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &jwt.MapClaims{
+		"sub":            userID,
+		"exp":            issuedAt.Add(consentRequestTTL).Unix(),
+		"iat":            issuedAt.Unix(),
+		"jti":            jti,
+		"typ":            consentRequestType,
+		"client_id":      request.ClientID,
+		"redirect_uri":   request.RedirectURI,
+		"scope":          strings.Join(request.Scopes, " "),
+		"state":          request.State,
+		"nonce":          request.Nonce,
+		"code_challenge": request.CodeChallenge,
+	}
+
+	return keys.Sign(claims)
+}
+
+// generateOIDCAccessToken signs the access token a client gets with the ID token. It is only
+// accepted by the userinfo endpoint, the typ claim keeps it from being taken for a login.
+func generateOIDCAccessToken(keys *Keyring, userID int, clientID string, scopes []string) (string, error) {
+	issuedAt := time.Now()
+
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &jwt.MapClaims{
+		"sub":       userID,
+		"client_id": clientID,
+		"exp":       issuedAt.Add(accessTokenTTL).Unix(),
+		"iat":       issuedAt.Unix(),
+		"jti":       jti,
+		"typ":       oidcAccessTokenType,
+		"scope":     strings.Join(scopes, " "),
+	}
+
+	return keys.Sign(claims)
+}
+
+// generateIDToken signs the ID token which tells the client who the user is
+func generateIDToken(keys *Keyring, issuer string, user *data.User, clientID, nonce string, scopes []string) (string, error) {
+	issuedAt := time.Now()
+
+	claims := userClaims(user, scopes)
+	claims["iss"] = issuer
+	claims["aud"] = clientID
+	claims["exp"] = issuedAt.Add(accessTokenTTL).Unix()
+	claims["iat"] = issuedAt.Unix()
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	return keys.Sign(claims)
+}
+
+// userClaims returns the standard claims about the user which the scopes allow
+func userClaims(user *data.User, scopes []string) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub": strconv.Itoa(user.ID),
+	}
+
+	if containsScope(scopes, "email") {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.Status != data.StatusPending
+	}
+	if containsScope(scopes, "profile") {
+		claims["name"] = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims["given_name"] = user.FirstName
+		claims["family_name"] = user.LastName
+		claims["updated_at"] = user.UpdatedAt.Unix()
+	}
+
+	return claims
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against the S256 challenge
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < minCodeVerifierLength || len(verifier) > maxCodeVerifierLength {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// requestedOIDCScopes keeps the scopes of the request which the provider knows, each once
+func requestedOIDCScopes(scope string) []string {
+	var scopes []string
+	for _, requested := range strings.Fields(scope) {
+		if containsScope(oidcScopes, requested) && !containsScope(scopes, requested) {
+			scopes = append(scopes, requested)
+		}
+	}
+
+	return scopes
+}
+
+// mergeScopes adds the scopes which aren't in granted yet
+func mergeScopes(granted, scopes []string) []string {
+	merged := append([]string(nil), granted...)
+	for _, scope := range scopes {
+		if !containsScope(merged, scope) {
+			merged = append(merged, scope)
+		}
+	}
+
+	return merged
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redirectURL returns the redirect uri of the request with the params and the state added
+func (request authorizeRequest) redirectURL(params url.Values) string {
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+
+	return withQuery(request.RedirectURI, params)
+}
+
+// withQuery adds the params to the query of an address
+func withQuery(address string, params url.Values) string {
+	target, err := url.Parse(address)
+	if err != nil {
+		return address
+	}
+
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+
+	return target.String()
+}
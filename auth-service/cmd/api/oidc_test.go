@@ -0,0 +1,293 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Test_OpenIDConfiguration проверяет документ обнаружения провайдера.
+func Test_OpenIDConfiguration(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	rr := httptest.NewRecorder()
+	testApp.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 but got %d", rr.Code)
+	}
+
+	var document map[string]any
+	_ = json.Unmarshal(rr.Body.Bytes(), &document)
+
+	expected := map[string]string{
+		"issuer":                 "http://localhost:8081",
+		"authorization_endpoint": "http://localhost:8081/authorize",
+		"token_endpoint":         "http://localhost:8081/token",
+		"userinfo_endpoint":      "http://localhost:8081/userinfo",
+		"jwks_uri":               "http://localhost:8081/.well-known/jwks.json",
+	}
+	for key, value := range expected {
+		if document[key] != value {
+			t.Errorf("expected %s to be %s but got %v", key, value, document[key])
+		}
+	}
+}
+
+// Test_OpenIDConnect проверяет вход через authorization code flow с PKCE: согласие
+// пользователя, обмен кода на токены, ID-токен и userinfo.
+func Test_OpenIDConnect(t *testing.T) {
+	routes := testApp.routes()
+	ctx := context.Background()
+
+	// публичный клиент без секрета и конфиденциальный клиент
+	_ = testApp.Clients.UpsertOAuthClient(ctx, data.OAuthClient{
+		ID:           "wiki",
+		Name:         "Wiki",
+		RedirectURIs: []string{"https://wiki.local/callback"},
+	})
+	_ = testApp.Clients.UpsertOAuthClient(ctx, data.OAuthClient{
+		ID:           "crm",
+		SecretHash:   hashToken("crm-secret"),
+		RedirectURIs: []string{"https://crm.local/callback"},
+	})
+
+	userData, err := testApp.issueTokens(ctx, httptest.NewRecorder(), 21, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	otherUser, err := testApp.issueTokens(ctx, httptest.NewRecorder(), 22, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	verifier := strings.Repeat("verifier-", 6)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	authorizeParams := func(clientID, redirectURI string) url.Values {
+		return url.Values{
+			"response_type":         {"code"},
+			"client_id":             {clientID},
+			"redirect_uri":          {redirectURI},
+			"scope":                 {"openid email profile"},
+			"state":                 {"xyz"},
+			"nonce":                 {"n-0S6"},
+			"code_challenge":        {challenge},
+			"code_challenge_method": {"S256"},
+		}
+	}
+	authorize := func(params url.Values, accessToken string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/authorize?"+params.Encode(), nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		if accessToken != "" {
+			req.AddCookie(&http.Cookie{Name: "access_token", Value: accessToken})
+		}
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+	location := func(rr *httptest.ResponseRecorder) *url.URL {
+		if rr.Code != http.StatusFound {
+			t.Fatalf("expected a redirect but got %d: %s", rr.Code, rr.Body.String())
+		}
+		u, _ := url.Parse(rr.Header().Get("Location"))
+		return u
+	}
+	consent := func(consentRequest string, approve bool, accessToken string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"consent_request": consentRequest, "approve": approve})
+		req, _ := http.NewRequest("POST", "/authorize/consent", bytes.NewReader(body))
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+	redirectTo := func(rr *httptest.ResponseRecorder) *url.URL {
+		var response struct {
+			Data struct {
+				RedirectTo string `json:"redirect_to"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &response)
+		u, _ := url.Parse(response.Data.RedirectTo)
+		return u
+	}
+	token := func(form url.Values) (int, map[string]any) {
+		req, _ := http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		var response map[string]any
+		_ = json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr.Code, response
+	}
+
+	// ошибки клиента и redirect_uri показываются пользователю, а не отправляются по адресу
+	unknownRedirect := authorizeParams("wiki", "https://evil.local/callback")
+	if rr := authorize(unknownRedirect, userData.AccessToken); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unregistered redirect uri but got %d", rr.Code)
+	}
+	if rr := authorize(authorizeParams("nobody", "https://wiki.local/callback"), userData.AccessToken); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown client but got %d", rr.Code)
+	}
+
+	// без PKCE клиент получает ошибку по redirect_uri
+	noPKCE := authorizeParams("wiki", "https://wiki.local/callback")
+	noPKCE.Del("code_challenge")
+	if u := location(authorize(noPKCE, userData.AccessToken)); u.Query().Get("error") != "invalid_request" || u.Query().Get("state") != "xyz" {
+		t.Errorf("expected invalid_request with the state, got %s", u)
+	}
+
+	// неавторизованный пользователь отправляется на страницу входа
+	u := location(authorize(authorizeParams("wiki", "https://wiki.local/callback"), ""))
+	if !strings.HasPrefix(u.String(), testApp.LoginURL) || !strings.HasPrefix(u.Query().Get("next"), "http://localhost:8081/authorize?") {
+		t.Errorf("expected a redirect to the login page, got %s", u)
+	}
+
+	silent := authorizeParams("wiki", "https://wiki.local/callback")
+	silent.Set("prompt", "none")
+	if u := location(authorize(silent, "")); u.Query().Get("error") != "login_required" {
+		t.Errorf("expected login_required, got %s", u)
+	}
+	if u := location(authorize(silent, userData.AccessToken)); u.Query().Get("error") != "consent_required" {
+		t.Errorf("expected consent_required, got %s", u)
+	}
+
+	// без согласия пользователь отправляется на экран согласия
+	u = location(authorize(authorizeParams("wiki", "https://wiki.local/callback"), userData.AccessToken))
+	if !strings.HasPrefix(u.String(), testApp.ConsentURL) || u.Query().Get("client") != "Wiki" {
+		t.Fatalf("expected a redirect to the consent screen, got %s", u)
+	}
+	consentRequest := u.Query().Get("consent_request")
+
+	// запрос согласия нельзя подтвердить за другого пользователя
+	if rr := consent(consentRequest, true, otherUser.AccessToken); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for another user but got %d", rr.Code)
+	}
+	if u := redirectTo(consent(consentRequest, false, userData.AccessToken)); u.Query().Get("error") != "access_denied" {
+		t.Errorf("expected access_denied, got %s", u)
+	}
+
+	rr := consent(consentRequest, true, userData.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 but got %d: %s", rr.Code, rr.Body.String())
+	}
+	u = redirectTo(rr)
+	if u.Host != "wiki.local" || u.Query().Get("code") == "" || u.Query().Get("state") != "xyz" {
+		t.Fatalf("expected a code for the client, got %s", u)
+	}
+	firstCode := u.Query().Get("code")
+
+	// согласие запоминается, повторный вход сразу возвращает код
+	u = location(authorize(authorizeParams("wiki", "https://wiki.local/callback"), userData.AccessToken))
+	secondCode := u.Query().Get("code")
+	if u.Host != "wiki.local" || secondCode == "" {
+		t.Fatalf("expected a code without asking again, got %s", u)
+	}
+
+	exchange := func(code, codeVerifier string) url.Values {
+		return url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {"wiki"},
+			"code":          {code},
+			"redirect_uri":  {"https://wiki.local/callback"},
+			"code_verifier": {codeVerifier},
+		}
+	}
+
+	if code, response := token(exchange(firstCode, strings.Repeat("x", 43))); code != http.StatusBadRequest || response["error"] != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a wrong verifier, got %d %v", code, response)
+	}
+
+	code, response := token(exchange(secondCode, verifier))
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 but got %d: %v", code, response)
+	}
+
+	// код можно обменять только один раз
+	if code, response := token(exchange(secondCode, verifier)); code != http.StatusBadRequest || response["error"] != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a used code, got %d %v", code, response)
+	}
+
+	idClaims := jwt.MapClaims{}
+	idToken, err := jwt.ParseWithClaims(response["id_token"].(string), &idClaims, testApp.Keys.Keyfunc)
+	if err != nil || !idToken.Valid {
+		t.Fatalf("expected a valid id token, got %v", err)
+	}
+	expectedClaims := map[string]any{
+		"iss":   "http://localhost:8081",
+		"aud":   "wiki",
+		"sub":   "21",
+		"nonce": "n-0S6",
+		"email": "me@here.com",
+		"name":  "First Last",
+	}
+	for key, value := range expectedClaims {
+		if idClaims[key] != value {
+			t.Errorf("expected %s to be %v in the id token but got %v", key, value, idClaims[key])
+		}
+	}
+
+	userInfo := func(accessToken string) (int, map[string]any) {
+		req, _ := http.NewRequest("GET", "/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		var claims map[string]any
+		_ = json.Unmarshal(rr.Body.Bytes(), &claims)
+		return rr.Code, claims
+	}
+
+	code, claims := userInfo(response["access_token"].(string))
+	if code != http.StatusOK || claims["sub"] != "21" || claims["email"] != "me@here.com" {
+		t.Errorf("expected the claims of the user, got %d %v", code, claims)
+	}
+
+	// обычный access-токен не подходит для userinfo, а токен OIDC - для API
+	if code, _ := userInfo(userData.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a login access token but got %d", code)
+	}
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+response["access_token"].(string))
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an OpenID Connect access token but got %d", rr.Code)
+	}
+
+	// конфиденциальный клиент должен передать секрет
+	_ = testApp.Consents.SaveConsent(ctx, data.Consent{UserID: 21, ClientID: "crm", Scopes: []string{"openid"}})
+	crmParams := authorizeParams("crm", "https://crm.local/callback")
+	crmParams.Set("scope", "openid")
+	crmCode := location(authorize(crmParams, userData.AccessToken)).Query().Get("code")
+
+	form := exchange(crmCode, verifier)
+	form.Set("client_id", "crm")
+	form.Set("redirect_uri", "https://crm.local/callback")
+	if code, response := token(form); code != http.StatusUnauthorized || response["error"] != "invalid_client" {
+		t.Errorf("expected invalid_client without the secret, got %d %v", code, response)
+	}
+	crmCode = location(authorize(crmParams, userData.AccessToken)).Query().Get("code")
+	form.Set("code", crmCode)
+	form.Set("client_secret", "crm-secret")
+	if code, response := token(form); code != http.StatusOK || response["id_token"] == nil {
+		t.Errorf("expected tokens with the secret, got %d %v", code, response)
+	}
+
+	// публичный клиент не может получить сервисный токен
+	if code, response := token(url.Values{"grant_type": {"client_credentials"}, "client_id": {"wiki"}}); code != http.StatusBadRequest || response["error"] != "unauthorized_client" {
+		t.Errorf("expected unauthorized_client, got %d %v", code, response)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"auth-service/data"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// passwordResetTTL is how long a password reset link can be used
+const passwordResetTTL = time.Hour
+
+// ForgotPassword sends a password reset link to the user. The response is the same whether the
+// email is registered or not, so it can't be used to find out who has an account. Requests are
+// rate limited per email and per client address.
+func (app *Config) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.resetIPLimiter.Allow(app.ClientIP.ClientIP(r)) || !app.resetEmailLimiter.Allow(strings.ToLower(requestPayload.Email)) {
+		app.errorJSON(w, errors.New("too many password resets requested, try again later"), http.StatusTooManyRequests)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "If the email is registered, a password reset link has been sent to it",
+	}
+
+	user, err := app.Repo.GetByEmail(r.Context(), requestPayload.Email)
+	if err != nil || user.Status == data.StatusDeleted {
+		app.writeJSON(w, http.StatusAccepted, payload)
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = app.Resets.InsertPasswordReset(r.Context(), data.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("Somebody has asked to reset the password of your account.\n\n"+
+			"To choose a new password, open the link below within %s:\n%s?token=%s\n\n"+
+			"If it wasn't you, just ignore this email.\n",
+			passwordResetTTL, app.PasswordResetURL, url.QueryEscape(token)),
+	})
+	if err != nil {
+		// the answer stays the same, otherwise it would tell which emails are registered
+		log.Println("Error sending password reset email:", err)
+		app.writeJSON(w, http.StatusAccepted, payload)
+		return
+	}
+
+	err = app.logRequest("authentication", fmt.Sprintf("%s requested a password reset", user.Email))
+	if err != nil {
+		log.Println("Error logging password reset request:", err)
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// ResetPassword sets a new password with a token from the reset link. Every session of the user
+// is ended, since whoever knew the old password could have logged in with it.
+func (app *Config) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if requestPayload.Password == "" {
+		app.errorJSON(w, errors.New("password is required"), http.StatusBadRequest)
+		return
+	}
+
+	// the token is only used up once the new password is accepted, so the user can try
+	// another password with the same link
+	reset, err := app.Resets.GetPasswordReset(r.Context(), hashToken(requestPayload.Token))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired reset token"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), reset.UserID)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired reset token"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.checkPassword(w, requestPayload.Password, *user) {
+		return
+	}
+
+	_, err = app.Resets.ConsumePasswordReset(r.Context(), reset.TokenHash)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired reset token"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Repo.ResetPassword(r.Context(), requestPayload.Password, *user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.revokeAllSessions(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.logRequest("authentication", fmt.Sprintf("%s has reset the password", user.Email))
+	if err != nil {
+		log.Println("Error logging password reset:", err)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Password has been reset, please log in again",
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
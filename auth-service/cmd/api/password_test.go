@@ -0,0 +1,132 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_PasswordReset(t *testing.T) {
+	outbox := t.TempDir()
+	testApp.Mailer = NewOutboxMailer(outbox)
+	testApp.PasswordResetURL = "http://localhost/reset-password"
+
+	// сброс пароля завершает все сессии пользователя, не затрагиваем остальные тесты
+	revocations := testApp.Revocations
+	testApp.Revocations = data.NewMemoryRevocationStore()
+	defer func() { testApp.Revocations = revocations }()
+
+	post := func(handler http.HandlerFunc, body map[string]string) *httptest.ResponseRecorder {
+		out, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/password", bytes.NewReader(out))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// сессия, которая должна завершиться после сброса пароля
+	userData, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), 1, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if rr := post(testApp.ForgotPassword, map[string]string{"email": "me@here.com"}); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(outbox, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one email in the outbox, got %d", len(files))
+	}
+	email, _ := os.ReadFile(files[0])
+	match := regexp.MustCompile(`reset-password\?token=([A-Za-z0-9_-]+)`).FindSubmatch(email)
+	if match == nil {
+		t.Fatalf("expected a reset link in the email, got %s", email)
+	}
+	token := string(match[1])
+
+	if rr := post(testApp.ResetPassword, map[string]string{"token": "wrong", "password": "newsecret"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for wrong token but got %d", rr.Code)
+	}
+
+	if rr := post(testApp.ResetPassword, map[string]string{"token": token, "password": "newsecret"}); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+
+	// ссылка одноразовая
+	if rr := post(testApp.ResetPassword, map[string]string{"token": token, "password": "newsecret"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for used token but got %d", rr.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: userData.AccessToken})
+	rr := httptest.NewRecorder()
+	testApp.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected sessions to be revoked after reset, got %d", rr.Code)
+	}
+}
+
+// failingMailer не может отправить ни одного письма.
+type failingMailer struct{}
+
+func (failingMailer) Send(msg Message) error { return errors.New("smtp is down") }
+
+func Test_ForgotPassword_RateLimitAndMailerError(t *testing.T) {
+	mailer := testApp.Mailer
+	testApp.Mailer = failingMailer{}
+	defer func() { testApp.Mailer = mailer }()
+	defer func() {
+		testApp.resetEmailLimiter = newRateLimiter(3, time.Hour)
+		testApp.resetIPLimiter = newRateLimiter(20, time.Hour)
+	}()
+
+	forgot := func(email, ip string) *httptest.ResponseRecorder {
+		out, _ := json.Marshal(map[string]string{"email": email})
+		req, _ := http.NewRequest("POST", "/password/forgot", bytes.NewReader(out))
+		req.RemoteAddr = ip + ":12345"
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(testApp.ForgotPassword).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// ошибка отправки не отличает зарегистрированный email от незарегистрированного
+	registered := forgot("me@here.com", "10.0.3.1")
+	unknown := forgot("nobody@here.com", "10.0.3.1")
+	if registered.Code != http.StatusAccepted || registered.Body.String() != unknown.Body.String() {
+		t.Errorf("expected the same answer for both emails, got %d %s and %d %s",
+			registered.Code, registered.Body.String(), unknown.Code, unknown.Body.String())
+	}
+
+	// лимит по email действует независимо от адреса клиента
+	testApp.resetEmailLimiter = newRateLimiter(3, time.Hour)
+	for i := 0; i < 3; i++ {
+		if rr := forgot("limited@here.com", fmt.Sprintf("10.0.4.%d", i)); rr.Code != http.StatusAccepted {
+			t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+		}
+	}
+	if rr := forgot("limited@here.com", "10.0.4.9"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected http.StatusTooManyRequests per email but got %d", rr.Code)
+	}
+
+	// лимит по адресу клиента действует для разных email
+	testApp.resetIPLimiter = newRateLimiter(20, time.Hour)
+	for i := 0; i < 20; i++ {
+		if rr := forgot(fmt.Sprintf("user%d@here.com", i), "10.0.5.1"); rr.Code != http.StatusAccepted {
+			t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+		}
+	}
+	if rr := forgot("another@here.com", "10.0.5.1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected http.StatusTooManyRequests per address but got %d", rr.Code)
+	}
+}
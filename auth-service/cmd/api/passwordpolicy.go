@@ -0,0 +1,202 @@
+package main
+
+import (
+	"auth-service/data"
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultBannedPasswords are rejected even without a PASSWORD_BANNED_FILE
+var defaultBannedPasswords = []string{
+	"password", "password1", "password123", "passw0rd", "123456", "12345678", "123456789",
+	"1234567890", "qwerty", "qwerty123", "qwertyuiop", "111111", "letmein", "welcome",
+	"welcome1", "admin", "admin123", "iloveyou", "monkey", "dragon", "football", "abc123",
+	"changeme", "secret", "verysecret", "trustno1", "sunshine", "princess", "superman",
+}
+
+// minSimilarityLength is the shortest part of the email or the name the password may not contain
+const minSimilarityLength = 3
+
+// PasswordPolicy decides which passwords users may choose
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// MinCharacterClasses is how many of lower case letters, upper case letters, digits and
+	// other characters the password must contain
+	MinCharacterClasses int
+	// Banned are the passwords which may not be used, in lower case
+	Banned map[string]bool
+	// CheckSimilarity rejects passwords containing the email or the name of the user
+	CheckSimilarity bool
+}
+
+// policyViolation is one rule of the policy a password breaks
+type policyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// newPasswordPolicy reads the policy from PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH,
+// PASSWORD_MIN_CHARACTER_CLASSES, PASSWORD_CHECK_SIMILARITY and PASSWORD_BANNED_FILE, a file
+// with one banned password per line which extends the built in list.
+func newPasswordPolicy() (PasswordPolicy, error) {
+	policy := PasswordPolicy{
+		Banned:          make(map[string]bool),
+		CheckSimilarity: envOr("PASSWORD_CHECK_SIMILARITY", "true") == "true",
+	}
+	var err error
+
+	ints := []struct {
+		key   string
+		def   string
+		value *int
+	}{
+		{"PASSWORD_MIN_LENGTH", "10", &policy.MinLength},
+		{"PASSWORD_MAX_LENGTH", "128", &policy.MaxLength},
+		{"PASSWORD_MIN_CHARACTER_CLASSES", "2", &policy.MinCharacterClasses},
+	}
+	for _, setting := range ints {
+		*setting.value, err = strconv.Atoi(envOr(setting.key, setting.def))
+		if err != nil {
+			return policy, fmt.Errorf("%s: %w", setting.key, err)
+		}
+	}
+	if policy.MinLength < 1 || policy.MaxLength < policy.MinLength {
+		return policy, fmt.Errorf("PASSWORD_MAX_LENGTH must not be shorter than PASSWORD_MIN_LENGTH, which must be at least 1")
+	}
+	if policy.MinCharacterClasses < 0 || policy.MinCharacterClasses > 4 {
+		return policy, fmt.Errorf("PASSWORD_MIN_CHARACTER_CLASSES must be between 0 and 4")
+	}
+
+	for _, password := range defaultBannedPasswords {
+		policy.Banned[password] = true
+	}
+
+	if file := os.Getenv("PASSWORD_BANNED_FILE"); file != "" {
+		err = policy.loadBanned(file)
+		if err != nil {
+			return policy, fmt.Errorf("PASSWORD_BANNED_FILE: %w", err)
+		}
+	}
+
+	return policy, nil
+}
+
+// loadBanned adds the passwords in the file to the banned ones, skipping empty lines and
+// lines starting with #
+func (p PasswordPolicy) loadBanned(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.Banned[strings.ToLower(line)] = true
+	}
+
+	return scanner.Err()
+}
+
+// Check returns every rule the password breaks for the user, nothing when it is acceptable
+func (p PasswordPolicy) Check(password string, user data.User) []policyViolation {
+	var violations []policyViolation
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, policyViolation{"min_length", fmt.Sprintf("must be at least %d characters long", p.MinLength)})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, policyViolation{"max_length", fmt.Sprintf("must be at most %d characters long", p.MaxLength)})
+	}
+
+	if classes := characterClasses(password); classes < p.MinCharacterClasses {
+		violations = append(violations, policyViolation{"character_classes", fmt.Sprintf(
+			"must contain at least %d of lower case letters, upper case letters, digits and other characters", p.MinCharacterClasses)})
+	}
+
+	lower := strings.ToLower(password)
+	if p.Banned[lower] {
+		violations = append(violations, policyViolation{"banned", "is too common"})
+	}
+
+	if p.CheckSimilarity && similarToUser(lower, user) {
+		violations = append(violations, policyViolation{"similar_to_account", "must not contain your email or name"})
+	}
+
+	return violations
+}
+
+// characterClasses counts the kinds of characters in the password
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	count := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			count++
+		}
+	}
+
+	return count
+}
+
+// similarToUser reports whether the lower case password contains the email, the part of the
+// email before the @ or the first or last name of the user
+func similarToUser(password string, user data.User) bool {
+	email := strings.ToLower(user.Email)
+	local, _, _ := strings.Cut(email, "@")
+
+	for _, part := range []string{email, local, strings.ToLower(user.FirstName), strings.ToLower(user.LastName)} {
+		if utf8.RuneCountInString(part) >= minSimilarityLength && strings.Contains(password, part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPassword writes the rules the password breaks as an error response and reports false,
+// or reports true when the password is acceptable
+func (app *Config) checkPassword(w http.ResponseWriter, password string, user data.User) bool {
+	violations := app.PasswordPolicy.Check(password, user)
+	if len(violations) == 0 {
+		return true
+	}
+
+	messages := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		messages = append(messages, violation.Message)
+	}
+
+	payload := jsonResponse{
+		Error:   true,
+		Message: "password " + strings.Join(messages, ", "),
+		Data:    violations,
+	}
+	app.writeJSON(w, http.StatusBadRequest, payload)
+	return false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_PasswordPolicy_Check(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:           10,
+		MaxLength:           20,
+		MinCharacterClasses: 3,
+		Banned:              map[string]bool{"correcthorse1!": true},
+		CheckSimilarity:     true,
+	}
+	user := data.User{Email: "alice.smith@example.com", FirstName: "Alice", LastName: "Smith"}
+
+	tests := []struct {
+		name     string
+		password string
+		rules    []string
+	}{
+		{"acceptable", "Tr0ub4dor&3x", nil},
+		{"too short", "Ab1!", []string{"min_length"}},
+		{"too long", "Abcdefghij1234567890!", []string{"max_length"}},
+		{"one class", "abcdefghijkl", []string{"character_classes"}},
+		{"banned in any case", "CorrectHorse1!", []string{"banned"}},
+		{"contains the name", "Smith-2024-pw", []string{"similar_to_account"}},
+		{"contains the email", "Alice.Smith#99", []string{"similar_to_account"}},
+		{"several rules", "alice", []string{"min_length", "character_classes", "similar_to_account"}},
+	}
+
+	for _, e := range tests {
+		var rules []string
+		for _, violation := range policy.Check(e.password, user) {
+			rules = append(rules, violation.Rule)
+		}
+		if !reflect.DeepEqual(rules, e.rules) {
+			t.Errorf("%s: expected %v but got %v", e.name, e.rules, rules)
+		}
+	}
+
+	// короткие части email не считаются совпадением
+	if violations := policy.Check("Me-and-you-42", data.User{Email: "me@here.com"}); len(violations) != 0 {
+		t.Errorf("expected no violations, got %v", violations)
+	}
+}
+
+func Test_NewPasswordPolicy(t *testing.T) {
+	banned := filepath.Join(t.TempDir(), "banned.txt")
+	_ = os.WriteFile(banned, []byte("# common passwords\nHunter2Hunter2\n\n"), 0o600)
+
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("PASSWORD_BANNED_FILE", banned)
+
+	policy, err := newPasswordPolicy()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if policy.MinLength != 12 || policy.MaxLength != 128 || policy.MinCharacterClasses != 2 || !policy.CheckSimilarity {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+	// встроенный список дополняется списком из файла
+	if !policy.Banned["hunter2hunter2"] || !policy.Banned["password123"] || policy.Banned["# common passwords"] {
+		t.Errorf("unexpected banned passwords %v", policy.Banned)
+	}
+
+	t.Setenv("PASSWORD_MAX_LENGTH", "8")
+	if _, err := newPasswordPolicy(); err == nil {
+		t.Error("expected an error for a maximum length below the minimum")
+	}
+}
+
+func Test_PasswordPolicy_Enforced(t *testing.T) {
+	serve := func(handler http.HandlerFunc, body map[string]string) *httptest.ResponseRecorder {
+		out, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/", bytes.NewReader(out))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	violations := func(rr *httptest.ResponseRecorder) []string {
+		var payload struct {
+			Error bool              `json:"error"`
+			Data  []policyViolation `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &payload)
+
+		var rules []string
+		for _, violation := range payload.Data {
+			rules = append(rules, violation.Rule)
+		}
+		return rules
+	}
+
+	rr := serve(testApp.Registrate, map[string]string{"email": "newcomer@here.com", "password": "newcomer1"})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected http.StatusBadRequest but got %d", rr.Code)
+	}
+	if rules := violations(rr); !reflect.DeepEqual(rules, []string{"similar_to_account"}) {
+		t.Errorf("expected the broken rules in the response, got %v", rules)
+	}
+
+	if rr := serveAuthenticated(t, "PUT", "/me/password", map[string]string{"old_password": "verysecret", "new_password": "password"}, 1); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for a banned password but got %d", rr.Code)
+	}
+
+	// отклонённый пароль не расходует ссылку для сброса
+	revocations := testApp.Revocations
+	testApp.Revocations = data.NewMemoryRevocationStore()
+	defer func() { testApp.Revocations = revocations }()
+
+	token := "policy-reset-token"
+	_, err := testApp.Resets.InsertPasswordReset(context.Background(), data.PasswordReset{
+		UserID:    1,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	rr = serve(testApp.ResetPassword, map[string]string{"token": token, "password": "short"})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected http.StatusBadRequest but got %d", rr.Code)
+	}
+	if rules := violations(rr); !reflect.DeepEqual(rules, []string{"min_length"}) {
+		t.Errorf("expected the broken rules in the response, got %v", rules)
+	}
+
+	if rr := serve(testApp.ResetPassword, map[string]string{"token": token, "password": "long enough"}); rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows at most limit events per key within a sliding window
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+	// sweptAt is when the keys without recent events have last been dropped
+	sweptAt time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		events:  make(map[string][]time.Time),
+		sweptAt: time.Now(),
+	}
+}
+
+// Allow records an event for the key and reports whether it is within the limit. Once per
+// window the keys whose events have all expired are dropped, so the map doesn't keep every
+// key it has ever seen.
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.sweptAt) >= l.window {
+		l.sweep(now)
+	}
+
+	var recent []time.Time
+	for _, at := range l.events[key] {
+		if now.Sub(at) < l.window {
+			recent = append(recent, at)
+		}
+	}
+
+	if len(recent) >= l.limit {
+		l.events[key] = recent
+		return false
+	}
+
+	l.events[key] = append(recent, now)
+	return true
+}
+
+// sweep drops the keys without events within the window, the lock has to be held
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, events := range l.events {
+		// the events are in order, so the last one is the newest
+		if len(events) == 0 || now.Sub(events[len(events)-1]) >= l.window {
+			delete(l.events, key)
+		}
+	}
+	l.sweptAt = now
+}
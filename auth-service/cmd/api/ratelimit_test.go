@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Test_RateLimiterSweep проверяет, что ключи без событий в окне удаляются из памяти.
+func Test_RateLimiterSweep(t *testing.T) {
+	limiter := newRateLimiter(1, 50*time.Millisecond)
+
+	if !limiter.Allow("a@here.com") || limiter.Allow("a@here.com") {
+		t.Fatal("expected one event per window to be allowed")
+	}
+	limiter.Allow("b@here.com")
+
+	time.Sleep(60 * time.Millisecond)
+
+	// после окна событие снова разрешено, а старые ключи удалены
+	if !limiter.Allow("c@here.com") {
+		t.Fatal("expected a new key to be allowed")
+	}
+	if len(limiter.events) != 1 {
+		t.Errorf("expected only the new key to be kept, got %v", limiter.events)
+	}
+	if !limiter.Allow("a@here.com") {
+		t.Error("expected the key to be allowed again after the window")
+	}
+}
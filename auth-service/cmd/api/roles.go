@@ -0,0 +1,104 @@
+package main
+
+import (
+	"auth-service/data"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// GetUserRoles returns the roles and the resulting permissions of one user
+func (app *Config) GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r, "roles:manage")
+	if !ok {
+		return
+	}
+
+	roles, err := app.Repo.GetRoles(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	permissions, err := app.Repo.GetPermissions(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched roles of user %d", user.ID),
+		Data: map[string][]string{
+			"roles":       roles,
+			"permissions": permissions,
+		},
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// GrantRole grants a role to one user. It takes effect once the user gets a new access token.
+func (app *Config) GrantRole(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Role string `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.userFromURL(w, r, "roles:manage")
+	if !ok {
+		return
+	}
+
+	err = app.Repo.GrantRole(r.Context(), user.ID, requestPayload.Role)
+	if errors.Is(err, data.ErrUnknownRole) {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("role %s has been granted to user %d", requestPayload.Role, user.ID))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Granted role %s to user %d", requestPayload.Role, user.ID),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// RevokeRole takes a role away from one user. Their current sessions are ended, so that the
+// access tokens still carrying the role can't be used anymore.
+func (app *Config) RevokeRole(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r, "roles:manage")
+	if !ok {
+		return
+	}
+
+	role := chi.URLParam(r, "role")
+	err := app.Repo.RevokeRole(r.Context(), user.ID, role)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.revokeAllSessions(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("role %s has been revoked from user %d", role, user.ID))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked role %s from user %d", role, user.ID),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"auth-service/data"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_RoleManagement(t *testing.T) {
+	_ = testApp.Repo.GrantRole(context.Background(), 200, "admin")
+
+	if rr := serveAuthenticated(t, "POST", "/users/201/roles", map[string]any{"role": "admin"}, 201); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden for granting without roles:manage but got %d", rr.Code)
+	}
+
+	if rr := serveAuthenticated(t, "POST", "/users/201/roles", map[string]any{"role": "superuser"}, 200); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected http.StatusBadRequest for unknown role but got %d", rr.Code)
+	}
+
+	if rr := serveAuthenticated(t, "POST", "/users/201/roles", map[string]any{"role": "admin"}, 200); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+
+	// новая роль попадает в следующий access-токен пользователя
+	if rr := serveAuthenticated(t, "GET", "/users", nil, 201); rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted after granting admin but got %d", rr.Code)
+	}
+
+	if rr := serveAuthenticated(t, "DELETE", "/users/201/roles/admin", nil, 200); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+
+	roles, _ := testApp.Repo.GetRoles(context.Background(), 201)
+	if len(roles) != 0 {
+		t.Errorf("expected no roles after revoking, got %v", roles)
+	}
+}
+
+func Test_SeedDemoAdmin(t *testing.T) {
+	setupBulk(t)
+	ctx := context.Background()
+
+	// повторный запуск не создаёт второго администратора
+	for i := 0; i < 2; i++ {
+		if err := testApp.seedDemoAdmin(ctx); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	user, err := testApp.Repo.GetByEmail(ctx, demoAdminEmail)
+	if err != nil || user.Status != data.StatusActive {
+		t.Fatalf("expected an active demo admin, got %+v %v", user, err)
+	}
+	if valid, _ := testApp.Repo.PasswordMatches(ctx, demoAdminPassword, *user); !valid {
+		t.Error("expected the demo password")
+	}
+	if roles, _ := testApp.Repo.GetRoles(ctx, user.ID); strings.Join(roles, ",") != "admin,user" {
+		t.Errorf("expected the admin and user roles, got %v", roles)
+	}
+}
@@ -13,20 +13,83 @@ func (app *Config) routes() http.Handler {
 	// specify who is allowed to connect
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-API-Key"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
 	mux.Group(func(r chi.Router) {
-		r.Use(app.authTokenMiddleware("some_secret_key")) //
+		r.Use(app.authTokenMiddleware()) //
 
-		r.Get("/users", app.GetAllUsers)
+		r.With(app.RequirePermission("users:read")).Get("/users", app.GetAllUsers)
+		r.With(app.RequirePermission("users:read")).Get("/users/export", app.ExportUsers)
+		r.With(app.RequirePermission("users:write")).Post("/users/import", app.ImportUsers)
+		r.Get("/users/{id}", app.GetUser)
+		r.Patch("/users/{id}", app.UpdateUser)
+		r.Delete("/users/{id}", app.DeleteUser)
+		r.With(app.RequirePermission("users:delete")).Post("/users/{id}/erase", app.EraseUser)
+		r.With(app.RequirePermission("users:write")).Post("/users/{id}/unlock", app.Unlock)
+		r.With(app.RequirePermission("users:write")).Post("/users/{id}/suspend", app.SuspendUser)
+		r.With(app.RequirePermission("users:write")).Post("/users/{id}/reactivate", app.ReactivateUser)
+		r.Get("/users/{id}/sessions", app.GetUserSessions)
+		r.Delete("/users/{id}/sessions/{session}", app.RevokeUserSession)
+		r.Get("/me", app.GetMe)
+		r.Get("/me/scope", app.GetMyScope)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequireLogin())
+
+			r.Put("/me/password", app.ChangePassword)
+			r.Get("/me/export", app.ExportMyData)
+			r.Post("/me/erase", app.EraseMe)
+			r.Post("/me/mfa", app.EnrollMFA)
+			r.Post("/me/mfa/confirm", app.ConfirmMFA)
+			r.Delete("/me/mfa", app.DisableMFA)
+			r.Get("/me/sessions", app.GetMySessions)
+			r.Delete("/me/sessions/{session}", app.RevokeMySession)
+			r.Get("/me/api-keys", app.GetMyAPIKeys)
+			r.Post("/me/api-keys", app.CreateAPIKey)
+			r.Delete("/me/api-keys/{key}", app.RevokeAPIKey)
+			r.Post("/authorize/consent", app.AuthorizeConsent)
+			r.Post("/logout", app.Logout)
+			r.Post("/logout-all", app.LogoutAll)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequirePermission("users:write"))
+
+			r.Get("/invitations", app.GetInvitations)
+			r.Post("/invitations", app.CreateInvitation)
+			r.Delete("/invitations/{id}", app.RevokeInvitation)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequirePermission("roles:manage"))
+
+			r.Get("/users/{id}/roles", app.GetUserRoles)
+			r.Post("/users/{id}/roles", app.GrantRole)
+			r.Delete("/users/{id}/roles/{role}", app.RevokeRole)
+		})
 	})
 
 	mux.Post("/authenticate", app.Authenticate)
+	mux.Post("/authenticate/mfa", app.AuthenticateMFA)
+	mux.Post("/login/magic", app.RequestMagicLink)
+	mux.Get("/login/magic/callback", app.MagicLinkCallback)
 	mux.Post("/registrate", app.Registrate)
+	mux.Post("/refresh", app.Refresh)
+	mux.Post("/password/forgot", app.ForgotPassword)
+	mux.Post("/password/reset", app.ResetPassword)
+	mux.Get("/verify", app.Verify)
+	mux.Post("/verify/resend", app.ResendVerification)
+	mux.Post("/oauth/token", app.OAuthToken)
+	mux.Get("/authorize", app.Authorize)
+	mux.Post("/token", app.OAuthToken)
+	mux.Get("/userinfo", app.UserInfo)
+	mux.Post("/userinfo", app.UserInfo)
+	mux.Get("/.well-known/openid-configuration", app.OpenIDConfiguration)
+	mux.Get("/.well-known/jwks.json", app.JWKSHandler)
 	return mux
 }
@@ -13,7 +13,7 @@ func Test_routes_exist(t *testing.T) {
 	testRoutes := testApp.routes()
 	chiRoutes := testRoutes.(chi.Router)
 
-	routes := []string{"/authenticate"}
+	routes := []string{"/authenticate", "/refresh", "/logout", "/logout-all", "/users/{id}", "/users/export", "/users/import", "/users/{id}/unlock", "/users/{id}/sessions", "/users/{id}/sessions/{session}", "/me", "/me/sessions", "/me/sessions/{session}", "/me/scope", "/me/api-keys", "/me/api-keys/{key}", "/me/password", "/me/export", "/me/erase", "/users/{id}/erase", "/users/{id}/suspend", "/users/{id}/reactivate", "/me/mfa", "/me/mfa/confirm", "/authenticate/mfa", "/login/magic", "/login/magic/callback", "/users/{id}/roles", "/invitations", "/invitations/{id}", "/users/{id}/roles/{role}", "/password/forgot", "/password/reset", "/verify", "/verify/resend", "/oauth/token", "/authorize", "/authorize/consent", "/token", "/userinfo", "/.well-known/openid-configuration"}
 
 	for _, route := range routes {
 		routeExists(t, chiRoutes, route)
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"auth-service/data"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// sessionTouchInterval limits how often the last seen time of a session is written, so not
+// every request costs an update
+const sessionTouchInterval = time.Minute
+
+// maxUserAgentLength is how much of the User-Agent header is kept with a session
+const maxUserAgentLength = 512
+
+// sessionResponse is one session as the users see it, marking the one they are using
+type sessionResponse struct {
+	*data.Session
+	Current bool `json:"current"`
+}
+
+// startSession records a new login of the user on the device the request comes from and
+// returns its id, which is also the family of the refresh tokens issued for it
+func (app *Config) startSession(r *http.Request, userID int, ip string) (string, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	err = app.Sessions.InsertSession(r.Context(), data.Session{
+		ID:        sessionID,
+		UserID:    userID,
+		IP:        ip,
+		UserAgent: userAgent,
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return sessionID, nil
+}
+
+// checkSession reports whether the session an access token was issued for is still valid,
+// and keeps its last seen time up to date. Tokens of sessions which aren't recorded, like
+// the ones issued before sessions existed, are only checked by the revocation store.
+func (app *Config) checkSession(ctx context.Context, userID int, sessionID string) (bool, error) {
+	session, err := app.Sessions.GetSession(ctx, sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if session.UserID != userID || session.RevokedAt != nil {
+		return false, nil
+	}
+
+	if now := time.Now(); now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		err = app.Sessions.TouchSession(ctx, sessionID, now)
+		if err != nil {
+			log.Println("Error updating the last seen time of a session:", err)
+		}
+	}
+
+	return true, nil
+}
+
+// endSession revokes one session together with the refresh tokens issued for it. Its access
+// tokens are rejected from then on, because the middleware checks the session.
+func (app *Config) endSession(ctx context.Context, sessionID string) error {
+	err := app.Sessions.RevokeSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+
+	return app.Tokens.RevokeRefreshTokenFamily(ctx, sessionID)
+}
+
+// GetMySessions lists the devices the current user is logged in on
+func (app *Config) GetMySessions(w http.ResponseWriter, r *http.Request) {
+	app.listSessions(w, r, r.Context().Value(userIDKey).(int))
+}
+
+// RevokeMySession logs the current user out on one device
+func (app *Config) RevokeMySession(w http.ResponseWriter, r *http.Request) {
+	app.revokeSession(w, r, r.Context().Value(userIDKey).(int))
+}
+
+// GetUserSessions lists the sessions of one user. Users can only see their own sessions
+// unless they have the users:read permission.
+func (app *Config) GetUserSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r, "users:read")
+	if !ok {
+		return
+	}
+
+	app.listSessions(w, r, user.ID)
+}
+
+// RevokeUserSession revokes one session of a user. Revoking the sessions of other users
+// needs the users:write permission.
+func (app *Config) RevokeUserSession(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r, "users:write")
+	if !ok {
+		return
+	}
+
+	app.revokeSession(w, r, user.ID)
+}
+
+func (app *Config) listSessions(w http.ResponseWriter, r *http.Request, userID int) {
+	sessions, err := app.Sessions.GetUserSessions(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	claims := r.Context().Value(claimsKey).(jwt.MapClaims)
+	currentID, _ := claims["sid"].(string)
+
+	response := []sessionResponse{}
+	for _, session := range sessions {
+		response = append(response, sessionResponse{Session: session, Current: session.ID == currentID})
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched sessions of user %d", userID),
+		Data:    response,
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) revokeSession(w http.ResponseWriter, r *http.Request, userID int) {
+	sessionID := chi.URLParam(r, "session")
+
+	session, err := app.Sessions.GetSession(r.Context(), sessionID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (session.UserID != userID || session.RevokedAt != nil)) {
+		app.errorJSON(w, errors.New("session not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.endSession(r.Context(), session.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("session %s of user %d has been revoked", session.ID, userID))
+
+	claims := r.Context().Value(claimsKey).(jwt.MapClaims)
+	if currentID, _ := claims["sid"].(string); currentID == session.ID {
+		clearTokenCookies(w)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked session %s", session.ID),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test_Sessions проверяет просмотр и отзыв сессий пользователем и администратором.
+func Test_Sessions(t *testing.T) {
+	routes := testApp.routes()
+
+	login := func(userID int, userAgent string) (string, *UserData) {
+		req, _ := http.NewRequest("POST", "/authenticate", nil)
+		req.Header.Set("User-Agent", userAgent)
+		sessionID, err := testApp.startSession(req, userID, "192.168.1.1")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		userData, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), userID, "192.168.1.1", sessionID)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		return sessionID, userData
+	}
+
+	request := func(method, path string, userData *UserData) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("Authorization", "Bearer "+userData.AccessToken)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	sessions := func(path string, userData *UserData) []sessionResponse {
+		rr := request("GET", path, userData)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected http.StatusOK but got %d", path, rr.Code)
+		}
+
+		var response struct {
+			Data []sessionResponse `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &response)
+		return response.Data
+	}
+
+	laptop, laptopTokens := login(6, "Firefox")
+	phone, phoneTokens := login(6, "Safari")
+	other, otherTokens := login(7, "Chrome")
+
+	list := sessions("/me/sessions", laptopTokens)
+	if len(list) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(list))
+	}
+	for _, session := range list {
+		if session.Current != (session.ID == laptop) {
+			t.Errorf("session %s: unexpected current flag %v", session.ID, session.Current)
+		}
+		if session.ID == phone && (session.UserAgent != "Safari" || session.IP != "192.168.1.1") {
+			t.Errorf("expected the device of the session to be recorded, got %+v", session.Session)
+		}
+	}
+
+	// чужую сессию нельзя ни увидеть, ни отозвать
+	if rr := request("DELETE", "/me/sessions/"+other, laptopTokens); rr.Code != http.StatusNotFound {
+		t.Errorf("expected http.StatusNotFound for the session of another user but got %d", rr.Code)
+	}
+	if rr := request("GET", "/users/7/sessions", laptopTokens); rr.Code != http.StatusForbidden {
+		t.Errorf("expected http.StatusForbidden but got %d", rr.Code)
+	}
+
+	if rr := request("DELETE", "/me/sessions/"+phone, laptopTokens); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+
+	// токены отозванной сессии больше не работают, в том числе refresh-токен
+	if rr := request("GET", "/me", phoneTokens); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for a revoked session but got %d", rr.Code)
+	}
+	body, _ := json.Marshal(map[string]string{"refresh_token": phoneTokens.RefreshToken})
+	req, _ := http.NewRequest("POST", "/refresh", bytes.NewReader(body))
+	req.RemoteAddr = "192.168.1.1:12345"
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized for the refresh token of a revoked session but got %d", rr.Code)
+	}
+
+	if rr := request("DELETE", "/me/sessions/"+phone, laptopTokens); rr.Code != http.StatusNotFound {
+		t.Errorf("expected http.StatusNotFound for an already revoked session but got %d", rr.Code)
+	}
+	if list := sessions("/me/sessions", laptopTokens); len(list) != 1 || list[0].ID != laptop {
+		t.Errorf("expected only the current session to be left, got %v", list)
+	}
+
+	// администратор видит и отзывает сессии любого пользователя
+	_ = testApp.Repo.GrantRole(context.Background(), 100, "admin")
+	_, adminTokens := login(100, "curl")
+	if list := sessions("/users/7/sessions", adminTokens); len(list) != 1 || list[0].ID != other || list[0].Current {
+		t.Errorf("expected the session of user 7, got %v", list)
+	}
+	if rr := request("DELETE", "/users/7/sessions/"+other, adminTokens); rr.Code != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+	if rr := request("GET", "/me", otherTokens); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected http.StatusUnauthorized after the admin revoked the session but got %d", rr.Code)
+	}
+}
+
+// Test_Authenticate_Session проверяет, что вход создаёт сессию с данными устройства.
+func Test_Authenticate_Session(t *testing.T) {
+	body, _ := json.Marshal(map[string]string{"email": "me@here.com", "password": "verysecret"})
+	req, _ := http.NewRequest("POST", "/authenticate", bytes.NewReader(body))
+	req.RemoteAddr = "192.168.1.1:12345"
+	req.Header.Set("User-Agent", "session-test-agent")
+	rr := httptest.NewRecorder()
+	testApp.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+
+	sessions, err := testApp.Sessions.GetUserSessions(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	found := false
+	for _, session := range sessions {
+		if session.UserAgent == "session-test-agent" && session.IP == "192.168.1.1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a session for the login, got %v", sessions)
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"auth-service/data"
+	"bytes"
+	"io"
+	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
 var testApp Config
@@ -11,5 +15,73 @@ var testApp Config
 func TestMain(m *testing.M) {
 	repo := data.NewPostgresTestRepository(nil)
 	testApp.Repo = repo
-	os.Exit(m.Run())
+	testApp.Tokens = data.NewPostgresTestRefreshTokenRepository(nil)
+	testApp.Revocations = data.NewMemoryRevocationStore()
+	testApp.Resets = data.NewPostgresTestPasswordResetRepository(nil)
+	testApp.Attempts = data.NewMemoryLoginAttemptStore()
+	testApp.MFA = data.NewPostgresTestMFARepository(nil)
+	testApp.Sessions = data.NewMemorySessionRepository()
+	testApp.APIKeys = data.NewMemoryAPIKeyRepository()
+	testApp.Clients = data.NewMemoryOAuthClientRepository()
+	testApp.Codes = data.NewMemoryAuthorizationCodeRepository()
+	testApp.Consents = data.NewMemoryConsentRepository()
+	testApp.MagicLinks = data.NewMemoryMagicLinkRepository()
+	testApp.Invitations = data.NewMemoryInvitationRepository()
+	testApp.Registration = RegistrationPolicy{Mode: registrationOpen}
+	testApp.Issuer = "http://localhost:8081"
+	testApp.LoginURL = "http://localhost/"
+	testApp.ConsentURL = "http://localhost/consent"
+	testApp.MFAIssuer = "test_task"
+	testApp.BearerTokens = true
+	testApp.DeletionGracePeriod = 30 * 24 * time.Hour
+	testApp.IPBinding = IPBindingPolicy{Mode: IPBindingStrict, IPv4Prefix: 24, IPv6Prefix: 64}
+	testApp.Lockout = LockoutPolicy{
+		BackoffAfter:     3,
+		BackoffBase:      time.Second,
+		MaxBackoff:       30 * time.Second,
+		AccountThreshold: 10,
+		IPThreshold:      100,
+		LockoutDuration:  15 * time.Minute,
+		ResetAfter:       time.Hour,
+	}
+
+	testApp.PasswordPolicy = PasswordPolicy{
+		MinLength:           8,
+		MaxLength:           128,
+		MinCharacterClasses: 1,
+		Banned:              map[string]bool{"password": true, "12345678": true},
+		CheckSimilarity:     true,
+	}
+
+	keys, err := NewKeyring("RS256")
+	if err != nil {
+		panic(err)
+	}
+	testApp.Keys = keys
+
+	testApp.Client = NewTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error": false}`)),
+			Header:     make(http.Header),
+		}
+	})
+	testApp.VerificationSecret = []byte("verification_secret")
+	testApp.VerifyURL = "http://localhost/verify"
+	testApp.resendEmailLimiter = newRateLimiter(3, time.Hour)
+	testApp.resendIPLimiter = newRateLimiter(20, time.Hour)
+	testApp.magicLinkLimiter = newRateLimiter(5, time.Hour)
+	testApp.resetEmailLimiter = newRateLimiter(3, time.Hour)
+	testApp.resetIPLimiter = newRateLimiter(20, time.Hour)
+	testApp.MagicLinkURL = "http://localhost/login/magic/callback"
+
+	outbox, err := os.MkdirTemp("", "outbox")
+	if err != nil {
+		panic(err)
+	}
+	testApp.Mailer = NewOutboxMailer(outbox)
+
+	code := m.Run()
+	os.RemoveAll(outbox)
+	os.Exit(code)
 }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"auth-service/data"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// GetUser returns one user by id. Users can only see themselves unless they have
+// the users:read permission.
+func (app *Config) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r, "users:read")
+	if !ok {
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched user %d", user.ID),
+		Data:    user,
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// UpdateUser changes the profile of one user. Only the fields present in the payload are changed.
+// Changing other users, as well as the status, needs the users:write permission, and nobody can
+// change their own status. Users without it who change their own email get a confirmation link
+// at the new address, and the email only changes once it is opened.
+func (app *Config) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email     *string `json:"email"`
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+		Status    *string `json:"status"`
+		Reason    string  `json:"status_reason"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.userFromURL(w, r, "users:write")
+	if !ok {
+		return
+	}
+
+	if requestPayload.Status != nil && !hasPermission(r, "users:write") {
+		app.errorJSON(w, errors.New("missing permission users:write"), http.StatusForbidden)
+		return
+	}
+	// the transition is checked before anything is saved, so a rejected request changes nothing
+	changeStatus := requestPayload.Status != nil && *requestPayload.Status != user.Status
+	if changeStatus && user.ID == r.Context().Value(userIDKey).(int) {
+		app.errorJSON(w, errors.New("can't change the status of your own account"), http.StatusBadRequest)
+		return
+	}
+	if changeStatus && !data.CanTransition(user.Status, *requestPayload.Status) {
+		app.errorJSON(w, invalidTransition(user.Status, *requestPayload.Status), http.StatusConflict)
+		return
+	}
+
+	var newEmail string
+	if requestPayload.Email != nil && *requestPayload.Email != user.Email {
+		if hasPermission(r, "users:write") {
+			user.Email = *requestPayload.Email
+		} else {
+			newEmail = *requestPayload.Email
+		}
+	}
+	if requestPayload.FirstName != nil {
+		user.FirstName = *requestPayload.FirstName
+	}
+	if requestPayload.LastName != nil {
+		user.LastName = *requestPayload.LastName
+	}
+
+	// the profile, the status and the confirmation email succeed or fail together
+	var updateErr, statusErr, mailErr error
+	err = app.Repo.WithTx(r.Context(), func(repo data.Repository) error {
+		updateErr = repo.Update(r.Context(), *user)
+		if updateErr != nil {
+			return updateErr
+		}
+
+		if changeStatus {
+			statusErr = repo.SetStatus(r.Context(), user.ID, *requestPayload.Status, requestPayload.Reason)
+			if statusErr != nil {
+				return statusErr
+			}
+		}
+
+		// sent last, so the update is rolled back when the email can't be sent
+		if newEmail != "" {
+			mailErr = app.sendEmailChangeEmail(user, newEmail)
+		}
+		return mailErr
+	})
+	if updateErr != nil {
+		app.errorJSON(w, updateErr, http.StatusBadRequest)
+		return
+	} else if statusErr != nil {
+		app.statusError(w, user, *requestPayload.Status, statusErr)
+		return
+	} else if mailErr != nil {
+		log.Println("Error sending email change confirmation:", mailErr)
+		app.errorJSON(w, errors.New("couldn't send the confirmation email"), http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if changeStatus {
+		if !app.statusChanged(w, r, user, *requestPayload.Status, requestPayload.Reason) {
+			return
+		}
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("user %d has been updated", user.ID))
+
+	message := fmt.Sprintf("Updated user %d", user.ID)
+	if newEmail != "" {
+		message += ", open the link sent to the new email to confirm it"
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: message,
+		Data:    user,
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// DeleteUser deletes one user and ends all of their sessions. The account can be restored
+// with ReactivateUser until it is purged after the grace period. Deleting other users needs
+// the users:delete permission.
+func (app *Config) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r, "users:delete")
+	if !ok {
+		return
+	}
+
+	if !app.changeStatus(w, r, user, data.StatusDeleted, r.URL.Query().Get("reason")) {
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Deleted user %d, the account is purged after %s", user.ID, app.DeletionGracePeriod),
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// GetMe returns the user the access token was issued to
+func (app *Config) GetMe(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Repo.GetOne(r.Context(), r.Context().Value(userIDKey).(int))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched user %d", user.ID),
+		Data:    user,
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ChangePassword changes the password of the current user, who has to confirm the old one
+func (app *Config) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), r.Context().Value(userIDKey).(int))
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	valid, err := app.Repo.PasswordMatches(r.Context(), requestPayload.OldPassword, *user)
+	if err != nil || !valid {
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.checkPassword(w, requestPayload.NewPassword, *user) {
+		return
+	}
+
+	err = app.Repo.ResetPassword(r.Context(), requestPayload.NewPassword, *user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logUserEvent(r, fmt.Sprintf("%s has changed the password", user.Email))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Password changed",
+	}
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// userQueryFromURL reads the filters, the sort order and the page of GET /users from the
+// query parameters
+func userQueryFromURL(r *http.Request) (data.UserQuery, error) {
+	values := r.URL.Query()
+	query := data.UserQuery{
+		EmailPrefix: values.Get("email"),
+		Name:        values.Get("name"),
+		Status:      values.Get("status"),
+		Cursor:      values.Get("cursor"),
+	}
+
+	if sortBy := values.Get("sort"); sortBy != "" {
+		query.SortBy = strings.TrimPrefix(sortBy, "-")
+		query.Descending = strings.HasPrefix(sortBy, "-")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > data.MaxPageSize {
+			return query, fmt.Errorf("limit must be between 1 and %d", data.MaxPageSize)
+		}
+		query.Limit = value
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"created_after", &query.CreatedAfter},
+		{"created_before", &query.CreatedBefore},
+	} {
+		if values.Get(param.name) == "" {
+			continue
+		}
+		value, err := time.Parse(time.RFC3339, values.Get(param.name))
+		if err != nil {
+			return query, fmt.Errorf("%s must be an RFC 3339 time", param.name)
+		}
+		*param.value = value
+	}
+
+	return query, nil
+}
+
+// userFromURL loads the user from the {id} url parameter. Users other than the current one can only
+// be accessed with the given permission. API keys always need the permission in their scope,
+// so a key can't change or delete the account of its owner the way /me routes don't let it
+// either. When it reports false, the error response has already been written.
+func (app *Config) userFromURL(w http.ResponseWriter, r *http.Request, permission string) (*data.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	self := id == r.Context().Value(userIDKey).(int) && !viaAPIKey(r)
+	if !self && !hasPermission(r, permission) {
+		app.errorJSON(w, fmt.Errorf("missing permission %s", permission), http.StatusForbidden)
+		return nil, false
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// logUserEvent sends a user management event to the log service, naming who did it
+func (app *Config) logUserEvent(r *http.Request, event string) {
+	err := app.logRequest("users", fmt.Sprintf("%s by user %d", event, r.Context().Value(userIDKey).(int)))
+	if err != nil {
+		log.Println("Error logging user event:", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// serveAuthenticated отправляет запрос через все маршруты сервиса от имени пользователя userID.
+func serveAuthenticated(t *testing.T, method, path string, body any, userID int) *httptest.ResponseRecorder {
+	t.Helper()
+
+	userData, err := testApp.issueTokens(context.Background(), httptest.NewRecorder(), userID, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		out, _ := json.Marshal(body)
+		reader = bytes.NewReader(out)
+	}
+
+	req, _ := http.NewRequest(method, path, reader)
+	req.RemoteAddr = "192.168.1.1:12345"
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: userData.AccessToken})
+
+	rr := httptest.NewRecorder()
+	testApp.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func Test_UserManagement(t *testing.T) {
+	testApp.Client = NewTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error": false}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     any
+		admin    bool
+		expected int
+	}{
+		{"get self", "GET", "/users/1", nil, false, http.StatusOK},
+		{"get other", "GET", "/users/2", nil, false, http.StatusForbidden},
+		{"get other as admin", "GET", "/users/2", nil, true, http.StatusOK},
+		{"list as user", "GET", "/users", nil, false, http.StatusForbidden},
+		{"list as admin", "GET", "/users", nil, true, http.StatusAccepted},
+		{"invalid id", "GET", "/users/abc", nil, false, http.StatusBadRequest},
+		{"update self", "PATCH", "/users/1", map[string]any{"first_name": "New"}, false, http.StatusAccepted},
+		{"activate self", "PATCH", "/users/1", map[string]any{"status": "active"}, false, http.StatusForbidden},
+		{"update other", "PATCH", "/users/2", map[string]any{"first_name": "New"}, false, http.StatusForbidden},
+		{"update other as admin", "PATCH", "/users/2", map[string]any{"status": "suspended", "status_reason": "spam"}, true, http.StatusAccepted},
+		{"delete other", "DELETE", "/users/2", nil, false, http.StatusForbidden},
+		{"delete other as admin", "DELETE", "/users/2", nil, true, http.StatusAccepted},
+		{"me", "GET", "/me", nil, false, http.StatusOK},
+		{"change password", "PUT", "/me/password", map[string]any{"old_password": "verysecret", "new_password": "evenmoresecret"}, false, http.StatusAccepted},
+	}
+
+	_ = testApp.Repo.GrantRole(context.Background(), 100, "admin")
+
+	for _, e := range tests {
+		userID := 1
+		if e.admin {
+			userID = 100
+		}
+
+		rr := serveAuthenticated(t, e.method, e.path, e.body, userID)
+		if rr.Code != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, rr.Code)
+		}
+	}
+}
+
+func Test_ListUsers(t *testing.T) {
+	repo := testApp.Repo
+	testApp.Repo = data.NewMemoryRepository()
+	defer func() { testApp.Repo = repo }()
+
+	ctx := context.Background()
+	admin, _ := testApp.Repo.Insert(ctx, data.User{Email: "admin@here.com", LastName: "Admin", Password: "verysecret", Status: data.StatusActive})
+	_ = testApp.Repo.GrantRole(ctx, admin, "admin")
+	for _, name := range []string{"Delta", "Alpha", "Charlie", "Bravo"} {
+		_, _ = testApp.Repo.Insert(ctx, data.User{Email: strings.ToLower(name) + "@here.com", LastName: name, Password: "verysecret"})
+	}
+
+	list := func(query string) (*httptest.ResponseRecorder, data.Page) {
+		rr := serveAuthenticated(t, "GET", "/users?"+query, nil, admin)
+		var payload struct {
+			Data data.Page `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &payload)
+		return rr, payload.Data
+	}
+
+	// постраничный обход по курсору
+	var names []string
+	query := "status=pending&sort=-last_name&limit=3"
+	for {
+		rr, page := list(query)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected http.StatusAccepted but got %d: %s", rr.Code, rr.Body.String())
+		}
+		if page.TotalCount != 4 {
+			t.Errorf("expected a total count of 4, got %d", page.TotalCount)
+		}
+		for _, user := range page.Users {
+			names = append(names, user.LastName)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query = "status=pending&sort=-last_name&limit=3&cursor=" + url.QueryEscape(page.NextCursor)
+	}
+	if strings.Join(names, ",") != "Delta,Charlie,Bravo,Alpha" {
+		t.Errorf("unexpected users %v", names)
+	}
+
+	if _, page := list("email=CHAR"); len(page.Users) != 1 || page.Users[0].LastName != "Charlie" {
+		t.Errorf("expected the user with the email prefix, got %+v", page.Users)
+	}
+
+	for _, query := range []string{"sort=password", "status=banned", "limit=0", "limit=1000", "created_after=yesterday", "cursor=broken"} {
+		if rr, _ := list(query); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected http.StatusBadRequest but got %d", query, rr.Code)
+		}
+	}
+}
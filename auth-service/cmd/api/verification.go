@@ -0,0 +1,231 @@
+package main
+
+import (
+	"auth-service/data"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// verificationTTL is how long an email verification link can be used
+const verificationTTL = 24 * time.Hour
+
+var errInvalidVerificationToken = errors.New("invalid or expired verification token")
+
+// verificationClaims is the signed content of an email verification token. The email is part
+// of it, so a link stops working once the user changes their email. Tokens confirming a change
+// of the email also carry the new one.
+type verificationClaims struct {
+	UserID    int    `json:"uid"`
+	Email     string `json:"email"`
+	NewEmail  string `json:"new_email,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// generateVerificationToken signs the claims with HMAC-SHA256. The token doesn't need to be
+// stored, the signature is enough to trust it.
+func generateVerificationToken(secret []byte, userID int, email string) (string, error) {
+	return signVerificationClaims(secret, verificationClaims{UserID: userID, Email: email})
+}
+
+// generateEmailChangeToken signs a token which changes the email of the user to newEmail
+// once it is opened from the new address
+func generateEmailChangeToken(secret []byte, userID int, email, newEmail string) (string, error) {
+	return signVerificationClaims(secret, verificationClaims{UserID: userID, Email: email, NewEmail: newEmail})
+}
+
+func signVerificationClaims(secret []byte, claims verificationClaims) (string, error) {
+	claims.ExpiresAt = time.Now().Add(verificationTTL).Unix()
+
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + signVerificationPayload(secret, payload), nil
+}
+
+// parseVerificationToken checks the signature and the expiry of the token and returns its claims
+func parseVerificationToken(secret []byte, token string) (*verificationClaims, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, errInvalidVerificationToken
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(signVerificationPayload(secret, payload))) {
+		return nil, errInvalidVerificationToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidVerificationToken
+	}
+
+	var claims verificationClaims
+	err = json.Unmarshal(raw, &claims)
+	if err != nil {
+		return nil, errInvalidVerificationToken
+	}
+
+	if time.Now().Unix() > claims.ExpiresAt {
+		return nil, errInvalidVerificationToken
+	}
+
+	return &claims, nil
+}
+
+func signVerificationPayload(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sendVerificationEmail emails the user a link which activates their account
+func (app *Config) sendVerificationEmail(user *data.User) error {
+	token, err := generateVerificationToken(app.VerificationSecret, user.ID, user.Email)
+	if err != nil {
+		return err
+	}
+
+	return app.Mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("Welcome!\n\nTo activate your account, open the link below within %s:\n%s?token=%s\n",
+			verificationTTL, app.VerifyURL, url.QueryEscape(token)),
+	})
+}
+
+// sendEmailChangeEmail emails the new address of the user a link which confirms the change
+func (app *Config) sendEmailChangeEmail(user *data.User, newEmail string) error {
+	token, err := generateEmailChangeToken(app.VerificationSecret, user.ID, user.Email, newEmail)
+	if err != nil {
+		return err
+	}
+
+	return app.Mailer.Send(Message{
+		To:      newEmail,
+		Subject: "Confirm your new email",
+		Body: fmt.Sprintf("Hello!\n\nTo use this address for your account, open the link below within %s:\n%s?token=%s\n",
+			verificationTTL, app.VerifyURL, url.QueryEscape(token)),
+	})
+}
+
+// Verify activates the account the verification token was issued for, or changes its email
+// when the token confirms a new one
+func (app *Config) Verify(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseVerificationToken(app.VerificationSecret, r.URL.Query().Get("token"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.Repo.GetOne(r.Context(), claims.UserID)
+	if err != nil || user.Email != claims.Email {
+		app.errorJSON(w, errInvalidVerificationToken, http.StatusBadRequest)
+		return
+	}
+
+	if claims.NewEmail != "" {
+		app.confirmEmailChange(w, r, user, claims.NewEmail)
+		return
+	}
+
+	if user.Status == data.StatusPending {
+		err = app.Repo.SetStatus(r.Context(), user.ID, data.StatusActive, "")
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		err = app.logRequest("registrations", fmt.Sprintf("%s has verified the email", user.Email))
+		if err != nil {
+			log.Println("Error logging email verification:", err)
+		}
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Email %s has been verified", user.Email),
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// confirmEmailChange changes the email of the user to the address the link has been opened
+// from. The address is verified now, so a pending account becomes active.
+func (app *Config) confirmEmailChange(w http.ResponseWriter, r *http.Request, user *data.User, newEmail string) {
+	user.Email = newEmail
+	err := app.Repo.Update(r.Context(), *user)
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if user.Status == data.StatusPending {
+		err = app.Repo.SetStatus(r.Context(), user.ID, data.StatusActive, "")
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = app.logRequest("users", fmt.Sprintf("user %d has confirmed a new email", user.ID))
+	if err != nil {
+		log.Println("Error logging email change:", err)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Email %s has been verified", user.Email),
+	}
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ResendVerification sends the verification link again. Like ForgotPassword, it is rate limited
+// per email and per client address, and answers the same whether the email is registered or not.
+func (app *Config) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.resendIPLimiter.Allow(app.ClientIP.ClientIP(r)) || !app.resendEmailLimiter.Allow(strings.ToLower(requestPayload.Email)) {
+		app.errorJSON(w, errors.New("too many verification emails requested, try again later"), http.StatusTooManyRequests)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "If the email is registered and not verified yet, a verification link has been sent to it",
+	}
+
+	user, err := app.Repo.GetByEmail(r.Context(), requestPayload.Email)
+	if err != nil || user.Status != data.StatusPending {
+		app.writeJSON(w, http.StatusAccepted, payload)
+		return
+	}
+
+	err = app.sendVerificationEmail(user)
+	if err != nil {
+		// the answer stays the same, otherwise it would tell which emails are pending
+		log.Println("Error sending verification email:", err)
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
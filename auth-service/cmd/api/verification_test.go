@@ -0,0 +1,149 @@
+package main
+
+import (
+	"auth-service/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_VerificationToken(t *testing.T) {
+	secret := []byte("verification_secret")
+
+	token, err := generateVerificationToken(secret, 5, "me@here.com")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	claims, err := parseVerificationToken(secret, token)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if claims.UserID != 5 || claims.Email != "me@here.com" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if _, err := parseVerificationToken([]byte("other_secret"), token); err == nil {
+		t.Error("expected token signed with another secret to be rejected")
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	if _, err := parseVerificationToken(secret, payload+"x."+signature); err == nil {
+		t.Error("expected tampered token to be rejected")
+	}
+}
+
+func Test_Verify(t *testing.T) {
+	token, _ := generateVerificationToken(testApp.VerificationSecret, 5, "me@here.com")
+
+	tests := []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{"valid token", token, http.StatusOK},
+		{"invalid token", "invalid", http.StatusBadRequest},
+		{"no token", "", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/verify?token="+url.QueryEscape(e.token), nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(testApp.Verify).ServeHTTP(rr, req)
+
+		if rr.Code != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, rr.Code)
+		}
+	}
+}
+
+func Test_Registrate_SendsVerificationEmail(t *testing.T) {
+	outbox := t.TempDir()
+	mailer := testApp.Mailer
+	testApp.Mailer = NewOutboxMailer(outbox)
+	defer func() { testApp.Mailer = mailer }()
+
+	body, _ := json.Marshal(map[string]any{
+		"email":    "new@here.com",
+		"password": "verysecret",
+		"status":   "active",
+	})
+	req, _ := http.NewRequest("POST", "/registrate", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(testApp.Registrate).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(outbox, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one email in the outbox, got %d", len(files))
+	}
+	email, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(email), "To: new@here.com") || !strings.Contains(string(email), "/verify?token=") {
+		t.Errorf("unexpected verification email %s", email)
+	}
+}
+
+func Test_ResendVerification_RateLimitAndMailerError(t *testing.T) {
+	mailer := testApp.Mailer
+	testApp.Mailer = failingMailer{}
+	defer func() { testApp.Mailer = mailer }()
+	defer func() {
+		testApp.resendEmailLimiter = newRateLimiter(3, time.Hour)
+		testApp.resendIPLimiter = newRateLimiter(20, time.Hour)
+	}()
+
+	resend := func(email, ip string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"email": email})
+		req, _ := http.NewRequest("POST", "/verify/resend", bytes.NewReader(body))
+		req.RemoteAddr = ip + ":12345"
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(testApp.ResendVerification).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// ошибка отправки не отличает неподтверждённый email от незарегистрированного
+	ctx := context.Background()
+	id, _ := testApp.Repo.Insert(ctx, data.User{Email: "pending-resend@here.com", Password: "verysecret", Status: data.StatusPending})
+	defer func() { _ = testApp.Repo.PurgeByID(ctx, id) }()
+
+	pending := resend("pending-resend@here.com", "10.0.6.1")
+	unknown := resend("nobody-resend@here.com", "10.0.6.1")
+	if pending.Code != http.StatusAccepted || pending.Body.String() != unknown.Body.String() {
+		t.Errorf("expected the same answer for both emails, got %d %s and %d %s",
+			pending.Code, pending.Body.String(), unknown.Code, unknown.Body.String())
+	}
+
+	// лимит по email действует независимо от адреса клиента
+	testApp.resendEmailLimiter = newRateLimiter(3, time.Hour)
+	for i := 0; i < 3; i++ {
+		if rr := resend("limited@here.com", fmt.Sprintf("10.0.7.%d", i)); rr.Code != http.StatusAccepted {
+			t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+		}
+	}
+	if rr := resend("limited@here.com", "10.0.7.9"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected http.StatusTooManyRequests per email but got %d", rr.Code)
+	}
+
+	// лимит по адресу клиента действует для разных email
+	testApp.resendIPLimiter = newRateLimiter(20, time.Hour)
+	for i := 0; i < 20; i++ {
+		if rr := resend(fmt.Sprintf("user%d@here.com", i), "10.0.8.1"); rr.Code != http.StatusAccepted {
+			t.Fatalf("expected http.StatusAccepted but got %d", rr.Code)
+		}
+	}
+	if rr := resend("another@here.com", "10.0.8.1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected http.StatusTooManyRequests per address but got %d", rr.Code)
+	}
+}
@@ -0,0 +1,359 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKey is a personal key for machine access on behalf of a user. Like refresh tokens, only
+// the hash of the key is stored; the prefix is kept so users can tell their keys apart.
+type APIKey struct {
+	ID      int    `json:"id"`
+	UserID  int    `json:"user_id"`
+	Name    string `json:"name"`
+	Prefix  string `json:"prefix"`
+	KeyHash string `json:"-"`
+	// Scopes limits the key to these permissions of the user, all of them when it is empty
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type PostgresAPIKeyRepository struct {
+	Conn *sql.DB
+	// tx is set on the repository returned by InTx
+	tx *sql.Tx
+}
+
+func NewPostgresAPIKeyRepository(pool *sql.DB) *PostgresAPIKeyRepository {
+	return &PostgresAPIKeyRepository{
+		Conn: pool,
+	}
+}
+
+// db returns the transaction the repository runs in, or the connection pool if there is none
+func (k *PostgresAPIKeyRepository) db() dbtx {
+	if k.tx != nil {
+		return k.tx
+	}
+
+	return k.Conn
+}
+
+// InTx returns the API keys bound to the database transaction of repo
+func (k *PostgresAPIKeyRepository) InTx(repo Repository) APIKeyRepository {
+	tx := sqlTxOf(repo)
+	if tx == nil {
+		return k
+	}
+
+	return &PostgresAPIKeyRepository{Conn: k.Conn, tx: tx}
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, created_at, revoked_at`
+
+// InsertAPIKey stores a new API key and returns the ID of the newly inserted row
+func (k *PostgresAPIKeyRepository) InsertAPIKey(ctx context.Context, key APIKey) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var expiresAt sql.NullTime
+	if key.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: *key.ExpiresAt, Valid: true}
+	}
+
+	var newID int
+	stmt := `insert into api_keys (user_id, name, prefix, key_hash, scopes, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := k.db().QueryRowContext(ctx, stmt,
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.KeyHash,
+		strings.Join(key.Scopes, " "),
+		expiresAt,
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetAPIKeyByHash returns one API key by the hash of its value, or sql.ErrNoRows if there
+// is none
+func (k *PostgresAPIKeyRepository) GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	rows, err := k.db().QueryContext(ctx, `select `+apiKeyColumns+` from api_keys where key_hash = $1`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys, err := scanAPIKeys(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return keys[0], nil
+}
+
+// GetUserAPIKeys returns the API keys of the user which haven't been revoked, the newest first
+func (k *PostgresAPIKeyRepository) GetUserAPIKeys(ctx context.Context, userID int) ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select ` + apiKeyColumns + ` from api_keys where user_id = $1 and revoked_at is null
+		order by created_at desc, id desc`
+
+	rows, err := k.db().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAPIKeys(rows)
+}
+
+// TouchAPIKey records that the key has just been used
+func (k *PostgresAPIKeyRepository) TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := k.db().ExecContext(ctx, `update api_keys set last_used_at = $1 where id = $2`, usedAt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeAPIKey revokes one API key of the user. It returns sql.ErrNoRows when the user has
+// no such key, or it has been revoked already.
+func (k *PostgresAPIKeyRepository) RevokeAPIKey(ctx context.Context, userID, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	result, err := k.db().ExecContext(ctx, `update api_keys set revoked_at = $1
+		where id = $2 and user_id = $3 and revoked_at is null`, time.Now(), id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// RevokeUserAPIKeys revokes every API key of the user
+func (k *PostgresAPIKeyRepository) RevokeUserAPIKeys(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := k.db().ExecContext(ctx, `update api_keys set revoked_at = $1 where user_id = $2 and revoked_at is null`,
+		time.Now(), userID)
+	return err
+}
+
+func scanAPIKeys(rows *sql.Rows) ([]*APIKey, error) {
+	var keys []*APIKey
+
+	for rows.Next() {
+		var key APIKey
+		var scopes string
+		var expiresAt, lastUsedAt, revokedAt sql.NullTime
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			&key.KeyHash,
+			&scopes,
+			&expiresAt,
+			&lastUsedAt,
+			&key.CreatedAt,
+			&revokedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		key.Scopes = strings.Fields(scopes)
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.Time
+		}
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+// MemoryAPIKeyRepository keeps the API keys in memory. It is meant for tests and for running
+// the service without Postgres.
+type MemoryAPIKeyRepository struct {
+	mu   sync.Mutex
+	keys []*APIKey
+}
+
+func NewMemoryAPIKeyRepository() *MemoryAPIKeyRepository {
+	return &MemoryAPIKeyRepository{}
+}
+
+// InsertAPIKey stores a new API key and returns its ID
+func (k *MemoryAPIKeyRepository) InsertAPIKey(ctx context.Context, key APIKey) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key.ID = len(k.keys) + 1
+	key.Scopes = append([]string(nil), key.Scopes...)
+	key.CreatedAt = time.Now()
+	key.LastUsedAt = nil
+	key.RevokedAt = nil
+	k.keys = append(k.keys, &key)
+
+	return key.ID, nil
+}
+
+// GetAPIKeyByHash returns one API key by the hash of its value, or sql.ErrNoRows if there
+// is none
+func (k *MemoryAPIKeyRepository) GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, key := range k.keys {
+		if key.KeyHash == hash {
+			found := *key
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetUserAPIKeys returns the API keys of the user which haven't been revoked, the newest first
+func (k *MemoryAPIKeyRepository) GetUserAPIKeys(ctx context.Context, userID int) ([]*APIKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var keys []*APIKey
+	for _, key := range k.keys {
+		if key.UserID == userID && key.RevokedAt == nil {
+			found := *key
+			keys = append(keys, &found)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID > keys[j].ID
+	})
+
+	return keys, nil
+}
+
+// TouchAPIKey records that the key has just been used
+func (k *MemoryAPIKeyRepository) TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, key := range k.keys {
+		if key.ID == id {
+			key.LastUsedAt = &usedAt
+		}
+	}
+
+	return nil
+}
+
+// RevokeAPIKey revokes one API key of the user. It returns sql.ErrNoRows when the user has
+// no such key, or it has been revoked already.
+func (k *MemoryAPIKeyRepository) RevokeAPIKey(ctx context.Context, userID, id int) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, key := range k.keys {
+		if key.ID == id && key.UserID == userID && key.RevokedAt == nil {
+			now := time.Now()
+			key.RevokedAt = &now
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+// RevokeUserAPIKeys revokes every API key of the user
+func (k *MemoryAPIKeyRepository) RevokeUserAPIKeys(ctx context.Context, userID int) error {
+	k.revokeUserAPIKeys(userID)
+	return nil
+}
+
+// revokeUserAPIKeys revokes the keys of the user and returns the function which restores them
+func (k *MemoryAPIKeyRepository) revokeUserAPIKeys(userID int) func() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	var revoked []*APIKey
+	for _, key := range k.keys {
+		if key.UserID == userID && key.RevokedAt == nil {
+			key.RevokedAt = &now
+			revoked = append(revoked, key)
+		}
+	}
+
+	return func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+
+		for _, key := range revoked {
+			key.RevokedAt = nil
+		}
+	}
+}
+
+// InTx returns the API keys for the transaction of repo. They stay in memory, so the keys
+// revoked with RevokeUserAPIKeys are restored when the transaction fails.
+func (k *MemoryAPIKeyRepository) InTx(repo Repository) APIKeyRepository {
+	tx, ok := repo.(txRepository)
+	if !ok {
+		return k
+	}
+
+	return &memoryAPIKeysTx{MemoryAPIKeyRepository: k, tx: tx}
+}
+
+// memoryAPIKeysTx are the memory API keys used in a transaction of another repository
+type memoryAPIKeysTx struct {
+	*MemoryAPIKeyRepository
+	tx txRepository
+}
+
+func (t *memoryAPIKeysTx) RevokeUserAPIKeys(ctx context.Context, userID int) error {
+	t.tx.onRollback(t.revokeUserAPIKeys(userID))
+	return nil
+}
@@ -0,0 +1,230 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// LoginAttempts counts the failed logins for one key, e.g. an account or an IP address
+type LoginAttempts struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+// PostgresLoginAttemptStore keeps the failed login counters in Postgres, so they are shared
+// by every replica of the service
+type PostgresLoginAttemptStore struct {
+	Conn *sql.DB
+	// tx is set on the repository returned by InTx
+	tx *sql.Tx
+}
+
+func NewPostgresLoginAttemptStore(pool *sql.DB) *PostgresLoginAttemptStore {
+	return &PostgresLoginAttemptStore{
+		Conn: pool,
+	}
+}
+
+// db returns the transaction the repository runs in, or the connection pool if there is none
+func (s *PostgresLoginAttemptStore) db() dbtx {
+	if s.tx != nil {
+		return s.tx
+	}
+
+	return s.Conn
+}
+
+// InTx returns the login attempts bound to the database transaction of repo
+func (s *PostgresLoginAttemptStore) InTx(repo Repository) LoginAttemptStore {
+	tx := sqlTxOf(repo)
+	if tx == nil {
+		return s
+	}
+
+	return &PostgresLoginAttemptStore{Conn: s.Conn, tx: tx}
+}
+
+// GetAttempts returns the counter for the key, or an empty one if there were no failures
+func (s *PostgresLoginAttemptStore) GetAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select key, failures, last_failure_at, locked_until from login_attempts where key = $1`
+
+	attempts, err := scanLoginAttempts(s.db().QueryRowContext(ctx, query, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return &LoginAttempts{Key: key}, nil
+	}
+
+	return attempts, err
+}
+
+// RecordFailure counts one more failed login for the key. Failures older than resetAfter
+// are forgotten, so counting starts over.
+func (s *PostgresLoginAttemptStore) RecordFailure(ctx context.Context, key string, resetAfter time.Duration) (*LoginAttempts, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	stmt := `insert into login_attempts (key, failures, last_failure_at) values ($1, 1, $2)
+		on conflict (key) do update set
+			failures = case when login_attempts.last_failure_at < $3 then 1 else login_attempts.failures + 1 end,
+			last_failure_at = $2
+		returning key, failures, last_failure_at, locked_until`
+
+	return scanLoginAttempts(s.db().QueryRowContext(ctx, stmt, key, now, now.Add(-resetAfter)))
+}
+
+// Lock locks the key until the given time
+func (s *PostgresLoginAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.db().ExecContext(ctx, `update login_attempts set locked_until = $1 where key = $2`, until, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reset forgets the failures of the key and lifts its lock
+func (s *PostgresLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.db().ExecContext(ctx, `delete from login_attempts where key = $1`, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func scanLoginAttempts(row *sql.Row) (*LoginAttempts, error) {
+	var attempts LoginAttempts
+	var lockedUntil sql.NullTime
+
+	err := row.Scan(&attempts.Key, &attempts.Failures, &attempts.LastFailureAt, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	if lockedUntil.Valid {
+		attempts.LockedUntil = &lockedUntil.Time
+	}
+
+	return &attempts, nil
+}
+
+// MemoryLoginAttemptStore keeps the failed login counters in memory. It is meant for tests and
+// single instance deployments.
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempts
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{
+		attempts: make(map[string]LoginAttempts),
+	}
+}
+
+// GetAttempts returns the counter for the key, or an empty one if there were no failures
+func (s *MemoryLoginAttemptStore) GetAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok {
+		attempts = LoginAttempts{Key: key}
+	}
+
+	return &attempts, nil
+}
+
+// RecordFailure counts one more failed login for the key. Failures older than resetAfter
+// are forgotten, so counting starts over.
+func (s *MemoryLoginAttemptStore) RecordFailure(ctx context.Context, key string, resetAfter time.Duration) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	attempts, ok := s.attempts[key]
+	if !ok || now.Sub(attempts.LastFailureAt) > resetAfter {
+		attempts = LoginAttempts{Key: key, LockedUntil: attempts.LockedUntil}
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = now
+	s.attempts[key] = attempts
+
+	return &attempts, nil
+}
+
+// Lock locks the key until the given time
+func (s *MemoryLoginAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := s.attempts[key]
+	attempts.Key = key
+	attempts.LockedUntil = &until
+	s.attempts[key] = attempts
+
+	return nil
+}
+
+// Reset forgets the failures of the key and lifts its lock
+func (s *MemoryLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+
+	return nil
+}
+
+// reset forgets the key and returns the function which restores it
+func (s *MemoryLoginAttemptStore) reset(key string) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.attempts[key]
+	delete(s.attempts, key)
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if ok {
+			s.attempts[key] = attempts
+		}
+	}
+}
+
+// InTx returns the counters for the transaction of repo. They stay in memory, so the keys
+// forgotten with Reset are restored when the transaction fails.
+func (s *MemoryLoginAttemptStore) InTx(repo Repository) LoginAttemptStore {
+	tx, ok := repo.(txRepository)
+	if !ok {
+		return s
+	}
+
+	return &memoryLoginAttemptsTx{MemoryLoginAttemptStore: s, tx: tx}
+}
+
+// memoryLoginAttemptsTx are the memory counters used in a transaction of another repository
+type memoryLoginAttemptsTx struct {
+	*MemoryLoginAttemptStore
+	tx txRepository
+}
+
+func (t *memoryLoginAttemptsTx) Reset(ctx context.Context, key string) error {
+	t.tx.onRollback(t.reset(key))
+	return nil
+}
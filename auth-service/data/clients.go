@@ -0,0 +1,153 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuthClient is a service registered to get tokens from the OAuth2 token endpoint, or an
+// application which logs its users in with OpenID Connect. Only the hash of its secret is
+// stored; public clients, like single page apps, have no secret and must use PKCE.
+type OAuthClient struct {
+	ID         string   `json:"client_id"`
+	Name       string   `json:"name"`
+	SecretHash string   `json:"-"`
+	Scopes     []string `json:"scopes"`
+	// RedirectURIs are the only addresses authorization codes are sent to
+	RedirectURIs []string  `json:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Public reports whether the client has no secret to authenticate with
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// HasRedirectURI reports whether the uri is registered for the client. It must match exactly.
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasScope reports whether the client may ask for the scope
+func (c *OAuthClient) HasScope(scope string) bool {
+	for _, granted := range c.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+type PostgresOAuthClientRepository struct {
+	Conn *sql.DB
+}
+
+func NewPostgresOAuthClientRepository(pool *sql.DB) *PostgresOAuthClientRepository {
+	return &PostgresOAuthClientRepository{
+		Conn: pool,
+	}
+}
+
+// GetOAuthClient returns one client by its id, or sql.ErrNoRows if there is none
+func (c *PostgresOAuthClientRepository) GetOAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select client_id, name, secret_hash, scopes, redirect_uris, created_at from oauth_clients where client_id = $1`
+
+	var client OAuthClient
+	var scopes, redirectURIs string
+	err := c.Conn.QueryRowContext(ctx, query, id).Scan(
+		&client.ID,
+		&client.Name,
+		&client.SecretHash,
+		&scopes,
+		&redirectURIs,
+		&client.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	client.Scopes = strings.Fields(scopes)
+	client.RedirectURIs = strings.Fields(redirectURIs)
+
+	return &client, nil
+}
+
+// UpsertOAuthClient registers a client, or replaces the name, secret, scopes and redirect uris
+// of a client which is registered already
+func (c *PostgresOAuthClientRepository) UpsertOAuthClient(ctx context.Context, client OAuthClient) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `insert into oauth_clients (client_id, name, secret_hash, scopes, redirect_uris, created_at)
+		values ($1, $2, $3, $4, $5, $6)
+		on conflict (client_id) do update set name = $2, secret_hash = $3, scopes = $4, redirect_uris = $5`
+
+	_, err := c.Conn.ExecContext(ctx, stmt,
+		client.ID,
+		client.Name,
+		client.SecretHash,
+		strings.Join(client.Scopes, " "),
+		strings.Join(client.RedirectURIs, " "),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MemoryOAuthClientRepository keeps the clients in memory. It is meant for tests and for
+// running the service without Postgres.
+type MemoryOAuthClientRepository struct {
+	mu      sync.Mutex
+	clients map[string]OAuthClient
+}
+
+func NewMemoryOAuthClientRepository() *MemoryOAuthClientRepository {
+	return &MemoryOAuthClientRepository{
+		clients: make(map[string]OAuthClient),
+	}
+}
+
+// GetOAuthClient returns one client by its id, or sql.ErrNoRows if there is none
+func (c *MemoryOAuthClientRepository) GetOAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, ok := c.clients[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &client, nil
+}
+
+// UpsertOAuthClient registers a client, or replaces the name, secret, scopes and redirect uris
+// of a client which is registered already
+func (c *MemoryOAuthClientRepository) UpsertOAuthClient(ctx context.Context, client OAuthClient) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client.Scopes = append([]string(nil), client.Scopes...)
+	client.RedirectURIs = append([]string(nil), client.RedirectURIs...)
+	client.CreatedAt = time.Now()
+	if existing, ok := c.clients[client.ID]; ok {
+		client.CreatedAt = existing.CreatedAt
+	}
+	c.clients[client.ID] = client
+
+	return nil
+}
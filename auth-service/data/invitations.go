@@ -0,0 +1,418 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invitation is a single-use code which lets somebody register when sign-ups are restricted.
+// Only the hash of the code is stored. The roles are granted to the user who registers with it.
+type Invitation struct {
+	ID       int    `json:"id"`
+	CodeHash string `json:"-"`
+	// Email, when set, is the only address the invitation can be used with
+	Email     string     `json:"email,omitempty"`
+	Roles     []string   `json:"roles"`
+	CreatedBy *int       `json:"created_by,omitempty"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	UsedBy    *int       `json:"used_by,omitempty"`
+}
+
+// usable reports whether the invitation can still be used
+func (i *Invitation) usable(now time.Time) bool {
+	return i.UsedAt == nil && i.ExpiresAt.After(now)
+}
+
+type PostgresInvitationRepository struct {
+	Conn *sql.DB
+	// tx is set on the repository returned by InTx
+	tx *sql.Tx
+}
+
+func NewPostgresInvitationRepository(pool *sql.DB) *PostgresInvitationRepository {
+	return &PostgresInvitationRepository{
+		Conn: pool,
+	}
+}
+
+// db returns the transaction the repository runs in, or the connection pool if there is none
+func (p *PostgresInvitationRepository) db() dbtx {
+	if p.tx != nil {
+		return p.tx
+	}
+
+	return p.Conn
+}
+
+// InTx returns the invitations bound to the database transaction of repo
+func (p *PostgresInvitationRepository) InTx(repo Repository) InvitationRepository {
+	tx := sqlTxOf(repo)
+	if tx == nil {
+		return p
+	}
+
+	return &PostgresInvitationRepository{Conn: p.Conn, tx: tx}
+}
+
+const invitationColumns = `id, code_hash, email, roles, created_by, expires_at, created_at, used_at, used_by`
+
+// InsertInvitation stores a new invitation and returns its ID
+func (p *PostgresInvitationRepository) InsertInvitation(ctx context.Context, invitation Invitation) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into invitations (code_hash, email, roles, created_by, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := p.db().QueryRowContext(ctx, stmt,
+		invitation.CodeHash,
+		invitation.Email,
+		strings.Join(invitation.Roles, " "),
+		invitation.CreatedBy,
+		invitation.ExpiresAt,
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetInvitation returns an unused and unexpired invitation without using it up. It returns
+// sql.ErrNoRows for any code which can't be used.
+func (p *PostgresInvitationRepository) GetInvitation(ctx context.Context, hash string) (*Invitation, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	rows, err := p.db().QueryContext(ctx, `select `+invitationColumns+` from invitations
+		where code_hash = $1 and used_at is null and expires_at > $2`, hash, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations, err := scanInvitations(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(invitations) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return invitations[0], nil
+}
+
+// ConsumeInvitation marks an unused and unexpired invitation as used and returns it. It returns
+// sql.ErrNoRows for any code which can't be used.
+func (p *PostgresInvitationRepository) ConsumeInvitation(ctx context.Context, hash string) (*Invitation, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	rows, err := p.db().QueryContext(ctx, `update invitations set used_at = $1
+		where code_hash = $2 and used_at is null and expires_at > $1
+		returning `+invitationColumns, time.Now(), hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations, err := scanInvitations(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(invitations) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return invitations[0], nil
+}
+
+// SetInvitationUser records the user who has registered with a consumed invitation
+func (p *PostgresInvitationRepository) SetInvitationUser(ctx context.Context, id, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := p.db().ExecContext(ctx, `update invitations set used_by = $1 where id = $2`, userID, id)
+	return err
+}
+
+// GetInvitations returns all the invitations, the newest first
+func (p *PostgresInvitationRepository) GetInvitations(ctx context.Context) ([]*Invitation, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	rows, err := p.db().QueryContext(ctx, `select `+invitationColumns+` from invitations order by created_at desc, id desc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanInvitations(rows)
+}
+
+// RevokeInvitation deletes an invitation which hasn't been used. It returns sql.ErrNoRows
+// when there is no such invitation, or it has been used already.
+func (p *PostgresInvitationRepository) RevokeInvitation(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	result, err := p.db().ExecContext(ctx, `delete from invitations where id = $1 and used_at is null`, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ClearInvitationEmails removes the email from the invitations sent to it or used by the user
+func (p *PostgresInvitationRepository) ClearInvitationEmails(ctx context.Context, email string, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := p.db().ExecContext(ctx, `update invitations set email = ''
+		where lower(email) = lower($1) or used_by = $2`, email, userID)
+	return err
+}
+
+func scanInvitations(rows *sql.Rows) ([]*Invitation, error) {
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		var invitation Invitation
+		var roles string
+		var createdBy, usedBy sql.NullInt64
+		var usedAt sql.NullTime
+		err := rows.Scan(
+			&invitation.ID,
+			&invitation.CodeHash,
+			&invitation.Email,
+			&roles,
+			&createdBy,
+			&invitation.ExpiresAt,
+			&invitation.CreatedAt,
+			&usedAt,
+			&usedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invitation.Roles = strings.Fields(roles)
+		if createdBy.Valid {
+			id := int(createdBy.Int64)
+			invitation.CreatedBy = &id
+		}
+		if usedAt.Valid {
+			invitation.UsedAt = &usedAt.Time
+		}
+		if usedBy.Valid {
+			id := int(usedBy.Int64)
+			invitation.UsedBy = &id
+		}
+		invitations = append(invitations, &invitation)
+	}
+
+	return invitations, rows.Err()
+}
+
+// MemoryInvitationRepository keeps the invitations in memory. It is meant for tests and for
+// running the service without Postgres.
+type MemoryInvitationRepository struct {
+	mu          sync.Mutex
+	nextID      int
+	invitations []*Invitation
+}
+
+func NewMemoryInvitationRepository() *MemoryInvitationRepository {
+	return &MemoryInvitationRepository{nextID: 1}
+}
+
+// copyInvitation returns a copy which doesn't share the roles with the stored invitation
+func copyInvitation(invitation *Invitation) *Invitation {
+	found := *invitation
+	found.Roles = append([]string{}, invitation.Roles...)
+	return &found
+}
+
+// InsertInvitation stores a new invitation and returns its ID
+func (m *MemoryInvitationRepository) InsertInvitation(ctx context.Context, invitation Invitation) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invitation.ID = m.nextID
+	m.nextID++
+	invitation.CreatedAt = time.Now()
+	invitation.UsedAt = nil
+	invitation.UsedBy = nil
+	m.invitations = append(m.invitations, copyInvitation(&invitation))
+
+	return invitation.ID, nil
+}
+
+// GetInvitation returns an unused and unexpired invitation without using it up
+func (m *MemoryInvitationRepository) GetInvitation(ctx context.Context, hash string) (*Invitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, invitation := range m.invitations {
+		if invitation.CodeHash == hash && invitation.usable(time.Now()) {
+			return copyInvitation(invitation), nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// InTx returns the invitations for the transaction of repo. They stay in memory, so the ones
+// consumed through it are released again when the transaction fails.
+func (m *MemoryInvitationRepository) InTx(repo Repository) InvitationRepository {
+	tx, ok := repo.(txRepository)
+	if !ok {
+		return m
+	}
+
+	return &memoryInvitationTx{MemoryInvitationRepository: m, tx: tx}
+}
+
+// ConsumeInvitation marks an unused and unexpired invitation as used and returns it
+func (m *MemoryInvitationRepository) ConsumeInvitation(ctx context.Context, hash string) (*Invitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, invitation := range m.invitations {
+		if invitation.CodeHash == hash && invitation.usable(now) {
+			invitation.UsedAt = &now
+			return copyInvitation(invitation), nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// SetInvitationUser records the user who has registered with a consumed invitation
+func (m *MemoryInvitationRepository) SetInvitationUser(ctx context.Context, id, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, invitation := range m.invitations {
+		if invitation.ID == id {
+			invitation.UsedBy = &userID
+		}
+	}
+
+	return nil
+}
+
+// release makes a consumed invitation usable again
+func (m *MemoryInvitationRepository) release(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, invitation := range m.invitations {
+		if invitation.ID == id {
+			invitation.UsedAt = nil
+			invitation.UsedBy = nil
+		}
+	}
+}
+
+// ClearInvitationEmails removes the email from the invitations sent to it or used by the user
+func (m *MemoryInvitationRepository) ClearInvitationEmails(ctx context.Context, email string, userID int) error {
+	m.clearInvitationEmails(email, userID)
+	return nil
+}
+
+// clearInvitationEmails clears the invitations and returns the function which restores them
+func (m *MemoryInvitationRepository) clearInvitationEmails(email string, userID int) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cleared := make(map[int]string)
+	for _, invitation := range m.invitations {
+		usedByUser := invitation.UsedBy != nil && *invitation.UsedBy == userID
+		if invitation.Email != "" && (strings.EqualFold(invitation.Email, email) || usedByUser) {
+			cleared[invitation.ID] = invitation.Email
+			invitation.Email = ""
+		}
+	}
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		for _, invitation := range m.invitations {
+			if email, ok := cleared[invitation.ID]; ok {
+				invitation.Email = email
+			}
+		}
+	}
+}
+
+// memoryInvitationTx are the memory invitations used in a transaction of another repository
+type memoryInvitationTx struct {
+	*MemoryInvitationRepository
+	tx txRepository
+}
+
+// ConsumeInvitation consumes the invitation and releases it when the transaction fails
+func (t *memoryInvitationTx) ConsumeInvitation(ctx context.Context, hash string) (*Invitation, error) {
+	invitation, err := t.MemoryInvitationRepository.ConsumeInvitation(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	t.tx.onRollback(func() { t.release(invitation.ID) })
+	return invitation, nil
+}
+
+// GetInvitations returns all the invitations, the newest first
+func (m *MemoryInvitationRepository) GetInvitations(ctx context.Context) ([]*Invitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invitations := []*Invitation{}
+	for _, invitation := range m.invitations {
+		invitations = append(invitations, copyInvitation(invitation))
+	}
+	sort.Slice(invitations, func(i, j int) bool { return invitations[i].ID > invitations[j].ID })
+
+	return invitations, nil
+}
+
+// RevokeInvitation deletes an invitation which hasn't been used
+func (m *MemoryInvitationRepository) RevokeInvitation(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, invitation := range m.invitations {
+		if invitation.ID == id && invitation.UsedAt == nil {
+			m.invitations = append(m.invitations[:i], m.invitations[i+1:]...)
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+// ClearInvitationEmails clears the emails and restores them when the transaction fails
+func (t *memoryInvitationTx) ClearInvitationEmails(ctx context.Context, email string, userID int) error {
+	t.tx.onRollback(t.clearInvitationEmails(email, userID))
+	return nil
+}
@@ -0,0 +1,134 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// MagicLink is one passwordless login link sent to a user. Only the hash of the token in the
+// link is stored, and using the link marks it as used, so it works only once.
+type MagicLink struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+type PostgresMagicLinkRepository struct {
+	Conn *sql.DB
+}
+
+func NewPostgresMagicLinkRepository(pool *sql.DB) *PostgresMagicLinkRepository {
+	return &PostgresMagicLinkRepository{
+		Conn: pool,
+	}
+}
+
+// InsertMagicLink stores a new login link. Links sent to the user before stop working, so
+// only the latest email can be used.
+func (m *PostgresMagicLinkRepository) InsertMagicLink(ctx context.Context, link MagicLink) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := m.Conn.ExecContext(ctx, `update magic_links set used_at = $1 where user_id = $2 and used_at is null`,
+		time.Now(), link.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into magic_links (user_id, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4) returning id`
+
+	err = m.Conn.QueryRowContext(ctx, stmt,
+		link.UserID,
+		link.TokenHash,
+		link.ExpiresAt,
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// ConsumeMagicLink marks an unused and unexpired login link as used and returns it. It
+// returns sql.ErrNoRows for any link which can't be used.
+func (m *PostgresMagicLinkRepository) ConsumeMagicLink(ctx context.Context, hash string) (*MagicLink, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update magic_links set used_at = $1
+		where token_hash = $2 and used_at is null and expires_at > $1
+		returning id, user_id, token_hash, expires_at, created_at, used_at`
+
+	var link MagicLink
+	var usedAt time.Time
+	err := m.Conn.QueryRowContext(ctx, stmt, time.Now(), hash).Scan(
+		&link.ID,
+		&link.UserID,
+		&link.TokenHash,
+		&link.ExpiresAt,
+		&link.CreatedAt,
+		&usedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	link.UsedAt = &usedAt
+
+	return &link, nil
+}
+
+// MemoryMagicLinkRepository keeps the login links in memory. It is meant for tests and for
+// running the service without Postgres.
+type MemoryMagicLinkRepository struct {
+	mu    sync.Mutex
+	links []*MagicLink
+}
+
+func NewMemoryMagicLinkRepository() *MemoryMagicLinkRepository {
+	return &MemoryMagicLinkRepository{}
+}
+
+// InsertMagicLink stores a new login link, invalidating the previous ones of the user
+func (m *MemoryMagicLinkRepository) InsertMagicLink(ctx context.Context, link MagicLink) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, existing := range m.links {
+		if existing.UserID == link.UserID && existing.UsedAt == nil {
+			existing.UsedAt = &now
+		}
+	}
+
+	link.ID = len(m.links) + 1
+	link.CreatedAt = now
+	m.links = append(m.links, &link)
+
+	return link.ID, nil
+}
+
+// ConsumeMagicLink marks an unused and unexpired login link as used and returns it. It
+// returns sql.ErrNoRows for any link which can't be used.
+func (m *MemoryMagicLinkRepository) ConsumeMagicLink(ctx context.Context, hash string) (*MagicLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, link := range m.links {
+		if link.TokenHash == hash && link.UsedAt == nil && link.ExpiresAt.After(now) {
+			link.UsedAt = &now
+			found := *link
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
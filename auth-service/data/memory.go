@@ -0,0 +1,403 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryRoles are the roles and permissions seeded by the migrations
+var memoryRoles = map[string][]string{
+	"admin": {"logs:write", "roles:manage", "users:delete", "users:read", "users:write"},
+	"user":  {"logs:write"},
+}
+
+// memoryState is everything a MemoryRepository stores
+type memoryState struct {
+	nextID int
+	users  map[int]User
+	roles  map[int]map[string]bool
+	// deletedFrom is the state each deleted user had before the deletion
+	deletedFrom map[int]string
+}
+
+func (s *memoryState) clone() *memoryState {
+	clone := &memoryState{
+		nextID:      s.nextID,
+		users:       make(map[int]User, len(s.users)),
+		roles:       make(map[int]map[string]bool, len(s.roles)),
+		deletedFrom: make(map[int]string, len(s.deletedFrom)),
+	}
+	for id, user := range s.users {
+		clone.users[id] = user
+	}
+	for id, status := range s.deletedFrom {
+		clone.deletedFrom[id] = status
+	}
+	for id, roles := range s.roles {
+		clone.roles[id] = make(map[string]bool, len(roles))
+		for role := range roles {
+			clone.roles[id][role] = true
+		}
+	}
+
+	return clone
+}
+
+// MemoryRepository keeps the users in memory. It is safe for concurrent use and enforces
+// the same constraints as the database, which makes it suitable for tests and for running
+// the service locally without Postgres. Everything is lost on restart.
+type MemoryRepository struct {
+	mu    *sync.Mutex
+	state *memoryState
+	// inTx is set on the repository passed to WithTx, which already holds the lock
+	inTx bool
+	// rollback holds the functions which undo changes made outside the repository when the
+	// transaction fails
+	rollback *[]func()
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		mu: &sync.Mutex{},
+		state: &memoryState{
+			nextID:      1,
+			users:       make(map[int]User),
+			roles:       make(map[int]map[string]bool),
+			deletedFrom: make(map[int]string),
+		},
+	}
+}
+
+// lock locks the repository unless it is running in a transaction, and returns the unlock function
+func (m *MemoryRepository) lock() func() {
+	if m.inTx {
+		return func() {}
+	}
+
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+// WithTx runs fn while holding the lock, so transactions are serialized. When fn fails,
+// all of its changes are undone.
+func (m *MemoryRepository) WithTx(ctx context.Context, fn func(Repository) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := m.state.clone()
+	var rollback []func()
+	err := fn(&MemoryRepository{mu: m.mu, state: m.state, inTx: true, rollback: &rollback})
+	if err != nil {
+		*m.state = *snapshot
+		undo(rollback)
+		return err
+	}
+
+	return nil
+}
+
+func (m *MemoryRepository) sqlTx() *sql.Tx {
+	return nil
+}
+
+func (m *MemoryRepository) onRollback(fn func()) {
+	if m.rollback != nil {
+		*m.rollback = append(*m.rollback, fn)
+	}
+}
+
+// GetAll returns a slice of all users, sorted by last name
+func (m *MemoryRepository) GetAll(ctx context.Context) ([]*User, error) {
+	defer m.lock()()
+
+	var users []*User
+	for _, user := range m.state.users {
+		user := user
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastName != users[j].LastName {
+			return users[i].LastName < users[j].LastName
+		}
+		return users[i].ID < users[j].ID
+	})
+
+	return users, nil
+}
+
+// GetByEmail returns one user by email
+func (m *MemoryRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	defer m.lock()()
+
+	for _, user := range m.state.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetOne returns one user by id
+func (m *MemoryRepository) GetOne(ctx context.Context, id int) (*User, error) {
+	defer m.lock()()
+
+	user, ok := m.state.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &user, nil
+}
+
+// Update updates the profile of one user, the status is changed with SetStatus
+func (m *MemoryRepository) Update(ctx context.Context, user User) error {
+	defer m.lock()()
+
+	existing, ok := m.state.users[user.ID]
+	if !ok {
+		return nil
+	}
+	if m.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	existing.Email = user.Email
+	existing.FirstName = user.FirstName
+	existing.LastName = user.LastName
+	existing.UpdatedAt = time.Now()
+	m.state.users[user.ID] = existing
+
+	return nil
+}
+
+// DeleteByID marks one user as deleted, PurgeDeleted removes the user after the grace period
+func (m *MemoryRepository) DeleteByID(ctx context.Context, id int) error {
+	return m.SetStatus(ctx, id, StatusDeleted, "")
+}
+
+// SetStatus moves the user to the new state with the reason
+func (m *MemoryRepository) SetStatus(ctx context.Context, id int, status, reason string) error {
+	defer m.lock()()
+
+	existing, ok := m.state.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if !CanTransition(existing.Status, status) {
+		return ErrInvalidTransition
+	}
+
+	delete(m.state.deletedFrom, id)
+	if status == StatusDeleted {
+		m.state.deletedFrom[id] = existing.Status
+	}
+	existing.setStatus(status, reason, time.Now())
+	m.state.users[id] = existing
+
+	return nil
+}
+
+// Restore brings a deleted user back to the state they had before the deletion and returns it
+func (m *MemoryRepository) Restore(ctx context.Context, id int, reason string) (string, error) {
+	defer m.lock()()
+
+	existing, ok := m.state.users[id]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	if existing.Status != StatusDeleted {
+		return "", ErrInvalidTransition
+	}
+
+	// users always have a state before the deletion here, pending only mirrors Postgres
+	status, ok := m.state.deletedFrom[id]
+	if !ok {
+		status = StatusPending
+	}
+	delete(m.state.deletedFrom, id)
+	existing.setStatus(status, reason, time.Now())
+	m.state.users[id] = existing
+
+	return existing.Status, nil
+}
+
+// PurgeByID removes one user together with their roles, whatever the state of the user
+func (m *MemoryRepository) PurgeByID(ctx context.Context, id int) error {
+	defer m.lock()()
+
+	delete(m.state.users, id)
+	delete(m.state.roles, id)
+	delete(m.state.deletedFrom, id)
+
+	return nil
+}
+
+// PurgeDeleted removes the users deleted before the time and returns how many there were
+func (m *MemoryRepository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	defer m.lock()()
+
+	purged := 0
+	for id, user := range m.state.users {
+		if user.Status == StatusDeleted && user.DeletedAt != nil && user.DeletedAt.Before(before) {
+			delete(m.state.users, id)
+			delete(m.state.roles, id)
+			delete(m.state.deletedFrom, id)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// Insert adds a new user and returns the ID of the user
+func (m *MemoryRepository) Insert(ctx context.Context, user User) (int, error) {
+	hashedPassword, err := hashPassword(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	defer m.lock()()
+
+	if m.emailTaken(user.Email, 0) {
+		return 0, ErrDuplicateEmail
+	}
+
+	user.ID = m.state.nextID
+	user.Password = hashedPassword
+	user.Status = user.initialStatus()
+	user.StatusReason = ""
+	user.DeletedAt = nil
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	m.state.users[user.ID] = user
+	m.state.nextID++
+
+	return user.ID, nil
+}
+
+// ResetPassword changes the password of the user
+func (m *MemoryRepository) ResetPassword(ctx context.Context, password string, user User) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	defer m.lock()()
+
+	existing, ok := m.state.users[user.ID]
+	if !ok {
+		return nil
+	}
+	existing.Password = hashedPassword
+	m.state.users[user.ID] = existing
+
+	return nil
+}
+
+// PasswordMatches compares the password with the hash of the user, replacing a legacy bcrypt
+// hash or one made with old settings once the password has matched
+func (m *MemoryRepository) PasswordMatches(ctx context.Context, plainText string, user User) (bool, error) {
+	match, rehash, err := verifyPassword(plainText, user.Password)
+	if err != nil || !match {
+		return false, err
+	}
+
+	if rehash {
+		hashedPassword, err := hashPassword(plainText)
+		if err != nil {
+			return true, err
+		}
+
+		defer m.lock()()
+
+		// the password may have been changed in the meantime
+		if existing, ok := m.state.users[user.ID]; ok && existing.Password == user.Password {
+			existing.Password = hashedPassword
+			m.state.users[user.ID] = existing
+		}
+	}
+
+	return true, nil
+}
+
+// GetRoles returns the names of the roles granted to the user
+func (m *MemoryRepository) GetRoles(ctx context.Context, userID int) ([]string, error) {
+	defer m.lock()()
+
+	roles := []string{}
+	for role := range m.state.roles[userID] {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	return roles, nil
+}
+
+// GetPermissions returns the names of all the permissions the user has through their roles
+func (m *MemoryRepository) GetPermissions(ctx context.Context, userID int) ([]string, error) {
+	defer m.lock()()
+
+	unique := make(map[string]bool)
+	for role := range m.state.roles[userID] {
+		for _, permission := range memoryRoles[role] {
+			unique[permission] = true
+		}
+	}
+
+	permissions := []string{}
+	for permission := range unique {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+
+	return permissions, nil
+}
+
+// GrantRole grants the role to the user. Granting a role the user already has is not an error.
+func (m *MemoryRepository) GrantRole(ctx context.Context, userID int, role string) error {
+	defer m.lock()()
+
+	if _, ok := memoryRoles[role]; !ok {
+		return ErrUnknownRole
+	}
+	if _, ok := m.state.users[userID]; !ok {
+		return errors.New("user does not exist")
+	}
+
+	if m.state.roles[userID] == nil {
+		m.state.roles[userID] = make(map[string]bool)
+	}
+	m.state.roles[userID][role] = true
+
+	return nil
+}
+
+// RevokeRole takes the role away from the user
+func (m *MemoryRepository) RevokeRole(ctx context.Context, userID int, role string) error {
+	defer m.lock()()
+
+	delete(m.state.roles[userID], role)
+
+	return nil
+}
+
+// emailTaken reports whether another user than the given one has the email. The emails are
+// compared like the unique index in the database does, i.e. case sensitive.
+func (m *MemoryRepository) emailTaken(email string, exceptID int) bool {
+	for id, user := range m.state.users {
+		if id != exceptID && user.Email == email {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,346 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// MFA is the TOTP second factor of a user. It only protects logins once it has been enabled,
+// i.e. the user has confirmed the secret with a valid code.
+type MFA struct {
+	UserID int    `json:"user_id"`
+	Secret string `json:"-"`
+	// LastUsedStep is the time step of the last accepted code, so no code can be used twice
+	LastUsedStep int64      `json:"-"`
+	EnabledAt    *time.Time `json:"enabled_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Enabled reports whether logins of the user need a second factor
+func (m *MFA) Enabled() bool {
+	return m.EnabledAt != nil
+}
+
+type PostgresMFARepository struct {
+	Conn *sql.DB
+	// tx is set on the repository returned by InTx
+	tx *sql.Tx
+}
+
+func NewPostgresMFARepository(pool *sql.DB) *PostgresMFARepository {
+	return &PostgresMFARepository{
+		Conn: pool,
+	}
+}
+
+// db returns the transaction the repository runs in, or the connection pool if there is none
+func (m *PostgresMFARepository) db() dbtx {
+	if m.tx != nil {
+		return m.tx
+	}
+
+	return m.Conn
+}
+
+// InTx returns the second factors bound to the database transaction of repo
+func (m *PostgresMFARepository) InTx(repo Repository) MFARepository {
+	tx := sqlTxOf(repo)
+	if tx == nil {
+		return m
+	}
+
+	return &PostgresMFARepository{Conn: m.Conn, tx: tx}
+}
+
+// GetMFA returns the second factor of the user, or sql.ErrNoRows if the user has none
+func (m *PostgresMFARepository) GetMFA(ctx context.Context, userID int) (*MFA, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select user_id, secret, last_used_step, enabled_at, created_at from user_mfa where user_id = $1`
+
+	var mfa MFA
+	var enabledAt sql.NullTime
+	err := m.db().QueryRowContext(ctx, query, userID).Scan(
+		&mfa.UserID,
+		&mfa.Secret,
+		&mfa.LastUsedStep,
+		&enabledAt,
+		&mfa.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if enabledAt.Valid {
+		mfa.EnabledAt = &enabledAt.Time
+	}
+
+	return &mfa, nil
+}
+
+// SetMFASecret starts a new, not yet enabled enrollment with the given secret, replacing
+// any previous one
+func (m *PostgresMFARepository) SetMFASecret(ctx context.Context, userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `insert into user_mfa (user_id, secret, last_used_step, enabled_at, created_at) values ($1, $2, 0, null, $3)
+		on conflict (user_id) do update set secret = $2, last_used_step = 0, enabled_at = null, created_at = $3`
+
+	_, err := m.db().ExecContext(ctx, stmt, userID, secret, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EnableMFA enables the second factor of the user and replaces the recovery codes
+// with the given hashes
+func (m *PostgresMFARepository) EnableMFA(ctx context.Context, userID int, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	return m.inTx(ctx, func(tx dbtx) error {
+		_, err := tx.ExecContext(ctx, `update user_mfa set enabled_at = $1 where user_id = $2`, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from mfa_recovery_codes where user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range recoveryCodeHashes {
+			_, err = tx.ExecContext(ctx, `insert into mfa_recovery_codes (user_id, code_hash) values ($1, $2)`, userID, hash)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// DisableMFA removes the second factor and the recovery codes of the user
+func (m *PostgresMFARepository) DisableMFA(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	return m.inTx(ctx, func(tx dbtx) error {
+		_, err := tx.ExecContext(ctx, `delete from mfa_recovery_codes where user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from user_mfa where user_id = $1`, userID)
+		return err
+	})
+}
+
+// inTx runs fn in the transaction the repository is bound to, or in a new one
+func (m *PostgresMFARepository) inTx(ctx context.Context, fn func(tx dbtx) error) error {
+	if m.tx != nil {
+		return fn(m.tx)
+	}
+
+	tx, err := m.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code of the given time step has been accepted. It reports false
+// if a code of this or a later step has been used already.
+func (m *PostgresMFARepository) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, `update user_mfa set last_used_step = $1 where user_id = $2 and last_used_step < $1`,
+		step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// ConsumeRecoveryCode marks an unused recovery code of the user as used. It reports false
+// if there is no such code.
+func (m *PostgresMFARepository) ConsumeRecoveryCode(ctx context.Context, userID int, hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, `update mfa_recovery_codes set used_at = $1
+		where user_id = $2 and code_hash = $3 and used_at is null`, time.Now(), userID, hash)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// MemoryMFARepository keeps the second factors in memory. It is meant for tests and for
+// running the service without Postgres.
+type MemoryMFARepository struct {
+	mu            sync.Mutex
+	mfa           map[int]*MFA
+	recoveryCodes map[int]map[string]bool
+}
+
+func NewMemoryMFARepository() *MemoryMFARepository {
+	return &MemoryMFARepository{
+		mfa:           make(map[int]*MFA),
+		recoveryCodes: make(map[int]map[string]bool),
+	}
+}
+
+// GetMFA returns the second factor of the user, or sql.ErrNoRows if the user has none
+func (m *MemoryMFARepository) GetMFA(ctx context.Context, userID int) (*MFA, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mfa, ok := m.mfa[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	found := *mfa
+	return &found, nil
+}
+
+// SetMFASecret starts a new, not yet enabled enrollment with the given secret
+func (m *MemoryMFARepository) SetMFASecret(ctx context.Context, userID int, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mfa[userID] = &MFA{UserID: userID, Secret: secret, CreatedAt: time.Now()}
+
+	return nil
+}
+
+// EnableMFA enables the second factor of the user and replaces the recovery codes
+func (m *MemoryMFARepository) EnableMFA(ctx context.Context, userID int, recoveryCodeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mfa, ok := m.mfa[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	mfa.EnabledAt = &now
+
+	m.recoveryCodes[userID] = make(map[string]bool)
+	for _, hash := range recoveryCodeHashes {
+		m.recoveryCodes[userID][hash] = false
+	}
+
+	return nil
+}
+
+// DisableMFA removes the second factor and the recovery codes of the user
+func (m *MemoryMFARepository) DisableMFA(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.mfa, userID)
+	delete(m.recoveryCodes, userID)
+
+	return nil
+}
+
+// UseTOTPStep records that a code of the given time step has been accepted
+func (m *MemoryMFARepository) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mfa, ok := m.mfa[userID]
+	if !ok || mfa.LastUsedStep >= step {
+		return false, nil
+	}
+	mfa.LastUsedStep = step
+
+	return true, nil
+}
+
+// ConsumeRecoveryCode marks an unused recovery code of the user as used
+func (m *MemoryMFARepository) ConsumeRecoveryCode(ctx context.Context, userID int, hash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	used, ok := m.recoveryCodes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	m.recoveryCodes[userID][hash] = true
+
+	return true, nil
+}
+
+// disableMFA removes the second factor of the user and returns the function which restores it
+func (m *MemoryMFARepository) disableMFA(userID int) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mfa, hadMFA := m.mfa[userID]
+	codes, hadCodes := m.recoveryCodes[userID]
+	delete(m.mfa, userID)
+	delete(m.recoveryCodes, userID)
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if hadMFA {
+			m.mfa[userID] = mfa
+		}
+		if hadCodes {
+			m.recoveryCodes[userID] = codes
+		}
+	}
+}
+
+// InTx returns the second factors for the transaction of repo. They stay in memory, so the
+// ones removed with DisableMFA are restored when the transaction fails.
+func (m *MemoryMFARepository) InTx(repo Repository) MFARepository {
+	tx, ok := repo.(txRepository)
+	if !ok {
+		return m
+	}
+
+	return &memoryMFATx{MemoryMFARepository: m, tx: tx}
+}
+
+// memoryMFATx are the memory second factors used in a transaction of another repository
+type memoryMFATx struct {
+	*MemoryMFARepository
+	tx txRepository
+}
+
+func (t *memoryMFATx) DisableMFA(ctx context.Context, userID int) error {
+	t.tx.onRollback(t.disableMFA(userID))
+	return nil
+}
@@ -5,208 +5,355 @@ import (
 	"database/sql"
 	"errors"
 	"log"
+	"strconv"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 const dbTimeout = time.Second * 3
 
-var db *sql.DB
+// ErrDuplicateEmail is returned when inserting or updating a user with an email which
+// belongs to another user
+var ErrDuplicateEmail = errors.New("email is already in use")
+
+// dbtx is what the queries need, satisfied by both *sql.DB and *sql.Tx
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
 
 type PostgresRepository struct {
 	Conn *sql.DB
+	// tx is set on the repository passed to WithTx
+	tx *sql.Tx
+	// rollback holds the functions which undo changes made outside the database when the
+	// transaction is rolled back
+	rollback *[]func()
 }
 
 func NewPostgresRepository(pool *sql.DB) *PostgresRepository {
-	db = pool
 	return &PostgresRepository{
 		Conn: pool,
 	}
 }
 
-// User is the structure which holds one user from the database.
-type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	FirstName string    `json:"first_name,omitempty"`
-	LastName  string    `json:"last_name,omitempty"`
-	Password  string    `json:"-"`
-	Active    int       `json:"active"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+// db returns the transaction the repository runs in, or the connection pool if there is none
+func (u *PostgresRepository) db() dbtx {
+	if u.tx != nil {
+		return u.tx
+	}
+
+	return u.Conn
 }
 
-// GetAll returns a slice of all users, sorted by last name
-func (u *PostgresRepository) GetAll() ([]*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// WithTx runs fn with a repository bound to a new transaction. When it is called inside
+// another WithTx, fn joins the transaction which is already running.
+func (u *PostgresRepository) WithTx(ctx context.Context, fn func(Repository) error) error {
+	if u.tx != nil {
+		return fn(u)
+	}
 
-	query := `select id, email, first_name, last_name, password, active, created_at, updated_at
-	from users order by last_name`
+	tx, err := u.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	rows, err := db.QueryContext(ctx, query)
+	var rollback []func()
+	err = fn(&PostgresRepository{Conn: u.Conn, tx: tx, rollback: &rollback})
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		return nil, err
+		undo(rollback)
+		return err
 	}
-	defer rows.Close()
 
-	var users []*User
+	return nil
+}
 
-	for rows.Next() {
-		var user User
-		err := rows.Scan(
-			&user.ID,
-			&user.Email,
-			&user.FirstName,
-			&user.LastName,
-			&user.Password,
-			&user.Active,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-		)
-		if err != nil {
-			log.Println("Error scanning", err)
-			return nil, err
-		}
+func (u *PostgresRepository) sqlTx() *sql.Tx {
+	return u.tx
+}
 
-		users = append(users, &user)
+func (u *PostgresRepository) onRollback(fn func()) {
+	if u.rollback != nil {
+		*u.rollback = append(*u.rollback, fn)
 	}
+}
 
-	return users, nil
+// User is the structure which holds one user from the database.
+type User struct {
+	ID        int    `json:"id"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Password  string `json:"-"`
+	// Status is one of Statuses, it is changed through SetStatus
+	Status string `json:"status"`
+	// StatusReason is why the account has been suspended or deleted
+	StatusReason string     `json:"status_reason,omitempty"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
 }
 
-// GetByEmail returns one user by email
-func (u *PostgresRepository) GetByEmail(email string) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+const userColumns = `id, email, first_name, last_name, password, status, status_reason, deleted_at, created_at, updated_at`
 
-	query := `select id, email, first_name, last_name, password, active, created_at, updated_at from users where email = $1`
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
 
+// scanUser reads one user selected with userColumns
+func scanUser(row rowScanner) (*User, error) {
 	var user User
-	row := db.QueryRowContext(ctx, query, email)
-
-	if db == nil {
-		return nil, errors.New("database connection is not initialized")
-	}
-
+	var deletedAt sql.NullTime
 	err := row.Scan(
 		&user.ID,
 		&user.Email,
 		&user.FirstName,
 		&user.LastName,
 		&user.Password,
-		&user.Active,
+		&user.Status,
+		&user.StatusReason,
+		&deletedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
-
 	if err != nil {
 		return nil, err
 	}
 
+	if deletedAt.Valid {
+		user.DeletedAt = &deletedAt.Time
+	}
+
 	return &user, nil
 }
 
-// GetOne returns one user by id
-func (u *PostgresRepository) GetOne(id int) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// GetAll returns a slice of all users, sorted by last name
+func (u *PostgresRepository) GetAll(ctx context.Context) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, active, created_at, updated_at from users where id = $1`
-
-	var user User
-	row := db.QueryRowContext(ctx, query, id)
-
-	err := row.Scan(
-		&user.ID,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.Active,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	query := `select ` + userColumns + ` from users order by last_name`
 
+	rows, err := u.db().QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &user, nil
+	var users []*User
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// GetByEmail returns one user by email
+func (u *PostgresRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select ` + userColumns + ` from users where email = $1`
+
+	return scanUser(u.db().QueryRowContext(ctx, query, email))
 }
 
-// Update updates one user in the database, using the information
-// stored in the receiver u
-func (u *PostgresRepository) Update(user User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// GetOne returns one user by id
+func (u *PostgresRepository) GetOne(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select ` + userColumns + ` from users where id = $1`
+
+	return scanUser(u.db().QueryRowContext(ctx, query, id))
+}
+
+// Update updates the profile of one user in the database, using the information
+// stored in the receiver u. The status is changed with SetStatus.
+func (u *PostgresRepository) Update(ctx context.Context, user User) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	stmt := `update users set
 		email = $1,
 		first_name = $2,
 		last_name = $3,
-		active = $4,
-		updated_at = $5
-		where id = $6
+		updated_at = $4
+		where id = $5
 	`
 
-	_, err := db.ExecContext(ctx, stmt,
+	_, err := u.db().ExecContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
-		user.Active,
 		time.Now(),
 		user.ID,
 	)
 
-	if err != nil {
+	if isUniqueViolation(err) {
+		return ErrDuplicateEmail
+	} else if err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// DeleteByID deletes one user from the database, by ID
-func (u *PostgresRepository) DeleteByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// DeleteByID marks one user as deleted. The row is kept until PurgeDeleted removes it, so
+// the account can be restored during the grace period.
+func (u *PostgresRepository) DeleteByID(ctx context.Context, id int) error {
+	return u.SetStatus(ctx, id, StatusDeleted, "")
+}
+
+// SetStatus moves the user to the new state with the reason. It returns ErrInvalidTransition
+// when the user can't go there from the current state and sql.ErrNoRows when there is no
+// such user.
+func (u *PostgresRepository) SetStatus(ctx context.Context, id int, status, reason string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	stmt := `delete from users where id = $1`
+	from := statusesTo(status)
+	if len(from) == 0 {
+		return ErrInvalidTransition
+	}
+
+	var changed User
+	changed.setStatus(status, reason, time.Now())
+	args := []any{changed.Status, changed.StatusReason, changed.DeletedAt, changed.UpdatedAt, id}
+	placeholders := ""
+	for i, state := range from {
+		if i > 0 {
+			placeholders += ", "
+		}
+		args = append(args, state)
+		placeholders += "$" + strconv.Itoa(len(args))
+	}
+
+	// the old state is kept on deletion, the right side reads the row before the update
+	before := "null"
+	if status == StatusDeleted {
+		before = "status"
+	}
+
+	stmt := `update users set status_before_deletion = ` + before + `,
+		status = $1, status_reason = $2, deleted_at = $3, updated_at = $4
+		where id = $5 and status in (` + placeholders + `)`
 
-	_, err := db.ExecContext(ctx, stmt, id)
+	result, err := u.db().ExecContext(ctx, stmt, args...)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	var exists int
+	err = u.db().QueryRowContext(ctx, `select 1 from users where id = $1`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	return ErrInvalidTransition
+}
+
+// Restore brings a deleted user back to the state they had before the deletion, pending for
+// users deleted before it was kept, and returns that state
+func (u *PostgresRepository) Restore(ctx context.Context, id int, reason string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update users set status = coalesce(status_before_deletion, $1), status_before_deletion = null,
+		status_reason = $2, deleted_at = null, updated_at = $3
+		where id = $4 and status = $5
+		returning status`
+
+	var status string
+	err := u.db().QueryRowContext(ctx, stmt, StatusPending, reason, time.Now(), id, StatusDeleted).Scan(&status)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return status, err
+	}
+
+	var exists int
+	err = u.db().QueryRowContext(ctx, `select 1 from users where id = $1`, id).Scan(&exists)
+	if err != nil {
+		return "", err
+	}
+
+	return "", ErrInvalidTransition
+}
+
+// PurgeByID removes one user from the database together with everything which belongs to
+// them, whatever the state of the user
+func (u *PostgresRepository) PurgeByID(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := u.db().ExecContext(ctx, `delete from users where id = $1`, id)
+	return err
+}
+
+// PurgeDeleted removes the users deleted before the time and returns how many there were
+func (u *PostgresRepository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	result, err := u.db().ExecContext(ctx, `delete from users where status = $1 and deleted_at < $2`, StatusDeleted, before)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := result.RowsAffected()
+	return int(rows), err
 }
 
 // Insert inserts a new user into the database, and returns the ID of the newly inserted row
-func (u *PostgresRepository) Insert(user User) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *PostgresRepository) Insert(ctx context.Context, user User) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	hashedPassword, err := hashPassword(user.Password)
 	if err != nil {
 		return 0, err
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, active, created_at, updated_at)
+	stmt := `insert into users (email, first_name, last_name, password, status, created_at, updated_at)
 		values ($1, $2, $3, $4, $5, $6, $7) returning id`
 
-	err = db.QueryRowContext(ctx, stmt,
+	err = u.db().QueryRowContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
-		user.Active,
+		user.initialStatus(),
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
 
-	if err != nil {
+	if isUniqueViolation(err) {
+		return 0, ErrDuplicateEmail
+	} else if err != nil {
 		return 0, err
 	}
 
@@ -214,17 +361,17 @@ func (u *PostgresRepository) Insert(user User) (int, error) {
 }
 
 // ResetPassword is the method we will use to change a user's password.
-func (u *PostgresRepository) ResetPassword(password string, user User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *PostgresRepository) ResetPassword(ctx context.Context, password string, user User) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return err
 	}
 
 	stmt := `update users set password = $1 where id = $2`
-	_, err = db.ExecContext(ctx, stmt, hashedPassword, user.ID)
+	_, err = u.db().ExecContext(ctx, stmt, hashedPassword, user.ID)
 	if err != nil {
 		return err
 	}
@@ -232,20 +379,47 @@ func (u *PostgresRepository) ResetPassword(password string, user User) error {
 	return nil
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
-func (u *PostgresRepository) PasswordMatches(plainText string, user User) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:
-			return false, err
+// PasswordMatches compares a user supplied password with the hash we have stored for the
+// user. A legacy bcrypt hash, or one made with old settings, is replaced by a new argon2id
+// hash once the password has matched.
+func (u *PostgresRepository) PasswordMatches(ctx context.Context, plainText string, user User) (bool, error) {
+	match, rehash, err := verifyPassword(plainText, user.Password)
+	if err != nil || !match {
+		return false, err
+	}
+
+	if rehash {
+		ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		defer cancel()
+
+		hashedPassword, err := hashPassword(plainText)
+		if err != nil {
+			return true, err
+		}
+
+		// the password may have been changed in the meantime
+		stmt := `update users set password = $1 where id = $2 and password = $3`
+		_, err = u.db().ExecContext(ctx, stmt, hashedPassword, user.ID, user.Password)
+		if err != nil {
+			return true, err
 		}
 	}
 
 	return true, nil
 }
+
+// isUniqueViolation reports whether the error is a violated unique constraint, in Postgres
+// as well as in SQLite
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505" // unique_violation
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+	}
+
+	return false
+}
@@ -0,0 +1,260 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthorizationCode is issued by the OpenID Connect authorization endpoint and exchanged once
+// for tokens at the token endpoint. Only the hash of the code is stored, together with the
+// PKCE challenge the client has to answer.
+type AuthorizationCode struct {
+	CodeHash      string
+	ClientID      string
+	UserID        int
+	RedirectURI   string
+	Scopes        []string
+	Nonce         string
+	CodeChallenge string
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+	CreatedAt     time.Time
+}
+
+// Consent records the scopes a user has allowed a client, so they aren't asked again on
+// every login
+type Consent struct {
+	UserID    int       `json:"user_id"`
+	ClientID  string    `json:"client_id"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Covers reports whether every one of the scopes has been allowed
+func (c *Consent) Covers(scopes []string) bool {
+	for _, scope := range scopes {
+		allowed := false
+		for _, granted := range c.Scopes {
+			if granted == scope {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+type PostgresAuthorizationCodeRepository struct {
+	Conn *sql.DB
+}
+
+func NewPostgresAuthorizationCodeRepository(pool *sql.DB) *PostgresAuthorizationCodeRepository {
+	return &PostgresAuthorizationCodeRepository{
+		Conn: pool,
+	}
+}
+
+// InsertAuthorizationCode stores a new authorization code
+func (a *PostgresAuthorizationCodeRepository) InsertAuthorizationCode(ctx context.Context, code AuthorizationCode) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `insert into oauth_authorization_codes
+		(code_hash, client_id, user_id, redirect_uri, scopes, nonce, code_challenge, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err := a.Conn.ExecContext(ctx, stmt,
+		code.CodeHash,
+		code.ClientID,
+		code.UserID,
+		code.RedirectURI,
+		strings.Join(code.Scopes, " "),
+		code.Nonce,
+		code.CodeChallenge,
+		code.ExpiresAt,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeAuthorizationCode marks a code as used and returns it. It returns sql.ErrNoRows when
+// there is no such code or it has been used already, so a code can be exchanged only once.
+func (a *PostgresAuthorizationCodeRepository) ConsumeAuthorizationCode(ctx context.Context, hash string) (*AuthorizationCode, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update oauth_authorization_codes set used_at = $1 where code_hash = $2 and used_at is null
+		returning code_hash, client_id, user_id, redirect_uri, scopes, nonce, code_challenge, expires_at, used_at, created_at`
+
+	var code AuthorizationCode
+	var scopes string
+	var usedAt time.Time
+	err := a.Conn.QueryRowContext(ctx, stmt, time.Now(), hash).Scan(
+		&code.CodeHash,
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		&scopes,
+		&code.Nonce,
+		&code.CodeChallenge,
+		&code.ExpiresAt,
+		&usedAt,
+		&code.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	code.Scopes = strings.Fields(scopes)
+	code.UsedAt = &usedAt
+
+	return &code, nil
+}
+
+// MemoryAuthorizationCodeRepository keeps the authorization codes in memory. It is meant for
+// tests and for running the service without Postgres.
+type MemoryAuthorizationCodeRepository struct {
+	mu    sync.Mutex
+	codes map[string]*AuthorizationCode
+}
+
+func NewMemoryAuthorizationCodeRepository() *MemoryAuthorizationCodeRepository {
+	return &MemoryAuthorizationCodeRepository{
+		codes: make(map[string]*AuthorizationCode),
+	}
+}
+
+// InsertAuthorizationCode stores a new authorization code
+func (a *MemoryAuthorizationCodeRepository) InsertAuthorizationCode(ctx context.Context, code AuthorizationCode) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	code.Scopes = append([]string(nil), code.Scopes...)
+	code.UsedAt = nil
+	code.CreatedAt = time.Now()
+	a.codes[code.CodeHash] = &code
+
+	return nil
+}
+
+// ConsumeAuthorizationCode marks a code as used and returns it. It returns sql.ErrNoRows when
+// there is no such code or it has been used already, so a code can be exchanged only once.
+func (a *MemoryAuthorizationCodeRepository) ConsumeAuthorizationCode(ctx context.Context, hash string) (*AuthorizationCode, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	code, ok := a.codes[hash]
+	if !ok || code.UsedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	now := time.Now()
+	code.UsedAt = &now
+	found := *code
+
+	return &found, nil
+}
+
+type PostgresConsentRepository struct {
+	Conn *sql.DB
+}
+
+func NewPostgresConsentRepository(pool *sql.DB) *PostgresConsentRepository {
+	return &PostgresConsentRepository{
+		Conn: pool,
+	}
+}
+
+// GetConsent returns what the user has allowed the client, or sql.ErrNoRows if they never
+// have
+func (c *PostgresConsentRepository) GetConsent(ctx context.Context, userID int, clientID string) (*Consent, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select user_id, client_id, scopes, created_at from oauth_consents where user_id = $1 and client_id = $2`
+
+	var consent Consent
+	var scopes string
+	err := c.Conn.QueryRowContext(ctx, query, userID, clientID).Scan(
+		&consent.UserID,
+		&consent.ClientID,
+		&scopes,
+		&consent.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	consent.Scopes = strings.Fields(scopes)
+
+	return &consent, nil
+}
+
+// SaveConsent records a consent, replacing the scopes of an earlier one
+func (c *PostgresConsentRepository) SaveConsent(ctx context.Context, consent Consent) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `insert into oauth_consents (user_id, client_id, scopes, created_at) values ($1, $2, $3, $4)
+		on conflict (user_id, client_id) do update set scopes = $3, created_at = $4`
+
+	_, err := c.Conn.ExecContext(ctx, stmt, consent.UserID, consent.ClientID, strings.Join(consent.Scopes, " "), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MemoryConsentRepository keeps the consents in memory. It is meant for tests and for running
+// the service without Postgres.
+type MemoryConsentRepository struct {
+	mu       sync.Mutex
+	consents map[consentKey]Consent
+}
+
+type consentKey struct {
+	userID   int
+	clientID string
+}
+
+func NewMemoryConsentRepository() *MemoryConsentRepository {
+	return &MemoryConsentRepository{
+		consents: make(map[consentKey]Consent),
+	}
+}
+
+// GetConsent returns what the user has allowed the client, or sql.ErrNoRows if they never
+// have
+func (c *MemoryConsentRepository) GetConsent(ctx context.Context, userID int, clientID string) (*Consent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	consent, ok := c.consents[consentKey{userID, clientID}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &consent, nil
+}
+
+// SaveConsent records a consent, replacing the scopes of an earlier one
+func (c *MemoryConsentRepository) SaveConsent(ctx context.Context, consent Consent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	consent.Scopes = append([]string(nil), consent.Scopes...)
+	consent.CreatedAt = time.Now()
+	c.consents[consentKey{consent.UserID, consent.ClientID}] = consent
+
+	return nil
+}
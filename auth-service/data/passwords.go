@@ -0,0 +1,120 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2Params are the settings new password hashes are made with. Hashes made with other
+// settings, and legacy bcrypt hashes, are replaced the next time the user logs in.
+type Argon2Params struct {
+	// Time is the number of passes over the memory
+	Time uint32
+	// Memory is the memory used in KiB
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// PasswordHashing holds the settings used for new password hashes. The defaults follow the
+// second recommendation of RFC 9106.
+var PasswordHashing = Argon2Params{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+// hashPassword hashes a password with argon2id, encoded in the usual
+// $argon2id$v=19$m=...,t=...,p=...$salt$key format
+func hashPassword(password string) (string, error) {
+	params := PasswordHashing
+
+	salt := make([]byte, params.SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Memory,
+		params.Time,
+		params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verifyPassword compares the password with an argon2id or a bcrypt hash. It also reports
+// whether the hash should be replaced by one made with the current settings.
+func verifyPassword(plainText, hash string) (match, rehash bool, err error) {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(plainText))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		}
+
+		return true, true, nil
+	}
+
+	params, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	other := argon2.IDKey([]byte(plainText), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+
+	current := PasswordHashing
+	rehash = params.Time != current.Time || params.Memory != current.Memory || params.Threads != current.Threads ||
+		uint32(len(salt)) != current.SaltLen || uint32(len(key)) != current.KeyLen
+
+	return true, rehash, nil
+}
+
+func decodeArgon2Hash(hash string) (params Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	return params, salt, key, nil
+}
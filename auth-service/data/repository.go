@@ -1,12 +1,160 @@
 package data
 
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Repository stores the users and their roles. All the methods called on the repository
+// passed to WithTx run in one transaction, which is committed when fn returns nil and
+// rolled back otherwise.
 type Repository interface {
-	GetAll() ([]*User, error)
-	GetByEmail(email string) (*User, error)
-	GetOne(id int) (*User, error)
-	Update(user User) error
-	DeleteByID(id int) error
-	Insert(user User) (int, error)
-	ResetPassword(password string, user User) error
-	PasswordMatches(plainText string, user User) (bool, error)
+	WithTx(ctx context.Context, fn func(Repository) error) error
+	GetAll(ctx context.Context) ([]*User, error)
+	List(ctx context.Context, q UserQuery) (Page, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetOne(ctx context.Context, id int) (*User, error)
+	Update(ctx context.Context, user User) error
+	DeleteByID(ctx context.Context, id int) error
+	SetStatus(ctx context.Context, id int, status, reason string) error
+	// Restore brings a deleted user back to the state they had before and returns it
+	Restore(ctx context.Context, id int, reason string) (string, error)
+	PurgeByID(ctx context.Context, id int) error
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
+	Insert(ctx context.Context, user User) (int, error)
+	ResetPassword(ctx context.Context, password string, user User) error
+	PasswordMatches(ctx context.Context, plainText string, user User) (bool, error)
+	GetRoles(ctx context.Context, userID int) ([]string, error)
+	GetPermissions(ctx context.Context, userID int) ([]string, error)
+	GrantRole(ctx context.Context, userID int, role string) error
+	RevokeRole(ctx context.Context, userID int, role string) error
+}
+
+type RefreshTokenRepository interface {
+	// InTx returns the refresh tokens bound to the transaction of repo
+	InTx(repo Repository) RefreshTokenRepository
+	InsertRefreshToken(ctx context.Context, token RefreshToken) (int, error)
+	GetRefreshTokenByHash(ctx context.Context, hash string) (*RefreshToken, error)
+	MarkRefreshTokenUsed(ctx context.Context, id int) (bool, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userID int) error
+	// ClearUserRefreshTokenIPs removes the addresses of the refresh tokens of the user
+	ClearUserRefreshTokenIPs(ctx context.Context, userID int) error
+}
+
+type RevocationStore interface {
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	RevokeUserTokens(ctx context.Context, userID int, before time.Time) error
+	IsRevoked(ctx context.Context, jti string, userID int, issuedAt time.Time) (bool, error)
+}
+
+type PasswordResetRepository interface {
+	InsertPasswordReset(ctx context.Context, reset PasswordReset) (int, error)
+	GetPasswordReset(ctx context.Context, hash string) (*PasswordReset, error)
+	ConsumePasswordReset(ctx context.Context, hash string) (*PasswordReset, error)
+}
+
+type LoginAttemptStore interface {
+	// InTx returns the counters bound to the transaction of repo
+	InTx(repo Repository) LoginAttemptStore
+	GetAttempts(ctx context.Context, key string) (*LoginAttempts, error)
+	RecordFailure(ctx context.Context, key string, resetAfter time.Duration) (*LoginAttempts, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+type MFARepository interface {
+	// InTx returns the second factors bound to the transaction of repo
+	InTx(repo Repository) MFARepository
+	GetMFA(ctx context.Context, userID int) (*MFA, error)
+	SetMFASecret(ctx context.Context, userID int, secret string) error
+	EnableMFA(ctx context.Context, userID int, recoveryCodeHashes []string) error
+	DisableMFA(ctx context.Context, userID int) error
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	ConsumeRecoveryCode(ctx context.Context, userID int, hash string) (bool, error)
+}
+
+type SessionRepository interface {
+	// InTx returns the sessions bound to the transaction of repo
+	InTx(repo Repository) SessionRepository
+	InsertSession(ctx context.Context, session Session) error
+	GetSession(ctx context.Context, id string) (*Session, error)
+	GetUserSessions(ctx context.Context, userID int) ([]*Session, error)
+	ExtendSession(ctx context.Context, id, ip string, expiresAt time.Time) error
+	TouchSession(ctx context.Context, id string, seenAt time.Time) error
+	RevokeSession(ctx context.Context, id string) error
+	RevokeUserSessions(ctx context.Context, userID int) error
+	// ClearUserSessionClients removes the addresses and user agents of the sessions of the user
+	ClearUserSessionClients(ctx context.Context, userID int) error
+}
+
+type APIKeyRepository interface {
+	// InTx returns the API keys bound to the transaction of repo
+	InTx(repo Repository) APIKeyRepository
+	InsertAPIKey(ctx context.Context, key APIKey) (int, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error)
+	GetUserAPIKeys(ctx context.Context, userID int) ([]*APIKey, error)
+	TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error
+	RevokeAPIKey(ctx context.Context, userID, id int) error
+	RevokeUserAPIKeys(ctx context.Context, userID int) error
+}
+
+type OAuthClientRepository interface {
+	GetOAuthClient(ctx context.Context, id string) (*OAuthClient, error)
+	UpsertOAuthClient(ctx context.Context, client OAuthClient) error
+}
+
+type AuthorizationCodeRepository interface {
+	InsertAuthorizationCode(ctx context.Context, code AuthorizationCode) error
+	ConsumeAuthorizationCode(ctx context.Context, hash string) (*AuthorizationCode, error)
+}
+
+type ConsentRepository interface {
+	GetConsent(ctx context.Context, userID int, clientID string) (*Consent, error)
+	SaveConsent(ctx context.Context, consent Consent) error
+}
+
+type MagicLinkRepository interface {
+	InsertMagicLink(ctx context.Context, link MagicLink) (int, error)
+	ConsumeMagicLink(ctx context.Context, hash string) (*MagicLink, error)
+}
+
+type InvitationRepository interface {
+	// InTx returns the invitations bound to the transaction of repo, which is passed to
+	// Repository.WithTx. Changes made through them are rolled back together with it.
+	InTx(repo Repository) InvitationRepository
+	InsertInvitation(ctx context.Context, invitation Invitation) (int, error)
+	GetInvitation(ctx context.Context, hash string) (*Invitation, error)
+	ConsumeInvitation(ctx context.Context, hash string) (*Invitation, error)
+	SetInvitationUser(ctx context.Context, id, userID int) error
+	GetInvitations(ctx context.Context) ([]*Invitation, error)
+	RevokeInvitation(ctx context.Context, id int) error
+	// ClearInvitationEmails removes the email from the invitations sent to it or used by the user
+	ClearInvitationEmails(ctx context.Context, email string, userID int) error
+}
+
+// txRepository is implemented by the repositories passed to WithTx, other stores use it to
+// join the transaction
+type txRepository interface {
+	// sqlTx returns the database transaction, or nil when the repository isn't in a database
+	sqlTx() *sql.Tx
+	// onRollback registers fn to undo a change made outside the transaction when it fails
+	onRollback(fn func())
+}
+
+// sqlTxOf returns the database transaction of a repository passed to WithTx, or nil
+func sqlTxOf(repo Repository) *sql.Tx {
+	if tx, ok := repo.(txRepository); ok {
+		return tx.sqlTx()
+	}
+
+	return nil
+}
+
+// undo runs the rollback functions, the last registered first
+func undo(rollback []func()) {
+	for i := len(rollback) - 1; i >= 0; i-- {
+		rollback[i]()
+	}
 }
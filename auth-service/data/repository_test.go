@@ -0,0 +1,763 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+// Every Repository implementation has to pass the same suite. The Postgres one runs only when
+// TEST_POSTGRES_DSN points at a migrated database, e.g.
+// TEST_POSTGRES_DSN="host=localhost port=5432 dbname=test_task user=postgres password=password"
+
+func Test_MemoryRepository(t *testing.T) {
+	testRepository(t, NewMemoryRepository())
+}
+
+func Test_SQLiteRepository(t *testing.T) {
+	conn, err := OpenSQLite(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer conn.Close()
+
+	repo, err := NewSQLiteRepository(conn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	testRepository(t, repo)
+}
+
+// Test_SQLiteStatusUpgrade проверяет, что файл со старым флагом active переводится на статусы.
+func Test_SQLiteStatusUpgrade(t *testing.T) {
+	conn, err := OpenSQLite(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Exec(`create table users
+(
+    id         integer primary key autoincrement,
+    email      varchar(255) not null unique,
+    first_name varchar(255) not null default '',
+    last_name  varchar(255) not null default '',
+    password   varchar(255) not null,
+    active     integer      not null default 0,
+    created_at timestamp    not null default current_timestamp,
+    updated_at timestamp    not null default current_timestamp
+);
+insert into users (email, password, active) values ('verified@here.com', 'x', 1), ('new@here.com', 'x', 0),
+    ('admin@example.com', '$2a$12$oqoOqys6o/Y3.D3YvyVPpevGRqxGLkEmQ/U7Ei7kt8Kg4H6XQmAtC', 1);`)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	repo, err := NewSQLiteRepository(conn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	ctx := context.Background()
+	for email, status := range map[string]string{"verified@here.com": StatusActive, "new@here.com": StatusPending} {
+		user, err := repo.GetByEmail(ctx, email)
+		if err != nil || user.Status != status {
+			t.Errorf("%s: expected %s, got %+v %v", email, status, user, err)
+		}
+	}
+
+	// демо-администратор с публичным паролем удаляется
+	if _, err := repo.GetByEmail(ctx, "admin@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the demo admin to be removed, got %v", err)
+	}
+}
+
+// Test_SQLiteStores проверяет, что второй фактор, API-ключи и приглашения в режиме SQLite
+// хранятся в файле и переживают перезапуск.
+func Test_SQLiteStores(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "auth.db")
+
+	conn, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	repo, err := NewSQLiteRepository(conn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	userID, _ := repo.Insert(ctx, User{Email: "jane@here.com", Password: "verysecret", Status: StatusActive})
+	mfa := NewPostgresMFARepository(conn)
+	_ = mfa.SetMFASecret(ctx, userID, "first")
+	_ = mfa.SetMFASecret(ctx, userID, "secret")
+	if err := mfa.EnableMFA(ctx, userID, []string{"code1", "code2"}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := NewPostgresAPIKeyRepository(conn).InsertAPIKey(ctx, APIKey{UserID: userID, Name: "ci", Prefix: "ak_1", KeyHash: "hash", Scopes: []string{"users:read"}, CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := NewPostgresInvitationRepository(conn).InsertInvitation(ctx, Invitation{CodeHash: "invitation", Email: "friend@here.com", Roles: []string{"user"}, ExpiresAt: time.Now().Add(time.Hour), CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	conn.Close()
+
+	// после перезапуска всё на месте
+	conn, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer conn.Close()
+	repo, err = NewSQLiteRepository(conn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	mfa = NewPostgresMFARepository(conn)
+	if found, err := mfa.GetMFA(ctx, userID); err != nil || found.Secret != "secret" || !found.Enabled() {
+		t.Errorf("expected the second factor to be kept, got %+v %v", found, err)
+	}
+	if used, err := mfa.ConsumeRecoveryCode(ctx, userID, "code1"); err != nil || !used {
+		t.Errorf("expected the recovery code to be kept, got %v %v", used, err)
+	}
+	if used, _ := mfa.UseTOTPStep(ctx, userID, 10); !used {
+		t.Error("expected the step to be accepted")
+	}
+	if used, _ := mfa.UseTOTPStep(ctx, userID, 10); used {
+		t.Error("expected the step to be used only once")
+	}
+
+	keys := NewPostgresAPIKeyRepository(conn)
+	if found, err := keys.GetAPIKeyByHash(ctx, "hash"); err != nil || found.Name != "ci" || len(found.Scopes) != 1 {
+		t.Errorf("expected the API key to be kept, got %+v %v", found, err)
+	}
+
+	invitations := NewPostgresInvitationRepository(conn)
+	if found, err := invitations.GetInvitation(ctx, "invitation"); err != nil || found.Email != "friend@here.com" {
+		t.Errorf("expected the invitation to be kept, got %+v %v", found, err)
+	}
+
+	// в транзакции хранилища пишут в тот же файл
+	err = repo.WithTx(ctx, func(tx Repository) error {
+		if err := mfa.InTx(tx).DisableMFA(ctx, userID); err != nil {
+			return err
+		}
+		if err := keys.InTx(tx).RevokeUserAPIKeys(ctx, userID); err != nil {
+			return err
+		}
+		return invitations.InTx(tx).ClearInvitationEmails(ctx, "FRIEND@here.com", userID)
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := mfa.GetMFA(ctx, userID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the second factor to be removed, got %v", err)
+	}
+	if found, _ := keys.GetUserAPIKeys(ctx, userID); len(found) != 0 {
+		t.Errorf("expected the API keys to be revoked, got %+v", found)
+	}
+	if found, _ := invitations.GetInvitation(ctx, "invitation"); found == nil || found.Email != "" {
+		t.Errorf("expected the invitation email to be cleared, got %+v", found)
+	}
+}
+
+func Test_PostgresRepository(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+
+	conn, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer conn.Close()
+
+	testRepository(t, NewPostgresRepository(conn))
+}
+
+// Test_InvitationsInTx проверяет, что приглашение, использованное в неудавшейся транзакции,
+// снова можно использовать.
+func Test_InvitationsInTx(t *testing.T) {
+	conn, err := OpenSQLite(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer conn.Close()
+
+	sqlite, err := NewSQLiteRepository(conn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		testInvitationsInTx(t, NewMemoryRepository(), NewMemoryInvitationRepository())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		testInvitationsInTx(t, sqlite, NewPostgresInvitationRepository(conn))
+	})
+
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		return
+	}
+	pg, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer pg.Close()
+
+	t.Run("postgres", func(t *testing.T) {
+		testInvitationsInTx(t, NewPostgresRepository(pg), NewPostgresInvitationRepository(pg))
+	})
+}
+
+// Test_MemoryStoresInTx проверяет, что стирание в памяти откатывается вместе с транзакцией.
+func Test_MemoryStoresInTx(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	sessions := NewMemorySessionRepository()
+	attempts := NewMemoryLoginAttemptStore()
+	mfa := NewMemoryMFARepository()
+	keys := NewMemoryAPIKeyRepository()
+
+	_ = sessions.InsertSession(ctx, Session{ID: "s1", UserID: 1, IP: "192.168.1.1", UserAgent: "curl", ExpiresAt: time.Now().Add(time.Hour)})
+	_, _ = attempts.RecordFailure(ctx, "account:jane@here.com", time.Hour)
+	_ = mfa.SetMFASecret(ctx, 1, "secret")
+	_, _ = keys.InsertAPIKey(ctx, APIKey{UserID: 1, Name: "ci", KeyHash: "hash"})
+
+	failed := errors.New("failed")
+	err := repo.WithTx(ctx, func(tx Repository) error {
+		_ = sessions.InTx(tx).ClearUserSessionClients(ctx, 1)
+		_ = attempts.InTx(tx).Reset(ctx, "account:jane@here.com")
+		_ = mfa.InTx(tx).DisableMFA(ctx, 1)
+		_ = keys.InTx(tx).RevokeUserAPIKeys(ctx, 1)
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("expected the error of fn, got %v", err)
+	}
+
+	// после отката всё на месте
+	if found, _ := sessions.GetUserSessions(ctx, 1); len(found) != 1 || found[0].IP != "192.168.1.1" || found[0].UserAgent != "curl" {
+		t.Errorf("expected the session to be restored, got %+v", found)
+	}
+	if found, _ := attempts.GetAttempts(ctx, "account:jane@here.com"); found.Failures != 1 {
+		t.Errorf("expected the failure to be restored, got %+v", found)
+	}
+	if found, err := mfa.GetMFA(ctx, 1); err != nil || found.Secret != "secret" {
+		t.Errorf("expected the second factor to be restored, got %+v %v", found, err)
+	}
+	if found, _ := keys.GetUserAPIKeys(ctx, 1); len(found) != 1 || found[0].RevokedAt != nil {
+		t.Errorf("expected the key to be restored, got %+v", found)
+	}
+
+	err = repo.WithTx(ctx, func(tx Repository) error {
+		return sessions.InTx(tx).ClearUserSessionClients(ctx, 1)
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if found, _ := sessions.GetUserSessions(ctx, 1); len(found) != 1 || found[0].IP != "" || found[0].UserAgent != "" {
+		t.Errorf("expected the session to be cleared, got %+v", found)
+	}
+}
+
+func testInvitationsInTx(t *testing.T, repo Repository, invitations InvitationRepository) {
+	ctx := context.Background()
+	hash := fmt.Sprintf("invitation-%d", time.Now().UnixNano())
+	id, err := invitations.InsertInvitation(ctx, Invitation{CodeHash: hash, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	failed := errors.New("failed")
+	err = repo.WithTx(ctx, func(tx Repository) error {
+		if _, err := invitations.InTx(tx).ConsumeInvitation(ctx, hash); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("expected the error of fn, got %v", err)
+	}
+	if _, err := invitations.GetInvitation(ctx, hash); err != nil {
+		t.Fatalf("expected the invitation to be released, got %v", err)
+	}
+
+	var userID int
+	err = repo.WithTx(ctx, func(tx Repository) error {
+		used := invitations.InTx(tx)
+		if _, err := used.ConsumeInvitation(ctx, hash); err != nil {
+			return err
+		}
+		var err error
+		userID, err = tx.Insert(ctx, User{Email: hash + "@here.com", Password: "verysecret"})
+		if err != nil {
+			return err
+		}
+		return used.SetInvitationUser(ctx, id, userID)
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	t.Cleanup(func() { _ = repo.PurgeByID(ctx, userID) })
+
+	if _, err := invitations.GetInvitation(ctx, hash); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the invitation to be used up, got %v", err)
+	}
+	all, _ := invitations.GetInvitations(ctx)
+	for _, invitation := range all {
+		if invitation.ID == id && (invitation.UsedBy == nil || *invitation.UsedBy != userID) {
+			t.Errorf("expected the invitation to be used by %d, got %+v", userID, invitation)
+		}
+	}
+}
+
+// Test_VerifyPassword проверяет argon2id и устаревшие bcrypt-хеши.
+func Test_VerifyPassword(t *testing.T) {
+	// хеш пароля verysecret демо-администратора из миграций
+	legacy := "$2a$12$oqoOqys6o/Y3.D3YvyVPpevGRqxGLkEmQ/U7Ei7kt8Kg4H6XQmAtC"
+
+	match, rehash, err := verifyPassword("verysecret", legacy)
+	if err != nil || !match || !rehash {
+		t.Errorf("expected a bcrypt hash to match and to be rehashed, got %v %v %v", match, rehash, err)
+	}
+	if match, _, _ := verifyPassword("wrong", legacy); match {
+		t.Error("expected a wrong password not to match a bcrypt hash")
+	}
+
+	hash, err := hashPassword("verysecret")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	match, rehash, err = verifyPassword("verysecret", hash)
+	if err != nil || !match || rehash {
+		t.Errorf("expected an argon2id hash to match without a rehash, got %v %v %v", match, rehash, err)
+	}
+	if match, _, _ := verifyPassword("wrong", hash); match {
+		t.Error("expected a wrong password not to match an argon2id hash")
+	}
+	if _, _, err := verifyPassword("verysecret", "$argon2id$v=19$broken"); err == nil {
+		t.Error("expected an error for a malformed hash")
+	}
+}
+
+// testRepository runs the conformance suite. The emails are unique for every run, so the suite
+// can share a database with other data.
+func testRepository(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	suffix := fmt.Sprintf("%d@example.com", time.Now().UnixNano())
+
+	insert := func(t *testing.T, email, lastName string) int {
+		t.Helper()
+
+		id, err := repo.Insert(ctx, User{Email: email + suffix, FirstName: "First", LastName: lastName, Password: "verysecret"})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		t.Cleanup(func() { _ = repo.PurgeByID(ctx, id) })
+
+		return id
+	}
+
+	t.Run("insert and get", func(t *testing.T) {
+		id := insert(t, "get", "Last")
+
+		user, err := repo.GetOne(ctx, id)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if user.ID != id || user.Email != "get"+suffix || user.FirstName != "First" || user.Status != StatusPending || user.DeletedAt != nil {
+			t.Errorf("unexpected user %+v", user)
+		}
+		if user.Password == "verysecret" {
+			t.Error("expected the password to be hashed")
+		}
+
+		byEmail, err := repo.GetByEmail(ctx, "get"+suffix)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if byEmail.ID != id {
+			t.Errorf("expected user %d, got %d", id, byEmail.ID)
+		}
+
+		if ok, _ := repo.PasswordMatches(ctx, "verysecret", *byEmail); !ok {
+			t.Error("expected the password to match")
+		}
+		if ok, _ := repo.PasswordMatches(ctx, "wrong", *byEmail); ok {
+			t.Error("expected a wrong password not to match")
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := repo.GetOne(ctx, -1); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected sql.ErrNoRows, got %v", err)
+		}
+		if _, err := repo.GetByEmail(ctx, "nobody"+suffix); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected sql.ErrNoRows, got %v", err)
+		}
+	})
+
+	t.Run("unique email", func(t *testing.T) {
+		insert(t, "unique", "Last")
+		id := insert(t, "other", "Last")
+
+		if _, err := repo.Insert(ctx, User{Email: "unique" + suffix, Password: "verysecret"}); !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("expected ErrDuplicateEmail on insert, got %v", err)
+		}
+
+		user, _ := repo.GetOne(ctx, id)
+		user.Email = "unique" + suffix
+		if err := repo.Update(ctx, *user); !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("expected ErrDuplicateEmail on update, got %v", err)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		id := insert(t, "update", "Last")
+
+		user, _ := repo.GetOne(ctx, id)
+		user.Email = "updated" + suffix
+		user.FirstName = "New"
+		// статус меняется только через SetStatus
+		user.Status = StatusSuspended
+		if err := repo.Update(ctx, *user); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		updated, _ := repo.GetOne(ctx, id)
+		if updated.Email != "updated"+suffix || updated.FirstName != "New" || updated.Status != StatusPending {
+			t.Errorf("unexpected user %+v", updated)
+		}
+
+		if err := repo.ResetPassword(ctx, "newsecret", *updated); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		updated, _ = repo.GetOne(ctx, id)
+		if ok, _ := repo.PasswordMatches(ctx, "newsecret", *updated); !ok {
+			t.Error("expected the new password to match")
+		}
+	})
+
+	t.Run("password hash upgrade", func(t *testing.T) {
+		id := insert(t, "upgrade", "Last")
+		user, _ := repo.GetOne(ctx, id)
+		if !strings.HasPrefix(user.Password, "$argon2id$") {
+			t.Fatalf("expected an argon2id hash, got %s", user.Password)
+		}
+
+		// хеш с устаревшими параметрами заменяется после успешной проверки пароля
+		params := PasswordHashing
+		defer func() { PasswordHashing = params }()
+		PasswordHashing.Time++
+
+		if ok, _ := repo.PasswordMatches(ctx, "wrong", *user); ok {
+			t.Error("expected a wrong password not to match")
+		}
+		unchanged, _ := repo.GetOne(ctx, id)
+		if unchanged.Password != user.Password {
+			t.Error("expected the hash to stay the same after a wrong password")
+		}
+
+		if ok, _ := repo.PasswordMatches(ctx, "verysecret", *user); !ok {
+			t.Fatal("expected the password to match")
+		}
+		upgraded, _ := repo.GetOne(ctx, id)
+		if upgraded.Password == user.Password || !strings.Contains(upgraded.Password, fmt.Sprintf("t=%d", PasswordHashing.Time)) {
+			t.Errorf("expected the hash to be upgraded, got %s", upgraded.Password)
+		}
+		if ok, _ := repo.PasswordMatches(ctx, "verysecret", *upgraded); !ok {
+			t.Error("expected the password to match the upgraded hash")
+		}
+	})
+
+	t.Run("get all", func(t *testing.T) {
+		b := insert(t, "b", "Beta")
+		a := insert(t, "a", "Alpha")
+
+		users, err := repo.GetAll(ctx)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		var order []int
+		for _, user := range users {
+			if user.ID == a || user.ID == b {
+				order = append(order, user.ID)
+			}
+		}
+		if !reflect.DeepEqual(order, []int{a, b}) {
+			t.Errorf("expected users sorted by last name, got %v", order)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		// уникальная фамилия отделяет пользователей теста от остальных данных
+		name := fmt.Sprintf("List%d", time.Now().UnixNano())
+		var ids []int
+		for _, letter := range []string{"a", "b", "c", "d", "e"} {
+			ids = append(ids, insert(t, "list"+letter, name+strings.ToUpper(letter)))
+		}
+		_ = repo.SetStatus(ctx, ids[1], StatusActive, "")
+		// удалённые пользователи не показываются, пока их не запросят явно
+		deleted := insert(t, "listf", name+"F")
+		_ = repo.DeleteByID(ctx, deleted)
+
+		collect := func(t *testing.T, q UserQuery) []int {
+			t.Helper()
+
+			var found []int
+			for pages := 0; ; pages++ {
+				page, err := repo.List(ctx, q)
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				if page.TotalCount != 5 {
+					t.Errorf("expected a total count of 5, got %d", page.TotalCount)
+				}
+				if len(page.Users) > q.Limit || pages > 5 {
+					t.Fatalf("expected pages of at most %d users, got %d", q.Limit, len(page.Users))
+				}
+				for _, user := range page.Users {
+					found = append(found, user.ID)
+				}
+				if page.NextCursor == "" {
+					return found
+				}
+				q.Cursor = page.NextCursor
+			}
+		}
+
+		reversed := []int{ids[4], ids[3], ids[2], ids[1], ids[0]}
+		for _, e := range []struct {
+			query    UserQuery
+			expected []int
+		}{
+			{UserQuery{Name: name, Limit: 2}, ids},
+			{UserQuery{Name: strings.ToLower(name), Limit: 2, Descending: true}, reversed},
+			{UserQuery{Name: name, Limit: 3, SortBy: "email", Descending: true}, reversed},
+			{UserQuery{Name: name, Limit: 2, SortBy: "created_at"}, ids},
+			{UserQuery{Name: name, Limit: 4, SortBy: "id", Descending: true}, reversed},
+		} {
+			if found := collect(t, e.query); !reflect.DeepEqual(found, e.expected) {
+				t.Errorf("%+v: expected %v, got %v", e.query, e.expected, found)
+			}
+		}
+
+		filtered := []struct {
+			query    UserQuery
+			expected int
+		}{
+			{UserQuery{Name: name, EmailPrefix: "LISTC"}, 1},
+			{UserQuery{Name: name, EmailPrefix: "list_"}, 0},
+			{UserQuery{Name: name, Status: StatusActive}, 1},
+			{UserQuery{Name: name, Status: StatusPending}, 4},
+			{UserQuery{Name: name, Status: StatusDeleted}, 1},
+			{UserQuery{Name: name, CreatedAfter: time.Now().Add(time.Hour)}, 0},
+			{UserQuery{Name: name, CreatedBefore: time.Now().Add(time.Hour)}, 5},
+		}
+		for _, e := range filtered {
+			page, err := repo.List(ctx, e.query)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if page.TotalCount != e.expected || len(page.Users) != e.expected {
+				t.Errorf("%+v: expected %d users, got %d of %d", e.query, e.expected, len(page.Users), page.TotalCount)
+			}
+		}
+
+		if _, err := repo.List(ctx, UserQuery{SortBy: "password"}); !errors.Is(err, ErrInvalidUserQuery) {
+			t.Errorf("expected ErrInvalidUserQuery for an unknown sort field, got %v", err)
+		}
+		if _, err := repo.List(ctx, UserQuery{Status: "banned"}); !errors.Is(err, ErrInvalidUserQuery) {
+			t.Errorf("expected ErrInvalidUserQuery for an unknown status, got %v", err)
+		}
+		if _, err := repo.List(ctx, UserQuery{Cursor: "not a cursor"}); !errors.Is(err, ErrInvalidUserQuery) {
+			t.Errorf("expected ErrInvalidUserQuery for a malformed cursor, got %v", err)
+		}
+	})
+
+	t.Run("roles", func(t *testing.T) {
+		id := insert(t, "roles", "Last")
+
+		for _, role := range []string{"user", "admin", "user"} {
+			if err := repo.GrantRole(ctx, id, role); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		if err := repo.GrantRole(ctx, id, "superuser"); !errors.Is(err, ErrUnknownRole) {
+			t.Errorf("expected ErrUnknownRole, got %v", err)
+		}
+		if err := repo.GrantRole(ctx, -1, "user"); err == nil {
+			t.Error("expected an error granting a role to a missing user")
+		}
+
+		roles, _ := repo.GetRoles(ctx, id)
+		if !reflect.DeepEqual(roles, []string{"admin", "user"}) {
+			t.Errorf("unexpected roles %v", roles)
+		}
+		permissions, _ := repo.GetPermissions(ctx, id)
+		if !reflect.DeepEqual(permissions, []string{"logs:write", "roles:manage", "users:delete", "users:read", "users:write"}) {
+			t.Errorf("unexpected permissions %v", permissions)
+		}
+
+		if err := repo.RevokeRole(ctx, id, "admin"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		permissions, _ = repo.GetPermissions(ctx, id)
+		if !reflect.DeepEqual(permissions, []string{"logs:write"}) {
+			t.Errorf("unexpected permissions %v", permissions)
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		id := insert(t, "status", "Last")
+
+		for _, e := range []struct {
+			status string
+			err    error
+		}{
+			{StatusSuspended, nil},
+			{StatusSuspended, ErrInvalidTransition},
+			{StatusPending, ErrInvalidTransition},
+			{StatusActive, nil},
+		} {
+			if err := repo.SetStatus(ctx, id, e.status, "spam"); !errors.Is(err, e.err) {
+				t.Errorf("%s: expected %v, got %v", e.status, e.err, err)
+			}
+		}
+
+		user, _ := repo.GetOne(ctx, id)
+		if user.Status != StatusActive || user.StatusReason != "spam" {
+			t.Errorf("unexpected user %+v", user)
+		}
+
+		if err := repo.SetStatus(ctx, -1, StatusActive, ""); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected sql.ErrNoRows for a missing user, got %v", err)
+		}
+	})
+
+	t.Run("soft delete and purge", func(t *testing.T) {
+		id := insert(t, "delete", "Last")
+		kept := insert(t, "kept", "Last")
+		_ = repo.GrantRole(ctx, id, "user")
+
+		if err := repo.DeleteByID(ctx, id); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		user, err := repo.GetOne(ctx, id)
+		if err != nil {
+			t.Fatalf("expected the deleted user to be kept until purged, got %v", err)
+		}
+		if user.Status != StatusDeleted || user.DeletedAt == nil {
+			t.Errorf("expected the user to be marked as deleted, got %+v", user)
+		}
+		if err := repo.DeleteByID(ctx, id); !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("expected ErrInvalidTransition deleting twice, got %v", err)
+		}
+
+		// удалённого пользователя можно восстановить до очистки, но только в прежний статус:
+		// неподтверждённый не становится активным
+		if err := repo.SetStatus(ctx, id, StatusActive, ""); !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("expected ErrInvalidTransition activating a deleted user, got %v", err)
+		}
+		if status, err := repo.Restore(ctx, id, "mistake"); err != nil || status != StatusPending {
+			t.Errorf("expected the user to be restored as pending, got %q %v", status, err)
+		}
+		if user, _ := repo.GetOne(ctx, id); user.Status != StatusPending || user.DeletedAt != nil || user.StatusReason != "mistake" {
+			t.Errorf("expected the user to be restored, got %+v", user)
+		}
+		if _, err := repo.Restore(ctx, id, ""); !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("expected ErrInvalidTransition restoring a user who isn't deleted, got %v", err)
+		}
+		if _, err := repo.Restore(ctx, -1, ""); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected sql.ErrNoRows restoring an unknown user, got %v", err)
+		}
+
+		_ = repo.SetStatus(ctx, id, StatusSuspended, "spam")
+		_ = repo.DeleteByID(ctx, id)
+		if status, err := repo.Restore(ctx, id, ""); err != nil || status != StatusSuspended {
+			t.Errorf("expected the user to be restored as suspended, got %q %v", status, err)
+		}
+		_ = repo.DeleteByID(ctx, id)
+
+		if purged, err := repo.PurgeDeleted(ctx, time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+			t.Errorf("expected nothing to be purged within the grace period, got %d %v", purged, err)
+		}
+		if _, err := repo.PurgeDeleted(ctx, time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, err := repo.GetOne(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected sql.ErrNoRows, got %v", err)
+		}
+		if roles, _ := repo.GetRoles(ctx, id); len(roles) != 0 {
+			t.Errorf("expected the roles to be purged with the user, got %v", roles)
+		}
+		if _, err := repo.GetOne(ctx, kept); err != nil {
+			t.Errorf("expected users who aren't deleted to be kept, got %v", err)
+		}
+
+		if err := repo.PurgeByID(ctx, kept); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, err := repo.GetOne(ctx, kept); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected sql.ErrNoRows, got %v", err)
+		}
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		failed := errors.New("failed")
+
+		var rolledBack int
+		err := repo.WithTx(ctx, func(tx Repository) error {
+			var err error
+			rolledBack, err = tx.Insert(ctx, User{Email: "rollback" + suffix, Password: "verysecret"})
+			if err != nil {
+				return err
+			}
+			if err := tx.GrantRole(ctx, rolledBack, "user"); err != nil {
+				return err
+			}
+			return failed
+		})
+		if !errors.Is(err, failed) {
+			t.Fatalf("expected the error of fn, got %v", err)
+		}
+		if _, err := repo.GetByEmail(ctx, "rollback"+suffix); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected the insert to be rolled back, got %v", err)
+		}
+
+		var committed int
+		err = repo.WithTx(ctx, func(tx Repository) error {
+			var err error
+			committed, err = tx.Insert(ctx, User{Email: "commit" + suffix, Password: "verysecret"})
+			if err != nil {
+				return err
+			}
+			// вложенная транзакция присоединяется к внешней
+			return tx.WithTx(ctx, func(tx Repository) error {
+				return tx.GrantRole(ctx, committed, "user")
+			})
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		t.Cleanup(func() { _ = repo.PurgeByID(ctx, committed) })
+
+		if roles, _ := repo.GetRoles(ctx, committed); !reflect.DeepEqual(roles, []string{"user"}) {
+			t.Errorf("expected the transaction to be committed, got roles %v", roles)
+		}
+	})
+}
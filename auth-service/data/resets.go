@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+type PostgresPasswordResetRepository struct {
+	Conn *sql.DB
+}
+
+func NewPostgresPasswordResetRepository(pool *sql.DB) *PostgresPasswordResetRepository {
+	return &PostgresPasswordResetRepository{
+		Conn: pool,
+	}
+}
+
+// PasswordReset is one password reset token sent to a user. Like refresh tokens, only
+// the hash of the token is stored.
+type PasswordReset struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// InsertPasswordReset stores a new reset token. Tokens sent to the user before stop working,
+// so only the latest email can be used.
+func (p *PostgresPasswordResetRepository) InsertPasswordReset(ctx context.Context, reset PasswordReset) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := p.Conn.ExecContext(ctx, `update password_resets set used_at = $1 where user_id = $2 and used_at is null`,
+		time.Now(), reset.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into password_resets (user_id, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4) returning id`
+
+	err = p.Conn.QueryRowContext(ctx, stmt,
+		reset.UserID,
+		reset.TokenHash,
+		reset.ExpiresAt,
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetPasswordReset returns an unused and unexpired reset token without using it up, or
+// sql.ErrNoRows for any token which can't be used
+func (p *PostgresPasswordResetRepository) GetPasswordReset(ctx context.Context, hash string) (*PasswordReset, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, token_hash, expires_at, created_at from password_resets
+		where token_hash = $1 and used_at is null and expires_at > $2`
+
+	var reset PasswordReset
+	err := p.Conn.QueryRowContext(ctx, query, hash, time.Now()).Scan(
+		&reset.ID,
+		&reset.UserID,
+		&reset.TokenHash,
+		&reset.ExpiresAt,
+		&reset.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reset, nil
+}
+
+// ConsumePasswordReset marks an unused and unexpired reset token as used and returns it.
+// It returns sql.ErrNoRows for any token which can't be used.
+func (p *PostgresPasswordResetRepository) ConsumePasswordReset(ctx context.Context, hash string) (*PasswordReset, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update password_resets set used_at = $1
+		where token_hash = $2 and used_at is null and expires_at > $1
+		returning id, user_id, token_hash, expires_at, created_at, used_at`
+
+	var reset PasswordReset
+	var usedAt time.Time
+	err := p.Conn.QueryRowContext(ctx, stmt, time.Now(), hash).Scan(
+		&reset.ID,
+		&reset.UserID,
+		&reset.TokenHash,
+		&reset.ExpiresAt,
+		&reset.CreatedAt,
+		&usedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	reset.UsedAt = &usedAt
+
+	return &reset, nil
+}
+
+// MemoryPasswordResetRepository keeps the password reset tokens in memory. It is meant for
+// tests and for running the service without Postgres.
+type MemoryPasswordResetRepository struct {
+	mu     sync.Mutex
+	resets []*PasswordReset
+}
+
+func NewMemoryPasswordResetRepository() *MemoryPasswordResetRepository {
+	return &MemoryPasswordResetRepository{}
+}
+
+// InsertPasswordReset stores a new reset token, invalidating the previous ones of the user
+func (p *MemoryPasswordResetRepository) InsertPasswordReset(ctx context.Context, reset PasswordReset) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, existing := range p.resets {
+		if existing.UserID == reset.UserID && existing.UsedAt == nil {
+			existing.UsedAt = &now
+		}
+	}
+
+	reset.ID = len(p.resets) + 1
+	reset.CreatedAt = now
+	p.resets = append(p.resets, &reset)
+
+	return reset.ID, nil
+}
+
+// GetPasswordReset returns an unused and unexpired reset token without using it up, or
+// sql.ErrNoRows for any token which can't be used
+func (p *MemoryPasswordResetRepository) GetPasswordReset(ctx context.Context, hash string) (*PasswordReset, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, reset := range p.resets {
+		if reset.TokenHash == hash && reset.UsedAt == nil && reset.ExpiresAt.After(now) {
+			found := *reset
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// ConsumePasswordReset marks an unused and unexpired reset token as used and returns it.
+// It returns sql.ErrNoRows for any token which can't be used.
+func (p *MemoryPasswordResetRepository) ConsumePasswordReset(ctx context.Context, hash string) (*PasswordReset, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, reset := range p.resets {
+		if reset.TokenHash == hash && reset.UsedAt == nil && reset.ExpiresAt.After(now) {
+			reset.UsedAt = &now
+			found := *reset
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// PostgresRevocationStore keeps revoked access tokens in Postgres, so every replica of the
+// service sees the same revocations.
+type PostgresRevocationStore struct {
+	Conn *sql.DB
+}
+
+func NewPostgresRevocationStore(pool *sql.DB) *PostgresRevocationStore {
+	return &PostgresRevocationStore{
+		Conn: pool,
+	}
+}
+
+// RevokeToken revokes one access token by its jti. The row is only needed until the token
+// expires on its own, so expired rows are cleaned up on the way.
+func (s *PostgresRevocationStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.Conn.ExecContext(ctx, `delete from revoked_tokens where expires_at < $1`, time.Now())
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into revoked_tokens (jti, expires_at) values ($1, $2) on conflict (jti) do nothing`
+	_, err = s.Conn.ExecContext(ctx, stmt, jti, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeUserTokens revokes every access token of the user issued up to the given time
+func (s *PostgresRevocationStore) RevokeUserTokens(ctx context.Context, userID int, before time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `insert into user_revocations (user_id, revoked_before) values ($1, $2)
+		on conflict (user_id) do update set revoked_before = excluded.revoked_before`
+
+	_, err := s.Conn.ExecContext(ctx, stmt, userID, before.Truncate(time.Second))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// IsRevoked reports whether the access token was revoked on its own or together with
+// all the other tokens of the user
+func (s *PostgresRevocationStore) IsRevoked(ctx context.Context, jti string, userID int, issuedAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select exists(select 1 from revoked_tokens where jti = $1)
+		or exists(select 1 from user_revocations where user_id = $2 and revoked_before >= $3)`
+
+	var revoked bool
+	err := s.Conn.QueryRowContext(ctx, query, jti, userID, issuedAt).Scan(&revoked)
+	if err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+// MemoryRevocationStore keeps revoked access tokens in memory. It is meant for tests and
+// single instance deployments, revocations are lost on restart.
+type MemoryRevocationStore struct {
+	mu     sync.RWMutex
+	tokens map[string]time.Time
+	users  map[int]time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		tokens: make(map[string]time.Time),
+		users:  make(map[int]time.Time),
+	}
+}
+
+// RevokeToken revokes one access token by its jti
+func (s *MemoryRevocationStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range s.tokens {
+		if exp.Before(now) {
+			delete(s.tokens, id)
+		}
+	}
+	s.tokens[jti] = expiresAt
+
+	return nil
+}
+
+// RevokeUserTokens revokes every access token of the user issued up to the given time
+func (s *MemoryRevocationStore) RevokeUserTokens(ctx context.Context, userID int, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[userID] = before.Truncate(time.Second)
+
+	return nil
+}
+
+// IsRevoked reports whether the access token was revoked on its own or together with
+// all the other tokens of the user
+func (s *MemoryRevocationStore) IsRevoked(ctx context.Context, jti string, userID int, issuedAt time.Time) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.tokens[jti]; ok {
+		return true, nil
+	}
+	if before, ok := s.users[userID]; ok && !issuedAt.After(before) {
+		return true, nil
+	}
+
+	return false, nil
+}
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnknownRole is returned when granting a role which doesn't exist
+var ErrUnknownRole = errors.New("unknown role")
+
+// GetRoles returns the names of the roles granted to the user
+func (u *PostgresRepository) GetRoles(ctx context.Context, userID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select r.name from roles r
+		join user_roles ur on ur.role_id = r.id
+		where ur.user_id = $1 order by r.name`
+
+	return u.queryNames(ctx, query, userID)
+}
+
+// GetPermissions returns the names of all the permissions the user has through their roles
+func (u *PostgresRepository) GetPermissions(ctx context.Context, userID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select distinct p.name from permissions p
+		join role_permissions rp on rp.permission_id = p.id
+		join user_roles ur on ur.role_id = rp.role_id
+		where ur.user_id = $1 order by p.name`
+
+	return u.queryNames(ctx, query, userID)
+}
+
+// GrantRole grants the role to the user. Granting a role the user already has is not an error.
+func (u *PostgresRepository) GrantRole(ctx context.Context, userID int, role string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `insert into user_roles (user_id, role_id)
+		select $1, id from roles where name = $2
+		on conflict do nothing`
+
+	result, err := u.db().ExecContext(ctx, stmt, userID, role)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		// either the role doesn't exist or the user already has it
+		var exists bool
+		err = u.db().QueryRowContext(ctx, `select exists(select 1 from roles where name = $1)`, role).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUnknownRole
+		}
+	}
+
+	return nil
+}
+
+// RevokeRole takes the role away from the user
+func (u *PostgresRepository) RevokeRole(ctx context.Context, userID int, role string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `delete from user_roles
+		where user_id = $1 and role_id = (select id from roles where name = $2)`
+
+	_, err := u.db().ExecContext(ctx, stmt, userID, role)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (u *PostgresRepository) queryNames(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := u.db().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
@@ -0,0 +1,390 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is one login of a user on one device. Its ID is the family of the refresh tokens
+// issued for the login, and the sid claim of its access tokens.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"user_id"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type PostgresSessionRepository struct {
+	Conn *sql.DB
+	// tx is set on the repository returned by InTx
+	tx *sql.Tx
+}
+
+func NewPostgresSessionRepository(pool *sql.DB) *PostgresSessionRepository {
+	return &PostgresSessionRepository{
+		Conn: pool,
+	}
+}
+
+// db returns the transaction the repository runs in, or the connection pool if there is none
+func (s *PostgresSessionRepository) db() dbtx {
+	if s.tx != nil {
+		return s.tx
+	}
+
+	return s.Conn
+}
+
+// InTx returns the sessions bound to the database transaction of repo
+func (s *PostgresSessionRepository) InTx(repo Repository) SessionRepository {
+	tx := sqlTxOf(repo)
+	if tx == nil {
+		return s
+	}
+
+	return &PostgresSessionRepository{Conn: s.Conn, tx: tx}
+}
+
+// InsertSession stores a new session
+func (s *PostgresSessionRepository) InsertSession(ctx context.Context, session Session) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	stmt := `insert into sessions (id, user_id, ip, user_agent, created_at, last_seen_at, expires_at)
+		values ($1, $2, $3, $4, $5, $5, $6)`
+
+	_, err := s.db().ExecContext(ctx, stmt,
+		session.ID,
+		session.UserID,
+		session.IP,
+		session.UserAgent,
+		now,
+		session.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetSession returns one session by id, or sql.ErrNoRows if there is none
+func (s *PostgresSessionRepository) GetSession(ctx context.Context, id string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, ip, user_agent, created_at, last_seen_at, expires_at, revoked_at
+		from sessions where id = $1`
+
+	rows, err := s.db().QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions, err := scanSessions(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return sessions[0], nil
+}
+
+// GetUserSessions returns the sessions of the user which are neither revoked nor expired,
+// the most recently seen first
+func (s *PostgresSessionRepository) GetUserSessions(ctx context.Context, userID int) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, ip, user_agent, created_at, last_seen_at, expires_at, revoked_at
+		from sessions where user_id = $1 and revoked_at is null and expires_at > $2
+		order by last_seen_at desc`
+
+	rows, err := s.db().QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanSessions(rows)
+}
+
+// ExtendSession records that the session got new tokens from the given address, which are
+// valid until expiresAt
+func (s *PostgresSessionRepository) ExtendSession(ctx context.Context, id, ip string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update sessions set ip = $1, last_seen_at = $2, expires_at = $3 where id = $4`
+
+	_, err := s.db().ExecContext(ctx, stmt, ip, time.Now(), expiresAt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// TouchSession records that the session has just been used
+func (s *PostgresSessionRepository) TouchSession(ctx context.Context, id string, seenAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.db().ExecContext(ctx, `update sessions set last_seen_at = $1 where id = $2`, seenAt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeSession revokes one session
+func (s *PostgresSessionRepository) RevokeSession(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update sessions set revoked_at = $1 where id = $2 and revoked_at is null`
+
+	_, err := s.db().ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeUserSessions revokes every session of the user
+func (s *PostgresSessionRepository) RevokeUserSessions(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update sessions set revoked_at = $1 where user_id = $2 and revoked_at is null`
+
+	_, err := s.db().ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ClearUserSessionClients removes the addresses and user agents of the sessions of the user
+func (s *PostgresSessionRepository) ClearUserSessionClients(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.db().ExecContext(ctx, `update sessions set ip = '', user_agent = '' where user_id = $1`, userID)
+	return err
+}
+
+func scanSessions(rows *sql.Rows) ([]*Session, error) {
+	var sessions []*Session
+
+	for rows.Next() {
+		var session Session
+		var revokedAt sql.NullTime
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.IP,
+			&session.UserAgent,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+			&revokedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if revokedAt.Valid {
+			session.RevokedAt = &revokedAt.Time
+		}
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// MemorySessionRepository keeps the sessions in memory. It is meant for tests and for running
+// the service without Postgres.
+type MemorySessionRepository struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewMemorySessionRepository() *MemorySessionRepository {
+	return &MemorySessionRepository{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// InsertSession stores a new session
+func (s *MemorySessionRepository) InsertSession(ctx context.Context, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	session.RevokedAt = nil
+	s.sessions[session.ID] = &session
+
+	return nil
+}
+
+// GetSession returns one session by id, or sql.ErrNoRows if there is none
+func (s *MemorySessionRepository) GetSession(ctx context.Context, id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	found := *session
+	return &found, nil
+}
+
+// GetUserSessions returns the sessions of the user which are neither revoked nor expired,
+// the most recently seen first
+func (s *MemorySessionRepository) GetUserSessions(ctx context.Context, userID int) ([]*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var sessions []*Session
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.RevokedAt == nil && session.ExpiresAt.After(now) {
+			found := *session
+			sessions = append(sessions, &found)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+
+	return sessions, nil
+}
+
+// ExtendSession records that the session got new tokens from the given address, which are
+// valid until expiresAt
+func (s *MemorySessionRepository) ExtendSession(ctx context.Context, id, ip string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[id]; ok {
+		session.IP = ip
+		session.LastSeenAt = time.Now()
+		session.ExpiresAt = expiresAt
+	}
+
+	return nil
+}
+
+// TouchSession records that the session has just been used
+func (s *MemorySessionRepository) TouchSession(ctx context.Context, id string, seenAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[id]; ok {
+		session.LastSeenAt = seenAt
+	}
+
+	return nil
+}
+
+// RevokeSession revokes one session
+func (s *MemorySessionRepository) RevokeSession(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[id]; ok && session.RevokedAt == nil {
+		now := time.Now()
+		session.RevokedAt = &now
+	}
+
+	return nil
+}
+
+// RevokeUserSessions revokes every session of the user
+func (s *MemorySessionRepository) RevokeUserSessions(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.RevokedAt == nil {
+			session.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+// ClearUserSessionClients removes the addresses and user agents of the sessions of the user
+func (s *MemorySessionRepository) ClearUserSessionClients(ctx context.Context, userID int) error {
+	s.clearUserSessionClients(userID)
+	return nil
+}
+
+// clearUserSessionClients clears the sessions of the user and returns the function which
+// restores them
+func (s *MemorySessionRepository) clearUserSessionClients(userID int) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cleared := make(map[*Session]Session)
+	for _, session := range s.sessions {
+		if session.UserID == userID {
+			cleared[session] = *session
+			session.IP = ""
+			session.UserAgent = ""
+		}
+	}
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for session, before := range cleared {
+			session.IP = before.IP
+			session.UserAgent = before.UserAgent
+		}
+	}
+}
+
+// InTx returns the sessions for the transaction of repo. They stay in memory, so the ones
+// cleared with ClearUserSessionClients are restored when the transaction fails.
+func (s *MemorySessionRepository) InTx(repo Repository) SessionRepository {
+	tx, ok := repo.(txRepository)
+	if !ok {
+		return s
+	}
+
+	return &memorySessionsTx{MemorySessionRepository: s, tx: tx}
+}
+
+// memorySessionsTx are the memory sessions used in a transaction of another repository
+type memorySessionsTx struct {
+	*MemorySessionRepository
+	tx txRepository
+}
+
+func (t *memorySessionsTx) ClearUserSessionClients(ctx context.Context, userID int) error {
+	t.tx.onRollback(t.clearUserSessionClients(userID))
+	return nil
+}
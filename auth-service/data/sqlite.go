@@ -0,0 +1,215 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema mirrors the users and roles tables created by the Postgres migrations, and the
+// second factors, API keys and invitations, which can't be set up again after a restart. Like
+// the 000016 migration, it removes the demo admin account older versions created with the
+// public password.
+const sqliteSchema = `
+create table if not exists users
+(
+    id            integer primary key autoincrement,
+    email         varchar(255) not null unique,
+    first_name    varchar(255) not null default '',
+    last_name     varchar(255) not null default '',
+    password      varchar(255) not null,
+    status        varchar(16)  not null default 'pending'
+        check (status in ('pending', 'active', 'suspended', 'deleted')),
+    status_reason text         not null default '',
+    deleted_at    timestamp,
+    created_at    timestamp    not null default current_timestamp,
+    updated_at    timestamp    not null default current_timestamp,
+    status_before_deletion varchar(16)
+);
+
+create table if not exists roles
+(
+    id   integer primary key autoincrement,
+    name varchar(64) not null unique
+);
+
+create table if not exists permissions
+(
+    id   integer primary key autoincrement,
+    name varchar(64) not null unique
+);
+
+create table if not exists role_permissions
+(
+    role_id       integer not null references roles (id) on delete cascade,
+    permission_id integer not null references permissions (id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists user_roles
+(
+    user_id integer not null references users (id) on delete cascade,
+    role_id integer not null references roles (id) on delete cascade,
+    primary key (user_id, role_id)
+);
+
+create table if not exists user_mfa
+(
+    user_id        integer primary key references users (id) on delete cascade,
+    secret         varchar(64) not null,
+    last_used_step bigint      not null default 0,
+    enabled_at     timestamp,
+    created_at     timestamp   not null
+);
+
+create table if not exists mfa_recovery_codes
+(
+    id        integer primary key autoincrement,
+    user_id   integer     not null references users (id) on delete cascade,
+    code_hash varchar(64) not null,
+    used_at   timestamp
+);
+
+create index if not exists mfa_recovery_codes_user_id_idx on mfa_recovery_codes (user_id);
+
+create table if not exists api_keys
+(
+    id           integer primary key autoincrement,
+    user_id      integer      not null references users (id) on delete cascade,
+    name         varchar(255) not null,
+    prefix       varchar(16)  not null,
+    key_hash     varchar(64)  not null unique,
+    scopes       text         not null default '',
+    expires_at   timestamp,
+    last_used_at timestamp,
+    created_at   timestamp    not null,
+    revoked_at   timestamp
+);
+
+create index if not exists api_keys_user_id_idx on api_keys (user_id);
+
+create table if not exists invitations
+(
+    id         integer primary key autoincrement,
+    code_hash  varchar(64)  not null unique,
+    email      varchar(255) not null default '',
+    roles      text         not null default '',
+    created_by integer references users (id) on delete set null,
+    expires_at timestamp    not null,
+    created_at timestamp    not null,
+    used_at    timestamp,
+    used_by    integer references users (id) on delete set null
+);
+
+insert into roles (name)
+values ('admin'),
+       ('user')
+on conflict do nothing;
+
+insert into permissions (name)
+values ('users:read'),
+       ('users:write'),
+       ('users:delete'),
+       ('roles:manage'),
+       ('logs:write')
+on conflict do nothing;
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id
+from roles r,
+     permissions p
+where r.name = 'admin'
+   or (r.name = 'user' and p.name = 'logs:write')
+on conflict do nothing;
+
+delete
+from users
+where email = 'admin@example.com'
+  and password = '$2a$12$oqoOqys6o/Y3.D3YvyVPpevGRqxGLkEmQ/U7Ei7kt8Kg4H6XQmAtC';
+`
+
+// sqliteStatusUpgrade replaces the active flag of a users table created before the account
+// states, like the 000015 migration does in Postgres
+const sqliteStatusUpgrade = `
+alter table users add column status varchar(16) not null default 'pending'
+    check (status in ('pending', 'active', 'suspended', 'deleted'));
+alter table users add column status_reason text not null default '';
+alter table users add column deleted_at timestamp;
+update users set status = 'active' where active = 1;
+alter table users drop column active;
+`
+
+// sqliteRestoreUpgrade keeps the state of deleted users in a users table created before it was
+// kept, like the 000018 migration does in Postgres
+const sqliteRestoreUpgrade = `alter table users add column status_before_deletion varchar(16);`
+
+// SQLiteRepository stores the users in a SQLite file, so the service can run locally without
+// Postgres. The queries of PostgresRepository work on SQLite as they are, only opening the
+// database and creating the schema differ. The same holds for PostgresMFARepository,
+// PostgresAPIKeyRepository and PostgresInvitationRepository, which use the same file.
+type SQLiteRepository struct {
+	*PostgresRepository
+}
+
+// OpenSQLite opens the SQLite database in the file, creating it when it doesn't exist. Foreign
+// keys are enforced like in Postgres, and times are written in a format which sorts and
+// compares like the times themselves.
+func OpenSQLite(path string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite", path))
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows one writer at a time, one connection avoids "database is locked" errors
+	conn.SetMaxOpenConns(1)
+
+	err = conn.Ping()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// NewSQLiteRepository creates the schema in the database if needed and returns the repository
+func NewSQLiteRepository(conn *sql.DB) (*SQLiteRepository, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// files created by older versions still have the active flag
+	var legacy int
+	err := conn.QueryRowContext(ctx, `select count(*) from pragma_table_info('users') where name = 'active'`).Scan(&legacy)
+	if err != nil {
+		return nil, err
+	}
+	if legacy > 0 {
+		_, err = conn.ExecContext(ctx, sqliteStatusUpgrade)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = conn.ExecContext(ctx, sqliteSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	var restorable int
+	err = conn.QueryRowContext(ctx, `select count(*) from pragma_table_info('users') where name = 'status_before_deletion'`).Scan(&restorable)
+	if err != nil {
+		return nil, err
+	}
+	if restorable == 0 {
+		_, err = conn.ExecContext(ctx, sqliteRestoreUpgrade)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &SQLiteRepository{
+		PostgresRepository: NewPostgresRepository(conn),
+	}, nil
+}
@@ -0,0 +1,79 @@
+package data
+
+import (
+	"errors"
+	"time"
+)
+
+// The states of an account. New accounts are pending until the email is verified, suspended
+// and deleted accounts can't log in. Deleted accounts are purged after a grace period.
+const (
+	StatusPending   = "pending"
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusDeleted   = "deleted"
+)
+
+// Statuses are all the states of an account
+var Statuses = []string{StatusPending, StatusActive, StatusSuspended, StatusDeleted}
+
+// statusTransitions are the states an account can go to from each state. A deleted account
+// can only be restored to the state it had before, with Restore, until it is purged.
+var statusTransitions = map[string][]string{
+	StatusPending:   {StatusActive, StatusSuspended, StatusDeleted},
+	StatusActive:    {StatusSuspended, StatusDeleted},
+	StatusSuspended: {StatusActive, StatusDeleted},
+}
+
+// ErrInvalidTransition is returned by SetStatus when the account can't go from its state to
+// the new one
+var ErrInvalidTransition = errors.New("invalid account status transition")
+
+// CanTransition reports whether an account can go from one state to the other
+func CanTransition(from, to string) bool {
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statusesTo returns the states from which an account can go to the state
+func statusesTo(to string) []string {
+	var from []string
+	for _, status := range Statuses {
+		if CanTransition(status, to) {
+			from = append(from, status)
+		}
+	}
+
+	return from
+}
+
+// IsActive reports whether the user can log in
+func (u *User) IsActive() bool {
+	return u.Status == StatusActive
+}
+
+// initialStatus is the state a new user is inserted in, pending unless another one is given
+func (u *User) initialStatus() string {
+	if u.Status == "" {
+		return StatusPending
+	}
+
+	return u.Status
+}
+
+// setStatus moves the user to the new state, setting deleted_at when the user is deleted and
+// clearing it otherwise
+func (u *User) setStatus(status, reason string, now time.Time) {
+	u.Status = status
+	u.StatusReason = reason
+	u.DeletedAt = nil
+	if status == StatusDeleted {
+		u.DeletedAt = &now
+	}
+	u.UpdatedAt = now
+}
@@ -1,36 +1,55 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"time"
 )
 
 type PostgresTestRepository struct {
-	Conn *sql.DB
+	Conn  *sql.DB
+	roles map[int][]string
 }
 
 func NewPostgresTestRepository(db *sql.DB) *PostgresTestRepository {
 	return &PostgresTestRepository{
-		Conn: db,
+		Conn:  db,
+		roles: make(map[int][]string),
 	}
 }
 
+// testRolePermissions mirrors the roles seeded by the migrations
+var testRolePermissions = map[string][]string{
+	"admin": {"logs:write", "roles:manage", "users:delete", "users:read", "users:write"},
+	"user":  {"logs:write"},
+}
+
+// WithTx runs fn with the same repository, the test repository has no transactions
+func (u *PostgresTestRepository) WithTx(ctx context.Context, fn func(Repository) error) error {
+	return fn(u)
+}
+
 // GetAll returns a slice of all users, sorted by last name
-func (u *PostgresTestRepository) GetAll() ([]*User, error) {
+func (u *PostgresTestRepository) GetAll(ctx context.Context) ([]*User, error) {
 	users := []*User{}
 
 	return users, nil
 }
 
+// List returns an empty page
+func (u *PostgresTestRepository) List(ctx context.Context, q UserQuery) (Page, error) {
+	return Page{Users: []*User{}}, nil
+}
+
 // GetByEmail returns one user by email
-func (u *PostgresTestRepository) GetByEmail(email string) (*User, error) {
+func (u *PostgresTestRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
 	user := User{
 		ID:        1,
 		FirstName: "First",
 		LastName:  "Last",
 		Email:     "me@here.com",
 		Password:  "",
-		Active:    1,
+		Status:    StatusActive,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -39,14 +58,14 @@ func (u *PostgresTestRepository) GetByEmail(email string) (*User, error) {
 }
 
 // GetOne returns one user by id
-func (u *PostgresTestRepository) GetOne(id int) (*User, error) {
+func (u *PostgresTestRepository) GetOne(ctx context.Context, id int) (*User, error) {
 	user := User{
-		ID:        1,
+		ID:        id,
 		FirstName: "First",
 		LastName:  "Last",
 		Email:     "me@here.com",
 		Password:  "",
-		Active:    1,
+		Status:    StatusActive,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -55,28 +74,312 @@ func (u *PostgresTestRepository) GetOne(id int) (*User, error) {
 }
 
 // Update updates one user in the database, using the information
-func (u *PostgresTestRepository) Update(user User) error {
+func (u *PostgresTestRepository) Update(ctx context.Context, user User) error {
 	return nil
 }
 
 // DeleteByID deletes one user from the database, by ID
-func (u *PostgresTestRepository) DeleteByID(id int) error {
+func (u *PostgresTestRepository) DeleteByID(ctx context.Context, id int) error {
+	return nil
+}
+
+// SetStatus does nothing, the test users are always active
+func (u *PostgresTestRepository) SetStatus(ctx context.Context, id int, status, reason string) error {
+	return nil
+}
+
+// Restore does nothing, the test users are always active
+func (u *PostgresTestRepository) Restore(ctx context.Context, id int, reason string) (string, error) {
+	return StatusActive, nil
+}
+
+// PurgeByID does nothing
+func (u *PostgresTestRepository) PurgeByID(ctx context.Context, id int) error {
 	return nil
 }
 
+// PurgeDeleted does nothing, the test repository has no deleted users
+func (u *PostgresTestRepository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	return 0, nil
+}
+
 // Insert inserts a new user into the database, and returns the ID of the newly inserted row
-func (u *PostgresTestRepository) Insert(user User) (int, error) {
+func (u *PostgresTestRepository) Insert(ctx context.Context, user User) (int, error) {
 	return 2, nil
 }
 
 // ResetPassword is the method we will use to change a user's password.
-func (u *PostgresTestRepository) ResetPassword(password string, user User) error {
+func (u *PostgresTestRepository) ResetPassword(ctx context.Context, password string, user User) error {
 	return nil
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
-func (u *PostgresTestRepository) PasswordMatches(plainText string, user User) (bool, error) {
+// WrongTestPassword is the only password the test repository rejects
+const WrongTestPassword = "wrong-password"
+
+// PasswordMatches accepts every password but WrongTestPassword
+func (u *PostgresTestRepository) PasswordMatches(ctx context.Context, plainText string, user User) (bool, error) {
+	return plainText != WrongTestPassword, nil
+}
+
+// GetRoles returns the names of the roles granted to the user
+func (u *PostgresTestRepository) GetRoles(ctx context.Context, userID int) ([]string, error) {
+	return append([]string{}, u.roles[userID]...), nil
+}
+
+// GetPermissions returns the names of all the permissions the user has through their roles
+func (u *PostgresTestRepository) GetPermissions(ctx context.Context, userID int) ([]string, error) {
+	var permissions []string
+	for _, role := range u.roles[userID] {
+		permissions = append(permissions, testRolePermissions[role]...)
+	}
+
+	return permissions, nil
+}
+
+// GrantRole grants the role to the user
+func (u *PostgresTestRepository) GrantRole(ctx context.Context, userID int, role string) error {
+	if _, ok := testRolePermissions[role]; !ok {
+		return ErrUnknownRole
+	}
+	for _, existing := range u.roles[userID] {
+		if existing == role {
+			return nil
+		}
+	}
+	u.roles[userID] = append(u.roles[userID], role)
+
+	return nil
+}
+
+// RevokeRole takes the role away from the user
+func (u *PostgresTestRepository) RevokeRole(ctx context.Context, userID int, role string) error {
+	var roles []string
+	for _, existing := range u.roles[userID] {
+		if existing != role {
+			roles = append(roles, existing)
+		}
+	}
+	u.roles[userID] = roles
+
+	return nil
+}
+
+type PostgresTestRefreshTokenRepository struct {
+	Conn   *sql.DB
+	tokens []*RefreshToken
+}
+
+func NewPostgresTestRefreshTokenRepository(db *sql.DB) *PostgresTestRefreshTokenRepository {
+	return &PostgresTestRefreshTokenRepository{
+		Conn: db,
+	}
+}
+
+// InsertRefreshToken keeps the token in memory, so rotation can be tested without a database
+func (t *PostgresTestRefreshTokenRepository) InsertRefreshToken(ctx context.Context, token RefreshToken) (int, error) {
+	token.ID = len(t.tokens) + 1
+	token.CreatedAt = time.Now()
+	t.tokens = append(t.tokens, &token)
+
+	return token.ID, nil
+}
+
+// GetRefreshTokenByHash returns one refresh token by the hash of its value
+func (t *PostgresTestRefreshTokenRepository) GetRefreshTokenByHash(ctx context.Context, hash string) (*RefreshToken, error) {
+	for _, token := range t.tokens {
+		if token.TokenHash == hash {
+			found := *token
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// MarkRefreshTokenUsed revokes a refresh token which is being rotated
+func (t *PostgresTestRefreshTokenRepository) MarkRefreshTokenUsed(ctx context.Context, id int) (bool, error) {
+	for _, token := range t.tokens {
+		if token.ID == id && token.RevokedAt == nil {
+			now := time.Now()
+			token.RevokedAt = &now
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token descended from the same login
+func (t *PostgresTestRefreshTokenRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	now := time.Now()
+	for _, token := range t.tokens {
+		if token.FamilyID == familyID && token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user
+func (t *PostgresTestRefreshTokenRepository) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	now := time.Now()
+	for _, token := range t.tokens {
+		if token.UserID == userID && token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+// ClearUserRefreshTokenIPs removes the addresses of the refresh tokens of the user
+func (t *PostgresTestRefreshTokenRepository) ClearUserRefreshTokenIPs(ctx context.Context, userID int) error {
+	for _, token := range t.tokens {
+		if token.UserID == userID {
+			token.IP = ""
+		}
+	}
+	return nil
+}
+
+// InTx returns the same refresh tokens, the test ones aren't transactional
+func (t *PostgresTestRefreshTokenRepository) InTx(repo Repository) RefreshTokenRepository {
+	return t
+}
+
+type PostgresTestPasswordResetRepository struct {
+	Conn   *sql.DB
+	resets []*PasswordReset
+}
+
+func NewPostgresTestPasswordResetRepository(db *sql.DB) *PostgresTestPasswordResetRepository {
+	return &PostgresTestPasswordResetRepository{
+		Conn: db,
+	}
+}
+
+// InsertPasswordReset keeps the reset token in memory, invalidating the previous ones of the user
+func (p *PostgresTestPasswordResetRepository) InsertPasswordReset(ctx context.Context, reset PasswordReset) (int, error) {
+	now := time.Now()
+	for _, existing := range p.resets {
+		if existing.UserID == reset.UserID && existing.UsedAt == nil {
+			existing.UsedAt = &now
+		}
+	}
+
+	reset.ID = len(p.resets) + 1
+	reset.CreatedAt = now
+	p.resets = append(p.resets, &reset)
+
+	return reset.ID, nil
+}
+
+// GetPasswordReset returns an unused and unexpired reset token without using it up
+func (p *PostgresTestPasswordResetRepository) GetPasswordReset(ctx context.Context, hash string) (*PasswordReset, error) {
+	now := time.Now()
+	for _, reset := range p.resets {
+		if reset.TokenHash == hash && reset.UsedAt == nil && reset.ExpiresAt.After(now) {
+			found := *reset
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// ConsumePasswordReset marks an unused and unexpired reset token as used and returns it
+func (p *PostgresTestPasswordResetRepository) ConsumePasswordReset(ctx context.Context, hash string) (*PasswordReset, error) {
+	now := time.Now()
+	for _, reset := range p.resets {
+		if reset.TokenHash == hash && reset.UsedAt == nil && reset.ExpiresAt.After(now) {
+			reset.UsedAt = &now
+			found := *reset
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+type PostgresTestMFARepository struct {
+	Conn          *sql.DB
+	mfa           map[int]*MFA
+	recoveryCodes map[int]map[string]bool
+}
+
+func NewPostgresTestMFARepository(db *sql.DB) *PostgresTestMFARepository {
+	return &PostgresTestMFARepository{
+		Conn:          db,
+		mfa:           make(map[int]*MFA),
+		recoveryCodes: make(map[int]map[string]bool),
+	}
+}
+
+// GetMFA returns the second factor of the user, or sql.ErrNoRows if the user has none
+func (m *PostgresTestMFARepository) GetMFA(ctx context.Context, userID int) (*MFA, error) {
+	mfa, ok := m.mfa[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	found := *mfa
+	return &found, nil
+}
+
+// SetMFASecret starts a new, not yet enabled enrollment with the given secret
+func (m *PostgresTestMFARepository) SetMFASecret(ctx context.Context, userID int, secret string) error {
+	m.mfa[userID] = &MFA{UserID: userID, Secret: secret, CreatedAt: time.Now()}
+	return nil
+}
+
+// EnableMFA enables the second factor of the user and replaces the recovery codes
+func (m *PostgresTestMFARepository) EnableMFA(ctx context.Context, userID int, recoveryCodeHashes []string) error {
+	mfa, ok := m.mfa[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	mfa.EnabledAt = &now
+
+	m.recoveryCodes[userID] = make(map[string]bool)
+	for _, hash := range recoveryCodeHashes {
+		m.recoveryCodes[userID][hash] = false
+	}
+
+	return nil
+}
+
+// InTx returns the same second factors, the test ones aren't transactional
+func (m *PostgresTestMFARepository) InTx(repo Repository) MFARepository {
+	return m
+}
+
+// DisableMFA removes the second factor and the recovery codes of the user
+func (m *PostgresTestMFARepository) DisableMFA(ctx context.Context, userID int) error {
+	delete(m.mfa, userID)
+	delete(m.recoveryCodes, userID)
+	return nil
+}
+
+// UseTOTPStep records that a code of the given time step has been accepted
+func (m *PostgresTestMFARepository) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	mfa, ok := m.mfa[userID]
+	if !ok || mfa.LastUsedStep >= step {
+		return false, nil
+	}
+	mfa.LastUsedStep = step
+
+	return true, nil
+}
+
+// ConsumeRecoveryCode marks an unused recovery code of the user as used
+func (m *PostgresTestMFARepository) ConsumeRecoveryCode(ctx context.Context, userID int, hash string) (bool, error) {
+	used, ok := m.recoveryCodes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	m.recoveryCodes[userID][hash] = true
+
 	return true, nil
 }
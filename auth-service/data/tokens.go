@@ -0,0 +1,298 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+type PostgresRefreshTokenRepository struct {
+	Conn *sql.DB
+	// tx is set on the repository returned by InTx
+	tx *sql.Tx
+}
+
+func NewPostgresRefreshTokenRepository(pool *sql.DB) *PostgresRefreshTokenRepository {
+	return &PostgresRefreshTokenRepository{
+		Conn: pool,
+	}
+}
+
+// db returns the transaction the repository runs in, or the connection pool if there is none
+func (t *PostgresRefreshTokenRepository) db() dbtx {
+	if t.tx != nil {
+		return t.tx
+	}
+
+	return t.Conn
+}
+
+// InTx returns the refresh tokens bound to the database transaction of repo
+func (t *PostgresRefreshTokenRepository) InTx(repo Repository) RefreshTokenRepository {
+	tx := sqlTxOf(repo)
+	if tx == nil {
+		return t
+	}
+
+	return &PostgresRefreshTokenRepository{Conn: t.Conn, tx: tx}
+}
+
+// RefreshToken is the structure which holds one issued refresh token. Only the hash
+// of the token is stored, the token itself is handed to the client once.
+type RefreshToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	TokenHash string     `json:"-"`
+	FamilyID  string     `json:"family_id"`
+	IP        string     `json:"ip"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// InsertRefreshToken stores a new refresh token and returns the ID of the newly inserted row
+func (t *PostgresRefreshTokenRepository) InsertRefreshToken(ctx context.Context, token RefreshToken) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into refresh_tokens (user_id, token_hash, family_id, ip, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := t.db().QueryRowContext(ctx, stmt,
+		token.UserID,
+		token.TokenHash,
+		token.FamilyID,
+		token.IP,
+		token.ExpiresAt,
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetRefreshTokenByHash returns one refresh token by the hash of its value
+func (t *PostgresRefreshTokenRepository) GetRefreshTokenByHash(ctx context.Context, hash string) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, token_hash, family_id, ip, expires_at, created_at, revoked_at
+		from refresh_tokens where token_hash = $1`
+
+	var token RefreshToken
+	var revokedAt sql.NullTime
+	err := t.db().QueryRowContext(ctx, query, hash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.TokenHash,
+		&token.FamilyID,
+		&token.IP,
+		&token.ExpiresAt,
+		&token.CreatedAt,
+		&revokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+
+	return &token, nil
+}
+
+// MarkRefreshTokenUsed revokes a refresh token which is being rotated. It reports false
+// when the token had already been revoked, so two concurrent refreshes can't both win.
+func (t *PostgresRefreshTokenRepository) MarkRefreshTokenUsed(ctx context.Context, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1 where id = $2 and revoked_at is null`
+
+	result, err := t.db().ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token descended from the same login
+func (t *PostgresRefreshTokenRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1 where family_id = $2 and revoked_at is null`
+
+	_, err := t.db().ExecContext(ctx, stmt, time.Now(), familyID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user, i.e. ends all of their sessions
+func (t *PostgresRefreshTokenRepository) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1 where user_id = $2 and revoked_at is null`
+
+	_, err := t.db().ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ClearUserRefreshTokenIPs removes the addresses of the refresh tokens of the user
+func (t *PostgresRefreshTokenRepository) ClearUserRefreshTokenIPs(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := t.db().ExecContext(ctx, `update refresh_tokens set ip = '' where user_id = $1`, userID)
+	return err
+}
+
+// MemoryRefreshTokenRepository keeps the refresh tokens in memory. It is meant for tests and
+// for running the service without Postgres, all sessions end on restart.
+type MemoryRefreshTokenRepository struct {
+	mu     sync.Mutex
+	tokens []*RefreshToken
+}
+
+func NewMemoryRefreshTokenRepository() *MemoryRefreshTokenRepository {
+	return &MemoryRefreshTokenRepository{}
+}
+
+// InsertRefreshToken stores a new refresh token and returns its ID
+func (t *MemoryRefreshTokenRepository) InsertRefreshToken(ctx context.Context, token RefreshToken) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	token.ID = len(t.tokens) + 1
+	token.CreatedAt = time.Now()
+	t.tokens = append(t.tokens, &token)
+
+	return token.ID, nil
+}
+
+// GetRefreshTokenByHash returns one refresh token by the hash of its value
+func (t *MemoryRefreshTokenRepository) GetRefreshTokenByHash(ctx context.Context, hash string) (*RefreshToken, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, token := range t.tokens {
+		if token.TokenHash == hash {
+			found := *token
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// MarkRefreshTokenUsed revokes a refresh token which is being rotated. It reports false
+// when the token had already been revoked.
+func (t *MemoryRefreshTokenRepository) MarkRefreshTokenUsed(ctx context.Context, id int) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, token := range t.tokens {
+		if token.ID == id && token.RevokedAt == nil {
+			now := time.Now()
+			token.RevokedAt = &now
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token descended from the same login
+func (t *MemoryRefreshTokenRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	t.revokeWhere(func(token *RefreshToken) bool { return token.FamilyID == familyID })
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user
+func (t *MemoryRefreshTokenRepository) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	t.revokeWhere(func(token *RefreshToken) bool { return token.UserID == userID })
+	return nil
+}
+
+func (t *MemoryRefreshTokenRepository) revokeWhere(match func(token *RefreshToken) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range t.tokens {
+		if match(token) && token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+}
+
+// ClearUserRefreshTokenIPs removes the addresses of the refresh tokens of the user
+func (t *MemoryRefreshTokenRepository) ClearUserRefreshTokenIPs(ctx context.Context, userID int) error {
+	t.clearUserRefreshTokenIPs(userID)
+	return nil
+}
+
+// clearUserRefreshTokenIPs clears the tokens of the user and returns the function which
+// restores them
+func (t *MemoryRefreshTokenRepository) clearUserRefreshTokenIPs(userID int) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cleared := make(map[*RefreshToken]string)
+	for _, token := range t.tokens {
+		if token.UserID == userID {
+			cleared[token] = token.IP
+			token.IP = ""
+		}
+	}
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		for token, ip := range cleared {
+			token.IP = ip
+		}
+	}
+}
+
+// InTx returns the refresh tokens for the transaction of repo. They stay in memory, so the
+// ones cleared with ClearUserRefreshTokenIPs are restored when the transaction fails.
+func (t *MemoryRefreshTokenRepository) InTx(repo Repository) RefreshTokenRepository {
+	tx, ok := repo.(txRepository)
+	if !ok {
+		return t
+	}
+
+	return &memoryRefreshTokensTx{MemoryRefreshTokenRepository: t, tx: tx}
+}
+
+// memoryRefreshTokensTx are the memory refresh tokens used in a transaction of another repository
+type memoryRefreshTokensTx struct {
+	*MemoryRefreshTokenRepository
+	tx txRepository
+}
+
+func (t *memoryRefreshTokensTx) ClearUserRefreshTokenIPs(ctx context.Context, userID int) error {
+	t.tx.onRollback(t.clearUserRefreshTokenIPs(userID))
+	return nil
+}
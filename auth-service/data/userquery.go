@@ -0,0 +1,368 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPageSize is the number of users in a page when the query doesn't set a limit
+	DefaultPageSize = 50
+	// MaxPageSize is the largest page which can be asked for
+	MaxPageSize = 200
+)
+
+// UserSortFields are the fields users can be sorted by. Users with the same value are
+// ordered by id, so every order is stable.
+var UserSortFields = []string{"id", "email", "first_name", "last_name", "created_at"}
+
+// ErrInvalidUserQuery is returned by List for an unknown sort field or a malformed cursor
+var ErrInvalidUserQuery = errors.New("invalid user query")
+
+// UserQuery selects one page of users. The zero value lists every user sorted by last name.
+type UserQuery struct {
+	// EmailPrefix matches the beginning of the email, ignoring case
+	EmailPrefix string
+	// Name matches any part of the first or the last name, ignoring case
+	Name string
+	// Status, when set, selects only the users in the state. Deleted users are only listed
+	// when they are asked for.
+	Status string
+	// CreatedAfter and CreatedBefore, when set, select users created at or after and
+	// before the time
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// SortBy is one of UserSortFields, last_name by default
+	SortBy     string
+	Descending bool
+	// Limit is the size of the page, DefaultPageSize by default and at most MaxPageSize
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty for the first one
+	Cursor string
+}
+
+// Page is one page of users
+type Page struct {
+	Users []*User `json:"users"`
+	// NextCursor continues the listing after this page, it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	// TotalCount is the number of users matching the filters on all the pages
+	TotalCount int `json:"total_count"`
+}
+
+// userCursor is the position after the last user of a page
+type userCursor struct {
+	Value string `json:"v,omitempty"`
+	ID    int    `json:"id"`
+}
+
+// normalize fills in the defaults and checks the sort field
+func (q UserQuery) normalize() (UserQuery, error) {
+	if q.SortBy == "" {
+		q.SortBy = "last_name"
+	}
+
+	known := false
+	for _, field := range UserSortFields {
+		known = known || field == q.SortBy
+	}
+	if !known {
+		return q, fmt.Errorf("%w: can't sort by %q", ErrInvalidUserQuery, q.SortBy)
+	}
+
+	if q.Status != "" {
+		known = false
+		for _, status := range Statuses {
+			known = known || status == q.Status
+		}
+		if !known {
+			return q, fmt.Errorf("%w: unknown status %q", ErrInvalidUserQuery, q.Status)
+		}
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageSize
+	} else if q.Limit > MaxPageSize {
+		q.Limit = MaxPageSize
+	}
+
+	return q, nil
+}
+
+// encodeCursor returns the cursor pointing after the user
+func (q UserQuery) encodeCursor(user *User) string {
+	cursor := userCursor{ID: user.ID}
+
+	switch q.SortBy {
+	case "email":
+		cursor.Value = user.Email
+	case "first_name":
+		cursor.Value = user.FirstName
+	case "last_name":
+		cursor.Value = user.LastName
+	case "created_at":
+		cursor.Value = user.CreatedAt.Format(time.RFC3339Nano)
+	}
+
+	out, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// decodeCursor returns the user the cursor points after, with only the id and the sort field set
+func (q UserQuery) decodeCursor() (*User, error) {
+	invalid := fmt.Errorf("%w: malformed cursor", ErrInvalidUserQuery)
+
+	out, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, invalid
+	}
+
+	var cursor userCursor
+	err = json.Unmarshal(out, &cursor)
+	if err != nil {
+		return nil, invalid
+	}
+
+	user := User{ID: cursor.ID}
+	switch q.SortBy {
+	case "email":
+		user.Email = cursor.Value
+	case "first_name":
+		user.FirstName = cursor.Value
+	case "last_name":
+		user.LastName = cursor.Value
+	case "created_at":
+		user.CreatedAt, err = time.Parse(time.RFC3339Nano, cursor.Value)
+		if err != nil {
+			return nil, invalid
+		}
+	}
+
+	return &user, nil
+}
+
+// sortValue returns the value of the sort field of the user as a query argument
+func (q UserQuery) sortValue(user *User) any {
+	switch q.SortBy {
+	case "email":
+		return user.Email
+	case "first_name":
+		return user.FirstName
+	case "last_name":
+		return user.LastName
+	case "created_at":
+		return user.CreatedAt
+	}
+
+	return user.ID
+}
+
+// compare orders two users by the sort field and then by id, ignoring Descending
+func (q UserQuery) compare(a, b *User) int {
+	result := 0
+	switch q.SortBy {
+	case "email":
+		result = strings.Compare(a.Email, b.Email)
+	case "first_name":
+		result = strings.Compare(a.FirstName, b.FirstName)
+	case "last_name":
+		result = strings.Compare(a.LastName, b.LastName)
+	case "created_at":
+		result = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if result != 0 {
+		return result
+	}
+
+	return a.ID - b.ID
+}
+
+// matches reports whether the user passes the filters of the query
+func (q UserQuery) matches(user *User) bool {
+	if q.EmailPrefix != "" && !strings.HasPrefix(strings.ToLower(user.Email), strings.ToLower(q.EmailPrefix)) {
+		return false
+	}
+	if q.Name != "" {
+		name := strings.ToLower(q.Name)
+		if !strings.Contains(strings.ToLower(user.FirstName), name) && !strings.Contains(strings.ToLower(user.LastName), name) {
+			return false
+		}
+	}
+	if q.Status != "" && user.Status != q.Status {
+		return false
+	}
+	if q.Status == "" && user.Status == StatusDeleted {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && user.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !user.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// escapeLike escapes the wildcards of a like pattern, which use \ as the escape character
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// List returns one page of the users matching the query
+func (u *PostgresRepository) List(ctx context.Context, q UserQuery) (Page, error) {
+	q, err := q.normalize()
+	if err != nil {
+		return Page{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var conditions []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if q.EmailPrefix != "" {
+		conditions = append(conditions, fmt.Sprintf(`lower(email) like %s escape '\'`,
+			arg(escapeLike(strings.ToLower(q.EmailPrefix))+"%")))
+	}
+	if q.Name != "" {
+		pattern := arg("%" + escapeLike(strings.ToLower(q.Name)) + "%")
+		conditions = append(conditions, fmt.Sprintf(`(lower(first_name) like %s escape '\' or lower(last_name) like %s escape '\')`,
+			pattern, pattern))
+	}
+	if q.Status != "" {
+		conditions = append(conditions, "status = "+arg(q.Status))
+	} else {
+		conditions = append(conditions, "status <> "+arg(StatusDeleted))
+	}
+	if !q.CreatedAfter.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(q.CreatedAfter))
+	}
+	if !q.CreatedBefore.IsZero() {
+		conditions = append(conditions, "created_at < "+arg(q.CreatedBefore))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " where " + strings.Join(conditions, " and ")
+	}
+
+	var page Page
+	err = u.db().QueryRowContext(ctx, "select count(*) from users"+where, args...).Scan(&page.TotalCount)
+	if err != nil {
+		return Page{}, err
+	}
+
+	direction, after := "asc", ">"
+	if q.Descending {
+		direction, after = "desc", "<"
+	}
+
+	if q.Cursor != "" {
+		last, err := q.decodeCursor()
+		if err != nil {
+			return Page{}, err
+		}
+
+		condition := fmt.Sprintf("id %s %s", after, arg(last.ID))
+		if q.SortBy != "id" {
+			condition = fmt.Sprintf("(%s, id) %s (%s, %s)", q.SortBy, after, arg(q.sortValue(last)), arg(last.ID))
+		}
+		conditions = append(conditions, condition)
+		where = " where " + strings.Join(conditions, " and ")
+	}
+
+	order := fmt.Sprintf("%s %s", q.SortBy, direction)
+	if q.SortBy != "id" {
+		order += fmt.Sprintf(", id %s", direction)
+	}
+
+	// the sort field comes from UserSortFields, everything else is an argument
+	query := `select ` + userColumns + ` from users` + where + " order by " + order + " limit " + arg(q.Limit+1)
+
+	rows, err := u.db().QueryContext(ctx, query, args...)
+	if err != nil {
+		return Page{}, err
+	}
+	defer rows.Close()
+
+	page.Users = []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return Page{}, err
+		}
+
+		page.Users = append(page.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return Page{}, err
+	}
+
+	if len(page.Users) > q.Limit {
+		page.Users = page.Users[:q.Limit]
+		page.NextCursor = q.encodeCursor(page.Users[q.Limit-1])
+	}
+
+	return page, nil
+}
+
+// List returns one page of the users matching the query
+func (m *MemoryRepository) List(ctx context.Context, q UserQuery) (Page, error) {
+	q, err := q.normalize()
+	if err != nil {
+		return Page{}, err
+	}
+
+	var last *User
+	if q.Cursor != "" {
+		last, err = q.decodeCursor()
+		if err != nil {
+			return Page{}, err
+		}
+	}
+
+	defer m.lock()()
+
+	var matching []*User
+	for _, user := range m.state.users {
+		user := user
+		if q.matches(&user) {
+			matching = append(matching, &user)
+		}
+	}
+
+	less := func(a, b *User) bool {
+		if q.Descending {
+			return q.compare(a, b) > 0
+		}
+		return q.compare(a, b) < 0
+	}
+	sort.Slice(matching, func(i, j int) bool { return less(matching[i], matching[j]) })
+
+	page := Page{Users: []*User{}, TotalCount: len(matching)}
+	for _, user := range matching {
+		if last != nil && !less(last, user) {
+			continue
+		}
+		if len(page.Users) == q.Limit {
+			page.NextCursor = q.encodeCursor(page.Users[q.Limit-1])
+			break
+		}
+		page.Users = append(page.Users, user)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// errInvalidAPIKey is returned when the auth service doesn't accept an API key
+var errInvalidAPIKey = errors.New("invalid api key")
+
+// APIKeyVerifier checks API keys with the auth service. Unlike access tokens they can't be
+// verified locally, because only the auth service knows which keys exist.
+type APIKeyVerifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewAPIKeyVerifier(url string) *APIKeyVerifier {
+	return &APIKeyVerifier{
+		URL:    url,
+		Client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Scope returns the permissions the API key grants, as a space separated list. The request r
+// the key came with is passed on, so the auth service sees the address of the client.
+func (v *APIKeyVerifier) Scope(r *http.Request, apiKey string) (string, error) {
+	scope, err := fetchScope(r, v.Client, v.URL, func(request *http.Request) {
+		request.Header.Set("X-API-Key", apiKey)
+	})
+	if errors.Is(err, errRejected) {
+		return "", errInvalidAPIKey
+	}
+
+	return scope, err
+}
+
+// errRejected is returned by fetchScope when the auth service doesn't accept the credentials
+var errRejected = errors.New("rejected by the auth service")
+
+// fetchScope asks the auth service at url for the scope of the credentials which authenticate
+// adds to the request. The address of the client of r is passed on.
+func fetchScope(r *http.Request, client *http.Client, url string, authenticate func(*http.Request)) (string, error) {
+	request, err := http.NewRequestWithContext(r.Context(), "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	authenticate(request)
+	forwardClientIP(request, r)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return "", errRejected
+	} else if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("auth service answered %d checking the credentials", response.StatusCode)
+	}
+
+	var jsonFromService struct {
+		Data struct {
+			Scope string `json:"scope"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		return "", err
+	}
+
+	return jsonFromService.Data.Scope, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test_APIKeyPermissions проверяет, что broker принимает API-ключи, проверяя их в auth-service.
+func Test_APIKeyPermissions(t *testing.T) {
+	var forwardedFor string
+
+	// auth-service отвечает scope ключа или 401 для неизвестного ключа
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = r.Header.Get("X-Forwarded-For")
+
+		scopes := map[string]string{"ak_logs": "logs:write", "ak_users": "users:read"}
+		scope, ok := scopes[r.Header.Get("X-API-Key")]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"user_id": 1, "scope": scope}})
+	}))
+	defer authServer.Close()
+
+	testApp := &Config{APIKeys: NewAPIKeyVerifier(authServer.URL)}
+
+	tests := []struct {
+		name     string
+		key      string
+		expected bool
+	}{
+		{"key with the permission", "ak_logs", true},
+		{"key without the permission", "ak_users", false},
+		{"unknown key", "ak_unknown", false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/handle", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.Header.Set("X-API-Key", e.key)
+
+		if allowed := testApp.requirePermission(httptest.NewRecorder(), req, "logs:write"); allowed != e.expected {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, allowed)
+		}
+		if forwardedFor != "192.168.1.1" {
+			t.Errorf("%s: expected the client address to be forwarded, got %q", e.name, forwardedFor)
+		}
+	}
+
+	// если auth-service недоступен, ключ не принимается
+	authServer.Close()
+	req, _ := http.NewRequest("POST", "/handle", nil)
+	req.Header.Set("X-API-Key", "ak_logs")
+	rr := httptest.NewRecorder()
+	if testApp.requirePermission(rr, req, "logs:write") || rr.Code != http.StatusBadGateway {
+		t.Errorf("expected http.StatusBadGateway when the auth service is down, got %d", rr.Code)
+	}
+}
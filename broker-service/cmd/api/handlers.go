@@ -15,9 +15,11 @@ import (
 )
 
 type RequestPayload struct {
-	Action string      `json:"action"`
-	Auth   authPayload `json:"auth,omitempty"`
-	Log    logPayload  `json:"log,omitempty"`
+	Action  string         `json:"action"`
+	Auth    authPayload    `json:"auth,omitempty"`
+	Log     logPayload     `json:"log,omitempty"`
+	Refresh refreshPayload `json:"refresh,omitempty"`
+	MFA     mfaPayload     `json:"mfa,omitempty"`
 }
 
 type authPayload struct {
@@ -30,6 +32,22 @@ type logPayload struct {
 	Data string `json:"data"`
 }
 
+type refreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type mfaPayload struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// actionPermissions lists the permissions the access token has to grant for an action.
+// Actions which aren't listed, like auth, mfa and refresh, can be used without a token.
+var actionPermissions = map[string]string{
+	"log": "logs:write",
+}
+
 func (app *Config) Broker(w http.ResponseWriter, r *http.Request) {
 	payload := jsonResponse{
 		Error:   false,
@@ -49,11 +67,21 @@ func (app *Config) HandleSubmission(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if permission, ok := actionPermissions[requestPayload.Action]; ok {
+		if !app.requirePermission(w, r, permission) {
+			return
+		}
+	}
+
 	switch requestPayload.Action {
 	case "auth":
-		app.authenticate(w, requestPayload.Auth)
+		app.authenticate(w, r, requestPayload.Auth)
 	case "log":
 		app.logItem(w, requestPayload.Log)
+	case "refresh":
+		app.refresh(w, r, requestPayload.Refresh)
+	case "mfa":
+		app.authenticateMFA(w, r, requestPayload.MFA)
 	default:
 		fmt.Println("BadRequest during action cases")
 		app.errorJSON(w, errors.New("invalid action"))
@@ -80,7 +108,10 @@ func (app *Config) logItem(w http.ResponseWriter, entry logPayload) {
 
 	request.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := app.LogClient
+	if client == nil {
+		client = &http.Client{}
+	}
 	response, err := client.Do(request)
 	if err != nil {
 		log.Println("Error during doing request in log service")
@@ -102,7 +133,7 @@ func (app *Config) logItem(w http.ResponseWriter, entry logPayload) {
 	app.writeJSON(w, http.StatusAccepted, payLoad)
 }
 
-func (app *Config) authenticate(w http.ResponseWriter, a authPayload) {
+func (app *Config) authenticate(w http.ResponseWriter, r *http.Request, a authPayload) {
 	// create some json we'll send to the auth microservice
 	jsonData, _ := json.MarshalIndent(a, "", "\t")
 
@@ -113,6 +144,7 @@ func (app *Config) authenticate(w http.ResponseWriter, a authPayload) {
 		app.errorJSON(w, err)
 		return
 	}
+	forwardClientIP(request, r)
 
 	client := &http.Client{}
 	fmt.Println(client)
@@ -130,6 +162,15 @@ func (app *Config) authenticate(w http.ResponseWriter, a authPayload) {
 		fmt.Println("Status Unathorized")
 		app.errorJSON(w, errors.New("unauthorized"))
 		return
+	} else if response.StatusCode == http.StatusForbidden || response.StatusCode == http.StatusTooManyRequests {
+		// e.g. the email of the account has not been verified yet, or too many logins failed
+		var jsonFromService jsonResponse
+		_ = json.NewDecoder(response.Body).Decode(&jsonFromService)
+		if retryAfter := response.Header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		app.errorJSON(w, errors.New(jsonFromService.Message), response.StatusCode)
+		return
 	} else if response.StatusCode != http.StatusAccepted {
 		fmt.Println("error calling auth service")
 		app.errorJSON(w, errors.New("error calling auth service"))
@@ -150,6 +191,128 @@ func (app *Config) authenticate(w http.ResponseWriter, a authPayload) {
 		return
 	}
 
+	// pass the token cookies set by the auth service on to the client
+	for _, cookie := range response.Cookies() {
+		http.SetCookie(w, cookie)
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.Message = "OK"
+	payload.Data = jsonFromService.Data
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// refresh exchanges a refresh token for a new pair of tokens in the auth service. The token is
+// taken from the payload or, when the client doesn't have it, from the refresh_token cookie.
+func (app *Config) refresh(w http.ResponseWriter, r *http.Request, p refreshPayload) {
+	if p.RefreshToken == "" {
+		cookie, err := r.Cookie("refresh_token")
+		if err != nil {
+			app.errorJSON(w, errors.New("refresh token is required"), http.StatusUnauthorized)
+			return
+		}
+		p.RefreshToken = cookie.Value
+	}
+
+	jsonData, _ := json.MarshalIndent(p, "", "\t")
+
+	request, err := http.NewRequest("POST", "http://auth-service:82/refresh", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Println("BadRquest during calling auth service")
+		app.errorJSON(w, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	forwardClientIP(request, r)
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		fmt.Println("BadRquest during doing new request in refresh func", err)
+		app.errorJSON(w, err)
+		return
+	}
+	defer response.Body.Close()
+
+	var jsonFromService jsonResponse
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		fmt.Println("BadRquest during decoding response")
+		app.errorJSON(w, err)
+		return
+	}
+
+	if response.StatusCode != http.StatusAccepted || jsonFromService.Error {
+		app.errorJSON(w, errors.New(jsonFromService.Message), http.StatusUnauthorized)
+		return
+	}
+
+	for _, cookie := range response.Cookies() {
+		http.SetCookie(w, cookie)
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.Message = "refreshed"
+	payload.Data = jsonFromService.Data
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// authenticateMFA finishes a login with two-factor authentication, exchanging the mfa token
+// returned by the auth action and a code for the token cookies
+func (app *Config) authenticateMFA(w http.ResponseWriter, r *http.Request, p mfaPayload) {
+	if p.MFAToken == "" {
+		app.errorJSON(w, errors.New("mfa token is required"), http.StatusUnauthorized)
+		return
+	}
+
+	jsonData, _ := json.MarshalIndent(p, "", "\t")
+
+	request, err := http.NewRequest("POST", "http://auth-service:82/authenticate/mfa", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Println("BadRquest during calling auth service")
+		app.errorJSON(w, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	forwardClientIP(request, r)
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		fmt.Println("BadRquest during doing new request in authenticateMFA func", err)
+		app.errorJSON(w, err)
+		return
+	}
+	defer response.Body.Close()
+
+	var jsonFromService jsonResponse
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		fmt.Println("BadRquest during decoding response")
+		app.errorJSON(w, err)
+		return
+	}
+
+	if response.StatusCode != http.StatusAccepted || jsonFromService.Error {
+		if retryAfter := response.Header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		status := http.StatusUnauthorized
+		if response.StatusCode == http.StatusTooManyRequests {
+			status = http.StatusTooManyRequests
+		}
+		app.errorJSON(w, errors.New(jsonFromService.Message), status)
+		return
+	}
+
+	for _, cookie := range response.Cookies() {
+		http.SetCookie(w, cookie)
+	}
+
 	var payload jsonResponse
 	payload.Error = false
 	payload.Message = "OK"
@@ -168,7 +331,16 @@ func (app *Config) LogViagRPC(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := grpc.NewClient("log-service:50001", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !app.requirePermission(w, r, actionPermissions["log"]) {
+		return
+	}
+
+	options := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if app.LogCredentials != nil {
+		options = append(options, grpc.WithPerRPCCredentials(app.LogCredentials))
+	}
+
+	conn, err := grpc.NewClient("log-service:50001", options...)
 	if err != nil {
 		fmt.Println("Error in broker-service/handlers, 173")
 		app.errorJSON(w, err)
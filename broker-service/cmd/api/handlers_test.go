@@ -180,3 +180,63 @@ func Test_Authenticate_Error(t *testing.T) {
 		t.Errorf("expected error, got none")
 	}
 }
+
+func Test_Refresh_MissingToken(t *testing.T) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"action": "refresh",
+	})
+
+	req, _ := http.NewRequest("POST", "/handle", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(testApp.HandleSubmission)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_MFA_MissingToken(t *testing.T) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"action": "mfa",
+		"mfa":    map[string]string{"code": "123456"},
+	})
+
+	req, _ := http.NewRequest("POST", "/handle", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(testApp.HandleSubmission)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+// Test_ForwardClientIP проверяет, что адрес клиента передаётся в auth-service.
+func Test_ForwardClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		prior      string
+		expected   string
+	}{
+		{"192.168.1.1:12345", "", "192.168.1.1"},
+		{"[2001:db8::1]:12345", "", "2001:db8::1"},
+		{"10.0.0.5:12345", "203.0.113.7", "203.0.113.7, 10.0.0.5"},
+	}
+
+	for _, e := range tests {
+		r, _ := http.NewRequest("POST", "/handle", nil)
+		r.RemoteAddr = e.remoteAddr
+		if e.prior != "" {
+			r.Header.Set("X-Forwarded-For", e.prior)
+		}
+
+		request, _ := http.NewRequest("POST", "http://auth-service:82/authenticate", nil)
+		forwardClientIP(request, r)
+		if got := request.Header.Get("X-Forwarded-For"); got != e.expected {
+			t.Errorf("%s: expected %q but got %q", e.remoteAddr, e.expected, got)
+		}
+	}
+}
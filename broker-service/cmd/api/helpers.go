@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 )
 
 type jsonResponse struct {
@@ -64,3 +66,22 @@ func (app *Config) errorJSON(w http.ResponseWriter, err error, status ...int) er
 
 	return app.writeJSON(w, statusCode, payload)
 }
+
+// forwardClientIP adds the address the request r came from to the X-Forwarded-For header of
+// the request to another service, so the auth service binds tokens to the client and not to us
+func forwardClientIP(request *http.Request, r *http.Request) {
+	request.Header.Set("X-Forwarded-For", forwardedFor(r))
+}
+
+// forwardedFor returns the X-Forwarded-For header of r with the address r came from appended
+func forwardedFor(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	return ip
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// requirePermission checks that the request carries a valid user access token, or an API key in
+// the X-API-Key header, whose scope contains the permission. Access tokens are also checked with
+// the auth service when Tokens is set. When it reports false, the error response has already
+// been written.
+func (app *Config) requirePermission(w http.ResponseWriter, r *http.Request, permission string) bool {
+	var scope string
+
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		if app.APIKeys == nil {
+			app.errorJSON(w, errInvalidAPIKey, http.StatusUnauthorized)
+			return false
+		}
+
+		var err error
+		scope, err = app.APIKeys.Scope(r, apiKey)
+		if errors.Is(err, errInvalidAPIKey) {
+			app.errorJSON(w, err, http.StatusUnauthorized)
+			return false
+		} else if err != nil {
+			app.errorJSON(w, err, http.StatusBadGateway)
+			return false
+		}
+	} else {
+		tokenString, err := accessTokenFromRequest(r)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusUnauthorized)
+			return false
+		}
+
+		// only access tokens of users have no typ, service and OIDC tokens are rejected
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(tokenString, claims, app.Keys.Keyfunc)
+		if err != nil || !token.Valid || claims["typ"] != nil {
+			app.errorJSON(w, errors.New("token is not valid"), http.StatusUnauthorized)
+			return false
+		}
+
+		scope, _ = claims["scope"].(string)
+
+		// the signature can't tell whether the token has been revoked since
+		if app.Tokens != nil {
+			scope, err = app.Tokens.Scope(r, tokenString)
+			if errors.Is(err, errTokenRevoked) {
+				app.errorJSON(w, err, http.StatusUnauthorized)
+				return false
+			} else if err != nil {
+				app.errorJSON(w, err, http.StatusBadGateway)
+				return false
+			}
+		}
+	}
+
+	for _, granted := range strings.Fields(scope) {
+		if granted == permission {
+			return true
+		}
+	}
+
+	app.errorJSON(w, fmt.Errorf("missing permission %s", permission), http.StatusForbidden)
+	return false
+}
+
+// accessTokenFromRequest returns the access token from the Authorization header, falling back
+// to the access_token cookie
+func accessTokenFromRequest(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, _ := strings.Cut(header, " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", errors.New("invalid authorization header")
+		}
+		return token, nil
+	}
+
+	cookie, err := r.Cookie("access_token")
+	if err != nil {
+		return "", errors.New("unauthorized")
+	}
+
+	return cookie.Value, nil
+}
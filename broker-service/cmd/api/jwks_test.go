@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"jwks"
+)
+
+func Test_LogActionPermissions(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// auth-service публикует открытый ключ в формате JWKS
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwksServer.Close()
+
+	testApp := &Config{Keys: jwks.New(jwksServer.URL)}
+
+	signClaims := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-key"
+		tokenString, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+	sign := func(scope string) string {
+		return signClaims(jwt.MapClaims{"sub": 1, "scope": scope})
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"invalid token", "not-a-token", http.StatusUnauthorized},
+		{"missing permission", sign("users:read"), http.StatusForbidden},
+		{"service token", signClaims(jwt.MapClaims{"sub": "broker-service", "typ": "service", "scope": "logs:write"}), http.StatusUnauthorized},
+		{"oidc token", signClaims(jwt.MapClaims{"sub": "1", "typ": "oidc_access", "scope": "logs:write"}), http.StatusUnauthorized},
+	}
+
+	for _, e := range tests {
+		body, _ := json.Marshal(map[string]any{
+			"action": "log",
+			"log":    map[string]string{"name": "event", "data": "some kind of data"},
+		})
+		req, _ := http.NewRequest("POST", "/handle", bytes.NewReader(body))
+		if e.token != "" {
+			req.AddCookie(&http.Cookie{Name: "access_token", Value: e.token})
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(testApp.HandleSubmission).ServeHTTP(rr, req)
+
+		if rr.Code != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, rr.Code)
+		}
+	}
+
+	// токен с нужным разрешением проходит проверку подписи и scope
+	req, _ := http.NewRequest("POST", "/handle", nil)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: sign("logs:write users:read")})
+	if !testApp.requirePermission(httptest.NewRecorder(), req, "logs:write") {
+		t.Error("expected token with logs:write to be accepted")
+	}
+}
@@ -1,19 +1,47 @@
 package main
 
 import (
+	"broker-service/oauth"
 	"fmt"
+	"jwks"
 	"log"
 	"net/http"
+	"os"
 )
 
 const webPort = "82"
 
 type Config struct {
-	Client *http.Client
+	Client  *http.Client
+	Keys    *jwks.KeySet
+	APIKeys *APIKeyVerifier
+	// Tokens checks access tokens with the auth service after their signature, without it only
+	// the signature and the expiry are checked
+	Tokens *AccessTokenVerifier
+	// LogClient sends requests to the log service, with a service token when the broker has
+	// OAuth2 client credentials
+	LogClient *http.Client
+	// LogCredentials adds the same service token to the gRPC calls to the log service
+	LogCredentials *oauth.ClientCredentials
 }
 
 func main() {
-	app := Config{}
+	app := Config{
+		Keys:    jwks.New("http://auth-service:82/.well-known/jwks.json"),
+		APIKeys: NewAPIKeyVerifier("http://auth-service:82/me/scope"),
+		Tokens:  NewAccessTokenVerifier("http://auth-service:82/me/scope"),
+	}
+
+	if clientID := os.Getenv("OAUTH_CLIENT_ID"); clientID != "" {
+		credentials := &oauth.ClientCredentials{
+			TokenURL:     "http://auth-service:82/oauth/token",
+			ClientID:     clientID,
+			ClientSecret: os.Getenv("OAUTH_CLIENT_SECRET"),
+			Scopes:       []string{"logs:write"},
+		}
+		app.LogClient = credentials.HTTPClient()
+		app.LogCredentials = credentials
+	}
 
 	log.Printf("Starting broker service on port %s\n", webPort)
 
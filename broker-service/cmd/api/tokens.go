@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errTokenRevoked is returned when the auth service no longer accepts an access token
+var errTokenRevoked = errors.New("token is not valid")
+
+// tokenCacheTTL is how long the answer of the auth service about an access token is reused, so
+// a revoked token is rejected at most this long after the revocation
+const tokenCacheTTL = 15 * time.Second
+
+// AccessTokenVerifier asks the auth service whether an access token is still accepted. The
+// signature is checked locally, but only the auth service knows which tokens have been revoked,
+// which users are suspended and from which addresses a bound token may be used.
+type AccessTokenVerifier struct {
+	URL    string
+	Client *http.Client
+	// TTL is how long an answer is cached
+	TTL time.Duration
+
+	mu      sync.Mutex
+	answers map[string]tokenAnswer
+	swept   time.Time
+}
+
+// tokenAnswer is a cached answer of the auth service, the scope or errTokenRevoked
+type tokenAnswer struct {
+	scope     string
+	err       error
+	expiresAt time.Time
+}
+
+func NewAccessTokenVerifier(url string) *AccessTokenVerifier {
+	return &AccessTokenVerifier{
+		URL:     url,
+		Client:  &http.Client{Timeout: 5 * time.Second},
+		TTL:     tokenCacheTTL,
+		answers: make(map[string]tokenAnswer),
+	}
+}
+
+// Scope returns the permissions the auth service grants the access token now, as a space
+// separated list. Answers are cached per token and client address, errors reaching the auth
+// service aren't.
+func (v *AccessTokenVerifier) Scope(r *http.Request, token string) (string, error) {
+	// a token bound to an address may be accepted from one client and not from another
+	sum := sha256.Sum256([]byte(token + "\n" + forwardedFor(r)))
+	key := hex.EncodeToString(sum[:])
+
+	now := time.Now()
+	if answer, ok := v.cached(key, now); ok {
+		return answer.scope, answer.err
+	}
+
+	scope, err := fetchScope(r, v.Client, v.URL, func(request *http.Request) {
+		// the cookie works whether or not the auth service accepts bearer tokens
+		request.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+	})
+	if errors.Is(err, errRejected) {
+		err = errTokenRevoked
+	} else if err != nil {
+		return "", err
+	}
+
+	v.store(key, tokenAnswer{scope: scope, err: err, expiresAt: now.Add(v.TTL)}, now)
+	return scope, err
+}
+
+func (v *AccessTokenVerifier) cached(key string, now time.Time) (tokenAnswer, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	answer, ok := v.answers[key]
+	if !ok || !now.Before(answer.expiresAt) {
+		return tokenAnswer{}, false
+	}
+
+	return answer, true
+}
+
+// store caches the answer, dropping the expired ones once per TTL
+func (v *AccessTokenVerifier) store(key string, answer tokenAnswer, now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.swept) >= v.TTL {
+		for k, cached := range v.answers {
+			if !now.Before(cached.expiresAt) {
+				delete(v.answers, k)
+			}
+		}
+		v.swept = now
+	}
+
+	v.answers[key] = answer
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"jwks"
+)
+
+// Test_AccessTokenRevocation проверяет, что broker не принимает токены, которые auth-service
+// уже не принимает, хотя подпись и срок у них в порядке.
+func Test_AccessTokenRevocation(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwksServer.Close()
+
+	sign := func(sub int) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": sub, "scope": "logs:write"})
+		token.Header["kid"] = "test-key"
+		tokenString, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+	active, revoked, narrowed := sign(1), sign(2), sign(3)
+
+	// auth-service не принимает второй токен, а третьему даёт меньше прав
+	calls := 0
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		cookie, _ := r.Cookie("access_token")
+		scopes := map[string]string{active: "logs:write", narrowed: "users:read"}
+		scope, ok := scopes[cookie.Value]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"scope": scope}})
+	}))
+	defer authServer.Close()
+
+	testApp := &Config{Keys: jwks.New(jwksServer.URL), Tokens: NewAccessTokenVerifier(authServer.URL)}
+
+	check := func(token string) int {
+		req, _ := http.NewRequest("POST", "/handle", nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+		rr := httptest.NewRecorder()
+		if testApp.requirePermission(rr, req, "logs:write") {
+			return http.StatusOK
+		}
+		return rr.Code
+	}
+
+	for _, e := range []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{"active token", active, http.StatusOK},
+		{"revoked token", revoked, http.StatusUnauthorized},
+		{"token narrowed by the auth service", narrowed, http.StatusForbidden},
+	} {
+		if code := check(e.token); code != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, code)
+		}
+	}
+
+	// ответ auth-service кешируется
+	if code := check(active); code != http.StatusOK || calls != 3 {
+		t.Errorf("expected the cached answer, got %d after %d calls", code, calls)
+	}
+
+	// если auth-service недоступен, непроверенный токен не принимается
+	authServer.Close()
+	testApp.Tokens = NewAccessTokenVerifier(authServer.URL)
+	if code := check(active); code != http.StatusBadGateway {
+		t.Errorf("expected http.StatusBadGateway when the auth service is down, got %d", code)
+	}
+}
@@ -7,6 +7,8 @@ toolchain go1.23.2
 require (
 	github.com/go-chi/chi/v5 v5.1.0
 	github.com/go-chi/cors v1.2.1
+	github.com/golang-jwt/jwt/v4 v4.5.0
+	jwks v0.0.0
 )
 
 require (
@@ -17,3 +19,6 @@ require (
 	google.golang.org/grpc v1.69.2 // indirect
 	google.golang.org/protobuf v1.36.2 // indirect
 )
+
+// jwks is shared with the other services which verify tokens of the auth service
+replace jwks => ../jwks
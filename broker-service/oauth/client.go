@@ -0,0 +1,178 @@
+// Package oauth gets service tokens from the OAuth2 token endpoint of the auth service with
+// the client_credentials grant, and adds them to outgoing requests.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expiryLeeway is how long before it expires a token is replaced, so it doesn't expire
+// on its way to the other service
+const expiryLeeway = time.Minute
+
+// ClientCredentials caches the token of one client and gets a new one when it is about
+// to expire. It is safe for concurrent use.
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	// Scopes to ask for, all the scopes of the client when it is empty
+	Scopes []string
+	// Client is used for the token requests, http.DefaultClient when it is nil
+	Client *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// Token returns a valid token, asking the token endpoint only when the cached one is about
+// to expire
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Until(c.expiresAt) > expiryLeeway {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var tokenResponse struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", fmt.Errorf("token endpoint answered %d: %w", response.StatusCode, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %d: %s %s", response.StatusCode, tokenResponse.Error, tokenResponse.ErrorDescription)
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access token")
+	}
+
+	c.token = tokenResponse.AccessToken
+	c.expiresAt = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+
+	return c.token, nil
+}
+
+// Invalidate forgets the cached token, e.g. after the other service has rejected it
+func (c *ClientCredentials) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = ""
+}
+
+// GetRequestMetadata adds the token to gRPC calls, so ClientCredentials can be passed to
+// grpc.WithPerRPCCredentials
+func (c *ClientCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := c.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+// RequireTransportSecurity lets the token be sent over the plain connections between the
+// services inside the docker network
+func (c *ClientCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// HTTPClient returns a client which adds the token to every request it sends
+func (c *ClientCredentials) HTTPClient() *http.Client {
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &Transport{Source: c},
+	}
+}
+
+// Transport adds the token of Source to the requests. When a request is rejected with 401,
+// e.g. because the signing keys have been rotated, it is sent once more with a new token.
+type Transport struct {
+	Source *ClientCredentials
+	// Base sends the requests, http.DefaultTransport when it is nil
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	response, err := t.send(base, req)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+
+	// the body has been read already, so it can only be sent again if it can be rewound
+	if req.Body != nil && req.GetBody == nil {
+		return response, nil
+	}
+	response.Body.Close()
+	t.Source.Invalidate()
+
+	retry := req
+	if req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry = req.Clone(req.Context())
+		retry.Body = body
+	}
+
+	return t.send(base, retry)
+}
+
+func (t *Transport) send(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	token, err := t.Source.Token(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	// a RoundTripper must not change the request it was given
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", "Bearer "+token)
+
+	return base.RoundTrip(authorized)
+}
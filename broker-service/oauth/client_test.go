@@ -0,0 +1,114 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test_ClientCredentials проверяет кэширование и обновление сервисного токена.
+func Test_ClientCredentials(t *testing.T) {
+	issued := 0
+	expiresIn := 3600
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "broker-service" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		issued++
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": fmt.Sprintf("token-%d", issued),
+			"token_type":   "Bearer",
+			"expires_in":   expiresIn,
+			"scope":        r.FormValue("scope"),
+		})
+	}))
+	defer tokenServer.Close()
+
+	source := &ClientCredentials{TokenURL: tokenServer.URL, ClientID: "broker-service", ClientSecret: "secret", Scopes: []string{"logs:write"}}
+
+	for i := 0; i < 3; i++ {
+		token, err := source.Token(context.Background())
+		if err != nil || token != "token-1" {
+			t.Fatalf("expected the cached token-1, got %q: %v", token, err)
+		}
+	}
+
+	// токен, который скоро истечёт, запрашивается заново
+	expiresIn = 30
+	source.Invalidate()
+	if token, _ := source.Token(context.Background()); token != "token-2" {
+		t.Errorf("expected token-2, got %q", token)
+	}
+	if token, _ := source.Token(context.Background()); token != "token-3" {
+		t.Errorf("expected token-3 because token-2 is about to expire, got %q", token)
+	}
+
+	// для gRPC токен передаётся в metadata
+	if md, err := source.GetRequestMetadata(context.Background()); err != nil || md["authorization"] != "Bearer token-4" {
+		t.Errorf("expected the token in the authorization metadata, got %v %v", md, err)
+	}
+
+	wrong := &ClientCredentials{TokenURL: tokenServer.URL, ClientID: "broker-service", ClientSecret: "wrong"}
+	if _, err := wrong.Token(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("expected invalid_client, got %v", err)
+	}
+	if _, err := wrong.GetRequestMetadata(context.Background()); err == nil {
+		t.Error("expected no metadata without a token")
+	}
+}
+
+// Test_Transport проверяет, что токен добавляется к запросам и обновляется после 401.
+func Test_Transport(t *testing.T) {
+	issued := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issued++
+		json.NewEncoder(w).Encode(map[string]any{"access_token": fmt.Sprintf("token-%d", issued), "expires_in": 3600})
+	}))
+	defer tokenServer.Close()
+
+	// сервис принимает только второй токен, как после смены ключей
+	var bodies []string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer service.Close()
+
+	source := &ClientCredentials{TokenURL: tokenServer.URL, ClientID: "broker-service", ClientSecret: "secret"}
+	client := source.HTTPClient()
+
+	response, err := client.Post(service.URL, "application/json", strings.NewReader(`{"name":"event"}`))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		t.Errorf("expected http.StatusAccepted after the retry but got %d", response.StatusCode)
+	}
+	if len(bodies) != 2 || bodies[1] != `{"name":"event"}` {
+		t.Errorf("expected the body to be sent again, got %v", bodies)
+	}
+
+	// следующий запрос сразу идёт с новым токеном
+	response, _ = client.Post(service.URL, "application/json", strings.NewReader(`{}`))
+	response.Body.Close()
+	if issued != 2 || len(bodies) != 3 {
+		t.Errorf("expected the new token to be reused, issued %d tokens for %d requests", issued, len(bodies))
+	}
+}
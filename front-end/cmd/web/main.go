@@ -16,6 +16,14 @@ func main() {
 		render(w, "logged.page.gohtml")
 	})
 
+	http.HandleFunc("/reset-password", func(w http.ResponseWriter, r *http.Request) {
+		render(w, "reset-password.page.gohtml")
+	})
+
+	http.HandleFunc("/consent", func(w http.ResponseWriter, r *http.Request) {
+		render(w, "consent.page.gohtml")
+	})
+
 	fmt.Println("Starting front end service on port 82")
 	err := http.ListenAndServe(":82", nil)
 	if err != nil {
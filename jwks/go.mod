@@ -0,0 +1,5 @@
+module jwks
+
+go 1.20
+
+require github.com/golang-jwt/jwt/v4 v4.5.0
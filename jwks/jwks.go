@@ -0,0 +1,144 @@
+// Package jwks fetches the public keys of the auth service and verifies the tokens it signs.
+// It is shared by the broker and the log service.
+package jwks
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// refreshInterval is how often the keys are fetched again, and also the minimum time
+// between two fetches caused by tokens with an unknown kid
+const refreshInterval = 5 * time.Minute
+
+// KeySet holds the public keys the auth service publishes at /.well-known/jwks.json. Its
+// Keyfunc verifies the tokens the auth service issues, so the other services don't need to
+// hold any secret.
+type KeySet struct {
+	URL    string
+	Client *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+// New returns a key set fetched from the url on first use
+func New(url string) *KeySet {
+	return &KeySet{
+		URL:    url,
+		Client: &http.Client{Timeout: 5 * time.Second},
+		keys:   make(map[string]any),
+	}
+}
+
+// Keyfunc looks up the public key a token was signed with by its kid header. The keys are fetched
+// again when they are stale or the kid is unknown, e.g. right after a key rotation.
+func (j *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, stale := j.lookup(kid)
+	if key == nil || stale {
+		err := j.fetch()
+		if err != nil && key == nil {
+			return nil, err
+		}
+		key, _ = j.lookup(kid)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+	case ed25519.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+	}
+
+	return key, nil
+}
+
+func (j *KeySet) lookup(kid string) (any, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	return j.keys[kid], time.Since(j.fetchedAt) > refreshInterval
+}
+
+func (j *KeySet) fetch() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if time.Since(j.fetchedAt) < refreshInterval && len(j.keys) > 0 {
+		return nil
+	}
+
+	response, err := j.Client.Get(j.URL)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching jwks: status %d", response.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&set)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]any)
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return err
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return err
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return err
+			}
+			keys[k.Kid] = ed25519.PublicKey(x)
+		}
+	}
+
+	j.keys = keys
+	j.fetchedAt = time.Now()
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package jwks
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func Test_Keyfunc(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// auth-service публикует открытые ключи RSA и Ed25519
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{
+				{
+					"kty": "RSA",
+					"kid": "rsa-key",
+					"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+				},
+				{
+					"kty": "OKP",
+					"crv": "Ed25519",
+					"kid": "ed-key",
+					"x":   base64.RawURLEncoding.EncodeToString(edPublic),
+				},
+			},
+		})
+	}))
+	defer server.Close()
+
+	keys := New(server.URL)
+
+	sign := func(method jwt.SigningMethod, kid string, key any) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{"sub": "1"})
+		token.Header["kid"] = kid
+		tokenString, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rsa", sign(jwt.SigningMethodRS256, "rsa-key", rsaKey), true},
+		{"ed25519", sign(jwt.SigningMethodEdDSA, "ed-key", edPrivate), true},
+		{"unknown kid", sign(jwt.SigningMethodRS256, "other-key", rsaKey), false},
+		{"wrong method for the key", sign(jwt.SigningMethodEdDSA, "rsa-key", edPrivate), false},
+		{"hmac with the public key", sign(jwt.SigningMethodHS256, "rsa-key", []byte("secret")), false},
+	}
+
+	for _, e := range tests {
+		token, err := jwt.Parse(e.token, keys.Keyfunc)
+		if valid := err == nil && token.Valid; valid != e.valid {
+			t.Errorf("%s: expected valid %v but got %v", e.name, e.valid, err)
+		}
+	}
+
+	// неизвестный kid не вызывает повторных запросов чаще refreshInterval
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected the keys to be fetched once, got %d", n)
+	}
+
+	// устаревшие ключи запрашиваются снова
+	keys.fetchedAt = time.Now().Add(-2 * refreshInterval)
+	if _, err := jwt.Parse(sign(jwt.SigningMethodRS256, "rsa-key", rsaKey), keys.Keyfunc); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("expected the stale keys to be fetched again, got %d fetches", n)
+	}
+}
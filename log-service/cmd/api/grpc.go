@@ -4,10 +4,14 @@ import (
 	"context"
 	"fmt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"log"
 	"log-service/logs"
 	data "log-service/models"
 	"net"
+	"net/http"
 )
 
 type LogServer struct {
@@ -39,7 +43,7 @@ func (app *Config) gRPCListen() {
 		log.Fatalf("Failed to listen gRPC: %v", err)
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(grpc.UnaryInterceptor(app.requireServiceScopeRPC("logs:write")))
 	logs.RegisterLogServiceServer(s, &LogServer{Models: data.MongoRepository{}})
 
 	log.Printf("gRPC server started on port %s", gRpcPort)
@@ -48,3 +52,23 @@ func (app *Config) gRPCListen() {
 		log.Fatalf("Failed to listen gRPC: %v", err)
 	}
 }
+
+// requireServiceScopeRPC is requireServiceScope for gRPC: the service token comes in the
+// authorization metadata
+func (app *Config) requireServiceScopeRPC(scope string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		var authorization string
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+			authorization = md.Get("authorization")[0]
+		}
+
+		code, err := app.verifyServiceToken(authorization, scope)
+		if code == http.StatusForbidden {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		} else if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		return handler(ctx, req)
+	}
+}
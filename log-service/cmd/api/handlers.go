@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	data "log-service/models"
 	"net/http"
 )
@@ -33,3 +35,76 @@ func (app *Config) WriteLog(w http.ResponseWriter, r *http.Request) {
 	}
 	app.writeJSON(w, http.StatusAccepted, resp)
 }
+
+// FindMentions returns the entries which mention any of the mention query parameters, for
+// the data export of a user
+func (app *Config) FindMentions(w http.ResponseWriter, r *http.Request) {
+	terms := r.URL.Query()["mention"]
+	if data.MentionPattern(terms) == "" {
+		app.errorJSON(w, errors.New("at least one mention is required"))
+		return
+	}
+
+	logs, err := app.Repo.FindMentions(terms)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("found %d entries", len(logs)),
+		Data:    logs,
+	}
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// erasePayload names the terms to erase, and whether the entries mentioning them are deleted
+// or have the terms replaced
+type erasePayload struct {
+	Mentions    []string `json:"mentions"`
+	Mode        string   `json:"mode"`
+	Replacement string   `json:"replacement"`
+}
+
+// EraseMentions deletes or anonymizes the entries which mention any of the terms, when the
+// data of a user is erased
+func (app *Config) EraseMentions(w http.ResponseWriter, r *http.Request) {
+	var requestPayload erasePayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if data.MentionPattern(requestPayload.Mentions) == "" {
+		app.errorJSON(w, errors.New("at least one mention is required"))
+		return
+	}
+
+	var affected int64
+	switch requestPayload.Mode {
+	case "delete":
+		affected, err = app.Repo.DeleteMentions(requestPayload.Mentions)
+	case "anonymize":
+		if requestPayload.Replacement == "" {
+			app.errorJSON(w, errors.New("replacement is required to anonymize"))
+			return
+		}
+		affected, err = app.Repo.AnonymizeMentions(requestPayload.Mentions, requestPayload.Replacement)
+	default:
+		app.errorJSON(w, errors.New("mode must be delete or anonymize"))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("erased %d entries", affected),
+		Data:    map[string]int64{"affected": affected},
+	}
+	app.writeJSON(w, http.StatusOK, resp)
+}
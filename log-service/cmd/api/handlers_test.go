@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	data "log-service/models"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -28,3 +30,77 @@ func Test_WriteLog(t *testing.T) {
 		t.Errorf("expected http.StatusAccepted but got %d", rr.Code)
 	}
 }
+
+func Test_EraseMentions(t *testing.T) {
+	repo := data.NewMongoTestRepository(nil)
+	app := &Config{Repo: repo}
+
+	for _, entry := range []data.LogEntry{
+		{Name: "authentication", Data: "Logged in user me@here.com"},
+		{Name: "user event", Data: "password has been changed by user 1"},
+		{Name: "user event", Data: "password has been changed by user 12"},
+		{Name: "authentication", Data: "Logged in user ME@HERE.COM"},
+	} {
+		_ = repo.Insert(entry)
+	}
+
+	find := func() []data.LogEntry {
+		req, _ := http.NewRequest("GET", "/logs?mention=me@here.com&mention=user+1", nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.FindMentions).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected http.StatusOK but got %d", rr.Code)
+		}
+
+		var payload struct {
+			Data []data.LogEntry `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &payload)
+		return payload.Data
+	}
+	erase := func(body map[string]any) *httptest.ResponseRecorder {
+		out, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/logs/erase", bytes.NewReader(out))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.EraseMentions).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// "user 1" не совпадает с "user 12", email сравнивается без учёта регистра
+	if found := find(); len(found) != 3 {
+		t.Fatalf("expected 3 entries but got %+v", found)
+	}
+
+	for _, body := range []map[string]any{
+		{"mentions": []string{}, "mode": "delete"},
+		{"mentions": []string{"user 1"}, "mode": "truncate"},
+		{"mentions": []string{"user 1"}, "mode": "anonymize"},
+	} {
+		if rr := erase(body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected http.StatusBadRequest but got %d", body, rr.Code)
+		}
+	}
+
+	rr := erase(map[string]any{"mentions": []string{"me@here.com"}, "mode": "anonymize", "replacement": "erased-user-1"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected http.StatusOK but got %d", rr.Code)
+	}
+	if found := find(); len(found) != 1 {
+		t.Errorf("expected only the entry of user 1 left, got %+v", found)
+	}
+	all, _ := repo.FindMentions([]string{"erased-user-1"})
+	if len(all) != 2 || all[0].Data != "Logged in user erased-user-1" {
+		t.Errorf("expected the email to be replaced, got %+v", all)
+	}
+
+	rr = erase(map[string]any{"mentions": []string{"user 1"}, "mode": "delete"})
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"affected":1`) {
+		t.Errorf("expected one entry to be deleted, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if found := find(); len(found) != 0 {
+		t.Errorf("expected no entries left, got %+v", found)
+	}
+	if left, _ := repo.FindMentions([]string{"user 12"}); len(left) != 1 {
+		t.Errorf("expected the entry of user 12 to be kept, got %+v", left)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// serviceTokenType is the typ claim of the tokens auth-service issues to services
+const serviceTokenType = "service"
+
+// requireServiceScope only lets through requests with a service token from the auth service
+// whose scope contains the scope. Access tokens of users are not accepted, the services
+// write logs on their behalf.
+func (app *Config) requireServiceScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status, err := app.verifyServiceToken(r.Header.Get("Authorization"), scope)
+			if err != nil {
+				app.errorJSON(w, err, status)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// verifyServiceToken checks the Authorization header value of a request, over HTTP or gRPC.
+// It returns the HTTP status to reject the request with: 401 without a valid service token,
+// 403 when the token lacks the scope.
+func (app *Config) verifyServiceToken(authorization, scope string) (int, error) {
+	scheme, tokenString, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") || tokenString == "" || app.Keys == nil {
+		return http.StatusUnauthorized, errors.New("unauthorized")
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, app.Keys.Keyfunc)
+	if err != nil || !token.Valid || claims["typ"] != serviceTokenType {
+		return http.StatusUnauthorized, errors.New("token is not valid")
+	}
+
+	granted, _ := claims["scope"].(string)
+	for _, s := range strings.Fields(granted) {
+		if s == scope {
+			return 0, nil
+		}
+	}
+
+	return http.StatusForbidden, fmt.Errorf("missing scope %s", scope)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"jwks"
+)
+
+func Test_WriteLogRequiresServiceToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// auth-service публикует открытый ключ в формате JWKS
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwksServer.Close()
+
+	app := &Config{Repo: testApp.Repo, Keys: jwks.New(jwksServer.URL)}
+
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-key"
+		tokenString, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"invalid token", "not-a-token", http.StatusUnauthorized},
+		{"user token", sign(jwt.MapClaims{"sub": 1, "scope": "logs:write"}), http.StatusUnauthorized},
+		{"missing scope", sign(jwt.MapClaims{"sub": "broker-service", "typ": "service", "scope": "logs:read"}), http.StatusForbidden},
+		{"service token", sign(jwt.MapClaims{"sub": "broker-service", "typ": "service", "scope": "logs:write"}), http.StatusAccepted},
+	}
+
+	for _, e := range tests {
+		body, _ := json.Marshal(map[string]string{"name": "event", "data": "some kind of data"})
+		req, _ := http.NewRequest("POST", "/log", bytes.NewReader(body))
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.token)
+		}
+
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, rr.Code)
+		}
+	}
+
+	// чтение и удаление записей требуют отдельных scope
+	for _, e := range []struct{ method, path, scope string }{
+		{"GET", "/logs?mention=user+1", "logs:read"},
+		{"POST", "/logs/erase", "logs:erase"},
+	} {
+		req, _ := http.NewRequest(e.method, e.path, nil)
+		req.Header.Set("Authorization", "Bearer "+sign(jwt.MapClaims{"sub": "auth-service", "typ": "service", "scope": "logs:write"}))
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s without %s: expected http.StatusForbidden but got %d", e.path, e.scope, rr.Code)
+		}
+	}
+
+	// gRPC проверяет тот же сервисный токен из metadata
+	interceptor := app.requireServiceScopeRPC("logs:write")
+	handler := func(ctx context.Context, req any) (any, error) { return "logged", nil }
+	for _, e := range []struct {
+		name     string
+		token    string
+		expected codes.Code
+	}{
+		{"no token", "", codes.Unauthenticated},
+		{"user token", sign(jwt.MapClaims{"sub": 1, "scope": "logs:write"}), codes.Unauthenticated},
+		{"missing scope", sign(jwt.MapClaims{"sub": "broker-service", "typ": "service", "scope": "logs:read"}), codes.PermissionDenied},
+		{"service token", sign(jwt.MapClaims{"sub": "broker-service", "typ": "service", "scope": "logs:write"}), codes.OK},
+	} {
+		ctx := context.Background()
+		if e.token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+e.token))
+		}
+
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/logs.LogService/WriteLog"}, handler)
+		if status.Code(err) != e.expected {
+			t.Errorf("grpc %s: expected %v but got %v", e.name, e.expected, err)
+		}
+	}
+
+	// net/rpc без сервисного токена ничего не записывает
+	server := &RPCServer{App: app}
+	for _, e := range []struct{ name, token string }{
+		{"no token", ""},
+		{"user token", sign(jwt.MapClaims{"sub": 1, "scope": "logs:write"})},
+		{"missing scope", sign(jwt.MapClaims{"sub": "broker-service", "typ": "service", "scope": "logs:read"})},
+	} {
+		var resp string
+		if err := server.LogInfo(RPCPayload{Name: "event", Data: "data", Token: e.token}, &resp); err == nil {
+			t.Errorf("rpc %s: expected an error", e.name)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"jwks"
 	"log"
 	"log-service/models"
 	"net"
@@ -24,6 +25,7 @@ var client *mongo.Client
 
 type Config struct {
 	Repo data.Repository
+	Keys *jwks.KeySet
 }
 
 func main() {
@@ -34,7 +36,9 @@ func main() {
 	}
 	// set up config
 	client = mongoClient
-	app := Config{}
+	app := Config{
+		Keys: jwks.New("http://auth-service:82/.well-known/jwks.json"),
+	}
 	app.setupRepo(client)
 	//create a context to disconnect
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
@@ -47,7 +51,7 @@ func main() {
 		}
 	}()
 
-	err = rpc.Register(new(RPCServer))
+	err = rpc.Register(&RPCServer{App: &app})
 	go app.rpcListen()
 
 	go app.gRPCListen()
@@ -23,7 +23,9 @@ func (app *Config) routes() http.Handler {
 
 	mux.Use(middleware.Heartbeat("/ping"))
 
-	mux.Post("/log", app.WriteLog)
+	mux.With(app.requireServiceScope("logs:write")).Post("/log", app.WriteLog)
+	mux.With(app.requireServiceScope("logs:read")).Get("/logs", app.FindMentions)
+	mux.With(app.requireServiceScope("logs:erase")).Post("/logs/erase", app.EraseMentions)
 
 	return mux
 }
@@ -13,7 +13,7 @@ func Test_routes_exist(t *testing.T) {
 	testRoutes := testApp.routes()
 	chiRoutes := testRoutes.(chi.Router)
 
-	routes := []string{"/log"}
+	routes := []string{"/log", "/logs", "/logs/erase"}
 
 	for _, route := range routes {
 		routeExists(t, chiRoutes, route)
@@ -10,18 +10,27 @@ import (
 
 // RPCServer is the type for our RPC Server. Methods that take this as a receiver are available
 // over RPC, as long as they are exported.
-type RPCServer struct{}
+type RPCServer struct {
+	App *Config
+}
 
 // RPCPayload is the type for data we receive from RPC
 type RPCPayload struct {
 	Name string
 	Data string
+	// Token is a service token of the auth service with the logs:write scope
+	Token string
 }
 
-// LogInfo writes our payload to mongo
+// LogInfo writes our payload to mongo. Like over HTTP and gRPC, it needs a service token.
 func (r *RPCServer) LogInfo(payload RPCPayload, resp *string) error {
+	_, err := r.App.verifyServiceToken("Bearer "+payload.Token, "logs:write")
+	if err != nil {
+		return err
+	}
+
 	collection := client.Database("logs").Collection("logs")
-	_, err := collection.InsertOne(context.TODO(), data.LogEntry{
+	_, err = collection.InsertOne(context.TODO(), data.LogEntry{
 		Name:      payload.Name,
 		Data:      payload.Data,
 		CreatedAt: time.Now(),
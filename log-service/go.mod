@@ -5,9 +5,11 @@ go 1.23.2
 require (
 	github.com/go-chi/chi/v5 v5.1.0
 	github.com/go-chi/cors v1.2.1
+	github.com/golang-jwt/jwt/v4 v4.5.0
 	go.mongodb.org/mongo-driver v1.17.1
 	google.golang.org/grpc v1.69.2
 	google.golang.org/protobuf v1.36.2
+	jwks v0.0.0
 )
 
 require (
@@ -25,3 +27,6 @@ require (
 	golang.org/x/text v0.19.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20241015192408-796eee8c2d53 // indirect
 )
+
+// jwks is shared with the other services which verify tokens of the auth service
+replace jwks => ../jwks
@@ -0,0 +1,45 @@
+package data
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MentionPattern returns a case insensitive pattern which matches any of the terms as whole
+// words, so the term "user 1" doesn't match "user 12". It returns an empty string when there
+// are no terms.
+func MentionPattern(terms []string) string {
+	var quoted []string
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		if term != "" {
+			quoted = append(quoted, regexp.QuoteMeta(term))
+		}
+	}
+	if len(quoted) == 0 {
+		return ""
+	}
+
+	return `\b(` + strings.Join(quoted, "|") + `)\b`
+}
+
+// mentionRegexp compiles the pattern of the terms, nil when there are no terms
+func mentionRegexp(terms []string) *regexp.Regexp {
+	pattern := MentionPattern(terms)
+	if pattern == "" {
+		return nil
+	}
+
+	return regexp.MustCompile(`(?i)` + pattern)
+}
+
+// mentions reports whether the name or the data of the entry match
+func (l *LogEntry) mentions(re *regexp.Regexp) bool {
+	return re.MatchString(l.Name) || re.MatchString(l.Data)
+}
+
+// anonymize replaces every match in the name and the data of the entry
+func (l *LogEntry) anonymize(re *regexp.Regexp, replacement string) {
+	l.Name = re.ReplaceAllLiteralString(l.Name, replacement)
+	l.Data = re.ReplaceAllLiteralString(l.Data, replacement)
+}
@@ -153,3 +153,89 @@ func (u *MongoRepository) UpdateOne(logs LogEntry) (*mongo.UpdateResult, error)
 	}
 	return result, nil
 }
+
+// mentionFilter selects the entries whose name or data match any of the terms
+func mentionFilter(terms []string) bson.M {
+	pattern := primitive.Regex{Pattern: MentionPattern(terms), Options: "i"}
+
+	return bson.M{"$or": bson.A{
+		bson.M{"name": pattern},
+		bson.M{"data": pattern},
+	}}
+}
+
+// FindMentions returns the entries which mention any of the terms, the newest first
+func (u *MongoRepository) FindMentions(terms []string) ([]*LogEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	logs := []*LogEntry{}
+	if mentionRegexp(terms) == nil {
+		return logs, nil
+	}
+
+	collection := client.Database("logs").Collection("logs")
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{"created_at", -1}})
+	cursor, err := collection.Find(ctx, mentionFilter(terms), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var item LogEntry
+		if err := cursor.Decode(&item); err != nil {
+			return nil, err
+		}
+		logs = append(logs, &item)
+	}
+
+	return logs, cursor.Err()
+}
+
+// DeleteMentions deletes the entries which mention any of the terms and returns how many
+// have been deleted
+func (u *MongoRepository) DeleteMentions(terms []string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if mentionRegexp(terms) == nil {
+		return 0, nil
+	}
+
+	collection := client.Database("logs").Collection("logs")
+
+	result, err := collection.DeleteMany(ctx, mentionFilter(terms))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+// AnonymizeMentions replaces the terms with the replacement in every entry which mentions
+// them and returns how many entries have been rewritten
+func (u *MongoRepository) AnonymizeMentions(terms []string, replacement string) (int64, error) {
+	re := mentionRegexp(terms)
+	if re == nil {
+		return 0, nil
+	}
+
+	entries, err := u.FindMentions(terms)
+	if err != nil {
+		return 0, err
+	}
+
+	var rewritten int64
+	for _, entry := range entries {
+		entry.anonymize(re, replacement)
+		if _, err := u.UpdateOne(*entry); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+
+	return rewritten, nil
+}
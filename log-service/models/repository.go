@@ -8,4 +8,7 @@ type Repository interface {
 	GetOne(id string) (*LogEntry, error)
 	DropCollection() error
 	UpdateOne(logs LogEntry) (*mongo.UpdateResult, error)
+	FindMentions(terms []string) ([]*LogEntry, error)
+	DeleteMentions(terms []string) (int64, error)
+	AnonymizeMentions(terms []string, replacement string) (int64, error)
 }
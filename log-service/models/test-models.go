@@ -2,11 +2,16 @@ package data
 
 import (
 	"go.mongodb.org/mongo-driver/mongo"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type MongoTestRepository struct {
 	Conn *mongo.Client
+
+	mu      sync.Mutex
+	entries []*LogEntry
 }
 
 func NewMongoTestRepository(client *mongo.Client) *MongoTestRepository {
@@ -35,8 +40,15 @@ func (u *MongoTestRepository) GetOne(id string) (*LogEntry, error) {
 	return &log, nil
 }
 
-// Insert inserts a new user into the database, and returns the ID of the newly inserted row
+// Insert keeps the entry in memory, so the erasure of mentions can be tested
 func (u *MongoTestRepository) Insert(log LogEntry) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	log.ID = strconv.Itoa(len(u.entries) + 1)
+	log.CreatedAt = time.Now()
+	log.UpdatedAt = log.CreatedAt
+	u.entries = append(u.entries, &log)
 	return nil
 }
 
@@ -46,5 +58,74 @@ func (u *MongoTestRepository) UpdateOne(logs LogEntry) (*mongo.UpdateResult, err
 
 // DeleteByID deletes one user from the database, by ID
 func (u *MongoTestRepository) DropCollection() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.entries = nil
 	return nil
 }
+
+// FindMentions returns the entries kept in memory which mention any of the terms, the newest first
+func (u *MongoTestRepository) FindMentions(terms []string) ([]*LogEntry, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	logs := []*LogEntry{}
+	re := mentionRegexp(terms)
+	if re == nil {
+		return logs, nil
+	}
+
+	for i := len(u.entries) - 1; i >= 0; i-- {
+		if u.entries[i].mentions(re) {
+			entry := *u.entries[i]
+			logs = append(logs, &entry)
+		}
+	}
+
+	return logs, nil
+}
+
+// DeleteMentions deletes the entries kept in memory which mention any of the terms
+func (u *MongoTestRepository) DeleteMentions(terms []string) (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	re := mentionRegexp(terms)
+	if re == nil {
+		return 0, nil
+	}
+
+	kept := u.entries[:0]
+	for _, entry := range u.entries {
+		if !entry.mentions(re) {
+			kept = append(kept, entry)
+		}
+	}
+	deleted := int64(len(u.entries) - len(kept))
+	u.entries = kept
+
+	return deleted, nil
+}
+
+// AnonymizeMentions replaces the terms in the entries kept in memory
+func (u *MongoTestRepository) AnonymizeMentions(terms []string, replacement string) (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	re := mentionRegexp(terms)
+	if re == nil {
+		return 0, nil
+	}
+
+	var rewritten int64
+	for _, entry := range u.entries {
+		if entry.mentions(re) {
+			entry.anonymize(re, replacement)
+			entry.UpdatedAt = time.Now()
+			rewritten++
+		}
+	}
+
+	return rewritten, nil
+}